@@ -0,0 +1,38 @@
+// Command printconfig prints the effective configuration, after defaults
+// and environment overrides, with secrets masked.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"wechat-service/internal/config"
+)
+
+func main() {
+	path := flag.String("config", "config.yaml", "path to the configuration file")
+	strict := flag.Bool("strict", false, "reject unknown configuration keys")
+	flag.Parse()
+
+	load := config.Load
+	if *strict {
+		load = config.LoadStrict
+	}
+
+	cfg, err := load(*path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if err := cfg.WriteMasked(os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid config: %v\n", err)
+		os.Exit(2)
+	}
+}
@@ -1,7 +1,9 @@
 package config
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"time"
 
@@ -18,6 +20,8 @@ type Config struct {
 		WriteTimeout   int    `yaml:"write_timeout"`   // seconds
 		MaxHeaderBytes int    `yaml:"max_header_bytes"`
 		Env            string `yaml:"env"` // development, production
+		AdminToken     string `yaml:"admin_token"` // bearer token for /admin routes
+		CallbackPath   string `yaml:"callback_path"` // WeChat callbacks, per account at <path>/:appid
 	} `yaml:"server"`
 
 	// WeChat Configuration
@@ -29,6 +33,10 @@ type Config struct {
 		AppKey         string `yaml:"app_key"`          // for stable access token
 	} `yaml:"wechat"`
 
+	// Accounts lists the service accounts served by this deployment. When
+	// empty, the WeChat block is the only account.
+	Accounts []AccountConfig `yaml:"accounts"`
+
 	// AccessToken Configuration
 	AccessToken struct {
 		CacheDuration     int  `yaml:"cache_duration"` // seconds, default 7000 (100 min before expire)
@@ -52,11 +60,51 @@ type Config struct {
 		Enabled       bool     `yaml:"enabled"`
 		MetricsPath   string   `yaml:"metrics_path"`
 		HealthPath    string   `yaml:"health_path"`
+		LivenessPath  string   `yaml:"liveness_path"`
+		ReadinessPath string   `yaml:"readiness_path"`
+		HealthCheckTimeout int `yaml:"health_check_timeout"` // seconds per check
 		AlertEnabled  bool     `yaml:"alert_enabled"`
 		AlertWebhook  string   `yaml:"alert_webhook"`
+		AlertPath     string   `yaml:"alert_path"` // receives WeChat callback-failure alert pushes
+		AlertGroupWindow    int `yaml:"alert_group_window"`    // seconds to collect alerts of a type before notifying, critical ones excepted
+		AlertRepeatInterval int `yaml:"alert_repeat_interval"` // seconds between notifications for an ongoing group
+		AlertResolveTimeout int `yaml:"alert_resolve_timeout"` // seconds without new alerts before sending a resolution
+		AlertMaxPerHour     int `yaml:"alert_max_per_hour"`    // global notification cap, 0 = unlimited
+		Notifiers     []NotifierConfig `yaml:"notifiers"`
+		RuleInterval          int     `yaml:"rule_interval"`           // seconds between anomaly rule evaluations
+		QuotaAlertThreshold   float64 `yaml:"quota_alert_threshold"`   // fraction of a daily API quota, e.g. 0.8
+		LatencyAlertThreshold int     `yaml:"latency_alert_threshold"` // callback p95 in milliseconds
+		DeadLetterAlertThreshold int  `yaml:"dead_letter_alert_threshold"` // dropped tasks per evaluation
+		AlertRetentionDays    int     `yaml:"alert_retention_days"`
+		HealthRetentionDays   int     `yaml:"health_retention_days"`
 		LogLevel      string   `yaml:"log_level"` // debug, info, warn, error
 	} `yaml:"monitoring"`
 
+	// Logging Configuration (level is Monitoring.LogLevel)
+	Logging struct {
+		Format string `yaml:"format"` // text, json
+		Output string `yaml:"output"` // stdout, file, both
+		Dir    string `yaml:"dir"`    // directory for file output
+		MaxSizeMB  int  `yaml:"max_size_mb"`  // rotate when the file exceeds this size, -1 = never
+		MaxAgeDays int  `yaml:"max_age_days"` // delete rotated files older than this, -1 = keep
+		MaxBackups int  `yaml:"max_backups"`  // keep at most this many rotated files, -1 = all
+		Compress   bool `yaml:"compress"`     // gzip rotated files
+		Redaction  struct {
+			Disabled bool              `yaml:"disabled"` // log values unmasked, for local debugging only
+			Fields   map[string]string `yaml:"fields"`   // log key -> full, partial, text or none
+		} `yaml:"redaction"`
+	} `yaml:"logging"`
+
+	// Tracing Configuration
+	Tracing struct {
+		Enabled     bool    `yaml:"enabled"`
+		Exporter    string  `yaml:"exporter"`     // otlp, stdout
+		Endpoint    string  `yaml:"endpoint"`     // OTLP/HTTP collector host:port
+		Insecure    bool    `yaml:"insecure"`     // plain HTTP to the collector
+		SampleRatio float64 `yaml:"sample_ratio"` // 0-1, fraction of traces sampled
+		ServiceName string  `yaml:"service_name"`
+	} `yaml:"tracing"`
+
 	// Async Processing Configuration
 	Async struct {
 		Enabled       bool `yaml:"enabled"`
@@ -64,6 +112,8 @@ type Config struct {
 		QueueSize     int  `yaml:"queue_size"`
 		RetryCount    int  `yaml:"retry_count"`
 		RetryDelay    int  `yaml:"retry_delay"` // milliseconds
+		ShutdownTimeout int    `yaml:"shutdown_timeout"` // seconds to drain queued tasks on shutdown
+		PersistPath     string `yaml:"persist_path"`     // file receiving tasks left over after shutdown
 	} `yaml:"async"`
 
 	// Database Configuration (optional)
@@ -74,20 +124,50 @@ type Config struct {
 		Username string `yaml:"username"`
 		Password string `yaml:"password"`
 		Name     string `yaml:"name"`
+		SSLMode  string `yaml:"sslmode"`
 		MaxOpen  int    `yaml:"max_open"`
 		MaxIdle  int    `yaml:"max_idle"`
 	} `yaml:"database"`
 
 	// Cache Configuration
 	Cache struct {
-		Type  string `yaml:"type"` // memory, redis
+		Type  string `yaml:"type"` // memory, redis, layered (local LRU in front of Redis)
+		LocalTTL            int    `yaml:"local_ttl"`            // layered: seconds a local copy is served
+		InvalidationChannel string `yaml:"invalidation_channel"` // layered: pub/sub channel for invalidations
 		Redis struct {
-			Addr     string `yaml:"addr"`
-			Password string `yaml:"password"`
-			DB       int    `yaml:"db"`
+			Mode             string   `yaml:"mode"`        // standalone, sentinel, cluster
+			Addr             string   `yaml:"addr"`        // standalone
+			Addrs            []string `yaml:"addrs"`       // sentinel or cluster nodes
+			MasterName       string   `yaml:"master_name"` // sentinel
+			Username         string   `yaml:"username"`
+			Password         string   `yaml:"password"`
+			SentinelPassword string   `yaml:"sentinel_password"`
+			DB               int      `yaml:"db"` // not supported in cluster mode
+			PoolSize         int      `yaml:"pool_size"`      // 0 = 10 per CPU
+			MinIdleConns     int      `yaml:"min_idle_conns"`
+			DialTimeout      int      `yaml:"dial_timeout"`  // milliseconds
+			ReadTimeout      int      `yaml:"read_timeout"`  // milliseconds
+			WriteTimeout     int      `yaml:"write_timeout"` // milliseconds
+			TLS              struct {
+				Enabled            bool   `yaml:"enabled"`
+				CAFile             string `yaml:"ca_file"`
+				CertFile           string `yaml:"cert_file"` // client certificate, with key_file
+				KeyFile            string `yaml:"key_file"`
+				ServerName         string `yaml:"server_name"`
+				InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+			} `yaml:"tls"`
 		} `yaml:"redis"`
+		Memory struct {
+			MaxEntries      int `yaml:"max_entries"`      // 0 = unbounded, otherwise LRU eviction
+			CleanupInterval int `yaml:"cleanup_interval"` // seconds between expired-entry sweeps
+		} `yaml:"memory"`
 	} `yaml:"cache"`
 
+	// Menu Configuration
+	Menu struct {
+		File string `yaml:"file"` // menu definition (YAML or JSON) published by the admin API
+	} `yaml:"menu"`
+
 	// API Domains Configuration
 	APIDomain struct {
 		Primary       string `yaml:"primary"`         // api.weixin.qq.com
@@ -99,15 +179,54 @@ type Config struct {
 	} `yaml:"api_domain"`
 }
 
+// AccountConfig configures one WeChat service account
+type AccountConfig struct {
+	Name           string         `yaml:"name"`
+	AppID          string         `yaml:"app_id"`
+	AppSecret      string         `yaml:"app_secret"`
+	Token          string         `yaml:"token"`
+	EncodingAESKey string         `yaml:"encoding_aes_key"`
+	AppKey         string         `yaml:"app_key"`
+	APIQuotas      map[string]int `yaml:"api_quotas"` // overrides rate_limit.api_quotas
+	MenuFile       string         `yaml:"menu_file"`  // overrides menu.file
+}
+
+// NotifierConfig configures one alert notification channel
+type NotifierConfig struct {
+	Type   string `yaml:"type"`   // webhook, wecom, dingtalk, feishu, email
+	URL    string `yaml:"url"`    // webhook / robot URL
+	Secret string `yaml:"secret"` // signing secret for dingtalk and feishu robots
+
+	// Email (SMTP) settings
+	SMTPHost string   `yaml:"smtp_host"`
+	SMTPPort int      `yaml:"smtp_port"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+}
+
 // Load reads configuration from file
 func Load(path string) (*Config, error) {
+	return load(path, false)
+}
+
+// LoadStrict reads configuration from file and rejects unknown keys
+func LoadStrict(path string) (*Config, error) {
+	return load(path, true)
+}
+
+// load reads, parses and completes the configuration
+func load(path string, strict bool) (*Config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read config file: %w", err)
 	}
 
 	var cfg Config
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(strict)
+	if err := dec.Decode(&cfg); err != nil && err != io.EOF {
 		return nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
 
@@ -116,6 +235,9 @@ func Load(path string) (*Config, error) {
 
 	// Apply environment overrides
 	cfg.applyEnvOverrides()
+	if err := cfg.applyPrefixedEnv(); err != nil {
+		return nil, fmt.Errorf("invalid environment override: %w", err)
+	}
 
 	return &cfg, nil
 }
@@ -138,6 +260,9 @@ func (c *Config) applyDefaults() {
 	if c.Server.Env == "" {
 		c.Server.Env = "development"
 	}
+	if c.Server.CallbackPath == "" {
+		c.Server.CallbackPath = "/wechat"
+	}
 
 	// AccessToken defaults
 	if c.AccessToken.CacheDuration == 0 {
@@ -157,10 +282,83 @@ func (c *Config) applyDefaults() {
 	if c.Monitoring.HealthPath == "" {
 		c.Monitoring.HealthPath = "/health"
 	}
+	if c.Monitoring.LivenessPath == "" {
+		c.Monitoring.LivenessPath = c.Monitoring.HealthPath + "/live"
+	}
+	if c.Monitoring.ReadinessPath == "" {
+		c.Monitoring.ReadinessPath = c.Monitoring.HealthPath + "/ready"
+	}
+	if c.Monitoring.HealthCheckTimeout == 0 {
+		c.Monitoring.HealthCheckTimeout = 3
+	}
+	if c.Monitoring.AlertPath == "" {
+		c.Monitoring.AlertPath = "/wechat/alert"
+	}
+	if c.Monitoring.AlertGroupWindow == 0 {
+		c.Monitoring.AlertGroupWindow = 60
+	}
+	if c.Monitoring.AlertRepeatInterval == 0 {
+		c.Monitoring.AlertRepeatInterval = 1800
+	}
+	if c.Monitoring.AlertResolveTimeout == 0 {
+		c.Monitoring.AlertResolveTimeout = 900
+	}
+	if c.Monitoring.RuleInterval == 0 {
+		c.Monitoring.RuleInterval = 60
+	}
+	if c.Monitoring.QuotaAlertThreshold == 0 {
+		c.Monitoring.QuotaAlertThreshold = 0.8
+	}
+	if c.Monitoring.LatencyAlertThreshold == 0 {
+		c.Monitoring.LatencyAlertThreshold = 4000 // WeChat gives up after 5s
+	}
+	if c.Monitoring.DeadLetterAlertThreshold == 0 {
+		c.Monitoring.DeadLetterAlertThreshold = 1
+	}
+	if c.Monitoring.AlertRetentionDays == 0 {
+		c.Monitoring.AlertRetentionDays = 90
+	}
+	if c.Monitoring.HealthRetentionDays == 0 {
+		c.Monitoring.HealthRetentionDays = 14
+	}
 	if c.Monitoring.LogLevel == "" {
 		c.Monitoring.LogLevel = "info"
 	}
 
+	// Logging defaults
+	if c.Logging.Format == "" {
+		c.Logging.Format = "text"
+	}
+	if c.Logging.Output == "" {
+		c.Logging.Output = "stdout"
+	}
+	if c.Logging.Dir == "" {
+		c.Logging.Dir = "logs"
+	}
+	if c.Logging.MaxSizeMB == 0 {
+		c.Logging.MaxSizeMB = 100
+	}
+	if c.Logging.MaxAgeDays == 0 {
+		c.Logging.MaxAgeDays = 30
+	}
+	if c.Logging.MaxBackups == 0 {
+		c.Logging.MaxBackups = 10
+	}
+
+	// Tracing defaults
+	if c.Tracing.Exporter == "" {
+		c.Tracing.Exporter = "otlp"
+	}
+	if c.Tracing.Endpoint == "" {
+		c.Tracing.Endpoint = "localhost:4318"
+	}
+	if c.Tracing.SampleRatio == 0 {
+		c.Tracing.SampleRatio = 1
+	}
+	if c.Tracing.ServiceName == "" {
+		c.Tracing.ServiceName = "wechat-service"
+	}
+
 	// Async defaults
 	if c.Async.Workers == 0 {
 		c.Async.Workers = 10
@@ -174,6 +372,38 @@ func (c *Config) applyDefaults() {
 	if c.Async.RetryDelay == 0 {
 		c.Async.RetryDelay = 1000 // 1 second
 	}
+	if c.Async.ShutdownTimeout == 0 {
+		c.Async.ShutdownTimeout = 30
+	}
+	if c.Async.PersistPath == "" {
+		c.Async.PersistPath = "data/async_pending.json"
+	}
+
+	// Cache defaults
+	if c.Cache.Type == "" {
+		c.Cache.Type = "redis"
+	}
+	if c.Cache.Memory.CleanupInterval == 0 {
+		c.Cache.Memory.CleanupInterval = 60
+	}
+	if c.Cache.Redis.Mode == "" {
+		c.Cache.Redis.Mode = "standalone"
+	}
+	if c.Cache.Redis.DialTimeout == 0 {
+		c.Cache.Redis.DialTimeout = 5000
+	}
+	if c.Cache.Redis.ReadTimeout == 0 {
+		c.Cache.Redis.ReadTimeout = 3000
+	}
+	if c.Cache.Redis.WriteTimeout == 0 {
+		c.Cache.Redis.WriteTimeout = 3000
+	}
+	if c.Cache.LocalTTL == 0 {
+		c.Cache.LocalTTL = 5
+	}
+	if c.Cache.InvalidationChannel == "" {
+		c.Cache.InvalidationChannel = "wechat-service:cache:invalidate"
+	}
 
 	// API Domain defaults
 	if c.APIDomain.CurrentDomain == "" {
@@ -195,29 +425,41 @@ func (c *Config) applyDefaults() {
 		c.APIDomain.HongKong = "hk.api.weixin.qq.com"
 	}
 
-	// Rate limit default quotas
+	// Rate limit default quotas, for APIs the file does not list
 	if c.RateLimit.APIQuotas == nil {
-		c.RateLimit.APIQuotas = map[string]int{
-			"access_token":     2000,
-			"menu_create":      1000,
-			"menu_query":       10000,
-			"menu_delete":      1000,
-			"tag_create":       1000,
-			"tag_query":        1000,
-			"tag_update":       1000,
-			"tag_move_user":    100000,
-			"media_upload":     100000,
-			"media_download":   200000,
-			"customer_message": 500000,
-			"mass_send":        100,
-			"qrcode_create":    100000,
-			"user_list":        500,
-			"user_info":        5000000,
+		c.RateLimit.APIQuotas = make(map[string]int, len(DefaultAPIQuotas))
+	}
+	for api, quota := range DefaultAPIQuotas {
+		if _, ok := c.RateLimit.APIQuotas[api]; !ok {
+			c.RateLimit.APIQuotas[api] = quota
 		}
 	}
 }
 
-// applyEnvOverrides applies environment variable overrides
+// DefaultAPIQuotas are the daily quotas WeChat grants a service account
+var DefaultAPIQuotas = map[string]int{
+	"access_token":        2000,
+	"menu_create":         1000,
+	"menu_query":          10000,
+	"menu_delete":         1000,
+	"menu_addconditional": 2000,
+	"menu_delconditional": 2000,
+	"tag_create":          1000,
+	"tag_query":           1000,
+	"tag_update":          1000,
+	"tag_delete":          1000,
+	"tag_move_user":       100000,
+	"media_upload":        100000,
+	"media_download":      200000,
+	"customer_message":    500000,
+	"mass_send":           100,
+	"qrcode_create":       100000,
+	"user_list":           500,
+	"user_info":           5000000,
+}
+
+// applyEnvOverrides applies the legacy unprefixed environment variable
+// overrides. WECHAT_SERVICE_* variables are applied afterwards and win.
 func (c *Config) applyEnvOverrides() {
 	// Server overrides
 	if v := os.Getenv("SERVER_HOST"); v != "" {
@@ -266,6 +508,63 @@ func (c *Config) GetAPIEndpoint() string {
 	}
 }
 
+// GetDatabaseDSN returns the PostgreSQL connection string
+func (c *Config) GetDatabaseDSN() string {
+	sslMode := c.Database.SSLMode
+	if sslMode == "" {
+		sslMode = "disable"
+	}
+	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		c.Database.Host, c.Database.Port, c.Database.Username, c.Database.Password, c.Database.Name, sslMode)
+}
+
+// GetAccounts returns the configured accounts, or the WeChat block as the
+// only account when none are listed
+func (c *Config) GetAccounts() []AccountConfig {
+	if len(c.Accounts) > 0 {
+		return c.Accounts
+	}
+	return []AccountConfig{{
+		Name:           "default",
+		AppID:          c.WeChat.AppID,
+		AppSecret:      c.WeChat.AppSecret,
+		Token:          c.WeChat.Token,
+		EncodingAESKey: c.WeChat.EncodingAESKey,
+		AppKey:         c.WeChat.AppKey,
+	}}
+}
+
+// ForAccount returns a copy of the configuration scoped to account: its
+// WeChat block holds the account's credentials and its API quotas are
+// merged over rate_limit.api_quotas. Components built from the copy work
+// unchanged for one account.
+func (c *Config) ForAccount(account AccountConfig) *Config {
+	scoped := *c
+	scoped.Accounts = nil
+
+	scoped.WeChat.AppID = account.AppID
+	scoped.WeChat.AppSecret = account.AppSecret
+	scoped.WeChat.Token = account.Token
+	scoped.WeChat.EncodingAESKey = account.EncodingAESKey
+	scoped.WeChat.AppKey = account.AppKey
+
+	if len(account.APIQuotas) > 0 {
+		quotas := make(map[string]int, len(c.RateLimit.APIQuotas)+len(account.APIQuotas))
+		for api, quota := range c.RateLimit.APIQuotas {
+			quotas[api] = quota
+		}
+		for api, quota := range account.APIQuotas {
+			quotas[api] = quota
+		}
+		scoped.RateLimit.APIQuotas = quotas
+	}
+	if account.MenuFile != "" {
+		scoped.Menu.File = account.MenuFile
+	}
+
+	return &scoped
+}
+
 // GetReadTimeout returns read timeout as duration
 func (c *Config) GetReadTimeout() time.Duration {
 	return time.Duration(c.Server.ReadTimeout) * time.Second
@@ -276,19 +575,3 @@ func (c *Config) GetWriteTimeout() time.Duration {
 	return time.Duration(c.Server.WriteTimeout) * time.Second
 }
 
-// Validate validates the configuration
-func (c *Config) Validate() error {
-	if c.WeChat.AppID == "" {
-		return fmt.Errorf("app_id is required")
-	}
-	if c.WeChat.AppSecret == "" {
-		return fmt.Errorf("app_secret is required")
-	}
-	if c.WeChat.Token == "" {
-		return fmt.Errorf("token is required")
-	}
-	if c.Server.Port <= 0 || c.Server.Port > 65535 {
-		return fmt.Errorf("invalid server port: %d", c.Server.Port)
-	}
-	return nil
-}
@@ -0,0 +1,93 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGetAccounts(t *testing.T) {
+	tests := []struct {
+		name      string
+		accounts  []AccountConfig
+		wantAppID []string
+	}{
+		{name: "wechat block only", wantAppID: []string{"wx-legacy"}},
+		{
+			name:      "accounts win over wechat block",
+			accounts:  []AccountConfig{{AppID: "wx1"}, {AppID: "wx2"}},
+			wantAppID: []string{"wx1", "wx2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{Accounts: tt.accounts}
+			cfg.WeChat.AppID = "wx-legacy"
+			cfg.WeChat.AppSecret = "secret"
+
+			var got []string
+			for _, a := range cfg.GetAccounts() {
+				got = append(got, a.AppID)
+			}
+			if !reflect.DeepEqual(got, tt.wantAppID) {
+				t.Errorf("app IDs = %v, want %v", got, tt.wantAppID)
+			}
+		})
+	}
+}
+
+func TestForAccount(t *testing.T) {
+	tests := []struct {
+		name       string
+		account    AccountConfig
+		wantQuotas map[string]int
+		wantMenu   string
+	}{
+		{
+			name:       "inherits quotas and menu",
+			account:    AccountConfig{AppID: "wx1", AppSecret: "s1"},
+			wantQuotas: map[string]int{"menu_create": 1000, "user_list": 500},
+			wantMenu:   "menu.yaml",
+		},
+		{
+			name: "overrides one quota",
+			account: AccountConfig{AppID: "wx2", AppSecret: "s2",
+				APIQuotas: map[string]int{"user_list": 50}},
+			wantQuotas: map[string]int{"menu_create": 1000, "user_list": 50},
+			wantMenu:   "menu.yaml",
+		},
+		{
+			name:       "overrides menu file",
+			account:    AccountConfig{AppID: "wx3", MenuFile: "wx3.yaml"},
+			wantQuotas: map[string]int{"menu_create": 1000, "user_list": 500},
+			wantMenu:   "wx3.yaml",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{Accounts: []AccountConfig{tt.account}}
+			cfg.RateLimit.APIQuotas = map[string]int{"menu_create": 1000, "user_list": 500}
+			cfg.Menu.File = "menu.yaml"
+
+			scoped := cfg.ForAccount(tt.account)
+
+			if scoped.WeChat.AppID != tt.account.AppID || scoped.WeChat.AppSecret != tt.account.AppSecret {
+				t.Errorf("credentials = %q/%q, want %q/%q", scoped.WeChat.AppID, scoped.WeChat.AppSecret,
+					tt.account.AppID, tt.account.AppSecret)
+			}
+			if len(scoped.Accounts) != 0 {
+				t.Errorf("scoped config keeps %d accounts", len(scoped.Accounts))
+			}
+			if !reflect.DeepEqual(scoped.RateLimit.APIQuotas, tt.wantQuotas) {
+				t.Errorf("quotas = %v, want %v", scoped.RateLimit.APIQuotas, tt.wantQuotas)
+			}
+			if scoped.Menu.File != tt.wantMenu {
+				t.Errorf("menu file = %q, want %q", scoped.Menu.File, tt.wantMenu)
+			}
+			if cfg.RateLimit.APIQuotas["user_list"] != 500 {
+				t.Error("ForAccount modified the shared quotas")
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix prefixes every environment variable override. The rest of the
+// name is the upper-cased YAML path joined by underscores, for example
+// WECHAT_SERVICE_RATE_LIMIT_ENABLED for rate_limit.enabled. Appending
+// _FILE reads the value from the named file instead, for secrets mounted
+// by Docker or Kubernetes.
+const EnvPrefix = "WECHAT_SERVICE_"
+
+// applyPrefixedEnv applies WECHAT_SERVICE_* overrides to every scalar,
+// list and map field
+func (c *Config) applyPrefixedEnv() error {
+	return applyEnv(reflect.ValueOf(c).Elem(), strings.TrimSuffix(EnvPrefix, "_"))
+}
+
+// applyEnv walks the struct v, overriding fields from the environment
+func applyEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := prefix + "_" + strings.ToUpper(tag)
+		fv := v.Field(i)
+
+		if fv.Kind() == reflect.Struct {
+			if err := applyEnv(fv, name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		raw, ok, err := lookupEnv(name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := setFromString(fv, raw); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// lookupEnv returns the value of name, or the trimmed content of the file
+// named by name_FILE
+func lookupEnv(name string) (string, bool, error) {
+	if v, ok := os.LookupEnv(name); ok {
+		return v, true, nil
+	}
+	path, ok := os.LookupEnv(name + "_FILE")
+	if !ok || path == "" {
+		return "", false, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false, fmt.Errorf("%s_FILE: %w", name, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), true, nil
+}
+
+// setFromString parses raw into fv. Lists are comma separated and replace
+// the current list. Maps are comma separated key=value pairs merged into
+// the current map, so that one entry can be overridden.
+func setFromString(fv reflect.Value, raw string) error {
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		fv.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		fv.SetInt(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		fv.SetFloat(f)
+	case reflect.Slice:
+		if fv.Type().Elem().Kind() == reflect.Struct {
+			return fmt.Errorf("list of %s cannot be set from the environment", fv.Type().Elem())
+		}
+		parts := splitList(raw)
+		s := reflect.MakeSlice(fv.Type(), len(parts), len(parts))
+		for i, p := range parts {
+			if err := setFromString(s.Index(i), p); err != nil {
+				return err
+			}
+		}
+		fv.Set(s)
+	case reflect.Map:
+		m := fv
+		if m.IsNil() {
+			m = reflect.MakeMap(fv.Type())
+		}
+		for _, pair := range splitList(raw) {
+			k, val, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("expected key=value, got %q", pair)
+			}
+			key := reflect.New(fv.Type().Key()).Elem()
+			if err := setFromString(key, strings.TrimSpace(k)); err != nil {
+				return err
+			}
+			elem := reflect.New(fv.Type().Elem()).Elem()
+			if err := setFromString(elem, strings.TrimSpace(val)); err != nil {
+				return err
+			}
+			m.SetMapIndex(key, elem)
+		}
+		fv.Set(m)
+	default:
+		return fmt.Errorf("unsupported field type %s", fv.Type())
+	}
+	return nil
+}
+
+// splitList splits a comma separated list, dropping empty items
+func splitList(raw string) []string {
+	var out []string
+	for _, p := range strings.Split(raw, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
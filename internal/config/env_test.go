@@ -0,0 +1,184 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeConfig writes yaml to a temporary config file and returns its path
+func writeConfig(t *testing.T, yaml string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadEnvOverrides(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secret, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		yaml    string
+		env     map[string]string
+		check   func(t *testing.T, cfg *Config)
+		wantErr bool
+	}{
+		{
+			name: "string",
+			env:  map[string]string{"WECHAT_SERVICE_SERVER_HOST": "0.0.0.0"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.Server.Host != "0.0.0.0" {
+					t.Errorf("server.host = %q", cfg.Server.Host)
+				}
+			},
+		},
+		{
+			name: "int and bool",
+			yaml: "server:\n  port: 9000\n",
+			env: map[string]string{
+				"WECHAT_SERVICE_SERVER_PORT":        "9100",
+				"WECHAT_SERVICE_RATE_LIMIT_ENABLED": "true",
+			},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.Server.Port != 9100 || !cfg.RateLimit.Enabled {
+					t.Errorf("port = %d, rate limit = %v", cfg.Server.Port, cfg.RateLimit.Enabled)
+				}
+			},
+		},
+		{
+			name: "float",
+			env:  map[string]string{"WECHAT_SERVICE_TRACING_SAMPLE_RATIO": "0.25"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.Tracing.SampleRatio != 0.25 {
+					t.Errorf("tracing.sample_ratio = %v", cfg.Tracing.SampleRatio)
+				}
+			},
+		},
+		{
+			name: "list replaces",
+			yaml: "cache:\n  redis:\n    addrs: [a:1]\n",
+			env:  map[string]string{"WECHAT_SERVICE_CACHE_REDIS_ADDRS": "b:1, c:1,"},
+			check: func(t *testing.T, cfg *Config) {
+				if want := []string{"b:1", "c:1"}; !reflect.DeepEqual(cfg.Cache.Redis.Addrs, want) {
+					t.Errorf("cache.redis.addrs = %v, want %v", cfg.Cache.Redis.Addrs, want)
+				}
+			},
+		},
+		{
+			name: "map merges",
+			yaml: "rate_limit:\n  api_quotas:\n    menu_create: 10\n",
+			env:  map[string]string{"WECHAT_SERVICE_RATE_LIMIT_API_QUOTAS": "user_list=7"},
+			check: func(t *testing.T, cfg *Config) {
+				q := cfg.RateLimit.APIQuotas
+				if q["user_list"] != 7 || q["menu_create"] != 10 || q["access_token"] != DefaultAPIQuotas["access_token"] {
+					t.Errorf("api_quotas = %v", q)
+				}
+			},
+		},
+		{
+			name: "secret from file",
+			env:  map[string]string{"WECHAT_SERVICE_WECHAT_APP_SECRET_FILE": secret},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.WeChat.AppSecret != "from-file" {
+					t.Errorf("wechat.app_secret = %q", cfg.WeChat.AppSecret)
+				}
+			},
+		},
+		{
+			name: "value wins over file",
+			env: map[string]string{
+				"WECHAT_SERVICE_WECHAT_APP_SECRET":      "direct",
+				"WECHAT_SERVICE_WECHAT_APP_SECRET_FILE": secret,
+			},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.WeChat.AppSecret != "direct" {
+					t.Errorf("wechat.app_secret = %q", cfg.WeChat.AppSecret)
+				}
+			},
+		},
+		{
+			name: "prefixed wins over legacy",
+			env: map[string]string{
+				"SERVER_PORT":                "9200",
+				"WECHAT_SERVICE_SERVER_PORT": "9300",
+			},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.Server.Port != 9300 {
+					t.Errorf("server.port = %d", cfg.Server.Port)
+				}
+			},
+		},
+		{name: "bad int", env: map[string]string{"WECHAT_SERVICE_SERVER_PORT": "high"}, wantErr: true},
+		{name: "bad map pair", env: map[string]string{"WECHAT_SERVICE_RATE_LIMIT_API_QUOTAS": "user_list"}, wantErr: true},
+		{name: "missing file", env: map[string]string{"WECHAT_SERVICE_WECHAT_TOKEN_FILE": "/nonexistent/token"}, wantErr: true},
+		{name: "list of structs", env: map[string]string{"WECHAT_SERVICE_ACCOUNTS": "wx1"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			cfg, err := Load(writeConfig(t, tt.yaml))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.check != nil {
+				tt.check(t, cfg)
+			}
+		})
+	}
+}
+
+func TestDefaultAPIQuotas(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want map[string]int // entries checked, on top of every default being set
+	}{
+		{name: "none listed", yaml: "", want: map[string]int{"menu_create": 1000}},
+		{
+			name: "some listed",
+			yaml: "rate_limit:\n  api_quotas:\n    menu_create: 5\n",
+			want: map[string]int{"menu_create": 5, "user_list": 500},
+		},
+		{
+			name: "custom api",
+			yaml: "rate_limit:\n  api_quotas:\n    custom_api: 3\n",
+			want: map[string]int{"custom_api": 3, "menu_query": 10000},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := Load(writeConfig(t, tt.yaml))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for api := range DefaultAPIQuotas {
+				if _, ok := cfg.RateLimit.APIQuotas[api]; !ok {
+					t.Errorf("quota of %s missing", api)
+				}
+			}
+			for api, want := range tt.want {
+				if got := cfg.RateLimit.APIQuotas[api]; got != want {
+					t.Errorf("quota of %s = %d, want %d", api, got, want)
+				}
+			}
+		})
+	}
+}
+
+// sprintf is fmt.Sprintf, kept short for YAML templates
+func sprintf(format string, args ...interface{}) string {
+	return fmt.Sprintf(format, args...)
+}
@@ -0,0 +1,75 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// secretKeys are YAML keys whose values are masked by WriteMasked
+var secretKeys = map[string]bool{
+	"app_secret":       true,
+	"token":            true,
+	"encoding_aes_key": true,
+	"app_key":          true,
+	"password":         true,
+	"admin_token":      true,
+	"secret":           true,
+	"alert_webhook":    true,
+	"url":              true,
+}
+
+// secretSuffixes mask any other key naming a password, secret or token,
+// such as sentinel_password
+var secretSuffixes = []string{"password", "secret", "token"}
+
+// isSecretKey reports whether values under key are masked
+func isSecretKey(key string) bool {
+	if secretKeys[key] {
+		return true
+	}
+	for _, suffix := range secretSuffixes {
+		if strings.HasSuffix(key, "_"+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteMasked writes the configuration as YAML with secrets masked
+func (c *Config) WriteMasked(w io.Writer) error {
+	var root yaml.Node
+	if err := root.Encode(c); err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+	maskNode(&root)
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(&root); err != nil {
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+	return enc.Close()
+}
+
+// maskNode masks secret scalar values under node
+func maskNode(node *yaml.Node) {
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, val := node.Content[i], node.Content[i+1]
+			if isSecretKey(key.Value) && val.Kind == yaml.ScalarNode && val.Value != "" {
+				val.Value = "******"
+				val.Tag = "!!str"
+				val.Style = 0
+				continue
+			}
+			maskNode(val)
+		}
+		return
+	}
+	for _, child := range node.Content {
+		maskNode(child)
+	}
+}
@@ -0,0 +1,62 @@
+package config
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteMaskedRedis(t *testing.T) {
+	tests := []struct {
+		name  string
+		set   func(cfg *Config)
+		value string
+		want  string // line expected in the output
+	}{
+		{name: "password", set: func(cfg *Config) { cfg.Cache.Redis.Password = "REDISSECRET" }, value: "REDISSECRET", want: "password: '******'"},
+		{name: "sentinel password", set: func(cfg *Config) { cfg.Cache.Redis.SentinelPassword = "SENTINELSECRET" }, value: "SENTINELSECRET", want: "sentinel_password: '******'"},
+		{name: "username kept", set: func(cfg *Config) { cfg.Cache.Redis.Username = "svc-user" }, value: "", want: "username: svc-user"},
+		{name: "key file path kept", set: func(cfg *Config) { cfg.Cache.Redis.TLS.KeyFile = "/etc/redis/client.key" }, value: "", want: "key_file: /etc/redis/client.key"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			tt.set(cfg)
+
+			var buf bytes.Buffer
+			if err := cfg.WriteMasked(&buf); err != nil {
+				t.Fatal(err)
+			}
+			out := buf.String()
+			if tt.value != "" && strings.Contains(out, tt.value) {
+				t.Errorf("%s printed in clear text", tt.value)
+			}
+			if !strings.Contains(out, tt.want) {
+				t.Errorf("%q missing from:\n%s", tt.want, out)
+			}
+		})
+	}
+}
+
+func TestIsSecretKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{key: "app_secret", want: true},
+		{key: "password", want: true},
+		{key: "sentinel_password", want: true},
+		{key: "admin_token", want: true},
+		{key: "client_secret", want: true},
+		{key: "username", want: false},
+		{key: "key_file", want: false},
+		{key: "tokens_per_second", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := isSecretKey(tt.key); got != tt.want {
+			t.Errorf("isSecretKey(%q) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FieldError describes one invalid configuration field
+type FieldError struct {
+	Path    string // YAML path, e.g. wechat.encoding_aes_key
+	Message string
+}
+
+// Error implements error
+func (e FieldError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+// ValidationErrors collects every problem found by Validate
+type ValidationErrors []FieldError
+
+// Error implements error, listing one problem per line
+func (e ValidationErrors) Error() string {
+	lines := make([]string, len(e))
+	for i, fe := range e {
+		lines[i] = fe.Error()
+	}
+	return fmt.Sprintf("%d config error(s):\n  %s", len(e), strings.Join(lines, "\n  "))
+}
+
+// validator accumulates field errors
+type validator struct {
+	errs ValidationErrors
+}
+
+// addf records a problem with path
+func (v *validator) addf(path, format string, args ...interface{}) {
+	v.errs = append(v.errs, FieldError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// required checks that value is set
+func (v *validator) required(path, value string) {
+	if strings.TrimSpace(value) == "" {
+		v.addf(path, "is required")
+	}
+}
+
+// positive checks that n > 0
+func (v *validator) positive(path string, n int) {
+	if n <= 0 {
+		v.addf(path, "must be positive, got %d", n)
+	}
+}
+
+// nonNegative checks that n >= 0
+func (v *validator) nonNegative(path string, n int) {
+	if n < 0 {
+		v.addf(path, "must not be negative, got %d", n)
+	}
+}
+
+// limit checks that n is positive or -1, which disables the limit; 0
+// selects the default
+func (v *validator) limit(path string, n int) {
+	if n < -1 {
+		v.addf(path, "must be positive, or -1 for no limit, got %d", n)
+	}
+}
+
+// oneOf checks that value is one of allowed
+func (v *validator) oneOf(path, value string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	v.addf(path, "must be one of %s, got %q", strings.Join(allowed, ", "), value)
+}
+
+// hostPort checks that value is a host:port address
+func (v *validator) hostPort(path, value string) {
+	host, port, err := net.SplitHostPort(value)
+	if err != nil {
+		v.addf(path, "must be host:port, got %q", value)
+		return
+	}
+	if host == "" {
+		v.addf(path, "host is empty in %q", value)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		v.addf(path, "invalid port in %q", value)
+	}
+}
+
+// sortedKeys returns the keys of m in order, so errors are reported
+// deterministically
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Validate checks every section and reports all problems at once as
+// ValidationErrors
+func (c *Config) Validate() error {
+	v := &validator{}
+
+	// Server
+	if c.Server.Port <= 0 || c.Server.Port > 65535 {
+		v.addf("server.port", "must be between 1 and 65535, got %d", c.Server.Port)
+	}
+	v.nonNegative("server.read_timeout", c.Server.ReadTimeout)
+	v.nonNegative("server.write_timeout", c.Server.WriteTimeout)
+	v.nonNegative("server.max_header_bytes", c.Server.MaxHeaderBytes)
+	if !strings.HasPrefix(c.Server.CallbackPath, "/") {
+		v.addf("server.callback_path", "must start with /, got %q", c.Server.CallbackPath)
+	}
+
+	// WeChat, or the account list that replaces it
+	if len(c.Accounts) == 0 {
+		v.required("wechat.app_id", c.WeChat.AppID)
+		v.required("wechat.app_secret", c.WeChat.AppSecret)
+		v.required("wechat.token", c.WeChat.Token)
+		if key := c.WeChat.EncodingAESKey; key != "" && len(key) != 43 {
+			v.addf("wechat.encoding_aes_key", "must be 43 characters, got %d", len(key))
+		}
+	}
+	seen := make(map[string]bool, len(c.Accounts))
+	for i, a := range c.Accounts {
+		path := fmt.Sprintf("accounts[%d]", i)
+		v.required(path+".app_id", a.AppID)
+		v.required(path+".app_secret", a.AppSecret)
+		v.required(path+".token", a.Token)
+		if len(a.EncodingAESKey) != 0 && len(a.EncodingAESKey) != 43 {
+			v.addf(path+".encoding_aes_key", "must be 43 characters, got %d", len(a.EncodingAESKey))
+		}
+		if a.AppID != "" && seen[a.AppID] {
+			v.addf(path+".app_id", "duplicate app_id %q", a.AppID)
+		}
+		seen[a.AppID] = true
+		for _, api := range sortedKeys(a.APIQuotas) {
+			v.nonNegative(path+".api_quotas."+api, a.APIQuotas[api])
+		}
+	}
+
+	// Access token
+	v.positive("access_token.cache_duration", c.AccessToken.CacheDuration)
+	if c.AccessToken.CacheDuration > 7200 {
+		v.addf("access_token.cache_duration", "must not exceed the 7200s token lifetime, got %d", c.AccessToken.CacheDuration)
+	}
+	v.nonNegative("access_token.refresh_interval", c.AccessToken.RefreshInterval)
+
+	// Rate limit
+	v.oneOf("rate_limit.storage", c.RateLimit.Storage, "", "memory", "redis")
+	if c.RateLimit.RedisAddr != "" {
+		v.hostPort("rate_limit.redis_addr", c.RateLimit.RedisAddr)
+	}
+	for _, api := range sortedKeys(c.RateLimit.APIQuotas) {
+		v.nonNegative("rate_limit.api_quotas."+api, c.RateLimit.APIQuotas[api])
+	}
+
+	// Monitoring
+	v.oneOf("monitoring.log_level", strings.ToLower(c.Monitoring.LogLevel), "debug", "info", "warn", "warning", "error")
+	v.positive("monitoring.health_check_timeout", c.Monitoring.HealthCheckTimeout)
+	v.nonNegative("monitoring.alert_max_per_hour", c.Monitoring.AlertMaxPerHour)
+	if r := c.Monitoring.QuotaAlertThreshold; r <= 0 || r > 1 {
+		v.addf("monitoring.quota_alert_threshold", "must be in (0, 1], got %g", r)
+	}
+	for i, n := range c.Monitoring.Notifiers {
+		path := fmt.Sprintf("monitoring.notifiers[%d]", i)
+		v.oneOf(path+".type", n.Type, "webhook", "wecom", "dingtalk", "feishu", "email")
+		if n.Type == "email" {
+			v.required(path+".smtp_host", n.SMTPHost)
+			if len(n.To) == 0 {
+				v.addf(path+".to", "needs at least one recipient")
+			}
+		} else {
+			v.required(path+".url", n.URL)
+		}
+	}
+
+	// Logging
+	v.oneOf("logging.format", c.Logging.Format, "text", "json")
+	v.oneOf("logging.output", c.Logging.Output, "stdout", "file", "both")
+	v.limit("logging.max_size_mb", c.Logging.MaxSizeMB)
+	v.limit("logging.max_age_days", c.Logging.MaxAgeDays)
+	v.limit("logging.max_backups", c.Logging.MaxBackups)
+	for _, key := range sortedKeys(c.Logging.Redaction.Fields) {
+		mode := strings.ToLower(c.Logging.Redaction.Fields[key])
+		v.oneOf("logging.redaction.fields."+key, mode, "full", "partial", "text", "none")
+	}
+
+	// Tracing
+	if c.Tracing.Enabled {
+		v.oneOf("tracing.exporter", c.Tracing.Exporter, "otlp", "stdout")
+	}
+	if r := c.Tracing.SampleRatio; r < 0 || r > 1 {
+		v.addf("tracing.sample_ratio", "must be in [0, 1], got %g", r)
+	}
+
+	// Async
+	v.positive("async.workers", c.Async.Workers)
+	v.positive("async.queue_size", c.Async.QueueSize)
+	v.nonNegative("async.retry_count", c.Async.RetryCount)
+	v.nonNegative("async.retry_delay", c.Async.RetryDelay)
+	v.nonNegative("async.shutdown_timeout", c.Async.ShutdownTimeout)
+
+	// Database
+	v.oneOf("database.type", c.Database.Type, "", "postgres")
+	if c.Database.Type != "" {
+		v.required("database.host", c.Database.Host)
+		v.required("database.name", c.Database.Name)
+		if c.Database.Port <= 0 || c.Database.Port > 65535 {
+			v.addf("database.port", "must be between 1 and 65535, got %d", c.Database.Port)
+		}
+		v.oneOf("database.sslmode", c.Database.SSLMode, "", "disable", "allow", "prefer", "require", "verify-ca", "verify-full")
+	}
+	v.nonNegative("database.max_open", c.Database.MaxOpen)
+	v.nonNegative("database.max_idle", c.Database.MaxIdle)
+
+	// Cache
+	v.oneOf("cache.type", c.Cache.Type, "", "memory", "redis", "layered")
+	if c.Cache.Type == "layered" {
+		v.positive("cache.local_ttl", c.Cache.LocalTTL)
+		v.required("cache.invalidation_channel", c.Cache.InvalidationChannel)
+	}
+	v.nonNegative("cache.memory.max_entries", c.Cache.Memory.MaxEntries)
+	v.positive("cache.memory.cleanup_interval", c.Cache.Memory.CleanupInterval)
+	// An empty type selects redis, like cache.New does
+	if c.Cache.Type == "" || c.Cache.Type == "redis" || c.Cache.Type == "layered" {
+		c.validateRedis(v)
+	}
+
+	// API domain
+	v.oneOf("api_domain.current_domain", c.APIDomain.CurrentDomain, "primary", "backup", "shanghai", "shenzhen", "hong_kong")
+
+	if len(v.errs) > 0 {
+		return v.errs
+	}
+	return nil
+}
+
+// validateRedis checks cache.redis for the selected mode
+func (c *Config) validateRedis(v *validator) {
+	r := c.Cache.Redis
+	v.oneOf("cache.redis.mode", r.Mode, "standalone", "sentinel", "cluster")
+
+	switch r.Mode {
+	case "standalone":
+		v.hostPort("cache.redis.addr", r.Addr)
+	case "sentinel":
+		v.required("cache.redis.master_name", r.MasterName)
+		if len(r.Addrs) == 0 {
+			v.addf("cache.redis.addrs", "needs at least one sentinel address")
+		}
+	case "cluster":
+		if len(r.Addrs) == 0 {
+			v.addf("cache.redis.addrs", "needs at least one cluster node address")
+		}
+		if r.DB != 0 {
+			v.addf("cache.redis.db", "must be 0 in cluster mode, got %d", r.DB)
+		}
+	}
+	if r.Mode != "standalone" {
+		for i, addr := range r.Addrs {
+			v.hostPort(fmt.Sprintf("cache.redis.addrs[%d]", i), addr)
+		}
+	}
+
+	if r.DB < 0 || r.DB > 15 {
+		v.addf("cache.redis.db", "must be between 0 and 15, got %d", r.DB)
+	}
+	v.nonNegative("cache.redis.pool_size", r.PoolSize)
+	v.nonNegative("cache.redis.min_idle_conns", r.MinIdleConns)
+	v.nonNegative("cache.redis.dial_timeout", r.DialTimeout)
+	v.nonNegative("cache.redis.read_timeout", r.ReadTimeout)
+	v.nonNegative("cache.redis.write_timeout", r.WriteTimeout)
+	if (r.TLS.CertFile == "") != (r.TLS.KeyFile == "") {
+		v.addf("cache.redis.tls", "cert_file and key_file must be set together")
+	}
+}
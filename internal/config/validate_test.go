@@ -0,0 +1,222 @@
+package config
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// baseYAML is a valid configuration without a cache section
+const baseYAML = `
+server:
+  port: 8080
+wechat:
+  app_id: wx1
+  app_secret: secret
+  token: token
+`
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		yaml      string // appended to baseYAML, or replacing it when full
+		full      bool
+		wantPaths []string
+	}{
+		{name: "memory cache", yaml: "cache:\n  type: memory\n"},
+		{name: "redis cache", yaml: "cache:\n  type: redis\n  redis:\n    addr: localhost:6379\n"},
+		{name: "empty type is redis", yaml: "cache:\n  redis:\n    addr: localhost:6379\n"},
+		{name: "empty type needs redis addr", yaml: "", wantPaths: []string{"cache.redis.addr"}},
+		{name: "unknown cache type", yaml: "cache:\n  type: disk\n", wantPaths: []string{"cache.type"}},
+		{
+			name:      "layered sentinel without master",
+			yaml:      "cache:\n  type: layered\n  redis:\n    mode: sentinel\n    addrs: [s1:26379]\n",
+			wantPaths: []string{"cache.redis.master_name"},
+		},
+		{
+			name:      "cluster with db",
+			yaml:      "cache:\n  type: redis\n  redis:\n    mode: cluster\n    addrs: [n1:6379, bad]\n    db: 1\n",
+			wantPaths: []string{"cache.redis.db", "cache.redis.addrs[1]"},
+		},
+		{
+			name:      "missing credentials",
+			full:      true,
+			yaml:      "cache:\n  type: memory\n",
+			wantPaths: []string{"wechat.app_id", "wechat.app_secret", "wechat.token"},
+		},
+		{
+			name:      "short aes key",
+			full:      true,
+			yaml:      "cache:\n  type: memory\nwechat:\n  app_id: wx1\n  app_secret: s\n  token: t\n  encoding_aes_key: short\n",
+			wantPaths: []string{"wechat.encoding_aes_key"},
+		},
+		{
+			name: "duplicate accounts",
+			full: true,
+			yaml: "cache:\n  type: memory\naccounts:\n" +
+				"  - {app_id: wx1, app_secret: s, token: t}\n" +
+				"  - {app_id: wx1, app_secret: s, token: t, encoding_aes_key: short}\n",
+			wantPaths: []string{"accounts[1].app_id", "accounts[1].encoding_aes_key"},
+		},
+		{
+			name:      "log limits",
+			yaml:      "cache:\n  type: memory\nlogging:\n  max_size_mb: -1\n  max_backups: -2\n",
+			wantPaths: []string{"logging.max_backups"},
+		},
+		{
+			name:      "ratios",
+			yaml:      "cache:\n  type: memory\ntracing:\n  sample_ratio: 2\nmonitoring:\n  quota_alert_threshold: 1.5\n",
+			wantPaths: []string{"tracing.sample_ratio", "monitoring.quota_alert_threshold"},
+		},
+		{
+			name:      "notifiers",
+			yaml:      "cache:\n  type: memory\nmonitoring:\n  notifiers:\n    - type: email\n    - type: wecom\n",
+			wantPaths: []string{"monitoring.notifiers[0].smtp_host", "monitoring.notifiers[0].to", "monitoring.notifiers[1].url"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			yaml := baseYAML + tt.yaml
+			if tt.full {
+				yaml = "server:\n  port: 8080\n" + tt.yaml
+			}
+			cfg, err := Load(writeConfig(t, yaml))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = cfg.Validate()
+			if len(tt.wantPaths) == 0 {
+				if err != nil {
+					t.Fatalf("Validate: %v", err)
+				}
+				return
+			}
+			var errs ValidationErrors
+			if !errors.As(err, &errs) {
+				t.Fatalf("Validate = %v, want ValidationErrors", err)
+			}
+			if len(errs) != len(tt.wantPaths) {
+				t.Errorf("got %d errors, want %d:\n%v", len(errs), len(tt.wantPaths), err)
+			}
+			for _, want := range tt.wantPaths {
+				if !strings.Contains(err.Error(), want+":") {
+					t.Errorf("no error at %s in:\n%v", want, err)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateSections(t *testing.T) {
+	tests := []struct {
+		name      string
+		port      string // server.port, 8080 when empty
+		yaml      string // appended to baseYAML with a memory cache
+		wantPaths []string
+	}{
+		{name: "defaults", yaml: ""},
+		{name: "port out of range", port: "70000", wantPaths: []string{"server.port"}},
+		{
+			name:      "async workers and queue",
+			yaml:      "async:\n  workers: -1\n  queue_size: -5\n  retry_count: -1\n",
+			wantPaths: []string{"async.workers", "async.queue_size", "async.retry_count"},
+		},
+		{name: "unknown rate limit storage", yaml: "rate_limit:\n  storage: etcd\n", wantPaths: []string{"rate_limit.storage"}},
+		{name: "rate limit redis address", yaml: "rate_limit:\n  redis_addr: localhost\n", wantPaths: []string{"rate_limit.redis_addr"}},
+		{
+			name:      "negative quotas",
+			yaml:      "rate_limit:\n  api_quotas:\n    user_info: -1\n    menu_create: -2\n",
+			wantPaths: []string{"rate_limit.api_quotas.menu_create", "rate_limit.api_quotas.user_info"},
+		},
+		{
+			name:      "negative account quota",
+			yaml:      "accounts:\n  - {app_id: wx1, app_secret: s, token: t, api_quotas: {tag_create: -1}}\n",
+			wantPaths: []string{"accounts[0].api_quotas.tag_create"},
+		},
+		{
+			name:      "unknown database type",
+			yaml:      "database:\n  type: mysql\n  host: db\n  name: wechat\n  port: 3306\n",
+			wantPaths: []string{"database.type"},
+		},
+		{
+			name:      "postgres without host",
+			yaml:      "database:\n  type: postgres\n  name: wechat\n  port: 5432\n  sslmode: sometimes\n",
+			wantPaths: []string{"database.host", "database.sslmode"},
+		},
+		{name: "unknown api domain", yaml: "api_domain:\n  current_domain: mars\n", wantPaths: []string{"api_domain.current_domain"}},
+		{
+			name: "every problem at once",
+			port: "-1",
+			yaml: "async:\n  workers: -1\nrate_limit:\n  storage: etcd\n" +
+				"database:\n  type: mysql\n  host: db\n  name: wechat\n  port: 3306\napi_domain:\n  current_domain: mars\n",
+			wantPaths: []string{"server.port", "rate_limit.storage", "async.workers", "database.type", "api_domain.current_domain"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := baseYAML
+			if tt.port != "" {
+				base = strings.Replace(base, "port: 8080", "port: "+tt.port, 1)
+			}
+			cfg, err := Load(writeConfig(t, base+"cache:\n  type: memory\n"+tt.yaml))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = cfg.Validate()
+			var errs ValidationErrors
+			if len(tt.wantPaths) == 0 {
+				if err != nil {
+					t.Fatalf("Validate: %v", err)
+				}
+				return
+			}
+			if !errors.As(err, &errs) {
+				t.Fatalf("Validate = %v, want ValidationErrors", err)
+			}
+			var paths []string
+			for _, fe := range errs {
+				paths = append(paths, fe.Path)
+			}
+			if !reflect.DeepEqual(paths, tt.wantPaths) {
+				t.Errorf("paths = %v, want %v", paths, tt.wantPaths)
+			}
+		})
+	}
+}
+
+func TestValidationErrorsMessage(t *testing.T) {
+	errs := ValidationErrors{
+		{Path: "server.port", Message: "must be between 1 and 65535, got 0"},
+		{Path: "async.workers", Message: "must be positive, got -1"},
+	}
+	want := "2 config error(s):\n  server.port: must be between 1 and 65535, got 0\n  async.workers: must be positive, got -1"
+	if got := errs.Error(); got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+}
+
+func TestApplyDefaultsCacheType(t *testing.T) {
+	tests := []struct {
+		yaml string
+		want string
+	}{
+		{yaml: "", want: "redis"},
+		{yaml: "cache:\n  type: memory\n", want: "memory"},
+		{yaml: "cache:\n  type: layered\n", want: "layered"},
+	}
+
+	for _, tt := range tests {
+		cfg, err := Load(writeConfig(t, tt.yaml))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Cache.Type != tt.want {
+			t.Errorf("cache.type for %q = %q, want %q", tt.yaml, cfg.Cache.Type, tt.want)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package config
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// SubscriberFunc is called with the previous and the new configuration
+// after a successful reload
+type SubscriberFunc func(old, new *Config)
+
+// Watcher reloads the configuration file when it changes on disk or the
+// process receives SIGHUP. A reloaded file is parsed and validated before
+// it replaces the current configuration; an invalid file is reported and
+// the previous configuration stays in effect. Once started, the watcher
+// is the process's only SIGHUP handler; see OnSIGHUP.
+type Watcher struct {
+	path    string
+	current atomic.Pointer[Config]
+	onError func(error)
+
+	reloadMu sync.Mutex // serializes reloads, so subscribers see them in order
+
+	mu      sync.Mutex
+	subs    []SubscriberFunc
+	sigSubs []func()
+	hash    [sha256.Size]byte
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewWatcher creates a watcher for path with cfg as the current
+// configuration. onError, if not nil, receives reload failures.
+func NewWatcher(path string, cfg *Config, onError func(error)) *Watcher {
+	w := &Watcher{
+		path:    path,
+		onError: onError,
+		stopCh:  make(chan struct{}),
+	}
+	w.current.Store(cfg)
+	if data, err := os.ReadFile(path); err == nil {
+		w.hash = sha256.Sum256(data)
+	}
+	return w
+}
+
+// Config returns the current configuration. The returned value must not
+// be modified.
+func (w *Watcher) Config() *Config {
+	return w.current.Load()
+}
+
+// Subscribe registers fn to be called after every successful reload
+func (w *Watcher) Subscribe(fn SubscriberFunc) {
+	w.mu.Lock()
+	w.subs = append(w.subs, fn)
+	w.mu.Unlock()
+}
+
+// OnSIGHUP registers fn to be called on every SIGHUP, before the
+// configuration is reloaded, for example to reopen log files
+func (w *Watcher) OnSIGHUP(fn func()) {
+	w.mu.Lock()
+	w.sigSubs = append(w.sigSubs, fn)
+	w.mu.Unlock()
+}
+
+// Reload re-reads and validates the configuration file, swaps it in and
+// notifies subscribers. Unknown keys are rejected, so a misspelt setting
+// is not silently dropped. Subscribers run without the watcher's lock held,
+// so they may call Config and Subscribe.
+func (w *Watcher) Reload() error {
+	w.reloadMu.Lock()
+	defer w.reloadMu.Unlock()
+
+	data, err := os.ReadFile(w.path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	w.mu.Lock()
+	w.hash = sha256.Sum256(data)
+	w.mu.Unlock()
+
+	cfg, err := LoadStrict(w.path)
+	if err != nil {
+		return err
+	}
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+
+	old := w.current.Swap(cfg)
+
+	w.mu.Lock()
+	subs := append([]SubscriberFunc(nil), w.subs...)
+	w.mu.Unlock()
+
+	for _, fn := range subs {
+		fn(old, cfg)
+	}
+	return nil
+}
+
+// Start polls the file every interval and listens for SIGHUP
+func (w *Watcher) Start(interval time.Duration) {
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		defer signal.Stop(sigCh)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if w.changed() {
+					w.reload()
+				}
+			case <-sigCh:
+				w.mu.Lock()
+				sigSubs := append([]func(){}, w.sigSubs...)
+				w.mu.Unlock()
+				for _, fn := range sigSubs {
+					fn()
+				}
+				w.reload()
+			case <-w.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops watching
+func (w *Watcher) Stop() {
+	close(w.stopCh)
+	w.wg.Wait()
+}
+
+// changed reports whether the file content differs from the last load
+func (w *Watcher) changed() bool {
+	data, err := os.ReadFile(w.path)
+	if err != nil {
+		return false
+	}
+	hash := sha256.Sum256(data)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return !bytes.Equal(hash[:], w.hash[:])
+}
+
+// reload reloads and reports failures
+func (w *Watcher) reload() {
+	if err := w.Reload(); err != nil && w.onError != nil {
+		w.onError(err)
+	}
+}
+
+// RestartRequired lists the sections that changed between old and new but
+// are only read at startup, such as listen addresses and connections
+func RestartRequired(old, new *Config) []string {
+	var sections []string
+	if old.Server.Host != new.Server.Host || old.Server.Port != new.Server.Port {
+		sections = append(sections, "server")
+	}
+	if old.WeChat != new.WeChat || !sameAccounts(old.Accounts, new.Accounts) {
+		sections = append(sections, "wechat")
+	}
+	if old.Database != new.Database {
+		sections = append(sections, "database")
+	}
+	if old.Cache.Type != new.Cache.Type || !reflect.DeepEqual(old.Cache.Redis, new.Cache.Redis) {
+		sections = append(sections, "cache")
+	}
+	if old.Logging.Output != new.Logging.Output || old.Logging.Dir != new.Logging.Dir || old.Logging.Format != new.Logging.Format {
+		sections = append(sections, "logging")
+	}
+	if old.Tracing != new.Tracing {
+		sections = append(sections, "tracing")
+	}
+	return sections
+}
+
+// sameAccounts reports whether a and b list the same account credentials.
+// Quotas are ignored since they apply without a restart.
+func sameAccounts(a, b []AccountConfig) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		x, y := a[i], b[i]
+		x.APIQuotas, y.APIQuotas = nil, nil
+		if !reflect.DeepEqual(x, y) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,159 @@
+package config
+
+import (
+	"os"
+	"reflect"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// validYAML is a minimal configuration that passes Validate
+const validYAML = `
+server:
+  port: %d
+wechat:
+  app_id: wx1
+  app_secret: secret
+  token: token
+cache:
+  type: memory
+`
+
+func TestWatcherReload(t *testing.T) {
+	tests := []struct {
+		name       string
+		newYAML    string
+		wantErr    bool
+		wantPort   int
+		wantCalled bool
+	}{
+		{name: "valid change", newYAML: sprintf(validYAML, 9001), wantPort: 9001, wantCalled: true},
+		{name: "unparsable", newYAML: "server: [", wantErr: true, wantPort: 9000},
+		{name: "invalid", newYAML: sprintf(validYAML, -1), wantErr: true, wantPort: 9000},
+		{name: "unknown key", newYAML: sprintf(validYAML, 9001) + "rate_limit:\n  api_quota:\n    menu_create: 7\n", wantErr: true, wantPort: 9000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfig(t, sprintf(validYAML, 9000))
+			cfg, err := Load(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := NewWatcher(path, cfg, nil)
+
+			var called bool
+			w.Subscribe(func(old, new *Config) {
+				called = true
+				if old.Server.Port != 9000 || new.Server.Port != tt.wantPort {
+					t.Errorf("subscriber got ports %d -> %d", old.Server.Port, new.Server.Port)
+				}
+				// Subscribers run outside the watcher's lock
+				w.Subscribe(func(_, _ *Config) {})
+				if w.Config() != new {
+					t.Error("Config() does not return the new configuration")
+				}
+			})
+
+			if err := os.WriteFile(path, []byte(tt.newYAML), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			err = w.Reload()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Reload err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if called != tt.wantCalled {
+				t.Errorf("subscriber called = %v, want %v", called, tt.wantCalled)
+			}
+			if got := w.Config().Server.Port; got != tt.wantPort {
+				t.Errorf("port = %d, want %d", got, tt.wantPort)
+			}
+		})
+	}
+}
+
+func TestWatcherSIGHUP(t *testing.T) {
+	path := writeConfig(t, sprintf(validYAML, 9000))
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWatcher(path, cfg, nil)
+
+	var hups, reloads atomic.Int32
+	w.OnSIGHUP(func() { hups.Add(1) })
+	w.Subscribe(func(_, _ *Config) { reloads.Add(1) })
+	w.Start(time.Hour)
+	defer w.Stop()
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for reloads.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if hups.Load() != 1 || reloads.Load() != 1 {
+		t.Errorf("SIGHUP ran %d hooks and %d reloads, want 1 and 1", hups.Load(), reloads.Load())
+	}
+}
+
+func TestWatcherPollsForChanges(t *testing.T) {
+	path := writeConfig(t, sprintf(validYAML, 9000))
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWatcher(path, cfg, nil)
+	w.Start(10 * time.Millisecond)
+	defer w.Stop()
+
+	if err := os.WriteFile(path, []byte(sprintf(validYAML, 9002)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for w.Config().Server.Port != 9002 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := w.Config().Server.Port; got != 9002 {
+		t.Errorf("port = %d after the file changed, want 9002", got)
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		want   []string
+	}{
+		{name: "nothing", change: func(c *Config) {}},
+		{name: "log level", change: func(c *Config) { c.Monitoring.LogLevel = "debug" }},
+		{name: "quotas", change: func(c *Config) { c.RateLimit.APIQuotas = map[string]int{"menu_create": 1} }},
+		{name: "account quotas", change: func(c *Config) { c.Accounts[0].APIQuotas = map[string]int{"user_list": 1} }},
+		{name: "port", change: func(c *Config) { c.Server.Port = 1 }, want: []string{"server"}},
+		{name: "account secret", change: func(c *Config) { c.Accounts[0].AppSecret = "new" }, want: []string{"wechat"}},
+		{name: "redis", change: func(c *Config) { c.Cache.Redis.Addr = "other:6379" }, want: []string{"cache"}},
+		{
+			name:   "several",
+			change: func(c *Config) { c.Database.Host = "db"; c.Logging.Format = "json"; c.Tracing.Enabled = true },
+			want:   []string{"database", "logging", "tracing"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := &Config{Accounts: []AccountConfig{{AppID: "wx1", AppSecret: "s"}}}
+			changed := *old
+			changed.Accounts = []AccountConfig{old.Accounts[0]}
+			tt.change(&changed)
+
+			if got := RestartRequired(old, &changed); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("RestartRequired = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"net/http"
+
+	"wechat-service/internal/config"
+	"wechat-service/internal/service"
+	"wechat-service/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AccountHandler routes WeChat callbacks to the MessageHandler of the
+// account named by the :appid path parameter
+type AccountHandler struct {
+	cfg      *config.Config
+	accounts *service.AccountRegistry
+	handlers map[string]*MessageHandler
+	log      *logger.Logger
+}
+
+// NewAccountHandler creates a MessageHandler for every account in the
+// registry
+func NewAccountHandler(cfg *config.Config, accounts *service.AccountRegistry, log *logger.Logger) *AccountHandler {
+	h := &AccountHandler{
+		cfg:      cfg,
+		accounts: accounts,
+		handlers: make(map[string]*MessageHandler),
+		log:      log,
+	}
+
+	for _, a := range accounts.All() {
+		h.handlers[a.AppID] = NewMessageHandler(a.Config, a.OA, a.Messages, a.Events, a.Log, a.Metrics)
+	}
+
+	return h
+}
+
+// Handler returns the MessageHandler of appID
+func (h *AccountHandler) Handler(appID string) (*MessageHandler, bool) {
+	mh, ok := h.handlers[appID]
+	return mh, ok
+}
+
+// RegisterRoutes registers <callback_path>/:appid for every account and
+// <callback_path> for the first one, which keeps single-account
+// deployments working unchanged
+func (h *AccountHandler) RegisterRoutes(r gin.IRouter) {
+	path := h.cfg.Server.CallbackPath
+	r.Any(path+"/:appid", h.Serve)
+	if def := h.accounts.Default(); def != nil {
+		r.Any(path, h.serveAccount(def.AppID))
+	}
+}
+
+// Serve dispatches a callback by the :appid path parameter
+func (h *AccountHandler) Serve(c *gin.Context) {
+	h.serveAccount(c.Param("appid"))(c)
+}
+
+// serveAccount returns a gin handler serving callbacks for appID
+func (h *AccountHandler) serveAccount(appID string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		mh, ok := h.handlers[appID]
+		if !ok {
+			logger.FromContextOr(c.Request.Context(), h.log).Warn("Callback for unknown account", "app_id", appID)
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		ctx := logger.WithContextFields(c.Request.Context(), "app_id", appID)
+		mh.ServeHTTP(c.Writer, c.Request.WithContext(ctx))
+	}
+}
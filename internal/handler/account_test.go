@@ -0,0 +1,65 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"wechat-service/internal/config"
+	"wechat-service/internal/service"
+	"wechat-service/pkg/cache"
+	"wechat-service/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAccountHandlerRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cfg := &config.Config{}
+	cfg.Server.CallbackPath = "/wechat"
+	for _, id := range []string{"wx1", "wx2"} {
+		cfg.Accounts = append(cfg.Accounts, config.AccountConfig{AppID: id, AppSecret: "s", Token: "token-" + id})
+	}
+
+	store := cache.NewMemoryCache(0, 0)
+	defer store.Close()
+	log := logger.New(nil)
+	accounts, err := service.NewAccountRegistry(cfg, store, nil, nil, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accounts.Stop()
+
+	h := NewAccountHandler(cfg, accounts, log)
+	r := gin.New()
+	h.RegisterRoutes(r)
+
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+	}{
+		// Unsigned requests reach the account's handler, which rejects them
+		{name: "first account", path: "/wechat/wx1", wantStatus: http.StatusOK},
+		{name: "second account", path: "/wechat/wx2", wantStatus: http.StatusOK},
+		{name: "default account", path: "/wechat", wantStatus: http.StatusOK},
+		{name: "unknown account", path: "/wechat/wx9", wantStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+
+	for _, id := range []string{"wx1", "wx2"} {
+		if _, ok := h.Handler(id); !ok {
+			t.Errorf("no message handler for %q", id)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"wechat-service/internal/config"
+	"wechat-service/pkg/logger"
+	"wechat-service/pkg/metrics"
+	"wechat-service/pkg/monitor"
+
+	"github.com/gin-gonic/gin"
+	"github.com/silenceper/wechat/v2/util"
+)
+
+// maxAlertBodyBytes bounds the size of an alert push body
+const maxAlertBodyBytes = 64 << 10
+
+// AlertHandler receives WeChat callback-failure alert pushes
+type AlertHandler struct {
+	cfg     *config.Config
+	monitor *monitor.Monitor
+	log     *logger.Logger
+	metrics *metrics.Metrics
+}
+
+// NewAlertHandler creates a new alert handler
+func NewAlertHandler(
+	cfg *config.Config,
+	mon *monitor.Monitor,
+	log *logger.Logger,
+	metrics *metrics.Metrics,
+) *AlertHandler {
+	return &AlertHandler{
+		cfg:     cfg,
+		monitor: mon,
+		log:     log,
+		metrics: metrics,
+	}
+}
+
+// RegisterRoutes registers the alert push endpoint and the admin listing
+func (h *AlertHandler) RegisterRoutes(r gin.IRouter) {
+	r.GET(h.cfg.Monitoring.AlertPath, h.Verify)
+	r.POST(h.cfg.Monitoring.AlertPath, h.Receive)
+
+	admin := r.Group("/admin", RequireAdminToken(h.cfg))
+	admin.GET("/alerts", h.List)
+	admin.POST("/alerts/:id/ack", h.Acknowledge)
+	admin.POST("/alerts/:id/resolve", h.Resolve)
+	admin.GET("/health/history", h.HealthHistory)
+}
+
+// Verify answers WeChat's URL verification by echoing echostr
+func (h *AlertHandler) Verify(c *gin.Context) {
+	if !h.validSignature(c) {
+		c.String(http.StatusForbidden, "invalid signature")
+		return
+	}
+	c.String(http.StatusOK, c.Query("echostr"))
+}
+
+// Receive accepts an alert push, validates it and feeds the monitor
+func (h *AlertHandler) Receive(c *gin.Context) {
+	if !h.validSignature(c) {
+		h.log.Warn("Alert push with invalid signature", "client_ip", c.ClientIP())
+		h.metrics.IncMessageError("alert_signature")
+		c.String(http.StatusForbidden, "invalid signature")
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxAlertBodyBytes))
+	if err != nil {
+		c.String(http.StatusBadRequest, "failed to read body")
+		return
+	}
+
+	var data map[string]interface{}
+	if err := json.Unmarshal(body, &data); err != nil {
+		h.metrics.IncMessageError("alert_payload")
+		c.String(http.StatusBadRequest, "invalid JSON payload")
+		return
+	}
+
+	if err := h.validatePayload(data); err != nil {
+		h.log.Warn("Rejected alert push", "error", err)
+		h.metrics.IncMessageError("alert_payload")
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	alert := h.monitor.HandleAlert(data)
+	h.metrics.IncAlertReceived(alertTypeLabel(alert.Type), alert.Severity)
+
+	c.String(http.StatusOK, "success")
+}
+
+// alertTypeLabel maps an alert type to its metric label. Types WeChat is
+// not known to push are counted as "other" to bound label cardinality.
+func alertTypeLabel(alertType string) string {
+	if monitor.IsKnownAlertType(alertType) {
+		return alertType
+	}
+	return "other"
+}
+
+// List returns alerts filtered by the type, severity, status, since,
+// until and limit query parameters
+func (h *AlertHandler) List(c *gin.Context) {
+	since, until, err := parseTimeRange(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	alerts, err := h.monitor.QueryAlerts(c.Request.Context(), monitor.AlertFilter{
+		Type:     c.Query("type"),
+		Severity: c.Query("severity"),
+		Status:   c.Query("status"),
+		Since:    since,
+		Until:    until,
+		Limit:    parseLimit(c, 100),
+	})
+	if err != nil {
+		h.log.Error("Failed to query alerts", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query alerts"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"alerts": alerts,
+		"total":  len(alerts),
+	})
+}
+
+// Acknowledge marks an alert as acknowledged by the operator named in the
+// X-Admin-User header
+func (h *AlertHandler) Acknowledge(c *gin.Context) {
+	err := h.monitor.AcknowledgeAlert(c.Request.Context(), c.Param("id"), author(c))
+	h.respondUpdate(c, err)
+}
+
+// Resolve marks an alert as resolved
+func (h *AlertHandler) Resolve(c *gin.Context) {
+	err := h.monitor.ResolveAlert(c.Request.Context(), c.Param("id"))
+	h.respondUpdate(c, err)
+}
+
+// HealthHistory returns recorded health check results filtered by the
+// name, status, since, until and limit query parameters
+func (h *AlertHandler) HealthHistory(c *gin.Context) {
+	since, until, err := parseTimeRange(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	results, err := h.monitor.QueryHealthHistory(c.Request.Context(), monitor.HealthFilter{
+		Name:   c.Query("name"),
+		Status: c.Query("status"),
+		Since:  since,
+		Until:  until,
+		Limit:  parseLimit(c, 100),
+	})
+	if err != nil {
+		h.log.Error("Failed to query health history", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query health history"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"results": results,
+		"total":   len(results),
+	})
+}
+
+// respondUpdate writes the result of an alert state change
+func (h *AlertHandler) respondUpdate(c *gin.Context, err error) {
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, gin.H{"id": c.Param("id"), "ok": true})
+	case errors.Is(err, monitor.ErrAlertNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	default:
+		h.log.Error("Failed to update alert", "alert_id", c.Param("id"), "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update alert"})
+	}
+}
+
+// parseTimeRange parses the RFC 3339 since and until query parameters
+func parseTimeRange(c *gin.Context) (time.Time, time.Time, error) {
+	var since, until time.Time
+	var err error
+
+	if v := c.Query("since"); v != "" {
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			return since, until, fmt.Errorf("invalid since: %w", err)
+		}
+	}
+	if v := c.Query("until"); v != "" {
+		if until, err = time.Parse(time.RFC3339, v); err != nil {
+			return since, until, fmt.Errorf("invalid until: %w", err)
+		}
+	}
+	return since, until, nil
+}
+
+// parseLimit parses the limit query parameter, capped at 1000
+func parseLimit(c *gin.Context, def int) int {
+	limit, err := strconv.Atoi(c.Query("limit"))
+	if err != nil || limit <= 0 {
+		return def
+	}
+	if limit > 1000 {
+		return 1000
+	}
+	return limit
+}
+
+// validSignature checks the signature/timestamp/nonce query parameters
+// against the callback token of any configured account
+func (h *AlertHandler) validSignature(c *gin.Context) bool {
+	signature := c.Query("signature")
+	timestamp := c.Query("timestamp")
+	nonce := c.Query("nonce")
+	if signature == "" || timestamp == "" || nonce == "" {
+		return false
+	}
+
+	for _, account := range h.cfg.GetAccounts() {
+		if account.Token == "" {
+			continue
+		}
+		expected := util.Signature(account.Token, timestamp, nonce)
+		if subtle.ConstantTimeCompare([]byte(signature), []byte(expected)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// knownAppID reports whether appID belongs to a configured account
+func (h *AlertHandler) knownAppID(appID string) bool {
+	for _, account := range h.cfg.GetAccounts() {
+		if account.AppID == appID {
+			return true
+		}
+	}
+	return false
+}
+
+// validatePayload checks the required alert fields
+func (h *AlertHandler) validatePayload(data map[string]interface{}) error {
+	appID, _ := data["appid"].(string)
+	if appID == "" {
+		return fmt.Errorf("appid is required")
+	}
+	if !h.knownAppID(appID) {
+		return fmt.Errorf("appid %q does not match any configured account", appID)
+	}
+
+	alertType, _ := data["type"].(string)
+	if alertType == "" {
+		return fmt.Errorf("type is required")
+	}
+	if !monitor.IsKnownAlertType(alertType) {
+		h.log.Warn("Unknown alert type received", "type", alertType)
+	}
+
+	if count, ok := data["count"].(float64); ok && count < 0 {
+		return fmt.Errorf("count must not be negative")
+	}
+	return nil
+}
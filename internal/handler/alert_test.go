@@ -0,0 +1,201 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"wechat-service/internal/config"
+	"wechat-service/pkg/logger"
+	"wechat-service/pkg/metrics"
+	"wechat-service/pkg/monitor"
+
+	"github.com/gin-gonic/gin"
+	"github.com/silenceper/wechat/v2/util"
+)
+
+func TestAlertHandlerAcknowledge(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name       string
+		user       string // X-Admin-User header, unset when empty
+		query      string
+		wantStatus int
+		wantBy     string
+	}{
+		{name: "operator header", user: "alice", wantStatus: http.StatusOK, wantBy: "alice"},
+		{name: "default operator", wantStatus: http.StatusOK, wantBy: "admin"},
+		{name: "by parameter ignored", user: "bob", query: "?by=mallory", wantStatus: http.StatusOK, wantBy: "bob"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{}
+			cfg.Server.AdminToken = "secret"
+			cfg.Monitoring.AlertPath = "/alert"
+
+			log := logger.New(nil)
+			mon := monitor.NewMonitor(cfg, log)
+			alert := mon.RaiseAlert(monitor.Alert{Type: monitor.AlertTypeDNSTimeout, Count: 1})
+
+			r := gin.New()
+			NewAlertHandler(cfg, mon, log, nil).RegisterRoutes(r)
+
+			req := httptest.NewRequest(http.MethodPost, "/admin/alerts/"+alert.ID+"/ack"+tt.query, nil)
+			req.Header.Set("Authorization", "Bearer secret")
+			if tt.user != "" {
+				req.Header.Set(adminUserHeader, tt.user)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+
+			alerts, err := mon.QueryAlerts(context.Background(), monitor.AlertFilter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(alerts) != 1 {
+				t.Fatalf("got %d alerts, want 1", len(alerts))
+			}
+			if alerts[0].AcknowledgedBy != tt.wantBy {
+				t.Errorf("acknowledged by %q, want %q", alerts[0].AcknowledgedBy, tt.wantBy)
+			}
+		})
+	}
+
+	t.Run("unknown alert", func(t *testing.T) {
+		cfg := &config.Config{}
+		cfg.Server.AdminToken = "secret"
+		cfg.Monitoring.AlertPath = "/alert"
+		log := logger.New(nil)
+
+		r := gin.New()
+		NewAlertHandler(cfg, monitor.NewMonitor(cfg, log), log, nil).RegisterRoutes(r)
+
+		req := httptest.NewRequest(http.MethodPost, "/admin/alerts/missing/ack", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("status = %d, want %d", w.Code, http.StatusNotFound)
+		}
+	})
+}
+
+func TestAlertHandlerReceive(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name       string
+		body       string
+		signed     bool
+		accounts   bool // configure wx1 and wx2 under accounts: only
+		wantStatus int
+		wantLabel  string // type label counted, none when empty
+	}{
+		{
+			name:       "known type",
+			body:       `{"appid":"wx1","type":"DNS_TIMEOUT","count":3}`,
+			signed:     true,
+			wantStatus: http.StatusOK,
+			wantLabel:  monitor.AlertTypeDNSTimeout,
+		},
+		{
+			name:       "unknown type counted as other",
+			body:       `{"appid":"wx1","type":"SOMETHING_NEW_42","count":1}`,
+			signed:     true,
+			wantStatus: http.StatusOK,
+			wantLabel:  "other",
+		},
+		{name: "unsigned", body: `{"appid":"wx1","type":"DNS_TIMEOUT"}`, wantStatus: http.StatusForbidden},
+		{name: "other account", body: `{"appid":"wx9","type":"DNS_TIMEOUT"}`, signed: true, wantStatus: http.StatusBadRequest},
+		{name: "missing type", body: `{"appid":"wx1"}`, signed: true, wantStatus: http.StatusBadRequest},
+		{
+			name:       "accounts only",
+			body:       `{"appid":"wx1","type":"DNS_TIMEOUT"}`,
+			signed:     true,
+			accounts:   true,
+			wantStatus: http.StatusOK,
+			wantLabel:  monitor.AlertTypeDNSTimeout,
+		},
+		{
+			name:       "second account",
+			body:       `{"appid":"wx2","type":"DNS_TIMEOUT"}`,
+			signed:     true,
+			accounts:   true,
+			wantStatus: http.StatusOK,
+			wantLabel:  monitor.AlertTypeDNSTimeout,
+		},
+		{name: "unknown account", body: `{"appid":"wx9","type":"DNS_TIMEOUT"}`, signed: true, accounts: true, wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{}
+			if tt.accounts {
+				cfg.Accounts = []config.AccountConfig{
+					{Name: "one", AppID: "wx1", Token: "token"},
+					{Name: "two", AppID: "wx2", Token: "token2"},
+				}
+			} else {
+				cfg.WeChat.AppID = "wx1"
+				cfg.WeChat.Token = "token"
+			}
+			cfg.Monitoring.AlertPath = "/alert"
+
+			log := logger.New(nil)
+			m := metrics.NewMetrics(nil, "")
+			r := gin.New()
+			NewAlertHandler(cfg, monitor.NewMonitor(cfg, log), log, m).RegisterRoutes(r)
+
+			path := "/alert"
+			if tt.signed {
+				path += "?timestamp=1&nonce=n&signature=" + util.Signature("token", "1", "n")
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader(tt.body)))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+
+			labels := alertTypeLabels(t, m)
+			if tt.wantLabel == "" {
+				if len(labels) != 0 {
+					t.Errorf("counted alerts %v, want none", labels)
+				}
+				return
+			}
+			if len(labels) != 1 || labels[0] != tt.wantLabel {
+				t.Errorf("counted alerts %v, want [%s]", labels, tt.wantLabel)
+			}
+		})
+	}
+}
+
+// alertTypeLabels returns the type labels of the received alert counter
+func alertTypeLabels(t *testing.T, m *metrics.Metrics) []string {
+	t.Helper()
+	families, err := m.Gatherer().Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var labels []string
+	for _, f := range families {
+		if f.GetName() != "wechat_alerts_received_total" {
+			continue
+		}
+		for _, metric := range f.GetMetric() {
+			for _, lp := range metric.GetLabel() {
+				if lp.GetName() == "type" {
+					labels = append(labels, lp.GetValue())
+				}
+			}
+		}
+	}
+	return labels
+}
@@ -0,0 +1,531 @@
+package handler
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"wechat-service/internal/config"
+	"wechat-service/internal/model"
+	"wechat-service/internal/repository"
+	"wechat-service/internal/service"
+	"wechat-service/pkg/logger"
+	"wechat-service/pkg/ratelimit"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxMenuBodyBytes bounds the size of a menu definition body
+const maxMenuBodyBytes = 64 << 10
+
+// MenuHandler exposes menu validation, publishing, version history,
+// conditional menu rules and A/B experiments on the admin API. Every
+// route takes an optional appid query parameter naming the account,
+// defaulting to the first one.
+type MenuHandler struct {
+	cfg      *config.Config
+	accounts *service.AccountRegistry
+	log      *logger.Logger
+}
+
+// NewMenuHandler creates a new menu handler
+func NewMenuHandler(cfg *config.Config, accounts *service.AccountRegistry, log *logger.Logger) *MenuHandler {
+	return &MenuHandler{
+		cfg:      cfg,
+		accounts: accounts,
+		log:      log,
+	}
+}
+
+// RegisterRoutes registers the admin menu routes
+func (h *MenuHandler) RegisterRoutes(r gin.IRouter) {
+	admin := r.Group("/admin/menu", RequireAdminToken(h.cfg))
+	admin.GET("", h.Live)
+	admin.POST("/validate", h.Validate)
+	admin.POST("/diff", h.Diff)
+	admin.POST("/publish", h.Publish)
+	admin.POST("/drift", h.CheckDrift)
+	admin.GET("/versions", h.Versions)
+	admin.GET("/versions/:version", h.Version)
+	admin.POST("/versions/:version/rollback", h.Rollback)
+	admin.GET("/rules", h.Rules)
+	admin.POST("/rules", h.SaveRule)
+	admin.PUT("/rules/:id", h.SaveRule)
+	admin.DELETE("/rules/:id", h.DeleteRule)
+	admin.POST("/rules/sync", h.SyncRules)
+	admin.GET("/trymatch", h.TryMatch)
+	admin.GET("/experiments", h.Experiments)
+	admin.POST("/experiments", h.CreateExperiment)
+	admin.GET("/experiments/:id", h.ExperimentReport)
+	admin.POST("/experiments/:id/start", h.StartExperiment)
+	admin.POST("/experiments/:id/assign", h.AssignExperiment)
+	admin.GET("/experiments/:id/assign", h.AssignmentProgress)
+	admin.POST("/experiments/:id/stop", h.StopExperiment)
+}
+
+// Live returns the live menu
+func (h *MenuHandler) Live(c *gin.Context) {
+	account, ok := h.account(c)
+	if !ok {
+		return
+	}
+
+	live, err := account.Menus.Live(c.Request.Context())
+	if err != nil {
+		h.fail(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, live)
+}
+
+// Validate checks a menu definition without calling WeChat
+func (h *MenuHandler) Validate(c *gin.Context) {
+	account, ok := h.account(c)
+	if !ok {
+		return
+	}
+	m, ok := h.menu(c, account)
+	if !ok {
+		return
+	}
+
+	if err := service.ValidateMenu(m); err != nil {
+		h.fail(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"valid": true})
+}
+
+// Diff returns the changes publishing a menu definition would make
+func (h *MenuHandler) Diff(c *gin.Context) {
+	account, ok := h.account(c)
+	if !ok {
+		return
+	}
+	m, ok := h.menu(c, account)
+	if !ok {
+		return
+	}
+
+	changes, err := account.Menus.Diff(c.Request.Context(), m)
+	if err != nil {
+		h.fail(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"changes": changes})
+}
+
+// Publish publishes a menu definition if it differs from the live menu.
+// force=true publishes it regardless.
+func (h *MenuHandler) Publish(c *gin.Context) {
+	account, ok := h.account(c)
+	if !ok {
+		return
+	}
+	m, ok := h.menu(c, account)
+	if !ok {
+		return
+	}
+	force, _ := strconv.ParseBool(c.Query("force"))
+
+	result, err := account.Menus.Publish(c.Request.Context(), m, service.PublishOptions{
+		Force:  force,
+		Author: author(c),
+	})
+	if err != nil {
+		h.fail(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// CheckDrift records the live menu as a version if it was changed
+// outside the service
+func (h *MenuHandler) CheckDrift(c *gin.Context) {
+	account, ok := h.account(c)
+	if !ok {
+		return
+	}
+
+	v, err := account.Menus.CheckDrift(c.Request.Context())
+	if err != nil {
+		h.fail(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"drift": v != nil, "version": v})
+}
+
+// Versions lists recorded menu versions, newest first, bounded by the
+// limit query parameter
+func (h *MenuHandler) Versions(c *gin.Context) {
+	account, ok := h.account(c)
+	if !ok {
+		return
+	}
+
+	versions, err := account.Menus.Versions(c.Request.Context(), parseLimit(c, 50))
+	if err != nil {
+		h.fail(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"versions": versions, "count": len(versions)})
+}
+
+// Version returns one recorded menu version
+func (h *MenuHandler) Version(c *gin.Context) {
+	account, ok := h.account(c)
+	if !ok {
+		return
+	}
+	version, ok := parseVersion(c)
+	if !ok {
+		return
+	}
+
+	v, err := account.Menus.Version(c.Request.Context(), version)
+	if err != nil {
+		h.fail(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, v)
+}
+
+// Rollback republishes a recorded menu version
+func (h *MenuHandler) Rollback(c *gin.Context) {
+	account, ok := h.account(c)
+	if !ok {
+		return
+	}
+	version, ok := parseVersion(c)
+	if !ok {
+		return
+	}
+
+	result, err := account.Menus.Rollback(c.Request.Context(), version, author(c))
+	if err != nil {
+		h.fail(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// Rules lists conditional menu rules, highest priority first
+func (h *MenuHandler) Rules(c *gin.Context) {
+	account, ok := h.account(c)
+	if !ok {
+		return
+	}
+
+	rules, err := account.MenuRules.Rules(c.Request.Context())
+	if err != nil {
+		h.fail(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"rules": rules, "count": len(rules)})
+}
+
+// SaveRule creates a conditional menu rule, or updates the rule named by
+// the :id path parameter, and deploys it when enabled
+func (h *MenuHandler) SaveRule(c *gin.Context) {
+	account, ok := h.account(c)
+	if !ok {
+		return
+	}
+
+	var rule repository.MenuRule
+	if err := c.ShouldBindJSON(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	rule.ID = 0
+	if c.Param("id") != "" {
+		id, ok := parseID(c, "rule")
+		if !ok {
+			return
+		}
+		rule.ID = id
+	}
+
+	if err := account.MenuRules.SaveRule(c.Request.Context(), &rule); err != nil {
+		h.fail(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, rule)
+}
+
+// DeleteRule deletes a conditional menu rule and its menu
+func (h *MenuHandler) DeleteRule(c *gin.Context) {
+	account, ok := h.account(c)
+	if !ok {
+		return
+	}
+	id, ok := parseID(c, "rule")
+	if !ok {
+		return
+	}
+
+	if err := account.MenuRules.DeleteRule(c.Request.Context(), id); err != nil {
+		h.fail(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deleted": id})
+}
+
+// SyncRules brings the conditional menus on WeChat in line with the
+// rules. redeploy=true recreates all of them in priority order.
+func (h *MenuHandler) SyncRules(c *gin.Context) {
+	account, ok := h.account(c)
+	if !ok {
+		return
+	}
+	redeploy, _ := strconv.ParseBool(c.Query("redeploy"))
+
+	result, err := account.MenuRules.Sync(c.Request.Context(), redeploy)
+	if err != nil {
+		h.fail(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// TryMatch returns the conditional menu the follower named by the openid
+// query parameter would see
+func (h *MenuHandler) TryMatch(c *gin.Context) {
+	account, ok := h.account(c)
+	if !ok {
+		return
+	}
+	openid := c.Query("openid")
+	if openid == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "openid is required"})
+		return
+	}
+
+	match, err := account.MenuRules.TryMatch(c.Request.Context(), openid)
+	if err != nil {
+		h.fail(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, match)
+}
+
+// Experiments lists menu A/B experiments, newest first
+func (h *MenuHandler) Experiments(c *gin.Context) {
+	account, ok := h.account(c)
+	if !ok {
+		return
+	}
+
+	experiments, err := account.Experiments.Experiments(c.Request.Context())
+	if err != nil {
+		h.fail(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"experiments": experiments, "count": len(experiments)})
+}
+
+// CreateExperiment creates a draft experiment from the JSON body
+func (h *MenuHandler) CreateExperiment(c *gin.Context) {
+	account, ok := h.account(c)
+	if !ok {
+		return
+	}
+
+	var e repository.Experiment
+	if err := c.ShouldBindJSON(&e); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := account.Experiments.Create(c.Request.Context(), &e); err != nil {
+		h.fail(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, e)
+}
+
+// ExperimentReport returns the per-variant counts and significance
+// summary of an experiment
+func (h *MenuHandler) ExperimentReport(c *gin.Context) {
+	account, ok := h.account(c)
+	if !ok {
+		return
+	}
+	id, ok := parseID(c, "experiment")
+	if !ok {
+		return
+	}
+
+	report, err := account.Experiments.Report(c.Request.Context(), id)
+	if err != nil {
+		h.fail(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// StartExperiment deploys the variant menus and queues the follower
+// assignment, reported by AssignmentProgress
+func (h *MenuHandler) StartExperiment(c *gin.Context) {
+	account, ok := h.account(c)
+	if !ok {
+		return
+	}
+	id, ok := parseID(c, "experiment")
+	if !ok {
+		return
+	}
+
+	e, err := account.Experiments.Start(c.Request.Context(), id)
+	if err != nil {
+		h.fail(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, e)
+}
+
+// AssignExperiment queues the assignment of followers who subscribed since
+// the experiment started
+func (h *MenuHandler) AssignExperiment(c *gin.Context) {
+	account, ok := h.account(c)
+	if !ok {
+		return
+	}
+	id, ok := parseID(c, "experiment")
+	if !ok {
+		return
+	}
+
+	progress, err := account.Experiments.AssignFollowers(c.Request.Context(), id)
+	if err != nil {
+		h.fail(c, err)
+		return
+	}
+	c.JSON(http.StatusAccepted, progress)
+}
+
+// AssignmentProgress returns the status and progress of the latest
+// follower assignment of an experiment
+func (h *MenuHandler) AssignmentProgress(c *gin.Context) {
+	account, ok := h.account(c)
+	if !ok {
+		return
+	}
+	id, ok := parseID(c, "experiment")
+	if !ok {
+		return
+	}
+
+	progress, ok := account.Experiments.Progress(id)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no follower assignment since the service started"})
+		return
+	}
+	c.JSON(http.StatusOK, progress)
+}
+
+// StopExperiment removes the variant menus
+func (h *MenuHandler) StopExperiment(c *gin.Context) {
+	account, ok := h.account(c)
+	if !ok {
+		return
+	}
+	id, ok := parseID(c, "experiment")
+	if !ok {
+		return
+	}
+
+	e, err := account.Experiments.Stop(c.Request.Context(), id)
+	if err != nil {
+		h.fail(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, e)
+}
+
+// account resolves the appid query parameter, writing a 404 when the
+// account is unknown
+func (h *MenuHandler) account(c *gin.Context) (*service.Account, bool) {
+	appID := c.Query("appid")
+	if appID == "" {
+		if def := h.accounts.Default(); def != nil {
+			return def, true
+		}
+	} else if a, ok := h.accounts.Get(appID); ok {
+		return a, true
+	}
+
+	c.JSON(http.StatusNotFound, gin.H{"error": "unknown account"})
+	return nil, false
+}
+
+// menu reads the menu definition from the JSON body, or from the
+// account's menu file when the body is empty
+func (h *MenuHandler) menu(c *gin.Context, account *service.Account) (*model.Menu, bool) {
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxMenuBodyBytes))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read body"})
+		return nil, false
+	}
+
+	var m *model.Menu
+	if len(body) > 0 {
+		m, err = service.ParseMenu(body, "json")
+	} else if path := account.Config.Menu.File; path != "" {
+		m, err = service.LoadMenuFile(path)
+	} else {
+		err = errors.New("no menu in body and no menu.file configured")
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return m, true
+}
+
+// parseVersion parses the :version path parameter, writing a 400 when it
+// is not a positive number
+func parseVersion(c *gin.Context) (int, bool) {
+	version, err := strconv.Atoi(c.Param("version"))
+	if err != nil || version < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid version"})
+		return 0, false
+	}
+	return version, true
+}
+
+// parseID parses the :id path parameter naming a kind of object
+func parseID(c *gin.Context, kind string) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + kind + " id"})
+		return 0, false
+	}
+	return id, true
+}
+
+// fail writes err, listing validation problems individually
+func (h *MenuHandler) fail(c *gin.Context, err error) {
+	var menuErrs service.MenuErrors
+	if errors.As(err, &menuErrs) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "invalid menu", "problems": menuErrs})
+		return
+	}
+	if errors.Is(err, repository.ErrMenuVersionNotFound) || errors.Is(err, repository.ErrMenuRuleNotFound) ||
+		errors.Is(err, repository.ErrExperimentNotFound) || errors.Is(err, service.ErrFollowerNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, service.ErrExperimentStatus) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, ratelimit.ErrQuotaExceeded) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		return
+	}
+
+	logger.FromContextOr(c.Request.Context(), h.log).Error("Menu request failed", "error", err)
+	c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+}
@@ -1,15 +1,20 @@
 package handler
 
 import (
+	"context"
 	"net/http"
+	"strconv"
+	"time"
 
 	"wechat-service/internal/config"
 	"wechat-service/internal/service"
 	"wechat-service/pkg/logger"
 	"wechat-service/pkg/metrics"
+	"wechat-service/pkg/tracing"
 
 	"github.com/silenceper/wechat/v2/officialaccount"
 	"github.com/silenceper/wechat/v2/officialaccount/message"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // MessageHandler handles WeChat callbacks using the SDK
@@ -20,6 +25,13 @@ type MessageHandler struct {
 	metrics  *metrics.Metrics
 	msgSvc   *service.MessageService
 	eventSvc *service.EventService
+	latency  LatencyRecorder
+}
+
+// LatencyRecorder receives callback processing latencies, such as
+// monitor.LatencyTracker
+type LatencyRecorder interface {
+	Observe(d time.Duration)
 }
 
 // NewMessageHandler creates a new message handler using SDK
@@ -43,88 +55,176 @@ func NewMessageHandler(
 	return h
 }
 
+// SetLatencyRecorder sets the recorder fed with callback latencies
+func (h *MessageHandler) SetLatencyRecorder(r LatencyRecorder) {
+	h.latency = r
+}
+
 // ServeHTTP handles the WeChat callback using SDK's server
 func (h *MessageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	h.metrics.IncHTTPRequest("wechat", r.Method, "200")
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	msgType, event := "verify", ""
+
+	ctx := r.Context()
+	if logger.RequestIDFromContext(ctx) == "" {
+		// Served without the RequestID middleware
+		id := logger.NewRequestID()
+		ctx = logger.WithRequestID(ctx, id)
+		ctx = logger.NewContext(ctx, h.log.With("request_id", id))
+		w.Header().Set(logger.RequestIDHeader, id)
+	}
+
+	ctx, span := tracing.Start(ctx, "MessageHandler.ServeHTTP",
+		attribute.String("http.method", r.Method),
+	)
+
+	defer func() {
+		span.SetAttributes(
+			attribute.String("wechat.msg_type", msgType),
+			attribute.String("wechat.event", event),
+			attribute.Int("http.status_code", rec.status),
+		)
+		span.End()
+
+		elapsed := time.Since(start)
+		h.metrics.IncHTTPRequest("wechat", r.Method, strconv.Itoa(rec.status))
+		h.metrics.ObserveCallbackLatency(msgType, event, elapsed.Seconds())
+		if h.latency != nil {
+			h.latency.Observe(elapsed)
+		}
+	}()
 
 	// Get server instance from SDK
-	srv := h.oa.GetServer(r, w)
+	srv := h.oa.GetServer(r.WithContext(ctx), rec)
 
 	// Set message handler
 	srv.SetMessageHandler(func(msg *message.MixMessage) *message.Reply {
-		// Handle based on message type
-		switch msg.MsgType {
-		case message.MsgTypeText:
-			h.metrics.IncMessageReceived("text")
-			if h.msgSvc != nil {
-				return h.msgSvc.OnTextMessage(msg)
-			}
-		case message.MsgTypeImage:
-			h.metrics.IncMessageReceived("image")
-			if h.msgSvc != nil {
-				return h.msgSvc.OnImageMessage(msg)
-			}
-		case message.MsgTypeVoice:
-			h.metrics.IncMessageReceived("voice")
-			if h.msgSvc != nil {
-				return h.msgSvc.OnVoiceMessage(msg)
-			}
-		case message.MsgTypeVideo:
-			h.metrics.IncMessageReceived("video")
-			if h.msgSvc != nil {
-				return h.msgSvc.OnVideoMessage(msg)
+		msgType, event = string(msg.MsgType), string(msg.Event)
+		msgCtx := logger.WithContextFields(ctx,
+			"openid", string(msg.FromUserName),
+			"msg_id", msg.MsgID,
+		)
+		log := logger.FromContext(msgCtx)
+		log.Debug("Callback received", "msg_type", msgType, "event", event)
+
+		// WeChat retries a callback up to 3 times; answer retries of a
+		// message we already handled with the same reply
+		if msg.MsgType != message.MsgTypeEvent && h.msgSvc != nil {
+			claimed, reply, err := h.msgSvc.Claim(msgCtx, msg)
+			if err != nil {
+				log.Warn("Failed to check duplicate callback", "error", err)
 			}
-		case message.MsgTypeLocation:
-			h.metrics.IncMessageReceived("location")
-			if h.msgSvc != nil {
-				return h.msgSvc.OnLocationMessage(msg)
+			if !claimed {
+				h.metrics.IncDedupHit()
+				log.Info("Duplicate callback answered")
+				return reply
 			}
-		case message.MsgTypeLink:
-			h.metrics.IncMessageReceived("link")
-			if h.msgSvc != nil {
-				return h.msgSvc.OnLinkMessage(msg)
+			if err := h.msgSvc.SaveMessage(msgCtx, msg); err != nil {
+				log.Error("Failed to save message", "error", err)
 			}
-		case message.MsgTypeEvent:
-			// Handle events
-			switch msg.Event {
-			case message.EventSubscribe:
-				h.metrics.IncEventReceived("subscribe")
-				if h.eventSvc != nil {
-					return h.eventSvc.OnSubscribe(msg)
-				}
-			case message.EventUnsubscribe:
-				h.metrics.IncEventReceived("unsubscribe")
-				if h.eventSvc != nil {
-					h.eventSvc.OnUnsubscribe(msg)
-				}
-			case message.EventClick:
-				h.metrics.IncEventReceived("click")
-				if h.eventSvc != nil {
-					return h.eventSvc.OnClick(msg)
-				}
-			case message.EventView:
-				h.metrics.IncEventReceived("view")
-				if h.eventSvc != nil {
-					h.eventSvc.OnView(msg)
-				}
-			case message.EventScan:
-				h.metrics.IncEventReceived("scan")
-				if h.eventSvc != nil {
-					return h.eventSvc.OnScan(msg)
-				}
-			case message.EventLocation:
-				h.metrics.IncEventReceived("location")
-				if h.eventSvc != nil {
-					h.eventSvc.OnLocation(msg)
-				}
+		}
+
+		reply := h.dispatch(msgCtx, msg)
+		if reply != nil {
+			h.metrics.IncMessageSent(string(reply.MsgType))
+		}
+		if msg.MsgType != message.MsgTypeEvent && h.msgSvc != nil {
+			if err := h.msgSvc.RememberReply(msgCtx, msg, reply); err != nil {
+				log.Warn("Failed to remember reply", "error", err)
 			}
 		}
-		return nil
+		return reply
 	})
 
 	// Serve the request (handles verification and message processing)
 	if err := srv.Serve(); err != nil {
-		h.log.Error("Server error", "error", err)
+		span.RecordError(err)
+		logger.FromContextOr(ctx, h.log).Error("Server error", "error", err)
 		h.metrics.IncMessageError("server_error")
 	}
 }
+
+// dispatch routes a callback message to the message or event service
+func (h *MessageHandler) dispatch(ctx context.Context, msg *message.MixMessage) *message.Reply {
+	// Handle based on message type
+	switch msg.MsgType {
+	case message.MsgTypeText:
+		h.metrics.IncMessageReceived("text")
+		if h.msgSvc != nil {
+			return h.msgSvc.OnTextMessage(ctx, msg)
+		}
+	case message.MsgTypeImage:
+		h.metrics.IncMessageReceived("image")
+		if h.msgSvc != nil {
+			return h.msgSvc.OnImageMessage(ctx, msg)
+		}
+	case message.MsgTypeVoice:
+		h.metrics.IncMessageReceived("voice")
+		if h.msgSvc != nil {
+			return h.msgSvc.OnVoiceMessage(ctx, msg)
+		}
+	case message.MsgTypeVideo:
+		h.metrics.IncMessageReceived("video")
+		if h.msgSvc != nil {
+			return h.msgSvc.OnVideoMessage(ctx, msg)
+		}
+	case message.MsgTypeLocation:
+		h.metrics.IncMessageReceived("location")
+		if h.msgSvc != nil {
+			return h.msgSvc.OnLocationMessage(ctx, msg)
+		}
+	case message.MsgTypeLink:
+		h.metrics.IncMessageReceived("link")
+		if h.msgSvc != nil {
+			return h.msgSvc.OnLinkMessage(ctx, msg)
+		}
+	case message.MsgTypeEvent:
+		// Handle events
+		switch msg.Event {
+		case message.EventSubscribe:
+			h.metrics.IncEventReceived("subscribe")
+			if h.eventSvc != nil {
+				return h.eventSvc.OnSubscribe(ctx, msg)
+			}
+		case message.EventUnsubscribe:
+			h.metrics.IncEventReceived("unsubscribe")
+			if h.eventSvc != nil {
+				h.eventSvc.OnUnsubscribe(ctx, msg)
+			}
+		case message.EventClick:
+			h.metrics.IncEventReceived("click")
+			if h.eventSvc != nil {
+				return h.eventSvc.OnClick(ctx, msg)
+			}
+		case message.EventView:
+			h.metrics.IncEventReceived("view")
+			if h.eventSvc != nil {
+				h.eventSvc.OnView(ctx, msg)
+			}
+		case message.EventScan:
+			h.metrics.IncEventReceived("scan")
+			if h.eventSvc != nil {
+				return h.eventSvc.OnScan(ctx, msg)
+			}
+		case message.EventLocation:
+			h.metrics.IncEventReceived("location")
+			if h.eventSvc != nil {
+				h.eventSvc.OnLocation(ctx, msg)
+			}
+		}
+	}
+	return nil
+}
+
+// statusRecorder captures the status code written by the SDK server
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the status code
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
@@ -0,0 +1,84 @@
+package model
+
+// Menu button types
+const (
+	ButtonClick              = "click"
+	ButtonView               = "view"
+	ButtonMiniprogram        = "miniprogram"
+	ButtonScanCodePush       = "scancode_push"
+	ButtonScanCodeWaitMsg    = "scancode_waitmsg"
+	ButtonPicSysPhoto        = "pic_sysphoto"
+	ButtonPicPhotoOrAlbum    = "pic_photo_or_album"
+	ButtonPicWeixin          = "pic_weixin"
+	ButtonLocationSelect     = "location_select"
+	ButtonMediaID            = "media_id"
+	ButtonViewLimited        = "view_limited"
+	ButtonArticleID          = "article_id"
+	ButtonArticleViewLimited = "article_view_limited"
+)
+
+// Menu change kinds
+const (
+	MenuChangeAdded   = "added"
+	MenuChangeRemoved = "removed"
+	MenuChangeChanged = "changed"
+)
+
+// Menu is a custom menu definition, loaded from YAML or JSON and
+// published to WeChat as is
+type Menu struct {
+	Buttons []*Button `json:"button" yaml:"button"`
+}
+
+// Button is a menu button. A button with sub-buttons has no type.
+type Button struct {
+	Type       string    `json:"type,omitempty" yaml:"type,omitempty"`
+	Name       string    `json:"name" yaml:"name"`
+	Key        string    `json:"key,omitempty" yaml:"key,omitempty"`
+	URL        string    `json:"url,omitempty" yaml:"url,omitempty"`
+	MediaID    string    `json:"media_id,omitempty" yaml:"media_id,omitempty"`
+	ArticleID  string    `json:"article_id,omitempty" yaml:"article_id,omitempty"`
+	AppID      string    `json:"appid,omitempty" yaml:"appid,omitempty"`
+	PagePath   string    `json:"pagepath,omitempty" yaml:"pagepath,omitempty"`
+	SubButtons []*Button `json:"sub_button,omitempty" yaml:"sub_button,omitempty"`
+}
+
+// HasSubButtons returns true if the button opens a sub-menu
+func (b *Button) HasSubButtons() bool {
+	return len(b.SubButtons) > 0
+}
+
+// Equal reports whether b and o have the same action, ignoring
+// sub-buttons
+func (b *Button) Equal(o *Button) bool {
+	return b.Type == o.Type && b.Name == o.Name && b.Key == o.Key &&
+		b.URL == o.URL && b.MediaID == o.MediaID && b.ArticleID == o.ArticleID &&
+		b.AppID == o.AppID && b.PagePath == o.PagePath
+}
+
+// MenuChange is one difference between two menus
+type MenuChange struct {
+	Path string  `json:"path"`
+	Kind string  `json:"kind"`
+	Old  *Button `json:"old,omitempty"`
+	New  *Button `json:"new,omitempty"`
+}
+
+// Client platforms of a conditional menu match rule
+const (
+	PlatformIOS     = "1"
+	PlatformAndroid = "2"
+	PlatformOthers  = "3"
+)
+
+// MatchRule selects the followers shown a conditional menu. Empty fields
+// match everyone.
+type MatchRule struct {
+	TagID              string `json:"tag_id,omitempty"`
+	Sex                string `json:"sex,omitempty"` // 1 male, 2 female
+	Country            string `json:"country,omitempty"`
+	Province           string `json:"province,omitempty"`
+	City               string `json:"city,omitempty"`
+	ClientPlatformType string `json:"client_platform_type,omitempty"`
+	Language           string `json:"language,omitempty"`
+}
@@ -0,0 +1,41 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"wechat-service/internal/config"
+
+	_ "github.com/lib/pq"
+)
+
+// OpenDB opens the PostgreSQL database configured in Database and
+// verifies the connection
+func OpenDB(cfg *config.Config) (*sql.DB, error) {
+	if cfg.Database.Type != "postgres" {
+		return nil, fmt.Errorf("unsupported database type: %q", cfg.Database.Type)
+	}
+
+	db, err := sql.Open("postgres", cfg.GetDatabaseDSN())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	if cfg.Database.MaxOpen > 0 {
+		db.SetMaxOpenConns(cfg.Database.MaxOpen)
+	}
+	if cfg.Database.MaxIdle > 0 {
+		db.SetMaxIdleConns(cfg.Database.MaxIdle)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+
+	return db, nil
+}
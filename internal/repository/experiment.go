@@ -0,0 +1,248 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"wechat-service/internal/model"
+	"wechat-service/pkg/tracing"
+)
+
+// Experiment statuses
+const (
+	ExperimentDraft   = "draft"
+	ExperimentRunning = "running"
+	ExperimentStopped = "stopped"
+)
+
+// ErrExperimentNotFound is returned when an experiment ID is unknown
+var ErrExperimentNotFound = errors.New("experiment not found")
+
+// Experiment is a menu A/B test. Followers are split between the
+// variants by weight; each variant is a conditional menu shown to one tag.
+type Experiment struct {
+	ID        int64                `json:"id"`
+	AppID     string               `json:"app_id"`
+	Name      string               `json:"name"`
+	Status    string               `json:"status"`
+	Variants  []*ExperimentVariant `json:"variants"` // the first one is the control
+	CreatedAt time.Time            `json:"created_at"`
+	StartedAt *time.Time           `json:"started_at,omitempty"`
+	StoppedAt *time.Time           `json:"stopped_at,omitempty"`
+}
+
+// ExperimentVariant is one menu under test
+type ExperimentVariant struct {
+	Name   string      `json:"name"`
+	Weight int         `json:"weight"` // share of followers, relative to the other variants
+	Menu   *model.Menu `json:"menu"`
+	TagID  int         `json:"tag_id"`  // WeChat tag of the variant's followers
+	RuleID int64       `json:"rule_id"` // menu rule deploying the variant
+}
+
+// VariantStats counts the menu events of one variant
+type VariantStats struct {
+	Variant  string `json:"variant"`
+	Assigned int    `json:"assigned"` // followers in the variant
+	Engaged  int    `json:"engaged"`  // followers with at least one click or view
+	Clicks   int64  `json:"clicks"`
+	Views    int64  `json:"views"`
+}
+
+// ExperimentStore persists the experiments of one account, their
+// follower assignments and event counts
+type ExperimentStore interface {
+	// Save creates the experiment when its ID is 0 and updates it otherwise
+	Save(ctx context.Context, e *Experiment) error
+	Get(ctx context.Context, id int64) (*Experiment, error)
+	// List returns all experiments, newest first
+	List(ctx context.Context) ([]*Experiment, error)
+
+	// Assign puts openid in variant; existing assignments are kept
+	Assign(ctx context.Context, id int64, openid, variant string) error
+	// Assignment returns the variant of openid, or "" when unassigned
+	Assignment(ctx context.Context, id int64, openid string) (string, error)
+	// RecordEvent counts a CLICK or VIEW event of openid in variant
+	RecordEvent(ctx context.Context, id int64, variant, openid, event string) error
+	// Stats returns the counts of every variant with an assignment
+	Stats(ctx context.Context, id int64) ([]VariantStats, error)
+}
+
+// experimentData holds the assignments and counts of one experiment
+type experimentData struct {
+	assignments map[string]string // openid -> variant
+	stats       map[string]*VariantStats
+	engaged     map[string]map[string]struct{} // variant -> openids
+}
+
+// MemoryExperimentStore keeps experiments in memory
+type MemoryExperimentStore struct {
+	appID       string
+	mu          sync.RWMutex
+	experiments map[int64]*Experiment
+	data        map[int64]*experimentData
+	nextID      int64
+}
+
+// NewMemoryExperimentStore creates a memory store for one account
+func NewMemoryExperimentStore(appID string) *MemoryExperimentStore {
+	return &MemoryExperimentStore{
+		appID:       appID,
+		experiments: make(map[int64]*Experiment),
+		data:        make(map[int64]*experimentData),
+	}
+}
+
+// Save creates the experiment when its ID is 0 and updates it otherwise
+func (s *MemoryExperimentStore) Save(ctx context.Context, e *Experiment) error {
+	_, span := tracing.Start(ctx, "MemoryExperimentStore.Save")
+	defer span.End()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e.AppID = s.appID
+	if e.ID == 0 {
+		s.nextID++
+		e.ID = s.nextID
+		e.CreatedAt = time.Now()
+		s.data[e.ID] = &experimentData{
+			assignments: make(map[string]string),
+			stats:       make(map[string]*VariantStats),
+			engaged:     make(map[string]map[string]struct{}),
+		}
+	} else if _, ok := s.experiments[e.ID]; !ok {
+		return ErrExperimentNotFound
+	}
+
+	s.experiments[e.ID] = copyExperiment(e)
+	return nil
+}
+
+// Get returns a copy of an experiment by ID
+func (s *MemoryExperimentStore) Get(ctx context.Context, id int64) (*Experiment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok := s.experiments[id]
+	if !ok {
+		return nil, ErrExperimentNotFound
+	}
+	return copyExperiment(e), nil
+}
+
+// List returns copies of all experiments, newest first
+func (s *MemoryExperimentStore) List(ctx context.Context) ([]*Experiment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]*Experiment, 0, len(s.experiments))
+	for _, e := range s.experiments {
+		result = append(result, copyExperiment(e))
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID > result[j].ID })
+	return result, nil
+}
+
+// Assign puts openid in variant; existing assignments are kept
+func (s *MemoryExperimentStore) Assign(ctx context.Context, id int64, openid, variant string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.data[id]
+	if !ok {
+		return ErrExperimentNotFound
+	}
+	if _, ok := d.assignments[openid]; ok {
+		return nil
+	}
+	d.assignments[openid] = variant
+	d.variant(variant).Assigned++
+	return nil
+}
+
+// Assignment returns the variant of openid, or "" when unassigned
+func (s *MemoryExperimentStore) Assignment(ctx context.Context, id int64, openid string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	d, ok := s.data[id]
+	if !ok {
+		return "", ErrExperimentNotFound
+	}
+	return d.assignments[openid], nil
+}
+
+// RecordEvent counts a CLICK or VIEW event of openid in variant
+func (s *MemoryExperimentStore) RecordEvent(ctx context.Context, id int64, variant, openid, event string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.data[id]
+	if !ok {
+		return ErrExperimentNotFound
+	}
+
+	vs := d.variant(variant)
+	switch event {
+	case model.EventClick:
+		vs.Clicks++
+	case model.EventView:
+		vs.Views++
+	default:
+		return nil
+	}
+
+	engaged := d.engaged[variant]
+	if engaged == nil {
+		engaged = make(map[string]struct{})
+		d.engaged[variant] = engaged
+	}
+	if _, ok := engaged[openid]; !ok {
+		engaged[openid] = struct{}{}
+		vs.Engaged++
+	}
+	return nil
+}
+
+// Stats returns the counts of every variant with an assignment or event
+func (s *MemoryExperimentStore) Stats(ctx context.Context, id int64) ([]VariantStats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	d, ok := s.data[id]
+	if !ok {
+		return nil, ErrExperimentNotFound
+	}
+
+	stats := make([]VariantStats, 0, len(d.stats))
+	for _, vs := range d.stats {
+		stats = append(stats, *vs)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Variant < stats[j].Variant })
+	return stats, nil
+}
+
+// variant returns the counters of a variant, creating them on first use
+func (d *experimentData) variant(name string) *VariantStats {
+	vs, ok := d.stats[name]
+	if !ok {
+		vs = &VariantStats{Variant: name}
+		d.stats[name] = vs
+	}
+	return vs
+}
+
+// copyExperiment returns a copy of e that shares no variants with it
+func copyExperiment(e *Experiment) *Experiment {
+	c := *e
+	c.Variants = make([]*ExperimentVariant, len(e.Variants))
+	for i, v := range e.Variants {
+		vc := *v
+		c.Variants[i] = &vc
+	}
+	return &c
+}
@@ -0,0 +1,212 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"wechat-service/internal/model"
+	"wechat-service/pkg/tracing"
+)
+
+// PostgresExperimentStore persists the experiments of one account in
+// PostgreSQL. The schema is created by migrations/006_experiments.sql.
+type PostgresExperimentStore struct {
+	db    *sql.DB
+	appID string
+}
+
+// NewPostgresExperimentStore creates a PostgreSQL-backed experiment store
+// for one account
+func NewPostgresExperimentStore(db *sql.DB, appID string) *PostgresExperimentStore {
+	return &PostgresExperimentStore{db: db, appID: appID}
+}
+
+// experimentColumns is the column list scanned by scanExperiment
+const experimentColumns = `id, app_id, name, status, variants, created_at, started_at, stopped_at`
+
+// Save creates the experiment when its ID is 0 and updates it otherwise
+func (s *PostgresExperimentStore) Save(ctx context.Context, e *Experiment) error {
+	ctx, span := tracing.Start(ctx, "PostgresExperimentStore.Save")
+	defer span.End()
+
+	variants, err := json.Marshal(e.Variants)
+	if err != nil {
+		return fmt.Errorf("failed to marshal variants: %w", err)
+	}
+	e.AppID = s.appID
+
+	if e.ID == 0 {
+		err = s.db.QueryRowContext(ctx, `
+			INSERT INTO experiments (app_id, name, status, variants, started_at, stopped_at)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			RETURNING id, created_at`,
+			s.appID, e.Name, e.Status, variants, e.StartedAt, e.StoppedAt,
+		).Scan(&e.ID, &e.CreatedAt)
+		if err != nil {
+			return fmt.Errorf("failed to insert experiment: %w", err)
+		}
+		return nil
+	}
+
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE experiments SET name = $3, status = $4, variants = $5, started_at = $6, stopped_at = $7
+		WHERE app_id = $1 AND id = $2`,
+		s.appID, e.ID, e.Name, e.Status, variants, e.StartedAt, e.StoppedAt)
+	if err != nil {
+		return fmt.Errorf("failed to update experiment: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrExperimentNotFound
+	}
+	return nil
+}
+
+// Get returns an experiment by ID
+func (s *PostgresExperimentStore) Get(ctx context.Context, id int64) (*Experiment, error) {
+	ctx, span := tracing.Start(ctx, "PostgresExperimentStore.Get")
+	defer span.End()
+
+	row := s.db.QueryRowContext(ctx, `SELECT `+experimentColumns+` FROM experiments
+		WHERE app_id = $1 AND id = $2`, s.appID, id)
+	e, err := scanExperiment(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrExperimentNotFound
+	}
+	return e, err
+}
+
+// List returns all experiments, newest first
+func (s *PostgresExperimentStore) List(ctx context.Context) ([]*Experiment, error) {
+	ctx, span := tracing.Start(ctx, "PostgresExperimentStore.List")
+	defer span.End()
+
+	rows, err := s.db.QueryContext(ctx, `SELECT `+experimentColumns+` FROM experiments
+		WHERE app_id = $1 ORDER BY id DESC`, s.appID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query experiments: %w", err)
+	}
+	defer rows.Close()
+
+	experiments := make([]*Experiment, 0)
+	for rows.Next() {
+		e, err := scanExperiment(rows)
+		if err != nil {
+			return nil, err
+		}
+		experiments = append(experiments, e)
+	}
+	return experiments, rows.Err()
+}
+
+// Assign puts openid in variant; existing assignments are kept
+func (s *PostgresExperimentStore) Assign(ctx context.Context, id int64, openid, variant string) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO experiment_assignments (experiment_id, openid, variant)
+		SELECT id, $3, $4 FROM experiments WHERE app_id = $1 AND id = $2
+		ON CONFLICT (experiment_id, openid) DO NOTHING`,
+		s.appID, id, openid, variant)
+	if err != nil {
+		return fmt.Errorf("failed to assign follower: %w", err)
+	}
+	return nil
+}
+
+// Assignment returns the variant of openid, or "" when unassigned
+func (s *PostgresExperimentStore) Assignment(ctx context.Context, id int64, openid string) (string, error) {
+	var variant string
+	err := s.db.QueryRowContext(ctx, `
+		SELECT a.variant FROM experiment_assignments a
+		JOIN experiments e ON e.id = a.experiment_id
+		WHERE e.app_id = $1 AND a.experiment_id = $2 AND a.openid = $3`,
+		s.appID, id, openid,
+	).Scan(&variant)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to query assignment: %w", err)
+	}
+	return variant, nil
+}
+
+// RecordEvent counts a CLICK or VIEW event of openid in variant
+func (s *PostgresExperimentStore) RecordEvent(ctx context.Context, id int64, variant, openid, event string) error {
+	var column string
+	switch event {
+	case model.EventClick:
+		column = "clicks"
+	case model.EventView:
+		column = "views"
+	default:
+		return nil
+	}
+
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE experiment_assignments SET `+column+` = `+column+` + 1
+		WHERE experiment_id = $2 AND openid = $3 AND variant = $4
+			AND experiment_id IN (SELECT id FROM experiments WHERE app_id = $1)`,
+		s.appID, id, openid, variant)
+	if err != nil {
+		return fmt.Errorf("failed to record experiment event: %w", err)
+	}
+	return nil
+}
+
+// Stats returns the counts of every variant with an assignment
+func (s *PostgresExperimentStore) Stats(ctx context.Context, id int64) ([]VariantStats, error) {
+	ctx, span := tracing.Start(ctx, "PostgresExperimentStore.Stats")
+	defer span.End()
+
+	if _, err := s.Get(ctx, id); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT variant, COUNT(*), COUNT(*) FILTER (WHERE clicks + views > 0),
+			COALESCE(SUM(clicks), 0), COALESCE(SUM(views), 0)
+		FROM experiment_assignments WHERE experiment_id = $1
+		GROUP BY variant ORDER BY variant`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query experiment stats: %w", err)
+	}
+	defer rows.Close()
+
+	stats := make([]VariantStats, 0)
+	for rows.Next() {
+		var vs VariantStats
+		if err := rows.Scan(&vs.Variant, &vs.Assigned, &vs.Engaged, &vs.Clicks, &vs.Views); err != nil {
+			return nil, fmt.Errorf("failed to scan experiment stats: %w", err)
+		}
+		stats = append(stats, vs)
+	}
+	return stats, rows.Err()
+}
+
+// scanExperiment scans one row selected with experimentColumns
+func scanExperiment(row interface{ Scan(...interface{}) error }) (*Experiment, error) {
+	e := &Experiment{}
+	var variants []byte
+	var startedAt, stoppedAt sql.NullTime
+	if err := row.Scan(&e.ID, &e.AppID, &e.Name, &e.Status, &variants, &e.CreatedAt,
+		&startedAt, &stoppedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to scan experiment: %w", err)
+	}
+	if err := json.Unmarshal(variants, &e.Variants); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal variants: %w", err)
+	}
+	if startedAt.Valid {
+		e.StartedAt = &startedAt.Time
+	}
+	if stoppedAt.Valid {
+		e.StoppedAt = &stoppedAt.Time
+	}
+	return e, nil
+}
@@ -0,0 +1,200 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"wechat-service/internal/model"
+	"wechat-service/pkg/tracing"
+)
+
+// ErrMenuRuleNotFound is returned when a menu rule ID is unknown
+var ErrMenuRuleNotFound = errors.New("menu rule not found")
+
+// MenuRule is a conditional menu and the followers it is shown to.
+// Zero-valued criteria match everyone.
+type MenuRule struct {
+	ID             int64       `json:"id"`
+	AppID          string      `json:"app_id"`
+	Name           string      `json:"name"`
+	MenuID         int64       `json:"menu_id"` // WeChat menuid, 0 while not deployed
+	TagID          int         `json:"tag_id"`
+	Sex            int         `json:"sex"`             // 1 male, 2 female
+	ClientPlatform string      `json:"client_platform"` // 1 iOS, 2 Android, 3 others
+	Language       string      `json:"language"`        // e.g. zh_CN
+	Country        string      `json:"country"`
+	Province       string      `json:"province"`
+	City           string      `json:"city"`
+	Menu           *model.Menu `json:"menu"`
+	Enabled        bool        `json:"is_enabled"`
+	Priority       int         `json:"priority"` // higher wins when several rules match
+	MatchCount     int64       `json:"match_count"`
+	CreatedAt      time.Time   `json:"created_at"`
+	UpdatedAt      time.Time   `json:"updated_at"`
+}
+
+// Deployed returns true if the rule's menu exists on WeChat
+func (r *MenuRule) Deployed() bool {
+	return r.MenuID != 0
+}
+
+// MatchRule returns the WeChat match rule of r
+func (r *MenuRule) MatchRule() *model.MatchRule {
+	mr := &model.MatchRule{
+		ClientPlatformType: r.ClientPlatform,
+		Language:           r.Language,
+		Country:            r.Country,
+		Province:           r.Province,
+		City:               r.City,
+	}
+	if r.TagID != 0 {
+		mr.TagID = strconv.Itoa(r.TagID)
+	}
+	if r.Sex != 0 {
+		mr.Sex = strconv.Itoa(r.Sex)
+	}
+	return mr
+}
+
+// MenuRuleStore persists the conditional menu rules of one account
+type MenuRuleStore interface {
+	// List returns all rules, highest priority first, newest first on ties
+	List(ctx context.Context) ([]*MenuRule, error)
+	Get(ctx context.Context, id int64) (*MenuRule, error)
+	// Save creates the rule when its ID is 0 and updates it otherwise
+	Save(ctx context.Context, rule *MenuRule) error
+	Delete(ctx context.Context, id int64) error
+	// SetMenuID records the WeChat menuid of a deployed rule
+	SetMenuID(ctx context.Context, id, menuID int64) error
+	// IncrementMatchCount counts one menu event on the rule with menuID
+	IncrementMatchCount(ctx context.Context, menuID int64) error
+}
+
+// MemoryMenuRuleStore keeps menu rules in memory
+type MemoryMenuRuleStore struct {
+	appID  string
+	mu     sync.RWMutex
+	rules  map[int64]*MenuRule
+	nextID int64
+}
+
+// NewMemoryMenuRuleStore creates a memory store for one account
+func NewMemoryMenuRuleStore(appID string) *MemoryMenuRuleStore {
+	return &MemoryMenuRuleStore{
+		appID: appID,
+		rules: make(map[int64]*MenuRule),
+	}
+}
+
+// List returns copies of all rules, highest priority first
+func (s *MemoryMenuRuleStore) List(ctx context.Context) ([]*MenuRule, error) {
+	_, span := tracing.Start(ctx, "MemoryMenuRuleStore.List")
+	defer span.End()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rules := make([]*MenuRule, 0, len(s.rules))
+	for _, r := range s.rules {
+		rule := *r
+		rules = append(rules, &rule)
+	}
+	SortMenuRules(rules)
+	return rules, nil
+}
+
+// Get returns a copy of a rule by ID
+func (s *MemoryMenuRuleStore) Get(ctx context.Context, id int64) (*MenuRule, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	r, ok := s.rules[id]
+	if !ok {
+		return nil, ErrMenuRuleNotFound
+	}
+	rule := *r
+	return &rule, nil
+}
+
+// Save creates the rule when its ID is 0 and updates it otherwise. The
+// match count is kept on update.
+func (s *MemoryMenuRuleStore) Save(ctx context.Context, rule *MenuRule) error {
+	_, span := tracing.Start(ctx, "MemoryMenuRuleStore.Save")
+	defer span.End()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	rule.AppID = s.appID
+	rule.UpdatedAt = now
+	if rule.ID == 0 {
+		s.nextID++
+		rule.ID = s.nextID
+		rule.CreatedAt = now
+	} else {
+		existing, ok := s.rules[rule.ID]
+		if !ok {
+			return ErrMenuRuleNotFound
+		}
+		rule.CreatedAt = existing.CreatedAt
+		rule.MatchCount = existing.MatchCount
+	}
+
+	stored := *rule
+	s.rules[rule.ID] = &stored
+	return nil
+}
+
+// Delete deletes a rule by ID
+func (s *MemoryMenuRuleStore) Delete(ctx context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.rules[id]; !ok {
+		return ErrMenuRuleNotFound
+	}
+	delete(s.rules, id)
+	return nil
+}
+
+// SetMenuID records the WeChat menuid of a deployed rule
+func (s *MemoryMenuRuleStore) SetMenuID(ctx context.Context, id, menuID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.rules[id]
+	if !ok {
+		return ErrMenuRuleNotFound
+	}
+	r.MenuID = menuID
+	r.UpdatedAt = time.Now()
+	return nil
+}
+
+// IncrementMatchCount counts one menu event on the rule with menuID
+func (s *MemoryMenuRuleStore) IncrementMatchCount(ctx context.Context, menuID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range s.rules {
+		if r.MenuID == menuID {
+			r.MatchCount++
+		}
+	}
+	return nil
+}
+
+// SortMenuRules orders rules highest priority first, newest first on ties
+func SortMenuRules(rules []*MenuRule) {
+	sort.SliceStable(rules, func(i, j int) bool {
+		if rules[i].Priority != rules[j].Priority {
+			return rules[i].Priority > rules[j].Priority
+		}
+		return rules[i].ID > rules[j].ID
+	})
+}
@@ -0,0 +1,171 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"wechat-service/pkg/tracing"
+)
+
+// PostgresMenuRuleStore persists the conditional menu rules of one
+// account in the menu_rules table, extended by
+// migrations/005_menu_rules.sql
+type PostgresMenuRuleStore struct {
+	db    *sql.DB
+	appID string
+}
+
+// NewPostgresMenuRuleStore creates a PostgreSQL-backed menu rule store for
+// one account
+func NewPostgresMenuRuleStore(db *sql.DB, appID string) *PostgresMenuRuleStore {
+	return &PostgresMenuRuleStore{db: db, appID: appID}
+}
+
+// menuRuleColumns is the column list scanned by scanMenuRule
+const menuRuleColumns = `id, app_id, name, menu_id, COALESCE(tag_id, 0), COALESCE(sex, 0),
+	COALESCE(client_platform, ''), COALESCE(language, ''), COALESCE(country, ''),
+	COALESCE(province, ''), COALESCE(city, ''), menu, is_enabled, priority, match_count,
+	created_at, updated_at`
+
+// List returns all rules, highest priority first, newest first on ties
+func (s *PostgresMenuRuleStore) List(ctx context.Context) ([]*MenuRule, error) {
+	ctx, span := tracing.Start(ctx, "PostgresMenuRuleStore.List")
+	defer span.End()
+
+	rows, err := s.db.QueryContext(ctx, `SELECT `+menuRuleColumns+` FROM menu_rules
+		WHERE app_id = $1 ORDER BY priority DESC, id DESC`, s.appID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query menu rules: %w", err)
+	}
+	defer rows.Close()
+
+	rules := make([]*MenuRule, 0)
+	for rows.Next() {
+		r, err := scanMenuRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+// Get returns a rule by ID
+func (s *PostgresMenuRuleStore) Get(ctx context.Context, id int64) (*MenuRule, error) {
+	ctx, span := tracing.Start(ctx, "PostgresMenuRuleStore.Get")
+	defer span.End()
+
+	row := s.db.QueryRowContext(ctx, `SELECT `+menuRuleColumns+` FROM menu_rules
+		WHERE app_id = $1 AND id = $2`, s.appID, id)
+	r, err := scanMenuRule(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrMenuRuleNotFound
+	}
+	return r, err
+}
+
+// Save creates the rule when its ID is 0 and updates it otherwise. The
+// match count is kept on update.
+func (s *PostgresMenuRuleStore) Save(ctx context.Context, rule *MenuRule) error {
+	ctx, span := tracing.Start(ctx, "PostgresMenuRuleStore.Save")
+	defer span.End()
+
+	menu, err := json.Marshal(rule.Menu)
+	if err != nil {
+		return fmt.Errorf("failed to marshal menu: %w", err)
+	}
+	rule.AppID = s.appID
+
+	if rule.ID == 0 {
+		err = s.db.QueryRowContext(ctx, `
+			INSERT INTO menu_rules (app_id, name, menu_id, tag_id, sex, client_platform, language,
+				country, province, city, menu, is_enabled, priority)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+			RETURNING id, created_at, updated_at`,
+			s.appID, rule.Name, rule.MenuID, rule.TagID, rule.Sex, rule.ClientPlatform, rule.Language,
+			rule.Country, rule.Province, rule.City, menu, rule.Enabled, rule.Priority,
+		).Scan(&rule.ID, &rule.CreatedAt, &rule.UpdatedAt)
+		if err != nil {
+			return fmt.Errorf("failed to insert menu rule: %w", err)
+		}
+		return nil
+	}
+
+	err = s.db.QueryRowContext(ctx, `
+		UPDATE menu_rules SET name = $3, menu_id = $4, tag_id = $5, sex = $6, client_platform = $7,
+			language = $8, country = $9, province = $10, city = $11, menu = $12, is_enabled = $13,
+			priority = $14, updated_at = CURRENT_TIMESTAMP
+		WHERE app_id = $1 AND id = $2
+		RETURNING match_count, created_at, updated_at`,
+		s.appID, rule.ID, rule.Name, rule.MenuID, rule.TagID, rule.Sex, rule.ClientPlatform,
+		rule.Language, rule.Country, rule.Province, rule.City, menu, rule.Enabled, rule.Priority,
+	).Scan(&rule.MatchCount, &rule.CreatedAt, &rule.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrMenuRuleNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update menu rule: %w", err)
+	}
+	return nil
+}
+
+// Delete deletes a rule by ID
+func (s *PostgresMenuRuleStore) Delete(ctx context.Context, id int64) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM menu_rules WHERE app_id = $1 AND id = $2`, s.appID, id)
+	return checkRuleAffected(res, err)
+}
+
+// SetMenuID records the WeChat menuid of a deployed rule
+func (s *PostgresMenuRuleStore) SetMenuID(ctx context.Context, id, menuID int64) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE menu_rules SET menu_id = $3, updated_at = CURRENT_TIMESTAMP
+		WHERE app_id = $1 AND id = $2`, s.appID, id, menuID)
+	return checkRuleAffected(res, err)
+}
+
+// IncrementMatchCount counts one menu event on the rule with menuID
+func (s *PostgresMenuRuleStore) IncrementMatchCount(ctx context.Context, menuID int64) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE menu_rules SET match_count = match_count + 1
+		WHERE app_id = $1 AND menu_id = $2`, s.appID, menuID)
+	if err != nil {
+		return fmt.Errorf("failed to increment match count: %w", err)
+	}
+	return nil
+}
+
+// checkRuleAffected maps an update of no rows to ErrMenuRuleNotFound
+func checkRuleAffected(res sql.Result, err error) error {
+	if err != nil {
+		return fmt.Errorf("failed to update menu rule: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrMenuRuleNotFound
+	}
+	return nil
+}
+
+// scanMenuRule scans one row selected with menuRuleColumns
+func scanMenuRule(row interface{ Scan(...interface{}) error }) (*MenuRule, error) {
+	r := &MenuRule{}
+	var menu []byte
+	if err := row.Scan(&r.ID, &r.AppID, &r.Name, &r.MenuID, &r.TagID, &r.Sex, &r.ClientPlatform,
+		&r.Language, &r.Country, &r.Province, &r.City, &menu, &r.Enabled, &r.Priority,
+		&r.MatchCount, &r.CreatedAt, &r.UpdatedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to scan menu rule: %w", err)
+	}
+	if len(menu) > 0 {
+		if err := json.Unmarshal(menu, &r.Menu); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal menu: %w", err)
+		}
+	}
+	return r, nil
+}
@@ -0,0 +1,117 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"wechat-service/internal/model"
+	"wechat-service/pkg/tracing"
+)
+
+// Menu version sources
+const (
+	MenuSourcePublish  = "publish"  // published through the menu service
+	MenuSourceRollback = "rollback" // republished from an earlier version
+	MenuSourceDrift    = "drift"    // changed outside the service, fetched from WeChat
+)
+
+// ErrMenuVersionNotFound is returned when a menu version is unknown
+var ErrMenuVersionNotFound = errors.New("menu version not found")
+
+// MenuVersion is one menu that was live on WeChat
+type MenuVersion struct {
+	ID         int64              `json:"id"`
+	AppID      string             `json:"app_id"`
+	Version    int                `json:"version"` // sequential per account, starting at 1
+	Menu       *model.Menu        `json:"menu"`
+	Diff       []model.MenuChange `json:"diff"` // changes from the menu live before it
+	Author     string             `json:"author"`
+	Source     string             `json:"source"`
+	RollbackOf int                `json:"rollback_of,omitempty"` // version restored by a rollback
+	CreatedAt  time.Time          `json:"created_at"`
+}
+
+// MenuVersionStore persists the menu history of one account
+type MenuVersionStore interface {
+	// Save assigns v the next version number and stores it
+	Save(ctx context.Context, v *MenuVersion) error
+	// Get returns a version by number
+	Get(ctx context.Context, version int) (*MenuVersion, error)
+	// Latest returns the newest version, or nil when there is none
+	Latest(ctx context.Context) (*MenuVersion, error)
+	// List returns at most limit versions, newest first
+	List(ctx context.Context, limit int) ([]*MenuVersion, error)
+}
+
+// MemoryMenuVersionStore keeps menu versions in memory. It is the
+// fallback when no database is configured; history is lost on restart.
+type MemoryMenuVersionStore struct {
+	appID    string
+	mu       sync.RWMutex
+	versions []*MenuVersion
+}
+
+// NewMemoryMenuVersionStore creates a memory store for one account
+func NewMemoryMenuVersionStore(appID string) *MemoryMenuVersionStore {
+	return &MemoryMenuVersionStore{
+		appID:    appID,
+		versions: make([]*MenuVersion, 0),
+	}
+}
+
+// Save assigns v the next version number and stores it
+func (s *MemoryMenuVersionStore) Save(ctx context.Context, v *MenuVersion) error {
+	_, span := tracing.Start(ctx, "MemoryMenuVersionStore.Save")
+	defer span.End()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v.AppID = s.appID
+	v.Version = len(s.versions) + 1
+	v.ID = int64(v.Version)
+	if v.CreatedAt.IsZero() {
+		v.CreatedAt = time.Now()
+	}
+	s.versions = append(s.versions, v)
+	return nil
+}
+
+// Get returns a version by number
+func (s *MemoryMenuVersionStore) Get(ctx context.Context, version int) (*MenuVersion, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if version < 1 || version > len(s.versions) {
+		return nil, ErrMenuVersionNotFound
+	}
+	return s.versions[version-1], nil
+}
+
+// Latest returns the newest version, or nil when there is none
+func (s *MemoryMenuVersionStore) Latest(ctx context.Context) (*MenuVersion, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.versions) == 0 {
+		return nil, nil
+	}
+	return s.versions[len(s.versions)-1], nil
+}
+
+// List returns at most limit versions, newest first
+func (s *MemoryMenuVersionStore) List(ctx context.Context, limit int) ([]*MenuVersion, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]*MenuVersion, 0)
+	for i := len(s.versions) - 1; i >= 0; i-- {
+		if limit > 0 && len(result) >= limit {
+			break
+		}
+		result = append(result, s.versions[i])
+	}
+	return result, nil
+}
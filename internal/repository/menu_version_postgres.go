@@ -0,0 +1,135 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"wechat-service/pkg/tracing"
+)
+
+// PostgresMenuVersionStore persists the menu history of one account in
+// PostgreSQL. The schema is created by migrations/004_menu_versions.sql.
+type PostgresMenuVersionStore struct {
+	db    *sql.DB
+	appID string
+}
+
+// NewPostgresMenuVersionStore creates a PostgreSQL-backed menu version
+// store for one account
+func NewPostgresMenuVersionStore(db *sql.DB, appID string) *PostgresMenuVersionStore {
+	return &PostgresMenuVersionStore{db: db, appID: appID}
+}
+
+// menuVersionColumns is the column list scanned by scanMenuVersion
+const menuVersionColumns = `id, app_id, version, menu, diff, author, source, rollback_of, created_at`
+
+// Save assigns v the next version number and stores it. The unique
+// (app_id, version) index rejects concurrent saves racing for a number.
+func (s *PostgresMenuVersionStore) Save(ctx context.Context, v *MenuVersion) error {
+	ctx, span := tracing.Start(ctx, "PostgresMenuVersionStore.Save")
+	defer span.End()
+
+	menu, err := json.Marshal(v.Menu)
+	if err != nil {
+		return fmt.Errorf("failed to marshal menu: %w", err)
+	}
+	diff, err := json.Marshal(v.Diff)
+	if err != nil {
+		return fmt.Errorf("failed to marshal menu diff: %w", err)
+	}
+
+	v.AppID = s.appID
+	err = s.db.QueryRowContext(ctx, `
+		INSERT INTO menu_versions (app_id, version, menu, diff, author, source, rollback_of)
+		SELECT $1, COALESCE(MAX(version), 0) + 1, $2, $3, $4, $5, $6
+		FROM menu_versions WHERE app_id = $1
+		RETURNING id, version, created_at`,
+		s.appID, menu, diff, v.Author, v.Source, v.RollbackOf,
+	).Scan(&v.ID, &v.Version, &v.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert menu version: %w", err)
+	}
+	return nil
+}
+
+// Get returns a version by number
+func (s *PostgresMenuVersionStore) Get(ctx context.Context, version int) (*MenuVersion, error) {
+	ctx, span := tracing.Start(ctx, "PostgresMenuVersionStore.Get")
+	defer span.End()
+
+	row := s.db.QueryRowContext(ctx,
+		`SELECT `+menuVersionColumns+` FROM menu_versions WHERE app_id = $1 AND version = $2`,
+		s.appID, version,
+	)
+	v, err := scanMenuVersion(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrMenuVersionNotFound
+	}
+	return v, err
+}
+
+// Latest returns the newest version, or nil when there is none
+func (s *PostgresMenuVersionStore) Latest(ctx context.Context) (*MenuVersion, error) {
+	ctx, span := tracing.Start(ctx, "PostgresMenuVersionStore.Latest")
+	defer span.End()
+
+	row := s.db.QueryRowContext(ctx,
+		`SELECT `+menuVersionColumns+` FROM menu_versions WHERE app_id = $1 ORDER BY version DESC LIMIT 1`,
+		s.appID,
+	)
+	v, err := scanMenuVersion(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return v, err
+}
+
+// List returns at most limit versions, newest first
+func (s *PostgresMenuVersionStore) List(ctx context.Context, limit int) ([]*MenuVersion, error) {
+	ctx, span := tracing.Start(ctx, "PostgresMenuVersionStore.List")
+	defer span.End()
+
+	query := `SELECT ` + menuVersionColumns + ` FROM menu_versions WHERE app_id = $1 ORDER BY version DESC`
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, s.appID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query menu versions: %w", err)
+	}
+	defer rows.Close()
+
+	versions := make([]*MenuVersion, 0)
+	for rows.Next() {
+		v, err := scanMenuVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+// scanMenuVersion scans one row selected with menuVersionColumns
+func scanMenuVersion(row interface{ Scan(...interface{}) error }) (*MenuVersion, error) {
+	v := &MenuVersion{}
+	var menu, diff []byte
+	if err := row.Scan(&v.ID, &v.AppID, &v.Version, &menu, &diff, &v.Author, &v.Source,
+		&v.RollbackOf, &v.CreatedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to scan menu version: %w", err)
+	}
+	if err := json.Unmarshal(menu, &v.Menu); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal menu: %w", err)
+	}
+	if len(diff) > 0 {
+		json.Unmarshal(diff, &v.Diff)
+	}
+	return v, nil
+}
@@ -1,13 +1,17 @@
 package repository
 
 import (
+	"context"
 	"sync"
 	"time"
+
+	"wechat-service/pkg/tracing"
 )
 
 // Message represents a WeChat message
 type Message struct {
 	ID           int64     `json:"id"`
+	AppID        string    `json:"app_id"`
 	MsgID        int64     `json:"msg_id"`
 	FromUser     string    `json:"from_user"`
 	ToUser       string    `json:"to_user"`
@@ -35,21 +39,37 @@ type Message struct {
 	CreatedAt    time.Time `json:"created_at"`
 }
 
-// MessageRepository handles message data storage
+// MessageRepository handles message data storage. Each account has its
+// own repository, so data is partitioned by app ID.
 type MessageRepository struct {
+	appID    string
 	mu       sync.RWMutex
 	messages map[int64]*Message
 }
 
 // NewMessageRepository creates a new message repository
 func NewMessageRepository() *MessageRepository {
+	return NewMessageRepositoryForApp("")
+}
+
+// NewMessageRepositoryForApp creates a message repository for one account
+func NewMessageRepositoryForApp(appID string) *MessageRepository {
 	return &MessageRepository{
+		appID:    appID,
 		messages: make(map[int64]*Message),
 	}
 }
 
+// AppID returns the account the repository belongs to
+func (r *MessageRepository) AppID() string {
+	return r.appID
+}
+
 // GetByMsgID retrieves a message by msg_id
-func (r *MessageRepository) GetByMsgID(msgID int64) (*Message, error) {
+func (r *MessageRepository) GetByMsgID(ctx context.Context, msgID int64) (*Message, error) {
+	_, span := tracing.Start(ctx, "MessageRepository.GetByMsgID")
+	defer span.End()
+
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
@@ -61,10 +81,14 @@ func (r *MessageRepository) GetByMsgID(msgID int64) (*Message, error) {
 }
 
 // Create creates a new message
-func (r *MessageRepository) Create(msg *Message) error {
+func (r *MessageRepository) Create(ctx context.Context, msg *Message) error {
+	_, span := tracing.Start(ctx, "MessageRepository.Create")
+	defer span.End()
+
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	msg.AppID = r.appID
 	msg.CreatedAt = time.Now()
 	r.messages[msg.MsgID] = msg
 
@@ -72,10 +96,14 @@ func (r *MessageRepository) Create(msg *Message) error {
 }
 
 // Save creates or updates a message
-func (r *MessageRepository) Save(msg *Message) error {
+func (r *MessageRepository) Save(ctx context.Context, msg *Message) error {
+	_, span := tracing.Start(ctx, "MessageRepository.Save")
+	defer span.End()
+
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	msg.AppID = r.appID
 	msg.CreatedAt = time.Now()
 	r.messages[msg.MsgID] = msg
 
@@ -83,7 +111,10 @@ func (r *MessageRepository) Save(msg *Message) error {
 }
 
 // Delete deletes a message by msg_id
-func (r *MessageRepository) Delete(msgID int64) error {
+func (r *MessageRepository) Delete(ctx context.Context, msgID int64) error {
+	_, span := tracing.Start(ctx, "MessageRepository.Delete")
+	defer span.End()
+
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
@@ -92,7 +123,10 @@ func (r *MessageRepository) Delete(msgID int64) error {
 }
 
 // GetAll retrieves all messages
-func (r *MessageRepository) GetAll() ([]*Message, error) {
+func (r *MessageRepository) GetAll(ctx context.Context) ([]*Message, error) {
+	_, span := tracing.Start(ctx, "MessageRepository.GetAll")
+	defer span.End()
+
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
@@ -104,7 +138,10 @@ func (r *MessageRepository) GetAll() ([]*Message, error) {
 }
 
 // GetByType retrieves messages by type
-func (r *MessageRepository) GetByType(msgType string) ([]*Message, error) {
+func (r *MessageRepository) GetByType(ctx context.Context, msgType string) ([]*Message, error) {
+	_, span := tracing.Start(ctx, "MessageRepository.GetByType")
+	defer span.End()
+
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
@@ -118,7 +155,10 @@ func (r *MessageRepository) GetByType(msgType string) ([]*Message, error) {
 }
 
 // GetByUser retrieves messages from a specific user
-func (r *MessageRepository) GetByUser(openid string) ([]*Message, error) {
+func (r *MessageRepository) GetByUser(ctx context.Context, openid string) ([]*Message, error) {
+	_, span := tracing.Start(ctx, "MessageRepository.GetByUser")
+	defer span.End()
+
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
@@ -132,7 +172,10 @@ func (r *MessageRepository) GetByUser(openid string) ([]*Message, error) {
 }
 
 // GetRecent retrieves recent messages with limit
-func (r *MessageRepository) GetRecent(limit int) ([]*Message, error) {
+func (r *MessageRepository) GetRecent(ctx context.Context, limit int) ([]*Message, error) {
+	_, span := tracing.Start(ctx, "MessageRepository.GetRecent")
+	defer span.End()
+
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
@@ -158,14 +201,20 @@ func (r *MessageRepository) GetRecent(limit int) ([]*Message, error) {
 }
 
 // Count returns total message count
-func (r *MessageRepository) Count() int {
+func (r *MessageRepository) Count(ctx context.Context) int {
+	_, span := tracing.Start(ctx, "MessageRepository.Count")
+	defer span.End()
+
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 	return len(r.messages)
 }
 
 // CountByType returns message count by type
-func (r *MessageRepository) CountByType(msgType string) int {
+func (r *MessageRepository) CountByType(ctx context.Context, msgType string) int {
+	_, span := tracing.Start(ctx, "MessageRepository.CountByType")
+	defer span.End()
+
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
@@ -179,7 +228,10 @@ func (r *MessageRepository) CountByType(msgType string) int {
 }
 
 // DeleteOld deletes messages older than duration
-func (r *MessageRepository) DeleteOld(olderThan time.Duration) error {
+func (r *MessageRepository) DeleteOld(ctx context.Context, olderThan time.Duration) error {
+	_, span := tracing.Start(ctx, "MessageRepository.DeleteOld")
+	defer span.End()
+
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
@@ -1,12 +1,16 @@
 package repository
 
 import (
+	"context"
 	"sync"
 	"time"
+
+	"wechat-service/pkg/tracing"
 )
 
 // User represents a WeChat user
 type User struct {
+	AppID        string    `json:"app_id"`
 	OpenID       string    `json:"openid"`
 	UnionID      string    `json:"unionid"`
 	Nickname     string    `json:"nickname"`
@@ -14,6 +18,7 @@ type User struct {
 	Province     string    `json:"province"`
 	City         string    `json:"city"`
 	Country      string    `json:"country"`
+	Language     string    `json:"language"`
 	HeadImgURL   string    `json:"headimgurl"`
 	Subscribe    int       `json:"subscribe"`
 	SubscribeTime time.Time `json:"subscribe_time"`
@@ -24,21 +29,37 @@ type User struct {
 	UpdatedAt    time.Time `json:"updated_at"`
 }
 
-// UserRepository handles user data storage
+// UserRepository handles user data storage. Each account has its own
+// repository, so data is partitioned by app ID.
 type UserRepository struct {
+	appID string
 	mu    sync.RWMutex
 	users map[string]*User
 }
 
 // NewUserRepository creates a new user repository
 func NewUserRepository() *UserRepository {
+	return NewUserRepositoryForApp("")
+}
+
+// NewUserRepositoryForApp creates a user repository for one account
+func NewUserRepositoryForApp(appID string) *UserRepository {
 	return &UserRepository{
+		appID: appID,
 		users: make(map[string]*User),
 	}
 }
 
+// AppID returns the account the repository belongs to
+func (r *UserRepository) AppID() string {
+	return r.appID
+}
+
 // GetByOpenID retrieves a user by openid
-func (r *UserRepository) GetByOpenID(openid string) (*User, error) {
+func (r *UserRepository) GetByOpenID(ctx context.Context, openid string) (*User, error) {
+	_, span := tracing.Start(ctx, "UserRepository.GetByOpenID")
+	defer span.End()
+
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
@@ -50,19 +71,26 @@ func (r *UserRepository) GetByOpenID(openid string) (*User, error) {
 }
 
 // Create creates a new user
-func (r *UserRepository) Create(user *User) error {
+func (r *UserRepository) Create(ctx context.Context, user *User) error {
+	_, span := tracing.Start(ctx, "UserRepository.Create")
+	defer span.End()
+
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
 	user.CreatedAt = time.Now()
 	user.UpdatedAt = time.Now()
+	user.AppID = r.appID
 	r.users[user.OpenID] = user
 
 	return nil
 }
 
 // Update updates an existing user
-func (r *UserRepository) Update(user *User) error {
+func (r *UserRepository) Update(ctx context.Context, user *User) error {
+	_, span := tracing.Start(ctx, "UserRepository.Update")
+	defer span.End()
+
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
@@ -70,13 +98,17 @@ func (r *UserRepository) Update(user *User) error {
 	if existing, ok := r.users[user.OpenID]; ok {
 		user.CreatedAt = existing.CreatedAt
 	}
+	user.AppID = r.appID
 	r.users[user.OpenID] = user
 
 	return nil
 }
 
 // Save creates or updates a user
-func (r *UserRepository) Save(user *User) error {
+func (r *UserRepository) Save(ctx context.Context, user *User) error {
+	_, span := tracing.Start(ctx, "UserRepository.Save")
+	defer span.End()
+
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
@@ -86,13 +118,17 @@ func (r *UserRepository) Save(user *User) error {
 	} else {
 		user.CreatedAt = time.Now()
 	}
+	user.AppID = r.appID
 	r.users[user.OpenID] = user
 
 	return nil
 }
 
 // Delete deletes a user by openid
-func (r *UserRepository) Delete(openid string) error {
+func (r *UserRepository) Delete(ctx context.Context, openid string) error {
+	_, span := tracing.Start(ctx, "UserRepository.Delete")
+	defer span.End()
+
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
@@ -101,7 +137,10 @@ func (r *UserRepository) Delete(openid string) error {
 }
 
 // GetAll retrieves all users
-func (r *UserRepository) GetAll() ([]*User, error) {
+func (r *UserRepository) GetAll(ctx context.Context) ([]*User, error) {
+	_, span := tracing.Start(ctx, "UserRepository.GetAll")
+	defer span.End()
+
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
@@ -113,7 +152,10 @@ func (r *UserRepository) GetAll() ([]*User, error) {
 }
 
 // GetByTag retrieves users by tag
-func (r *UserRepository) GetByTag(tagID int) ([]*User, error) {
+func (r *UserRepository) GetByTag(ctx context.Context, tagID int) ([]*User, error) {
+	_, span := tracing.Start(ctx, "UserRepository.GetByTag")
+	defer span.End()
+
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
@@ -130,7 +172,10 @@ func (r *UserRepository) GetByTag(tagID int) ([]*User, error) {
 }
 
 // GetSubscribed retrieves all subscribed users
-func (r *UserRepository) GetSubscribed() ([]*User, error) {
+func (r *UserRepository) GetSubscribed(ctx context.Context) ([]*User, error) {
+	_, span := tracing.Start(ctx, "UserRepository.GetSubscribed")
+	defer span.End()
+
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
@@ -144,14 +189,20 @@ func (r *UserRepository) GetSubscribed() ([]*User, error) {
 }
 
 // Count returns the total number of users
-func (r *UserRepository) Count() int {
+func (r *UserRepository) Count(ctx context.Context) int {
+	_, span := tracing.Start(ctx, "UserRepository.Count")
+	defer span.End()
+
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 	return len(r.users)
 }
 
 // CountSubscribed returns the number of subscribed users
-func (r *UserRepository) CountSubscribed() int {
+func (r *UserRepository) CountSubscribed(ctx context.Context) int {
+	_, span := tracing.Start(ctx, "UserRepository.CountSubscribed")
+	defer span.End()
+
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
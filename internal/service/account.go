@@ -0,0 +1,219 @@
+package service
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+
+	"wechat-service/internal/config"
+	"wechat-service/internal/repository"
+	"wechat-service/pkg/async"
+	"wechat-service/pkg/cache"
+	"wechat-service/pkg/logger"
+	"wechat-service/pkg/metrics"
+	"wechat-service/pkg/ratelimit"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/silenceper/wechat/v2/officialaccount"
+	offConfig "github.com/silenceper/wechat/v2/officialaccount/config"
+)
+
+// Account bundles the components serving one WeChat service account
+type Account struct {
+	Name   string
+	AppID  string
+	Config *config.Config // scoped to this account, see Config.ForAccount
+
+	OA          *officialaccount.OfficialAccount
+	Tokens      *Server
+	Limiter     *ratelimit.Limiter
+	Metrics     *metrics.Metrics
+	Log         *logger.Logger
+	MessageRepo *repository.MessageRepository
+	UserRepo    *repository.UserRepository
+	Messages    *MessageService
+	Events      *EventService
+	Menus       *MenuService
+	MenuRules   *ConditionalMenuService
+	Experiments *ExperimentService
+}
+
+// AccountRegistry holds the configured accounts by app ID
+type AccountRegistry struct {
+	mu       sync.RWMutex
+	accounts map[string]*Account
+	order    []string
+}
+
+// NewAccountRegistry builds an Account for every entry of
+// cfg.GetAccounts(). All accounts share cacheInst and register their
+// metrics on reg, labelled with their app ID. db is the database opened by
+// repository.OpenDB when database.type is set; with a nil db, menu
+// history, menu rules and experiments are kept in memory.
+func NewAccountRegistry(cfg *config.Config, cacheInst cache.Cache, db *sql.DB, reg prometheus.Registerer, log *logger.Logger) (*AccountRegistry, error) {
+	if cacheInst == nil {
+		return nil, fmt.Errorf("account registry needs a cache for access tokens")
+	}
+	if reg == nil {
+		reg = prometheus.NewRegistry()
+	}
+
+	r := &AccountRegistry{
+		accounts: make(map[string]*Account),
+	}
+
+	for _, ac := range cfg.GetAccounts() {
+		if _, ok := r.accounts[ac.AppID]; ok {
+			return nil, fmt.Errorf("duplicate account app_id: %q", ac.AppID)
+		}
+		r.accounts[ac.AppID] = newAccount(cfg, ac, cacheInst, db, reg, log)
+		r.order = append(r.order, ac.AppID)
+	}
+
+	return r, nil
+}
+
+// newAccount builds the components of one account
+func newAccount(cfg *config.Config, ac config.AccountConfig, cacheInst cache.Cache, db *sql.DB, reg prometheus.Registerer, log *logger.Logger) *Account {
+	scoped := cfg.ForAccount(ac)
+	accLog := log.With("app_id", ac.AppID)
+
+	oa := officialaccount.NewOfficialAccount(&offConfig.Config{
+		AppID:          ac.AppID,
+		AppSecret:      ac.AppSecret,
+		Token:          ac.Token,
+		EncodingAESKey: ac.EncodingAESKey,
+		Cache:          cacheInst,
+		UseStableAK:    scoped.AccessToken.UseStableAPI,
+	})
+
+	m := metrics.NewMetrics(reg, ac.AppID)
+	tokens := NewServer(scoped, cacheInst, accLog)
+	tokens.SetMetrics(m)
+	oa.SetAccessTokenHandle(tokens)
+
+	msgRepo := repository.NewMessageRepositoryForApp(ac.AppID)
+	userRepo := repository.NewUserRepositoryForApp(ac.AppID)
+	limiter := ratelimit.NewLimiter(scoped, cacheInst, accLog)
+	menuClient := NewWeChatMenuClient(oa)
+	menus := NewMenuService(menuClient, limiter, accLog)
+	var menuRules repository.MenuRuleStore
+	var experimentStore repository.ExperimentStore
+	if db != nil {
+		menus.SetVersionStore(repository.NewPostgresMenuVersionStore(db, ac.AppID))
+		menuRules = repository.NewPostgresMenuRuleStore(db, ac.AppID)
+		experimentStore = repository.NewPostgresExperimentStore(db, ac.AppID)
+	} else {
+		menus.SetVersionStore(repository.NewMemoryMenuVersionStore(ac.AppID))
+		menuRules = repository.NewMemoryMenuRuleStore(ac.AppID)
+		experimentStore = repository.NewMemoryExperimentStore(ac.AppID)
+	}
+	conditional := NewConditionalMenuService(menuClient, menuRules, userRepo, limiter, accLog)
+	followers := NewWeChatFollowerClient(oa)
+	experiments := NewExperimentService(NewWeChatTagClient(oa), followers, conditional,
+		experimentStore, userRepo, limiter, accLog)
+	messages := NewMessageService(msgRepo)
+	events := NewEventService(userRepo)
+	if store, ok := cacheInst.(cache.Store); ok {
+		dedup := cache.WithNamespace(store, cache.Namespace(cfg, ac.AppID))
+		messages.SetDedupStore(dedup)
+		events.SetDedupStore(dedup)
+	}
+	events.SetFollowerClient(followers, limiter)
+	events.SetMenuRuleStore(menuRules)
+	events.AddMenuEventObserver(experiments.RecordMenuEvent)
+
+	return &Account{
+		Name:        ac.Name,
+		AppID:       ac.AppID,
+		Config:      scoped,
+		OA:          oa,
+		Tokens:      tokens,
+		Limiter:     limiter,
+		Metrics:     m,
+		Log:         accLog,
+		MessageRepo: msgRepo,
+		UserRepo:    userRepo,
+		Messages:    messages,
+		Events:      events,
+		Menus:       menus,
+		MenuRules:   conditional,
+		Experiments: experiments,
+	}
+}
+
+// Get returns the account with appID
+func (r *AccountRegistry) Get(appID string) (*Account, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	a, ok := r.accounts[appID]
+	return a, ok
+}
+
+// Default returns the first configured account
+func (r *AccountRegistry) Default() *Account {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.order) == 0 {
+		return nil
+	}
+	return r.accounts[r.order[0]]
+}
+
+// All returns the accounts in configuration order
+func (r *AccountRegistry) All() []*Account {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make([]*Account, 0, len(r.order))
+	for _, appID := range r.order {
+		out = append(out, r.accounts[appID])
+	}
+	return out
+}
+
+// ApplyConfig applies reloadable settings to every account: the quotas of
+// its limiter and the level and redaction fields of its logger
+func (r *AccountRegistry) ApplyConfig(cfg *config.Config) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, ac := range cfg.GetAccounts() {
+		if a, ok := r.accounts[ac.AppID]; ok {
+			scoped := cfg.ForAccount(ac)
+			a.Limiter.ApplyConfig(scoped)
+			a.Log.ApplyConfig(scoped)
+		}
+	}
+}
+
+// Watch applies configuration reloads of w to every account and warns
+// about changes that need a restart. Replies to messages and events are
+// not configured in the file, and conditional menu rules live in their
+// stores, so neither is reloaded; a changed menu_file needs a restart.
+func (r *AccountRegistry) Watch(w *config.Watcher, log *logger.Logger) {
+	w.Subscribe(func(old, cfg *config.Config) {
+		r.ApplyConfig(cfg)
+		if sections := config.RestartRequired(old, cfg); len(sections) > 0 {
+			log.Warn("Configuration reloaded, restart to apply some changes", "sections", sections)
+			return
+		}
+		log.Info("Configuration reloaded")
+	})
+}
+
+// SetProcessor runs the background work of every account, such as
+// experiment follower assignments and subscriber profile fetches, as
+// tasks of p
+func (r *AccountRegistry) SetProcessor(p *async.Processor) {
+	for _, a := range r.All() {
+		a.Experiments.SetProcessor(p, a.AppID)
+		a.Events.SetProcessor(p, a.AppID)
+	}
+}
+
+// Stop stops the token servers and limiters of all accounts
+func (r *AccountRegistry) Stop() {
+	for _, a := range r.All() {
+		a.Tokens.Stop()
+		a.Limiter.Stop()
+	}
+}
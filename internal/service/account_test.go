@@ -0,0 +1,242 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"wechat-service/internal/config"
+	"wechat-service/internal/repository"
+	"wechat-service/pkg/cache"
+	"wechat-service/pkg/logger"
+	"wechat-service/pkg/monitor"
+)
+
+// testLogger returns a logger that only reports errors
+func testLogger() *logger.Logger {
+	cfg := &config.Config{}
+	cfg.Monitoring.LogLevel = "error"
+	return logger.New(cfg)
+}
+
+// testConfig returns a configuration serving the accounts appIDs
+func testConfig(appIDs ...string) *config.Config {
+	cfg := &config.Config{}
+	for _, id := range appIDs {
+		cfg.Accounts = append(cfg.Accounts, config.AccountConfig{Name: id, AppID: id, AppSecret: "secret-" + id})
+	}
+	return cfg
+}
+
+func TestNewAccountRegistry(t *testing.T) {
+	tests := []struct {
+		name        string
+		appIDs      []string
+		wantErr     bool
+		wantDefault string
+	}{
+		{name: "single account", appIDs: []string{"wx1"}, wantDefault: "wx1"},
+		{name: "several accounts", appIDs: []string{"wx2", "wx1", "wx3"}, wantDefault: "wx2"},
+		{name: "duplicate app id", appIDs: []string{"wx1", "wx1"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := cache.NewMemoryCache(0, 0)
+			defer store.Close()
+
+			r, err := NewAccountRegistry(testConfig(tt.appIDs...), store, nil, nil, testLogger())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer r.Stop()
+
+			if got := r.Default().AppID; got != tt.wantDefault {
+				t.Errorf("Default = %q, want %q", got, tt.wantDefault)
+			}
+			all := r.All()
+			if len(all) != len(tt.appIDs) {
+				t.Fatalf("All returned %d accounts, want %d", len(all), len(tt.appIDs))
+			}
+			for i, a := range all {
+				if a.AppID != tt.appIDs[i] {
+					t.Errorf("All[%d] = %q, want %q", i, a.AppID, tt.appIDs[i])
+				}
+				got, ok := r.Get(a.AppID)
+				if !ok || got != a {
+					t.Errorf("Get(%q) = %v, %v", a.AppID, got, ok)
+				}
+				if a.Config.WeChat.AppID != a.AppID {
+					t.Errorf("account %q is scoped to %q", a.AppID, a.Config.WeChat.AppID)
+				}
+			}
+			if _, ok := r.Get("unknown"); ok {
+				t.Error("Get(unknown) found an account")
+			}
+		})
+	}
+}
+
+func TestNewAccountRegistryRequiresCache(t *testing.T) {
+	if _, err := NewAccountRegistry(testConfig("wx1"), nil, nil, nil, testLogger()); err == nil {
+		t.Error("expected an error without a cache")
+	}
+}
+
+func TestNewAccountRegistryMenuStores(t *testing.T) {
+	tests := []struct {
+		name         string
+		database     bool
+		wantPostgres bool
+	}{
+		{name: "in memory without a database", database: false},
+		{name: "postgres with a database", database: true, wantPostgres: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var db *sql.DB
+			if tt.database {
+				// sql.Open does not connect, so no server is needed
+				var err error
+				if db, err = sql.Open("postgres", "postgres://localhost/wechat?sslmode=disable"); err != nil {
+					t.Fatal(err)
+				}
+				defer db.Close()
+			}
+
+			store := cache.NewMemoryCache(0, 0)
+			defer store.Close()
+			r, err := NewAccountRegistry(testConfig("wx1"), store, db, nil, testLogger())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Stop()
+
+			a := r.Default()
+			_, versionsInPostgres := a.Menus.versions.(*repository.PostgresMenuVersionStore)
+			if versionsInPostgres != tt.wantPostgres {
+				t.Errorf("menu versions kept in %T, want postgres: %v", a.Menus.versions, tt.wantPostgres)
+			}
+			_, rulesInPostgres := a.MenuRules.rules.(*repository.PostgresMenuRuleStore)
+			if rulesInPostgres != tt.wantPostgres {
+				t.Errorf("menu rules kept in %T, want postgres: %v", a.MenuRules.rules, tt.wantPostgres)
+			}
+			_, experimentsInPostgres := a.Experiments.store.(*repository.PostgresExperimentStore)
+			if experimentsInPostgres != tt.wantPostgres {
+				t.Errorf("experiments kept in %T, want postgres: %v", a.Experiments.store, tt.wantPostgres)
+			}
+		})
+	}
+}
+
+func TestAccountRegistryWatch(t *testing.T) {
+	tests := []struct {
+		name      string
+		yaml      string
+		wantQuota int
+		wantDebug bool
+	}{
+		{name: "global quota", yaml: "rate_limit:\n  api_quotas:\n    menu_create: 7\n", wantQuota: 7},
+		{
+			name:      "account quota",
+			yaml:      "rate_limit:\n  api_quotas:\n    menu_create: 7\naccounts:\n  - {app_id: wx1, app_secret: s, token: t, api_quotas: {menu_create: 3}}\n",
+			wantQuota: 3,
+		},
+		{name: "log level", yaml: "monitoring:\n  log_level: debug\n", wantQuota: config.DefaultAPIQuotas["menu_create"], wantDebug: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			write := func(yaml string) {
+				base := "cache:\n  type: memory\nwechat: {app_id: wx1, app_secret: s, token: t}\n"
+				if err := os.WriteFile(path, []byte(base+yaml), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			write("")
+			cfg, err := config.Load(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			store := cache.NewMemoryCache(0, 0)
+			defer store.Close()
+			log := testLogger()
+			r, err := NewAccountRegistry(cfg, store, nil, nil, log)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Stop()
+
+			w := config.NewWatcher(path, cfg, nil)
+			r.Watch(w, log)
+
+			write(tt.yaml)
+			if err := w.Reload(); err != nil {
+				t.Fatal(err)
+			}
+			_, quota, err := r.Default().Limiter.GetUsage("menu_create")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if quota != tt.wantQuota {
+				t.Errorf("menu_create quota = %d, want %d", quota, tt.wantQuota)
+			}
+			for _, a := range r.All() {
+				if got := a.Log.Slog().Enabled(context.Background(), slog.LevelDebug); got != tt.wantDebug {
+					t.Errorf("account %s logs debug = %v, want %v", a.AppID, got, tt.wantDebug)
+				}
+			}
+		})
+	}
+}
+
+// The token server feeds the token health check and anomaly rule
+var _ monitor.TokenStatsProvider = (*Server)(nil)
+
+func TestAccountRegistrySetProcessor(t *testing.T) {
+	tests := []struct {
+		name   string
+		appIDs []string
+	}{
+		{name: "single account", appIDs: []string{"wx1"}},
+		{name: "several accounts", appIDs: []string{"wx1", "wx2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := cache.NewMemoryCache(0, 0)
+			defer store.Close()
+			r, err := NewAccountRegistry(testConfig(tt.appIDs...), store, nil, nil, testLogger())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Stop()
+
+			p := newTestProcessor(t, 1)
+			r.SetProcessor(p)
+
+			// Restored tasks reach the account that queued them
+			seen := make(map[string]bool)
+			for _, a := range r.All() {
+				if a.Experiments.processor != p || a.Events.processor != p {
+					t.Errorf("account %s runs without the processor", a.AppID)
+				}
+				for _, taskType := range []string{a.Experiments.taskType, a.Events.taskType} {
+					if seen[taskType] {
+						t.Errorf("task type %s shared", taskType)
+					}
+					seen[taskType] = true
+				}
+			}
+		})
+	}
+}
@@ -1,16 +1,105 @@
 package service
 
 import (
+	"context"
+	"fmt"
+	"strconv"
 	"time"
 
 	"wechat-service/internal/repository"
+	"wechat-service/pkg/async"
+	"wechat-service/pkg/cache"
+	"wechat-service/pkg/logger"
+	"wechat-service/pkg/ratelimit"
+	"wechat-service/pkg/tracing"
 
+	"github.com/silenceper/wechat/v2/officialaccount"
 	"github.com/silenceper/wechat/v2/officialaccount/message"
 )
 
+// subscriberProfileTask prefixes the async task type fetching the profile
+// of a new subscriber of an account
+const subscriberProfileTask = "subscriber_profile:"
+
+// maxFollowerPage is the most openids WeChat lists in one call
+const maxFollowerPage = 10000
+
+// FollowerClient reads the followers of one account
+type FollowerClient interface {
+	GetFollower(ctx context.Context, openid string) (*repository.User, error)
+	// ListFollowers returns a page of follower openids after next, "" for
+	// the first page, and the next value of the following page, "" after
+	// the last one
+	ListFollowers(ctx context.Context, next string) ([]string, string, error)
+}
+
+// WeChatFollowerClient is the FollowerClient backed by the WeChat API
+type WeChatFollowerClient struct {
+	oa *officialaccount.OfficialAccount
+}
+
+// NewWeChatFollowerClient creates a follower client for oa
+func NewWeChatFollowerClient(oa *officialaccount.OfficialAccount) *WeChatFollowerClient {
+	return &WeChatFollowerClient{oa: oa}
+}
+
+// GetFollower returns the profile of openid, including the sex, language,
+// location and tags matched by conditional menus
+func (c *WeChatFollowerClient) GetFollower(ctx context.Context, openid string) (*repository.User, error) {
+	info, err := c.oa.GetUser().GetUserInfo(openid)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make([]int, len(info.TagIDList))
+	for i, id := range info.TagIDList {
+		tags[i] = int(id)
+	}
+	return &repository.User{
+		OpenID:        info.OpenID,
+		UnionID:       info.UnionID,
+		Nickname:      info.Nickname,
+		Sex:           int(info.Sex),
+		Province:      info.Province,
+		City:          info.City,
+		Country:       info.Country,
+		Language:      info.Language,
+		HeadImgURL:    info.Headimgurl,
+		Subscribe:     int(info.Subscribe),
+		SubscribeTime: time.Unix(int64(info.SubscribeTime), 0),
+		Remark:        info.Remark,
+		TagIDList:     tags,
+		GroupID:       int(info.GroupID),
+	}, nil
+}
+
+// ListFollowers returns a page of follower openids after next, "" for the
+// first page, and the next value of the following page, "" after the last
+func (c *WeChatFollowerClient) ListFollowers(ctx context.Context, next string) ([]string, string, error) {
+	list, err := c.oa.GetUser().ListUserOpenIDs(next)
+	if err != nil {
+		return nil, "", err
+	}
+	if list.Count < maxFollowerPage {
+		return list.Data.OpenIDs, "", nil
+	}
+	return list.Data.OpenIDs, list.NextOpenID, nil
+}
+
+// MenuEventObserver is notified of menu CLICK and VIEW events with the
+// follower's openid and the event type
+type MenuEventObserver func(ctx context.Context, openid, event string)
+
 // EventService handles event business logic
 type EventService struct {
-	userRepo *repository.UserRepository
+	userRepo  *repository.UserRepository
+	followers FollowerClient
+	limiter   *ratelimit.Limiter
+	menuRules repository.MenuRuleStore
+	observers []MenuEventObserver
+	dedup     cache.Store
+	processor *async.Processor
+	taskType  string
 }
 
 // NewEventService creates a new event service
@@ -20,16 +109,64 @@ func NewEventService(userRepo *repository.UserRepository) *EventService {
 	}
 }
 
-// OnSubscribe handles subscribe events
-func (s *EventService) OnSubscribe(msg *message.MixMessage) *message.Reply {
+// SetFollowerClient sets the client fetching the profile of new
+// subscribers, counted against the user_info quota of limiter, which may
+// be nil
+func (s *EventService) SetFollowerClient(followers FollowerClient, limiter *ratelimit.Limiter) {
+	s.followers = followers
+	s.limiter = limiter
+}
+
+// SetProcessor fetches the profiles of new subscribers as tasks of p,
+// registered under a task type of appID so persisted tasks are restored.
+// Without a processor, profiles are fetched in a goroutine.
+func (s *EventService) SetProcessor(p *async.Processor, appID string) {
+	s.processor = p
+	s.taskType = subscriberProfileTask + appID
+	p.Handle(s.taskType, s.executeProfile)
+}
+
+// SetMenuRuleStore sets the store whose match counts are incremented by
+// menu events from conditional menus
+func (s *EventService) SetMenuRuleStore(rules repository.MenuRuleStore) {
+	s.menuRules = rules
+}
+
+// AddMenuEventObserver registers an observer of menu events
+func (s *EventService) AddMenuEventObserver(observe MenuEventObserver) {
+	s.observers = append(s.observers, observe)
+}
+
+// SetDedupStore sets the store used to recognize retried menu events,
+// which are counted once
+func (s *EventService) SetDedupStore(store cache.Store) {
+	s.dedup = store
+}
+
+// OnSubscribe handles subscribe events. The subscriber is stored with
+// what is known of them and the reply sent right away; their profile is
+// fetched in the background.
+func (s *EventService) OnSubscribe(ctx context.Context, msg *message.MixMessage) *message.Reply {
+	ctx, span := tracing.Start(ctx, "EventService.OnSubscribe")
+	defer span.End()
+
 	if s.userRepo != nil {
-		user := &repository.User{
-			OpenID:        string(msg.FromUserName),
-			Subscribe:     1,
-			SubscribeTime: time.Now(),
+		openid := string(msg.FromUserName)
+		user := &repository.User{OpenID: openid}
+		if existing, _ := s.userRepo.GetByOpenID(ctx, openid); existing != nil {
+			known := *existing
+			user = &known
+		}
+		user.Subscribe = 1
+		if user.SubscribeTime.IsZero() || user.SubscribeTime.Unix() == 0 {
+			user.SubscribeTime = time.Now()
+		}
+		if err := s.userRepo.Save(ctx, user); err != nil {
+			logger.FromContext(ctx).Error("Failed to save subscriber", "error", err)
 		}
-		s.userRepo.Save(user)
+		s.queueProfile(ctx, openid)
 	}
+	logger.FromContext(ctx).Info("User subscribed")
 
 	return &message.Reply{
 		MsgType: message.MsgTypeText,
@@ -40,23 +177,40 @@ func (s *EventService) OnSubscribe(msg *message.MixMessage) *message.Reply {
 }
 
 // OnUnsubscribe handles unsubscribe events
-func (s *EventService) OnUnsubscribe(msg *message.MixMessage) {
+func (s *EventService) OnUnsubscribe(ctx context.Context, msg *message.MixMessage) {
+	ctx, span := tracing.Start(ctx, "EventService.OnUnsubscribe")
+	defer span.End()
+
 	if s.userRepo != nil {
-		user, _ := s.userRepo.GetByOpenID(string(msg.FromUserName))
+		user, _ := s.userRepo.GetByOpenID(ctx, string(msg.FromUserName))
 		if user != nil {
 			user.Subscribe = 0
-			s.userRepo.Save(user)
+			if err := s.userRepo.Save(ctx, user); err != nil {
+				logger.FromContext(ctx).Error("Failed to save unsubscriber", "error", err)
+			}
 		}
 	}
+	logger.FromContext(ctx).Info("User unsubscribed")
 }
 
 // OnScan handles QR code scan events
-func (s *EventService) OnScan(msg *message.MixMessage) *message.Reply {
+func (s *EventService) OnScan(ctx context.Context, msg *message.MixMessage) *message.Reply {
+	_, span := tracing.Start(ctx, "EventService.OnScan")
+	defer span.End()
+
 	return nil
 }
 
 // OnClick handles menu click events
-func (s *EventService) OnClick(msg *message.MixMessage) *message.Reply {
+func (s *EventService) OnClick(ctx context.Context, msg *message.MixMessage) *message.Reply {
+	ctx, span := tracing.Start(ctx, "EventService.OnClick")
+	defer span.End()
+
+	if s.claimMenuEvent(ctx, msg) {
+		s.countMenuMatch(ctx, msg)
+		s.notifyMenuEvent(ctx, msg)
+	}
+
 	switch string(msg.EventKey) {
 	case "V1001_HELP":
 		return s.showHelp(msg)
@@ -73,11 +227,127 @@ func (s *EventService) OnClick(msg *message.MixMessage) *message.Reply {
 }
 
 // OnView handles menu view events
-func (s *EventService) OnView(msg *message.MixMessage) {
+func (s *EventService) OnView(ctx context.Context, msg *message.MixMessage) {
+	ctx, span := tracing.Start(ctx, "EventService.OnView")
+	defer span.End()
+
+	if s.claimMenuEvent(ctx, msg) {
+		s.countMenuMatch(ctx, msg)
+		s.notifyMenuEvent(ctx, msg)
+	}
 }
 
 // OnLocation handles location events
-func (s *EventService) OnLocation(msg *message.MixMessage) {
+func (s *EventService) OnLocation(ctx context.Context, msg *message.MixMessage) {
+	_, span := tracing.Start(ctx, "EventService.OnLocation")
+	defer span.End()
+
+}
+
+// queueProfile fetches the profile of openid in the background
+func (s *EventService) queueProfile(ctx context.Context, openid string) {
+	if s.followers == nil {
+		return
+	}
+	if s.processor != nil {
+		if err := s.processor.SubmitFunc(ctx, s.taskType, openid, s.executeProfile); err != nil {
+			logger.FromContext(ctx).Warn("Failed to queue subscriber profile", "error", err)
+		}
+		return
+	}
+	bg := logger.NewContext(context.Background(), logger.FromContext(ctx))
+	go func() {
+		if err := s.executeProfile(bg, openid); err != nil {
+			logger.FromContext(bg).Warn("Failed to fetch subscriber profile", "error", err)
+		}
+	}()
+}
+
+// executeProfile fetches the profile of the subscriber whose openid is
+// payload and stores it, keeping the subscription status and time
+// recorded from events
+func (s *EventService) executeProfile(ctx context.Context, payload interface{}) error {
+	openid, ok := payload.(string)
+	if !ok || openid == "" {
+		return fmt.Errorf("invalid subscriber profile payload: %v", payload)
+	}
+
+	user, err := s.fetchFollower(ctx, openid)
+	if err != nil {
+		return fmt.Errorf("failed to fetch subscriber profile: %w", err)
+	}
+	if existing, _ := s.userRepo.GetByOpenID(ctx, openid); existing != nil {
+		user.Subscribe = existing.Subscribe
+		if user.SubscribeTime.IsZero() || user.SubscribeTime.Unix() == 0 {
+			user.SubscribeTime = existing.SubscribeTime
+		}
+	}
+	if err := s.userRepo.Save(ctx, user); err != nil {
+		return fmt.Errorf("failed to save subscriber profile: %w", err)
+	}
+	return nil
+}
+
+// fetchFollower returns the WeChat profile of openid
+func (s *EventService) fetchFollower(ctx context.Context, openid string) (*repository.User, error) {
+	if s.followers == nil {
+		return nil, fmt.Errorf("no follower client")
+	}
+	if s.limiter != nil {
+		if ok, err := s.limiter.AllowContext(ctx, "user_info"); !ok {
+			return nil, fmt.Errorf("user_info: %w", err)
+		}
+	}
+	user, err := s.followers.GetFollower(ctx, openid)
+	if err != nil {
+		return nil, err
+	}
+	user.OpenID = openid
+	return user, nil
+}
+
+// claimMenuEvent marks a menu event as counted. It returns false for a
+// retry of an event already claimed; WeChat retries events carry the same
+// sender, CreateTime and event type. Without a dedup store, or when the
+// claim fails with an error, the event is counted.
+func (s *EventService) claimMenuEvent(ctx context.Context, msg *message.MixMessage) bool {
+	if s.dedup == nil {
+		return true
+	}
+	claimed, err := s.dedup.SetNX(ctx, menuEventKey(msg), "1", MessageDedupTTL)
+	if err != nil {
+		logger.FromContext(ctx).Warn("Failed to claim menu event", "error", err)
+		return true
+	}
+	return claimed
+}
+
+// menuEventKey is the dedup key of a menu event
+func menuEventKey(msg *message.MixMessage) string {
+	return "event:" + string(msg.FromUserName) + ":" +
+		strconv.FormatInt(msg.CreateTime, 10) + ":" + string(msg.Event)
+}
+
+// countMenuMatch increments the match count of the conditional menu rule
+// whose menu the event came from
+func (s *EventService) countMenuMatch(ctx context.Context, msg *message.MixMessage) {
+	if s.menuRules == nil || msg.MenuID == "" {
+		return
+	}
+	menuID, err := strconv.ParseInt(msg.MenuID, 10, 64)
+	if err != nil || menuID == 0 {
+		return
+	}
+	if err := s.menuRules.IncrementMatchCount(ctx, menuID); err != nil {
+		logger.FromContext(ctx).Error("Failed to count menu match", "menu_id", menuID, "error", err)
+	}
+}
+
+// notifyMenuEvent passes a menu event to the observers
+func (s *EventService) notifyMenuEvent(ctx context.Context, msg *message.MixMessage) {
+	for _, observe := range s.observers {
+		observe(ctx, string(msg.FromUserName), string(msg.Event))
+	}
 }
 
 // showHelp returns help information
@@ -0,0 +1,816 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"wechat-service/internal/repository"
+	"wechat-service/pkg/async"
+	"wechat-service/pkg/logger"
+	"wechat-service/pkg/ratelimit"
+	"wechat-service/pkg/tracing"
+
+	"github.com/silenceper/wechat/v2/officialaccount"
+)
+
+// ExperimentRulePriority is the priority of the menu rules deploying
+// experiment variants, above hand-written rules
+const ExperimentRulePriority = 1000
+
+// SignificanceLevel is the p-value below which a variant is reported as
+// significantly different from the control
+const SignificanceLevel = 0.05
+
+// maxBatchTag is the most openids WeChat tags in one call
+const maxBatchTag = 50
+
+// maxTagNameRunes is the longest tag name WeChat accepts
+const maxTagNameRunes = 30
+
+// assignChunk is the most followers one assignment task tags, keeping each
+// task well within the async processor's task timeout
+const assignChunk = 500
+
+// experimentAssignTask prefixes the async task type assigning the
+// followers of an account
+const experimentAssignTask = "experiment_assign:"
+
+// Follower assignment statuses
+const (
+	AssignmentQueued    = "queued"
+	AssignmentRunning   = "running"
+	AssignmentDone      = "done"
+	AssignmentFailed    = "failed"
+	AssignmentCancelled = "cancelled" // the experiment stopped first
+)
+
+// ErrExperimentStatus is returned when an experiment is not in the status
+// an operation requires
+var ErrExperimentStatus = errors.New("invalid experiment status")
+
+// ErrAssignmentRunning is returned when followers of an experiment are
+// already being assigned
+var ErrAssignmentRunning = fmt.Errorf("%w: followers are already being assigned", ErrExperimentStatus)
+
+// errAssignmentCancelled stops the assignment of a stopped experiment
+var errAssignmentCancelled = errors.New("experiment no longer running")
+
+// TagClient manages the follower tags of one account
+type TagClient interface {
+	CreateTag(ctx context.Context, name string) (int, error)
+	BatchTag(ctx context.Context, openids []string, tagID int) error
+	DeleteTag(ctx context.Context, tagID int) error
+}
+
+// WeChatTagClient is the TagClient backed by the WeChat API
+type WeChatTagClient struct {
+	oa *officialaccount.OfficialAccount
+}
+
+// NewWeChatTagClient creates a tag client for oa
+func NewWeChatTagClient(oa *officialaccount.OfficialAccount) *WeChatTagClient {
+	return &WeChatTagClient{oa: oa}
+}
+
+// CreateTag creates a tag and returns its ID
+func (c *WeChatTagClient) CreateTag(ctx context.Context, name string) (int, error) {
+	info, err := c.oa.GetUser().CreateTag(name)
+	if err != nil {
+		return 0, err
+	}
+	return int(info.ID), nil
+}
+
+// BatchTag adds tagID to at most 50 followers
+func (c *WeChatTagClient) BatchTag(ctx context.Context, openids []string, tagID int) error {
+	return c.oa.GetUser().BatchTag(openids, int32(tagID))
+}
+
+// DeleteTag deletes a tag, untagging its followers
+func (c *WeChatTagClient) DeleteTag(ctx context.Context, tagID int) error {
+	return c.oa.GetUser().DeleteTag(int32(tagID))
+}
+
+// VariantReport is the outcome of one variant. Rates and significance
+// are computed on engaged followers, those with at least one click or view.
+type VariantReport struct {
+	repository.VariantStats
+	EngagementRate float64 `json:"engagement_rate"`
+	Lift           float64 `json:"lift"`    // relative to the control
+	ZScore         float64 `json:"z_score"` // two-proportion z-test against the control
+	PValue         float64 `json:"p_value"`
+	Significant    bool    `json:"significant"`
+}
+
+// ExperimentReport is the outcome of an experiment
+type ExperimentReport struct {
+	Experiment *repository.Experiment `json:"experiment"`
+	Variants   []VariantReport        `json:"variants"` // the control first
+	Summary    string                 `json:"summary"`
+}
+
+// AssignmentProgress reports the follower assignment of an experiment
+type AssignmentProgress struct {
+	ExperimentID int64      `json:"experiment_id"`
+	Status       string     `json:"status"`
+	Pages        int        `json:"pages"`    // follower pages listed
+	Assigned     int        `json:"assigned"` // followers tagged so far
+	Error        string     `json:"error,omitempty"`
+	StartedAt    time.Time  `json:"started_at"`
+	FinishedAt   *time.Time `json:"finished_at,omitempty"`
+}
+
+// assignJob is the payload of an assignment task: the followers left on
+// the current page and the cursor of the next page
+type assignJob struct {
+	ExperimentID int64    `json:"experiment_id"`
+	OpenIDs      []string `json:"openids,omitempty"`
+	Next         string   `json:"next,omitempty"`
+	Listed       bool     `json:"listed"` // false until the first page is listed
+}
+
+// ExperimentService runs menu A/B tests: it splits followers between
+// variants with tags, deploys each variant as a conditional menu and
+// reports the menu events of each variant
+type ExperimentService struct {
+	tags      TagClient
+	followers FollowerClient
+	menus     *ConditionalMenuService
+	store     repository.ExperimentStore
+	users     *repository.UserRepository
+	limiter   *ratelimit.Limiter
+	processor *async.Processor
+	taskType  string
+	log       *logger.Logger
+
+	progressMu sync.Mutex
+	progress   map[int64]*AssignmentProgress
+}
+
+// NewExperimentService creates a new experiment service. limiter may be
+// nil.
+func NewExperimentService(
+	tags TagClient,
+	followers FollowerClient,
+	menus *ConditionalMenuService,
+	store repository.ExperimentStore,
+	users *repository.UserRepository,
+	limiter *ratelimit.Limiter,
+	log *logger.Logger,
+) *ExperimentService {
+	return &ExperimentService{
+		tags:      tags,
+		followers: followers,
+		menus:     menus,
+		store:     store,
+		users:     users,
+		limiter:   limiter,
+		log:       log,
+		progress:  make(map[int64]*AssignmentProgress),
+	}
+}
+
+// SetProcessor runs follower assignments as tasks of p, one chunk of
+// followers per task, and registers the task handler of account appID so
+// that assignments interrupted by a shutdown resume after Restore.
+// Without a processor, assignments run in a goroutine.
+func (s *ExperimentService) SetProcessor(p *async.Processor, appID string) {
+	s.processor = p
+	s.taskType = experimentAssignTask + appID
+	p.Handle(s.taskType, s.executeAssign)
+}
+
+// Experiments returns all experiments, newest first
+func (s *ExperimentService) Experiments(ctx context.Context) ([]*repository.Experiment, error) {
+	return s.store.List(ctx)
+}
+
+// Create validates and stores a new draft experiment
+func (s *ExperimentService) Create(ctx context.Context, e *repository.Experiment) error {
+	if err := ValidateExperiment(e); err != nil {
+		return err
+	}
+
+	e.ID = 0
+	e.Status = repository.ExperimentDraft
+	e.StartedAt, e.StoppedAt = nil, nil
+	for _, v := range e.Variants {
+		v.TagID, v.RuleID = 0, 0
+	}
+	return s.store.Save(ctx, e)
+}
+
+// Start creates a tag per variant, deploys the variant menus and queues
+// the assignment of the current followers, reported by Progress
+func (s *ExperimentService) Start(ctx context.Context, id int64) (*repository.Experiment, error) {
+	ctx, span := tracing.Start(ctx, "ExperimentService.Start")
+	defer span.End()
+
+	e, err := s.store.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if e.Status != repository.ExperimentDraft {
+		return nil, fmt.Errorf("%w: cannot start a %s experiment", ErrExperimentStatus, e.Status)
+	}
+
+	for _, v := range e.Variants {
+		if v.TagID != 0 {
+			continue
+		}
+		if err := s.allow(ctx, "tag_create"); err != nil {
+			return nil, err
+		}
+		if v.TagID, err = s.tags.CreateTag(ctx, experimentTagName(e, v)); err != nil {
+			return nil, fmt.Errorf("failed to create tag for variant %s: %w", v.Name, err)
+		}
+		// Keep tags and rules if a later step fails, so a retry reuses them
+		if err := s.store.Save(ctx, e); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, v := range e.Variants {
+		if v.RuleID != 0 {
+			continue
+		}
+		rule := &repository.MenuRule{
+			Name:     experimentTagName(e, v),
+			TagID:    v.TagID,
+			Menu:     v.Menu,
+			Enabled:  true,
+			Priority: ExperimentRulePriority,
+		}
+		if err := s.menus.SaveRule(ctx, rule); err != nil {
+			return nil, fmt.Errorf("failed to deploy variant %s: %w", v.Name, err)
+		}
+		v.RuleID = rule.ID
+		if err := s.store.Save(ctx, e); err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	e.Status = repository.ExperimentRunning
+	e.StartedAt = &now
+	if err := s.store.Save(ctx, e); err != nil {
+		return nil, err
+	}
+
+	log := logger.FromContextOr(ctx, s.log)
+	log.Info("Experiment started", "experiment_id", e.ID, "variants", len(e.Variants))
+
+	// The experiment runs even if the assignment cannot be queued; its
+	// progress reports the failure and AssignFollowers retries it
+	if _, err := s.startAssignment(ctx, e.ID); err != nil {
+		log.Warn("Failed to queue experiment follower assignment", "experiment_id", e.ID, "error", err)
+	}
+	return e, nil
+}
+
+// AssignFollowers queues the assignment of followers who have no variant
+// yet, such as those who subscribed since the experiment started
+func (s *ExperimentService) AssignFollowers(ctx context.Context, id int64) (*AssignmentProgress, error) {
+	ctx, span := tracing.Start(ctx, "ExperimentService.AssignFollowers")
+	defer span.End()
+
+	e, err := s.store.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if e.Status != repository.ExperimentRunning {
+		return nil, fmt.Errorf("%w: cannot assign followers to a %s experiment", ErrExperimentStatus, e.Status)
+	}
+	return s.startAssignment(ctx, e.ID)
+}
+
+// Progress returns the latest follower assignment of an experiment since
+// the service started
+func (s *ExperimentService) Progress(id int64) (*AssignmentProgress, bool) {
+	s.progressMu.Lock()
+	defer s.progressMu.Unlock()
+
+	p, ok := s.progress[id]
+	if !ok {
+		return nil, false
+	}
+	copied := *p
+	return &copied, true
+}
+
+// Stop deletes the variant menus, then the variant tags, since WeChat
+// allows an account only 100 tags. Assignments and event counts stay in
+// the store for the report. Stop retries the tags left behind by a failed
+// deletion when called again on the stopped experiment.
+func (s *ExperimentService) Stop(ctx context.Context, id int64) (*repository.Experiment, error) {
+	ctx, span := tracing.Start(ctx, "ExperimentService.Stop")
+	defer span.End()
+
+	e, err := s.store.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case e.Status == repository.ExperimentRunning:
+	case e.Status == repository.ExperimentStopped && hasVariantTags(e):
+		return s.deleteTags(ctx, e)
+	default:
+		return nil, fmt.Errorf("%w: cannot stop a %s experiment", ErrExperimentStatus, e.Status)
+	}
+
+	for _, v := range e.Variants {
+		if v.RuleID == 0 {
+			continue
+		}
+		if err := s.menus.DeleteRule(ctx, v.RuleID); err != nil && !errors.Is(err, repository.ErrMenuRuleNotFound) {
+			return nil, fmt.Errorf("failed to remove variant %s: %w", v.Name, err)
+		}
+		v.RuleID = 0
+	}
+
+	now := time.Now()
+	e.Status = repository.ExperimentStopped
+	e.StoppedAt = &now
+	if err := s.store.Save(ctx, e); err != nil {
+		return nil, err
+	}
+
+	logger.FromContextOr(ctx, s.log).Info("Experiment stopped", "experiment_id", e.ID)
+	return s.deleteTags(ctx, e)
+}
+
+// deleteTags deletes the tags of a stopped experiment's variants
+func (s *ExperimentService) deleteTags(ctx context.Context, e *repository.Experiment) (*repository.Experiment, error) {
+	for _, v := range e.Variants {
+		if v.TagID == 0 {
+			continue
+		}
+		if err := s.allow(ctx, "tag_delete"); err != nil {
+			return nil, err
+		}
+		if err := s.tags.DeleteTag(ctx, v.TagID); err != nil {
+			return nil, fmt.Errorf("experiment stopped, but failed to delete the tag of variant %s: %w", v.Name, err)
+		}
+		v.TagID = 0
+		if err := s.store.Save(ctx, e); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// RecordMenuEvent counts a menu event of openid in every running
+// experiment the follower is assigned to. It is a MenuEventObserver.
+func (s *ExperimentService) RecordMenuEvent(ctx context.Context, openid, event string) {
+	experiments, err := s.store.List(ctx)
+	if err != nil {
+		logger.FromContextOr(ctx, s.log).Error("Failed to list experiments", "error", err)
+		return
+	}
+
+	for _, e := range experiments {
+		if e.Status != repository.ExperimentRunning {
+			continue
+		}
+		variant, err := s.store.Assignment(ctx, e.ID, openid)
+		if err != nil || variant == "" {
+			continue
+		}
+		if err := s.store.RecordEvent(ctx, e.ID, variant, openid, event); err != nil {
+			logger.FromContextOr(ctx, s.log).Error("Failed to record experiment event",
+				"experiment_id", e.ID, "error", err)
+		}
+	}
+}
+
+// Report returns the per-variant counts of an experiment and compares the
+// engagement of every variant with the control
+func (s *ExperimentService) Report(ctx context.Context, id int64) (*ExperimentReport, error) {
+	e, err := s.store.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	stats, err := s.store.Stats(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	byVariant := make(map[string]repository.VariantStats, len(stats))
+	for _, vs := range stats {
+		byVariant[vs.Variant] = vs
+	}
+
+	report := &ExperimentReport{Experiment: e}
+	for _, v := range e.Variants {
+		vs := byVariant[v.Name]
+		vs.Variant = v.Name
+		report.Variants = append(report.Variants, VariantReport{
+			VariantStats:   vs,
+			EngagementRate: rate(vs.Engaged, vs.Assigned),
+		})
+	}
+
+	// The control is not compared with itself
+	report.Variants[0].PValue = 1
+	control := report.Variants[0]
+	for i := 1; i < len(report.Variants); i++ {
+		vr := &report.Variants[i]
+		if control.EngagementRate > 0 {
+			vr.Lift = vr.EngagementRate/control.EngagementRate - 1
+		}
+		vr.ZScore, vr.PValue = twoProportionZTest(control.Engaged, control.Assigned, vr.Engaged, vr.Assigned)
+		vr.Significant = vr.PValue < SignificanceLevel
+	}
+
+	report.Summary = summarize(report.Variants)
+	return report, nil
+}
+
+// startAssignment queues the assignment of the followers of experiment id
+func (s *ExperimentService) startAssignment(ctx context.Context, id int64) (*AssignmentProgress, error) {
+	s.progressMu.Lock()
+	if p, ok := s.progress[id]; ok && (p.Status == AssignmentQueued || p.Status == AssignmentRunning) {
+		s.progressMu.Unlock()
+		return nil, ErrAssignmentRunning
+	}
+	s.progress[id] = &AssignmentProgress{ExperimentID: id, Status: AssignmentQueued, StartedAt: time.Now()}
+	s.progressMu.Unlock()
+
+	job := &assignJob{ExperimentID: id}
+	if s.processor != nil {
+		if err := s.processor.SubmitFunc(ctx, s.taskType, job, s.executeAssign); err != nil {
+			s.finishAssignment(ctx, id, err)
+			return nil, err
+		}
+	} else {
+		bg := logger.NewContext(context.Background(), logger.FromContextOr(ctx, s.log))
+		go func() {
+			for job != nil {
+				var err error
+				if job, err = s.assignStep(bg, job); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	p, _ := s.Progress(id)
+	return p, nil
+}
+
+// executeAssign runs one assignment task and queues the next chunk. A
+// failed task is retried by the processor; followers it already assigned
+// are skipped.
+func (s *ExperimentService) executeAssign(ctx context.Context, payload interface{}) error {
+	job, err := decodeAssignJob(payload)
+	if err != nil {
+		return err
+	}
+
+	next, err := s.assignStep(ctx, job)
+	if errors.Is(err, errAssignmentCancelled) || errors.Is(err, repository.ErrExperimentNotFound) {
+		return nil
+	}
+	if err != nil || next == nil {
+		return err
+	}
+	if err := s.processor.SubmitFunc(ctx, s.taskType, next, s.executeAssign); err != nil {
+		s.finishAssignment(ctx, job.ExperimentID, err)
+		return err
+	}
+	return nil
+}
+
+// assignStep tags the next chunk of followers of job, listing the next
+// page from WeChat when the current one is done, so that followers never
+// seen by a callback are included too. It returns the job left, nil when
+// the assignment is finished.
+func (s *ExperimentService) assignStep(ctx context.Context, job *assignJob) (*assignJob, error) {
+	id := job.ExperimentID
+	s.updateProgress(id, func(p *AssignmentProgress) { p.Status = AssignmentRunning })
+
+	e, err := s.store.Get(ctx, id)
+	if err == nil && e.Status != repository.ExperimentRunning {
+		err = errAssignmentCancelled
+	}
+	if err != nil {
+		s.finishAssignment(ctx, id, err)
+		return nil, err
+	}
+
+	next := *job
+	if len(next.OpenIDs) == 0 {
+		if next.Listed && next.Next == "" {
+			s.finishAssignment(ctx, id, nil)
+			return nil, nil
+		}
+		if err := s.allow(ctx, "user_list"); err != nil {
+			s.finishAssignment(ctx, id, err)
+			return nil, err
+		}
+		openids, following, err := s.followers.ListFollowers(ctx, next.Next)
+		if err != nil {
+			err = fmt.Errorf("failed to list followers: %w", err)
+			s.finishAssignment(ctx, id, err)
+			return nil, err
+		}
+		s.updateProgress(id, func(p *AssignmentProgress) { p.Pages++ })
+		if len(openids) == 0 {
+			s.finishAssignment(ctx, id, nil)
+			return nil, nil
+		}
+		next.OpenIDs, next.Next, next.Listed = openids, following, true
+	}
+
+	chunk := next.OpenIDs[:min(assignChunk, len(next.OpenIDs))]
+	n, err := s.assignPage(ctx, e, chunk)
+	s.updateProgress(id, func(p *AssignmentProgress) { p.Assigned += n })
+	if err != nil {
+		s.finishAssignment(ctx, id, err)
+		return nil, err
+	}
+
+	next.OpenIDs = next.OpenIDs[len(chunk):]
+	if len(next.OpenIDs) == 0 && next.Next == "" {
+		s.finishAssignment(ctx, id, nil)
+		return nil, nil
+	}
+	return &next, nil
+}
+
+// updateProgress applies update to the progress of experiment id,
+// tracking assignments restored from a previous run too
+func (s *ExperimentService) updateProgress(id int64, update func(p *AssignmentProgress)) {
+	s.progressMu.Lock()
+	defer s.progressMu.Unlock()
+
+	p, ok := s.progress[id]
+	if !ok {
+		p = &AssignmentProgress{ExperimentID: id, Status: AssignmentRunning, StartedAt: time.Now()}
+		s.progress[id] = p
+	}
+	update(p)
+}
+
+// finishAssignment records the outcome of the assignment of experiment id
+func (s *ExperimentService) finishAssignment(ctx context.Context, id int64, err error) {
+	now := time.Now()
+	var progress AssignmentProgress
+	s.updateProgress(id, func(p *AssignmentProgress) {
+		switch {
+		case err == nil:
+			p.Status = AssignmentDone
+		case errors.Is(err, errAssignmentCancelled):
+			p.Status = AssignmentCancelled
+		default:
+			p.Status = AssignmentFailed
+			p.Error = err.Error()
+		}
+		p.FinishedAt = &now
+		progress = *p
+	})
+
+	log := logger.FromContextOr(ctx, s.log)
+	if progress.Status == AssignmentFailed {
+		log.Error("Experiment follower assignment failed", "experiment_id", id,
+			"assigned", progress.Assigned, "error", err)
+		return
+	}
+	log.Info("Experiment followers assigned", "experiment_id", id,
+		"status", progress.Status, "pages", progress.Pages, "assigned", progress.Assigned)
+}
+
+// decodeAssignJob returns the job of an assignment task, whose payload is
+// decoded JSON when the task was restored after a restart
+func decodeAssignJob(payload interface{}) (*assignJob, error) {
+	if job, ok := payload.(*assignJob); ok {
+		return job, nil
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid assignment payload: %w", err)
+	}
+	var job assignJob
+	if err := json.Unmarshal(data, &job); err != nil || job.ExperimentID == 0 {
+		return nil, fmt.Errorf("invalid assignment payload: %s", data)
+	}
+	return &job, nil
+}
+
+// assignPage tags the followers in openids that have no variant yet
+func (s *ExperimentService) assignPage(ctx context.Context, e *repository.Experiment, openids []string) (int, error) {
+	pending := make(map[*repository.ExperimentVariant][]string)
+	for _, openid := range openids {
+		if variant, err := s.store.Assignment(ctx, e.ID, openid); err != nil {
+			return 0, err
+		} else if variant != "" {
+			continue
+		}
+		v := bucket(e, openid)
+		pending[v] = append(pending[v], openid)
+	}
+
+	assigned := 0
+	for _, v := range e.Variants {
+		openids := pending[v]
+		for start := 0; start < len(openids); start += maxBatchTag {
+			batch := openids[start:min(start+maxBatchTag, len(openids))]
+
+			if err := s.allow(ctx, "tag_move_user"); err != nil {
+				return assigned, err
+			}
+			if err := s.tags.BatchTag(ctx, batch, v.TagID); err != nil {
+				return assigned, fmt.Errorf("failed to tag followers of variant %s: %w", v.Name, err)
+			}
+
+			for _, openid := range batch {
+				if err := s.store.Assign(ctx, e.ID, openid, v.Name); err != nil {
+					return assigned, err
+				}
+				if err := s.addStoredTag(ctx, openid, v.TagID); err != nil {
+					return assigned, err
+				}
+				assigned++
+			}
+		}
+	}
+	return assigned, nil
+}
+
+// addStoredTag adds tagID to the stored profile of openid, so that
+// TryMatch sees it. The stored user is shared, so a copy is modified.
+func (s *ExperimentService) addStoredTag(ctx context.Context, openid string, tagID int) error {
+	stored, err := s.users.GetByOpenID(ctx, openid)
+	if err != nil {
+		return err
+	}
+
+	var u repository.User
+	if stored != nil {
+		u = *stored
+	} else {
+		u = repository.User{OpenID: openid, Subscribe: 1}
+	}
+	if hasTag(u.TagIDList, tagID) {
+		return nil
+	}
+	u.TagIDList = append(append([]int(nil), u.TagIDList...), tagID)
+	return s.users.Save(ctx, &u)
+}
+
+// allow consumes one call of apiName from the daily quota
+func (s *ExperimentService) allow(ctx context.Context, apiName string) error {
+	if s.limiter == nil {
+		return nil
+	}
+	if ok, err := s.limiter.AllowContext(ctx, apiName); !ok {
+		return fmt.Errorf("%s: %w", apiName, err)
+	}
+	return nil
+}
+
+// bucket picks the variant of openid by weight. The choice depends only
+// on the experiment and openid, so it is stable across runs.
+func bucket(e *repository.Experiment, openid string) *repository.ExperimentVariant {
+	total := 0
+	for _, v := range e.Variants {
+		total += v.Weight
+	}
+
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%d:%s", e.ID, openid)
+	n := int(h.Sum32() % uint32(total))
+
+	for _, v := range e.Variants {
+		if n < v.Weight {
+			return v
+		}
+		n -= v.Weight
+	}
+	return e.Variants[len(e.Variants)-1]
+}
+
+// hasVariantTags reports whether a variant of e still has a tag
+func hasVariantTags(e *repository.Experiment) bool {
+	for _, v := range e.Variants {
+		if v.TagID != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// experimentTagName names the tag and menu rule of a variant
+func experimentTagName(e *repository.Experiment, v *repository.ExperimentVariant) string {
+	name := []rune(fmt.Sprintf("ab%d_%s", e.ID, v.Name))
+	if len(name) > maxTagNameRunes {
+		name = name[:maxTagNameRunes]
+	}
+	return string(name)
+}
+
+// rate returns n/total, or 0 when total is 0
+func rate(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total)
+}
+
+// twoProportionZTest compares the proportions x1/n1 and x2/n2 and returns
+// the z score and two-sided p-value. The p-value is 1 when either sample
+// is empty or both proportions are 0 or 1.
+func twoProportionZTest(x1, n1, x2, n2 int) (float64, float64) {
+	if n1 == 0 || n2 == 0 {
+		return 0, 1
+	}
+	p1, p2 := rate(x1, n1), rate(x2, n2)
+	pooled := float64(x1+x2) / float64(n1+n2)
+	se := math.Sqrt(pooled * (1 - pooled) * (1/float64(n1) + 1/float64(n2)))
+	if se == 0 {
+		return 0, 1
+	}
+	z := (p2 - p1) / se
+	return z, math.Erfc(math.Abs(z) / math.Sqrt2)
+}
+
+// summarize describes the variants that differ significantly from the
+// control
+func summarize(variants []VariantReport) string {
+	control := variants[0]
+	var lines []string
+	for _, vr := range variants[1:] {
+		if !vr.Significant {
+			continue
+		}
+		p := fmt.Sprintf("p=%.3f", vr.PValue)
+		if vr.PValue < 0.001 {
+			p = "p<0.001"
+		}
+		lines = append(lines, fmt.Sprintf("%s engages %.1f%% of followers vs %.1f%% for %s (%+.1f%%, %s)",
+			vr.Variant, vr.EngagementRate*100, control.EngagementRate*100, control.Variant, vr.Lift*100, p))
+	}
+	if len(lines) == 0 {
+		return fmt.Sprintf("No variant differs significantly from control %s at p<%.2f", control.Variant, SignificanceLevel)
+	}
+	return strings.Join(lines, "; ")
+}
+
+// ValidateExperiment checks an experiment and its variant menus, reporting
+// all problems at once as MenuErrors
+func ValidateExperiment(e *repository.Experiment) error {
+	var errs MenuErrors
+	addf := func(path, format string, args ...interface{}) {
+		errs = append(errs, MenuError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if strings.TrimSpace(e.Name) == "" {
+		addf("name", "is required")
+	}
+	if len(e.Variants) < 2 {
+		addf("variants", "at least 2 variants are required, got %d", len(e.Variants))
+	}
+
+	seen := make(map[string]bool)
+	total := 0
+	for i, v := range e.Variants {
+		path := fmt.Sprintf("variants[%d]", i)
+		if v == nil {
+			addf(path, "is empty")
+			continue
+		}
+		if strings.TrimSpace(v.Name) == "" {
+			addf(path+".name", "is required")
+		} else if seen[v.Name] {
+			addf(path+".name", "duplicate variant %q", v.Name)
+		}
+		seen[v.Name] = true
+
+		if v.Weight < 0 {
+			addf(path+".weight", "must not be negative, got %d", v.Weight)
+		}
+		total += v.Weight
+
+		var menuErrs MenuErrors
+		if err := ValidateMenu(v.Menu); errors.As(err, &menuErrs) {
+			for _, me := range menuErrs {
+				addf(path+".menu."+me.Path, "%s", me.Message)
+			}
+		}
+	}
+	if len(e.Variants) >= 2 && total <= 0 {
+		addf("variants", "at least one variant needs a positive weight")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,612 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"wechat-service/internal/config"
+	"wechat-service/internal/model"
+	"wechat-service/internal/repository"
+	"wechat-service/pkg/async"
+)
+
+// fakeTagClient records the tags created and deleted and the followers
+// tagged
+type fakeTagClient struct {
+	mu        sync.Mutex
+	nextID    int
+	names     map[int]string
+	tagged    map[int][]string
+	batches   []int // size of every BatchTag call
+	deleteErr error // returned by DeleteTag when set
+}
+
+func newFakeTagClient() *fakeTagClient {
+	return &fakeTagClient{nextID: 100, names: make(map[int]string), tagged: make(map[int][]string)}
+}
+
+func (c *fakeTagClient) CreateTag(ctx context.Context, name string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextID++
+	c.names[c.nextID] = name
+	return c.nextID, nil
+}
+
+func (c *fakeTagClient) BatchTag(ctx context.Context, openids []string, tagID int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(openids) > maxBatchTag {
+		return fmt.Errorf("batch of %d openids", len(openids))
+	}
+	c.batches = append(c.batches, len(openids))
+	c.tagged[tagID] = append(c.tagged[tagID], openids...)
+	return nil
+}
+
+func (c *fakeTagClient) DeleteTag(ctx context.Context, tagID int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.deleteErr != nil {
+		return c.deleteErr
+	}
+	if _, ok := c.names[tagID]; !ok {
+		return fmt.Errorf("tag %d not found", tagID)
+	}
+	delete(c.names, tagID)
+	delete(c.tagged, tagID)
+	return nil
+}
+
+// testExperiment returns a valid two-variant experiment
+func testExperiment(controlWeight, treatmentWeight int) *repository.Experiment {
+	return &repository.Experiment{
+		Name: "menu test",
+		Variants: []*repository.ExperimentVariant{
+			{Name: "control", Weight: controlWeight, Menu: testMenu("control")},
+			{Name: "treatment", Weight: treatmentWeight, Menu: testMenu("treatment")},
+		},
+	}
+}
+
+// testOpenIDs returns n distinct openids
+func testOpenIDs(n int) []string {
+	openids := make([]string, n)
+	for i := range openids {
+		openids[i] = fmt.Sprintf("o%03d", i)
+	}
+	return openids
+}
+
+// newTestExperimentService returns a service over fake clients and memory
+// stores
+func newTestExperimentService(followers *fakeFollowerClient) (*ExperimentService, *fakeTagClient, *repository.UserRepository) {
+	menus, _, users := newTestConditionalService()
+	tags := newFakeTagClient()
+	svc := NewExperimentService(tags, followers, menus, repository.NewMemoryExperimentStore("wx1"), users, nil, testLogger())
+	return svc, tags, users
+}
+
+// waitAssignment waits for the follower assignment of experiment id to
+// finish and returns its progress
+func waitAssignment(t *testing.T, svc *ExperimentService, id int64) *AssignmentProgress {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if p, ok := svc.Progress(id); ok && p.FinishedAt != nil {
+			return p
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("assignment of experiment %d did not finish", id)
+	return nil
+}
+
+// newTestProcessor returns an async processor with workers workers
+func newTestProcessor(t *testing.T, workers int) *async.Processor {
+	t.Helper()
+	cfg := &config.Config{}
+	cfg.Async.Workers = workers
+	cfg.Async.QueueSize = 10
+	cfg.Async.ShutdownTimeout = 1
+	p := async.NewProcessor(cfg, testLogger(), nil)
+	t.Cleanup(p.Stop)
+	return p
+}
+
+func TestValidateExperiment(t *testing.T) {
+	tests := []struct {
+		name      string
+		mutate    func(e *repository.Experiment)
+		wantPaths []string
+	}{
+		{name: "valid", mutate: func(e *repository.Experiment) {}},
+		{name: "missing name", mutate: func(e *repository.Experiment) { e.Name = " " }, wantPaths: []string{"name"}},
+		{name: "single variant", mutate: func(e *repository.Experiment) { e.Variants = e.Variants[:1] }, wantPaths: []string{"variants"}},
+		{name: "duplicate variant", mutate: func(e *repository.Experiment) { e.Variants[1].Name = "control" }, wantPaths: []string{"variants[1].name"}},
+		{name: "negative weight", mutate: func(e *repository.Experiment) { e.Variants[1].Weight = -1 }, wantPaths: []string{"variants[1].weight"}},
+		{
+			name: "no positive weight",
+			mutate: func(e *repository.Experiment) {
+				e.Variants[0].Weight, e.Variants[1].Weight = 0, 0
+			},
+			wantPaths: []string{"variants"},
+		},
+		{name: "nil variant", mutate: func(e *repository.Experiment) { e.Variants[1] = nil }, wantPaths: []string{"variants[1]"}},
+		{
+			name:      "invalid menu",
+			mutate:    func(e *repository.Experiment) { e.Variants[0].Menu = &model.Menu{} },
+			wantPaths: []string{"variants[0].menu."},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := testExperiment(1, 1)
+			tt.mutate(e)
+
+			err := ValidateExperiment(e)
+			if len(tt.wantPaths) == 0 {
+				if err != nil {
+					t.Fatalf("ValidateExperiment: %v", err)
+				}
+				return
+			}
+			var errs MenuErrors
+			if !errors.As(err, &errs) {
+				t.Fatalf("ValidateExperiment = %v, want MenuErrors", err)
+			}
+			for _, want := range tt.wantPaths {
+				found := false
+				for _, me := range errs {
+					if strings.HasPrefix(me.Path, want) {
+						found = true
+					}
+				}
+				if !found {
+					t.Errorf("no error at %q in %v", want, errs)
+				}
+			}
+		})
+	}
+}
+
+func TestBucket(t *testing.T) {
+	tests := []struct {
+		name          string
+		weights       []int
+		wantMinShares []float64 // lower bound of every variant's share
+		wantMaxShares []float64
+	}{
+		{name: "even split", weights: []int{1, 1}, wantMinShares: []float64{0.4, 0.4}, wantMaxShares: []float64{0.6, 0.6}},
+		{name: "uneven split", weights: []int{3, 1}, wantMinShares: []float64{0.65, 0.15}, wantMaxShares: []float64{0.85, 0.35}},
+		{name: "zero weight", weights: []int{0, 1}, wantMinShares: []float64{0, 1}, wantMaxShares: []float64{0, 1}},
+	}
+
+	openids := testOpenIDs(1000)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := testExperiment(tt.weights[0], tt.weights[1])
+			e.ID = 7
+
+			counts := make(map[string]int)
+			for _, openid := range openids {
+				v := bucket(e, openid)
+				if again := bucket(e, openid); again != v {
+					t.Fatalf("bucket(%s) not stable: %s then %s", openid, v.Name, again.Name)
+				}
+				counts[v.Name]++
+			}
+			for i, v := range e.Variants {
+				share := float64(counts[v.Name]) / float64(len(openids))
+				if share < tt.wantMinShares[i] || share > tt.wantMaxShares[i] {
+					t.Errorf("%s share = %.2f, want [%.2f, %.2f]", v.Name, share, tt.wantMinShares[i], tt.wantMaxShares[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTwoProportionZTest(t *testing.T) {
+	tests := []struct {
+		name           string
+		x1, n1, x2, n2 int
+		wantZ          float64
+		wantP          float64
+	}{
+		{name: "empty sample", x1: 0, n1: 0, x2: 5, n2: 10, wantZ: 0, wantP: 1},
+		{name: "no engagement", x1: 0, n1: 10, x2: 0, n2: 10, wantZ: 0, wantP: 1},
+		{name: "equal rates", x1: 50, n1: 100, x2: 50, n2: 100, wantZ: 0, wantP: 1},
+		{name: "higher treatment", x1: 50, n1: 100, x2: 65, n2: 100, wantZ: 2.1456, wantP: 0.0319},
+		{name: "lower treatment", x1: 65, n1: 100, x2: 50, n2: 100, wantZ: -2.1456, wantP: 0.0319},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			z, p := twoProportionZTest(tt.x1, tt.n1, tt.x2, tt.n2)
+			if math.Abs(z-tt.wantZ) > 1e-3 || math.Abs(p-tt.wantP) > 1e-3 {
+				t.Errorf("twoProportionZTest = %.4f, %.4f; want %.4f, %.4f", z, p, tt.wantZ, tt.wantP)
+			}
+		})
+	}
+}
+
+func TestExperimentTagName(t *testing.T) {
+	tests := []struct {
+		name    string
+		variant string
+		want    string
+	}{
+		{name: "short", variant: "control", want: "ab12_control"},
+		{name: "truncated", variant: strings.Repeat("x", 40), want: "ab12_" + strings.Repeat("x", 25)},
+		{name: "truncated by rune", variant: strings.Repeat("菜", 40), want: "ab12_" + strings.Repeat("菜", 25)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &repository.Experiment{ID: 12}
+			if got := experimentTagName(e, &repository.ExperimentVariant{Name: tt.variant}); got != tt.want {
+				t.Errorf("experimentTagName = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExperimentAssign(t *testing.T) {
+	tests := []struct {
+		name      string
+		followers int
+		pageSize  int
+		stored    int // followers with a stored profile
+		wantPages int
+	}{
+		{name: "no followers", followers: 0, pageSize: 10, wantPages: 1},
+		{name: "one page", followers: 8, pageSize: 10, stored: 3, wantPages: 1},
+		{name: "several pages", followers: 130, pageSize: 40, stored: 130, wantPages: 4},
+		{name: "full last page", followers: 80, pageSize: 40, wantPages: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			followers := &fakeFollowerClient{openids: testOpenIDs(tt.followers), pageSize: tt.pageSize}
+			svc, tags, users := newTestExperimentService(followers)
+
+			// Stored profiles are shared with the repository and must not
+			// be modified in place
+			stored := make(map[string]*repository.User)
+			for _, openid := range followers.openids[:tt.stored] {
+				u := &repository.User{OpenID: openid, Subscribe: 1, Sex: 2, TagIDList: []int{1}}
+				if err := users.Save(ctx, u); err != nil {
+					t.Fatal(err)
+				}
+				stored[openid], _ = users.GetByOpenID(ctx, openid)
+			}
+
+			e := testExperiment(1, 1)
+			if err := svc.Create(ctx, e); err != nil {
+				t.Fatal(err)
+			}
+			e, err := svc.Start(ctx, e.ID)
+			if err != nil {
+				t.Fatalf("Start: %v", err)
+			}
+			progress := waitAssignment(t, svc, e.ID)
+			if progress.Status != AssignmentDone || progress.Assigned != tt.followers {
+				t.Errorf("progress = %+v, want done with %d assigned", progress, tt.followers)
+			}
+
+			if followers.pages != tt.wantPages || progress.Pages != tt.wantPages {
+				t.Errorf("pages = %d, reported %d, want %d", followers.pages, progress.Pages, tt.wantPages)
+			}
+			tagged := 0
+			for _, n := range tags.batches {
+				tagged += n
+			}
+			if tagged != tt.followers {
+				t.Errorf("tagged %d followers, want %d", tagged, tt.followers)
+			}
+
+			for _, openid := range followers.openids {
+				variant, err := svc.store.Assignment(ctx, e.ID, openid)
+				if err != nil || variant == "" {
+					t.Fatalf("Assignment(%s) = %q, %v", openid, variant, err)
+				}
+				var tagID int
+				for _, v := range e.Variants {
+					if v.Name == variant {
+						tagID = v.TagID
+					}
+				}
+
+				u, _ := users.GetByOpenID(ctx, openid)
+				if u == nil || !hasTag(u.TagIDList, tagID) {
+					t.Errorf("stored profile of %s lacks tag %d: %+v", openid, tagID, u)
+				}
+				if old, ok := stored[openid]; ok {
+					if len(old.TagIDList) != 1 {
+						t.Errorf("stored profile of %s modified in place: %v", openid, old.TagIDList)
+					}
+					if u.Sex != 2 || !hasTag(u.TagIDList, 1) {
+						t.Errorf("stored profile of %s lost fields: %+v", openid, u)
+					}
+				}
+			}
+
+			// Assigned followers are not tagged again
+			batches := len(tags.batches)
+			if _, err := svc.AssignFollowers(ctx, e.ID); err != nil {
+				t.Fatalf("AssignFollowers: %v", err)
+			}
+			if p := waitAssignment(t, svc, e.ID); p.Status != AssignmentDone || p.Assigned != 0 {
+				t.Errorf("reassignment progress = %+v, want done with 0 assigned", p)
+			}
+			if len(tags.batches) != batches {
+				t.Errorf("AssignFollowers tagged %d more batches", len(tags.batches)-batches)
+			}
+		})
+	}
+}
+
+func TestExperimentLifecycle(t *testing.T) {
+	tests := []struct {
+		name    string
+		events  map[string]string // variant -> event of all its followers
+		wantSig bool
+	}{
+		{
+			name:    "treatment engages more",
+			events:  map[string]string{"treatment": model.EventClick},
+			wantSig: true,
+		},
+		{
+			name:   "same engagement",
+			events: map[string]string{"control": model.EventView, "treatment": model.EventClick},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			followers := &fakeFollowerClient{openids: testOpenIDs(200), pageSize: 100}
+			svc, _, _ := newTestExperimentService(followers)
+
+			e := testExperiment(1, 1)
+			if err := svc.Create(ctx, e); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := svc.Stop(ctx, e.ID); !errors.Is(err, ErrExperimentStatus) {
+				t.Errorf("Stop draft = %v, want ErrExperimentStatus", err)
+			}
+			started, err := svc.Start(ctx, e.ID)
+			if err != nil {
+				t.Fatalf("Start: %v", err)
+			}
+			waitAssignment(t, svc, e.ID)
+			for _, v := range started.Variants {
+				if v.TagID == 0 || v.RuleID == 0 {
+					t.Errorf("variant %s not deployed: tag %d, rule %d", v.Name, v.TagID, v.RuleID)
+				}
+			}
+
+			for _, openid := range followers.openids {
+				variant, _ := svc.store.Assignment(ctx, e.ID, openid)
+				if event, ok := tt.events[variant]; ok {
+					svc.RecordMenuEvent(ctx, openid, event)
+				}
+			}
+
+			report, err := svc.Report(ctx, e.ID)
+			if err != nil {
+				t.Fatalf("Report: %v", err)
+			}
+			if len(report.Variants) != 2 || report.Variants[0].Variant != "control" {
+				t.Fatalf("report variants = %+v", report.Variants)
+			}
+			assigned := report.Variants[0].Assigned + report.Variants[1].Assigned
+			if assigned != len(followers.openids) {
+				t.Errorf("assigned = %d, want %d", assigned, len(followers.openids))
+			}
+			if got := report.Variants[1].Significant; got != tt.wantSig {
+				t.Errorf("significant = %v, want %v (%s)", got, tt.wantSig, report.Summary)
+			}
+
+			stopped, err := svc.Stop(ctx, e.ID)
+			if err != nil {
+				t.Fatalf("Stop: %v", err)
+			}
+			if stopped.Status != repository.ExperimentStopped {
+				t.Errorf("status = %s, want stopped", stopped.Status)
+			}
+			for _, v := range stopped.Variants {
+				if v.RuleID != 0 {
+					t.Errorf("variant %s still deployed as rule %d", v.Name, v.RuleID)
+				}
+			}
+
+			// Events after the stop are not counted
+			svc.RecordMenuEvent(ctx, followers.openids[0], model.EventClick)
+			after, _ := svc.Report(ctx, e.ID)
+			if after.Variants[0].Clicks+after.Variants[1].Clicks != report.Variants[0].Clicks+report.Variants[1].Clicks {
+				t.Error("event recorded after the experiment stopped")
+			}
+		})
+	}
+}
+
+func TestExperimentStopDeletesTags(t *testing.T) {
+	tests := []struct {
+		name      string
+		deleteErr error
+	}{
+		{name: "deleted on stop"},
+		{name: "retried after a failed deletion", deleteErr: errors.New("system busy")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			followers := &fakeFollowerClient{openids: testOpenIDs(20), pageSize: 10}
+			svc, tags, _ := newTestExperimentService(followers)
+
+			e := testExperiment(1, 1)
+			if err := svc.Create(ctx, e); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := svc.Start(ctx, e.ID); err != nil {
+				t.Fatalf("Start: %v", err)
+			}
+			waitAssignment(t, svc, e.ID)
+			for _, openid := range followers.openids {
+				svc.RecordMenuEvent(ctx, openid, model.EventClick)
+			}
+			before, _ := svc.Report(ctx, e.ID)
+
+			tags.deleteErr = tt.deleteErr
+			stopped, err := svc.Stop(ctx, e.ID)
+			if tt.deleteErr != nil {
+				if err == nil {
+					t.Fatal("Stop succeeded with failing tag deletion")
+				}
+				stored, _ := svc.store.Get(ctx, e.ID)
+				if stored.Status != repository.ExperimentStopped || !hasVariantTags(stored) {
+					t.Fatalf("after failed deletion: status %s, tags kept %v", stored.Status, hasVariantTags(stored))
+				}
+
+				tags.deleteErr = nil
+				if stopped, err = svc.Stop(ctx, e.ID); err != nil {
+					t.Fatalf("retried Stop: %v", err)
+				}
+			} else if err != nil {
+				t.Fatalf("Stop: %v", err)
+			}
+
+			if hasVariantTags(stopped) || len(tags.names) != 0 {
+				t.Errorf("tags left: experiment %+v, WeChat %v", stopped.Variants, tags.names)
+			}
+			if _, err := svc.Stop(ctx, e.ID); !errors.Is(err, ErrExperimentStatus) {
+				t.Errorf("Stop after cleanup = %v, want ErrExperimentStatus", err)
+			}
+
+			// The report counts survive the tag deletion
+			after, err := svc.Report(ctx, e.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range after.Variants {
+				if after.Variants[i].VariantStats != before.Variants[i].VariantStats {
+					t.Errorf("variant %s counts = %+v, want %+v", after.Variants[i].Variant,
+						after.Variants[i].VariantStats, before.Variants[i].VariantStats)
+				}
+			}
+		})
+	}
+}
+
+func TestExperimentAssignProcessor(t *testing.T) {
+	tests := []struct {
+		name      string
+		followers int
+		pageSize  int
+		wantPages int
+	}{
+		{name: "one chunk", followers: 30, pageSize: 100, wantPages: 1},
+		{name: "chunks of a page", followers: assignChunk*2 + 10, pageSize: 10000, wantPages: 1},
+		{name: "chunks across pages", followers: assignChunk + 300, pageSize: 600, wantPages: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			followers := &fakeFollowerClient{openids: testOpenIDs(tt.followers), pageSize: tt.pageSize}
+			svc, _, _ := newTestExperimentService(followers)
+			p := newTestProcessor(t, 1)
+			svc.SetProcessor(p, "wx1")
+
+			e := testExperiment(1, 1)
+			if err := svc.Create(ctx, e); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := svc.Start(ctx, e.ID); err != nil {
+				t.Fatalf("Start: %v", err)
+			}
+
+			progress := waitAssignment(t, svc, e.ID)
+			if progress.Status != AssignmentDone || progress.Assigned != tt.followers || progress.Pages != tt.wantPages {
+				t.Errorf("progress = %+v, want done with %d assigned over %d pages", progress, tt.followers, tt.wantPages)
+			}
+			// One task per chunk, plus one listing an empty page at the end
+			// when the last page was full
+			if got, min := p.GetStats().TotalProcessed, int64((tt.followers+assignChunk-1)/assignChunk); got < min {
+				t.Errorf("processed %d tasks, want at least %d", got, min)
+			}
+		})
+	}
+}
+
+func TestExperimentAssignStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		stop       bool // stop the experiment before the task runs
+		payload    func(id int64) interface{}
+		wantStatus string
+	}{
+		{name: "restored payload", payload: func(id int64) interface{} {
+			return map[string]interface{}{"experiment_id": float64(id)}
+		}, wantStatus: AssignmentDone},
+		{name: "stopped before running", stop: true, payload: func(id int64) interface{} {
+			return &assignJob{ExperimentID: id}
+		}, wantStatus: AssignmentCancelled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			followers := &fakeFollowerClient{openids: testOpenIDs(20), pageSize: 10}
+			svc, _, _ := newTestExperimentService(followers)
+			// No workers: queued tasks stay queued
+			svc.SetProcessor(newTestProcessor(t, 0), "wx1")
+
+			e := testExperiment(1, 1)
+			if err := svc.Create(ctx, e); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := svc.Start(ctx, e.ID); err != nil {
+				t.Fatalf("Start: %v", err)
+			}
+			if p, _ := svc.Progress(e.ID); p.Status != AssignmentQueued {
+				t.Fatalf("status = %s, want queued", p.Status)
+			}
+			if _, err := svc.AssignFollowers(ctx, e.ID); !errors.Is(err, ErrAssignmentRunning) {
+				t.Errorf("AssignFollowers while queued = %v, want ErrAssignmentRunning", err)
+			}
+			if tt.stop {
+				if _, err := svc.Stop(ctx, e.ID); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Run the task chain by hand, as the processor would
+			job, err := decodeAssignJob(tt.payload(e.ID))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for job != nil {
+				if job, err = svc.assignStep(ctx, job); err != nil {
+					break
+				}
+			}
+
+			progress, _ := svc.Progress(e.ID)
+			if progress.Status != tt.wantStatus {
+				t.Errorf("status = %s (%s), want %s", progress.Status, progress.Error, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,559 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"wechat-service/internal/model"
+	"wechat-service/internal/repository"
+	"wechat-service/pkg/logger"
+	"wechat-service/pkg/ratelimit"
+	"wechat-service/pkg/tracing"
+
+	"github.com/silenceper/wechat/v2/officialaccount"
+	"github.com/silenceper/wechat/v2/util"
+	"gopkg.in/yaml.v3"
+)
+
+// WeChat custom menu limits
+const (
+	MaxMenuButtons     = 3
+	MaxMenuSubButtons  = 5
+	MaxButtonNameBytes = 16
+	MaxSubNameBytes    = 60
+	MaxButtonKeyBytes  = 128
+	MaxButtonURLBytes  = 1024
+)
+
+// menuGetURL is called directly because the SDK's Button has no
+// article_id, which would make article buttons look changed on every diff
+const menuGetURL = "https://api.weixin.qq.com/cgi-bin/menu/get"
+
+// menuAddConditionalURL is called directly because the SDK's
+// AddConditional discards the menuid of the created menu
+const menuAddConditionalURL = "https://api.weixin.qq.com/cgi-bin/menu/addconditional"
+
+// errCodeMenuNotExist is returned by menu/get when no menu is set
+const errCodeMenuNotExist = 46003
+
+// MenuError describes one invalid menu button
+type MenuError struct {
+	Path    string `json:"path"` // e.g. button[1].sub_button[0].name
+	Message string `json:"message"`
+}
+
+// Error implements error
+func (e MenuError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+// MenuErrors collects every problem found by ValidateMenu
+type MenuErrors []MenuError
+
+// Error implements error, listing one problem per line
+func (e MenuErrors) Error() string {
+	lines := make([]string, len(e))
+	for i, me := range e {
+		lines[i] = me.Error()
+	}
+	return fmt.Sprintf("%d menu error(s):\n  %s", len(e), strings.Join(lines, "\n  "))
+}
+
+// driftAuthor is the author recorded on versions fetched from WeChat
+const driftAuthor = "wechat"
+
+// PublishOptions controls Publish
+type PublishOptions struct {
+	Force  bool   // publish even if the menu matches the live one
+	Author string // recorded on the new version
+}
+
+// PublishResult reports what Publish did
+type PublishResult struct {
+	Changes   []model.MenuChange      `json:"changes"`
+	Published bool                    `json:"published"`
+	Version   *repository.MenuVersion `json:"version,omitempty"` // recorded for the publish
+	Drift     *repository.MenuVersion `json:"drift,omitempty"`   // live menu found changed outside the service
+}
+
+// MenuClient reads and writes the live menu of one account
+type MenuClient interface {
+	GetMenu(ctx context.Context) (*model.Menu, error)
+	SetMenu(ctx context.Context, m *model.Menu) error
+}
+
+// WeChatMenuClient is the MenuClient backed by the WeChat API
+type WeChatMenuClient struct {
+	oa *officialaccount.OfficialAccount
+}
+
+// NewWeChatMenuClient creates a menu client for oa
+func NewWeChatMenuClient(oa *officialaccount.OfficialAccount) *WeChatMenuClient {
+	return &WeChatMenuClient{oa: oa}
+}
+
+// GetMenu returns the live default menu, or an empty menu when none is set
+func (c *WeChatMenuClient) GetMenu(ctx context.Context) (*model.Menu, error) {
+	token, err := c.oa.GetAccessTokenContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := util.HTTPGetContext(ctx, menuGetURL+"?access_token="+token)
+	if err != nil {
+		return nil, err
+	}
+
+	var res struct {
+		util.CommonError
+		Menu model.Menu `json:"menu"`
+	}
+	if err := util.DecodeWithError(resp, &res, "GetMenu"); err != nil {
+		var ce *util.CommonError
+		if errors.As(err, &ce) && ce.ErrCode == errCodeMenuNotExist {
+			return &model.Menu{}, nil
+		}
+		return nil, err
+	}
+	return &res.Menu, nil
+}
+
+// SetMenu replaces the live default menu with m
+func (c *WeChatMenuClient) SetMenu(ctx context.Context, m *model.Menu) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to marshal menu: %w", err)
+	}
+	return c.oa.GetMenu().SetMenuByJSON(string(data))
+}
+
+// AddConditional creates a conditional menu shown to followers matching
+// rule and returns its menuid
+func (c *WeChatMenuClient) AddConditional(ctx context.Context, m *model.Menu, rule *model.MatchRule) (int64, error) {
+	token, err := c.oa.GetAccessTokenContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	req := struct {
+		Buttons   []*model.Button  `json:"button"`
+		MatchRule *model.MatchRule `json:"matchrule"`
+	}{m.Buttons, rule}
+	resp, err := util.PostJSONContext(ctx, menuAddConditionalURL+"?access_token="+token, req)
+	if err != nil {
+		return 0, err
+	}
+
+	// menuid is documented as a string but has been seen as a number
+	var res struct {
+		util.CommonError
+		MenuID json.RawMessage `json:"menuid"`
+	}
+	if err := util.DecodeWithError(resp, &res, "AddConditional"); err != nil {
+		return 0, err
+	}
+	menuID, err := strconv.ParseInt(strings.Trim(string(res.MenuID), `"`), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid menuid in response: %s", res.MenuID)
+	}
+	return menuID, nil
+}
+
+// DeleteConditional deletes a conditional menu by menuid
+func (c *WeChatMenuClient) DeleteConditional(ctx context.Context, menuID int64) error {
+	return c.oa.GetMenu().DeleteConditional(menuID)
+}
+
+// MenuService validates menu definitions, publishes them when they
+// differ from the live menu and keeps the history of published menus
+type MenuService struct {
+	client   MenuClient
+	versions repository.MenuVersionStore
+	limiter  *ratelimit.Limiter
+	log      *logger.Logger
+}
+
+// NewMenuService creates a new menu service. limiter may be nil.
+func NewMenuService(client MenuClient, limiter *ratelimit.Limiter, log *logger.Logger) *MenuService {
+	return &MenuService{
+		client:  client,
+		limiter: limiter,
+		log:     log,
+	}
+}
+
+// SetVersionStore sets the store keeping menu history. Without one no
+// history is kept and rollback is unavailable.
+func (s *MenuService) SetVersionStore(versions repository.MenuVersionStore) {
+	s.versions = versions
+}
+
+// Live returns the live default menu
+func (s *MenuService) Live(ctx context.Context) (*model.Menu, error) {
+	ctx, span := tracing.Start(ctx, "MenuService.Live")
+	defer span.End()
+
+	if err := s.allow(ctx, "menu_query"); err != nil {
+		return nil, err
+	}
+	live, err := s.client.GetMenu(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get live menu: %w", err)
+	}
+	return live, nil
+}
+
+// Diff validates m and returns its differences from the live menu
+func (s *MenuService) Diff(ctx context.Context, m *model.Menu) ([]model.MenuChange, error) {
+	if err := ValidateMenu(m); err != nil {
+		return nil, err
+	}
+	live, err := s.Live(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return DiffMenus(live, m), nil
+}
+
+// Publish validates m and sets it as the live menu if it differs from
+// it, or unconditionally with opts.Force, recording it as a new version
+func (s *MenuService) Publish(ctx context.Context, m *model.Menu, opts PublishOptions) (*PublishResult, error) {
+	ctx, span := tracing.Start(ctx, "MenuService.Publish")
+	defer span.End()
+
+	return s.publish(ctx, m, opts, repository.MenuSourcePublish, 0)
+}
+
+// Rollback republishes a recorded version, recording it as a new version
+func (s *MenuService) Rollback(ctx context.Context, version int, author string) (*PublishResult, error) {
+	ctx, span := tracing.Start(ctx, "MenuService.Rollback")
+	defer span.End()
+
+	if s.versions == nil {
+		return nil, fmt.Errorf("menu history is not enabled")
+	}
+	v, err := s.versions.Get(ctx, version)
+	if err != nil {
+		return nil, err
+	}
+	return s.publish(ctx, v.Menu, PublishOptions{Author: author}, repository.MenuSourceRollback, version)
+}
+
+// publish implements Publish and Rollback
+func (s *MenuService) publish(ctx context.Context, m *model.Menu, opts PublishOptions, source string, rollbackOf int) (*PublishResult, error) {
+	log := logger.FromContextOr(ctx, s.log)
+
+	if err := ValidateMenu(m); err != nil {
+		return nil, err
+	}
+	live, err := s.Live(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &PublishResult{Changes: DiffMenus(live, m)}
+	if result.Drift, err = s.recordDrift(ctx, live); err != nil {
+		return nil, err
+	}
+
+	if len(result.Changes) == 0 && !opts.Force {
+		log.Info("Menu unchanged, skipping publish")
+		return result, nil
+	}
+
+	if err := s.allow(ctx, "menu_create"); err != nil {
+		return nil, err
+	}
+	if err := s.client.SetMenu(ctx, m); err != nil {
+		return nil, fmt.Errorf("failed to publish menu: %w", err)
+	}
+	result.Published = true
+
+	if s.versions != nil {
+		v := &repository.MenuVersion{
+			Menu:       m,
+			Diff:       result.Changes,
+			Author:     opts.Author,
+			Source:     source,
+			RollbackOf: rollbackOf,
+		}
+		// The menu is live already; a failed save only loses history
+		if err := s.versions.Save(ctx, v); err != nil {
+			log.Error("Failed to save menu version", "error", err)
+		} else {
+			result.Version = v
+		}
+	}
+
+	log.Info("Menu published", "source", source, "author", opts.Author,
+		"changes", len(result.Changes), "forced", opts.Force)
+	return result, nil
+}
+
+// CheckDrift fetches the live menu and records it as a version if it
+// differs from the newest recorded one. It returns the recorded version,
+// or nil when there is no drift.
+func (s *MenuService) CheckDrift(ctx context.Context) (*repository.MenuVersion, error) {
+	ctx, span := tracing.Start(ctx, "MenuService.CheckDrift")
+	defer span.End()
+
+	live, err := s.Live(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.recordDrift(ctx, live)
+}
+
+// recordDrift records live as a version if it differs from the newest
+// recorded one. An existing live menu is recorded when there is no
+// history yet, so that it can be rolled back to.
+func (s *MenuService) recordDrift(ctx context.Context, live *model.Menu) (*repository.MenuVersion, error) {
+	if s.versions == nil {
+		return nil, nil
+	}
+
+	latest, err := s.versions.Latest(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get latest menu version: %w", err)
+	}
+	var recorded *model.Menu
+	if latest != nil {
+		recorded = latest.Menu
+	}
+
+	diff := DiffMenus(recorded, live)
+	if len(diff) == 0 {
+		return nil, nil
+	}
+
+	v := &repository.MenuVersion{
+		Menu:   live,
+		Diff:   diff,
+		Author: driftAuthor,
+		Source: repository.MenuSourceDrift,
+	}
+	if err := s.versions.Save(ctx, v); err != nil {
+		return nil, fmt.Errorf("failed to save drifted menu: %w", err)
+	}
+
+	logger.FromContextOr(ctx, s.log).Warn("Live menu differs from the last recorded version",
+		"version", v.Version, "changes", len(diff))
+	return v, nil
+}
+
+// Versions returns at most limit recorded versions, newest first
+func (s *MenuService) Versions(ctx context.Context, limit int) ([]*repository.MenuVersion, error) {
+	if s.versions == nil {
+		return []*repository.MenuVersion{}, nil
+	}
+	return s.versions.List(ctx, limit)
+}
+
+// Version returns a recorded version by number
+func (s *MenuService) Version(ctx context.Context, version int) (*repository.MenuVersion, error) {
+	if s.versions == nil {
+		return nil, repository.ErrMenuVersionNotFound
+	}
+	return s.versions.Get(ctx, version)
+}
+
+// allow consumes one call of apiName from the daily quota
+func (s *MenuService) allow(ctx context.Context, apiName string) error {
+	if s.limiter == nil {
+		return nil
+	}
+	if ok, err := s.limiter.AllowContext(ctx, apiName); !ok {
+		return fmt.Errorf("%s: %w", apiName, err)
+	}
+	return nil
+}
+
+// LoadMenuFile reads a menu definition, parsing .yaml and .yml files as
+// YAML and .json files as JSON. Unknown keys are rejected.
+func LoadMenuFile(path string) (*model.Menu, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read menu file: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return ParseMenu(data, "yaml")
+	case ".json":
+		return ParseMenu(data, "json")
+	default:
+		return nil, fmt.Errorf("unsupported menu file extension: %q", filepath.Ext(path))
+	}
+}
+
+// ParseMenu decodes a menu definition in format, yaml or json
+func ParseMenu(data []byte, format string) (*model.Menu, error) {
+	m := &model.Menu{}
+	switch format {
+	case "yaml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(m); err != nil {
+			return nil, fmt.Errorf("failed to parse menu: %w", err)
+		}
+	case "json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(m); err != nil {
+			return nil, fmt.Errorf("failed to parse menu: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported menu format: %q", format)
+	}
+	return m, nil
+}
+
+// ValidateMenu checks m against the WeChat custom menu limits and reports
+// all problems at once as MenuErrors
+func ValidateMenu(m *model.Menu) error {
+	var errs MenuErrors
+	addf := func(path, format string, args ...interface{}) {
+		errs = append(errs, MenuError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if m == nil || len(m.Buttons) == 0 {
+		addf("button", "at least one button is required")
+		return errs
+	}
+	if len(m.Buttons) > MaxMenuButtons {
+		addf("button", "at most %d buttons allowed, got %d", MaxMenuButtons, len(m.Buttons))
+	}
+
+	for i, b := range m.Buttons {
+		path := fmt.Sprintf("button[%d]", i)
+		if b == nil {
+			addf(path, "is empty")
+			continue
+		}
+		validateButtonName(addf, path, b.Name, MaxButtonNameBytes)
+
+		if !b.HasSubButtons() {
+			validateButtonAction(addf, path, b)
+			continue
+		}
+
+		if b.Type != "" {
+			addf(path+".type", "must be empty on a button with sub_button, got %q", b.Type)
+		}
+		if len(b.SubButtons) > MaxMenuSubButtons {
+			addf(path+".sub_button", "at most %d sub-buttons allowed, got %d", MaxMenuSubButtons, len(b.SubButtons))
+		}
+		for j, sub := range b.SubButtons {
+			subPath := fmt.Sprintf("%s.sub_button[%d]", path, j)
+			if sub == nil {
+				addf(subPath, "is empty")
+				continue
+			}
+			validateButtonName(addf, subPath, sub.Name, MaxSubNameBytes)
+			if sub.HasSubButtons() {
+				addf(subPath+".sub_button", "sub-buttons cannot be nested")
+			}
+			validateButtonAction(addf, subPath, sub)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validateButtonName checks that name is set and at most limit bytes
+func validateButtonName(addf func(string, string, ...interface{}), path, name string, limit int) {
+	if strings.TrimSpace(name) == "" {
+		addf(path+".name", "is required")
+	} else if len(name) > limit {
+		addf(path+".name", "must be at most %d bytes, got %d", limit, len(name))
+	}
+}
+
+// validateButtonAction checks the fields required by the button type
+func validateButtonAction(addf func(string, string, ...interface{}), path string, b *model.Button) {
+	requireField := func(field, value string, limit int) {
+		if value == "" {
+			addf(path+"."+field, "is required for type %s", b.Type)
+		} else if limit > 0 && len(value) > limit {
+			addf(path+"."+field, "must be at most %d bytes, got %d", limit, len(value))
+		}
+	}
+
+	switch b.Type {
+	case "":
+		addf(path+".type", "is required")
+	case model.ButtonClick, model.ButtonScanCodePush, model.ButtonScanCodeWaitMsg,
+		model.ButtonPicSysPhoto, model.ButtonPicPhotoOrAlbum, model.ButtonPicWeixin,
+		model.ButtonLocationSelect:
+		requireField("key", b.Key, MaxButtonKeyBytes)
+	case model.ButtonView:
+		requireField("url", b.URL, MaxButtonURLBytes)
+	case model.ButtonMiniprogram:
+		// url is opened by clients without mini program support
+		requireField("url", b.URL, MaxButtonURLBytes)
+		requireField("appid", b.AppID, 0)
+		requireField("pagepath", b.PagePath, 0)
+	case model.ButtonMediaID, model.ButtonViewLimited:
+		requireField("media_id", b.MediaID, 0)
+	case model.ButtonArticleID, model.ButtonArticleViewLimited:
+		requireField("article_id", b.ArticleID, 0)
+	default:
+		addf(path+".type", "unknown button type %q", b.Type)
+	}
+}
+
+// DiffMenus compares two menus button by button, in position order
+func DiffMenus(from, to *model.Menu) []model.MenuChange {
+	var changes []model.MenuChange
+	diffButtons(&changes, "button", buttonsOf(from), buttonsOf(to))
+	return changes
+}
+
+// buttonsOf returns the buttons of m, which may be nil
+func buttonsOf(m *model.Menu) []*model.Button {
+	if m == nil {
+		return nil
+	}
+	return m.Buttons
+}
+
+// diffButtons appends the differences between two button lists under path
+func diffButtons(changes *[]model.MenuChange, path string, from, to []*model.Button) {
+	n := len(from)
+	if len(to) > n {
+		n = len(to)
+	}
+
+	for i := 0; i < n; i++ {
+		p := fmt.Sprintf("%s[%d]", path, i)
+		switch {
+		case i >= len(from):
+			*changes = append(*changes, model.MenuChange{Path: p, Kind: model.MenuChangeAdded, New: to[i]})
+		case i >= len(to):
+			*changes = append(*changes, model.MenuChange{Path: p, Kind: model.MenuChangeRemoved, Old: from[i]})
+		default:
+			o, c := from[i], to[i]
+			if !o.Equal(c) {
+				*changes = append(*changes, model.MenuChange{Path: p, Kind: model.MenuChangeChanged, Old: leafOf(o), New: leafOf(c)})
+			}
+			diffButtons(changes, p+".sub_button", o.SubButtons, c.SubButtons)
+		}
+	}
+}
+
+// leafOf returns b without its sub-buttons, which are diffed separately
+func leafOf(b *model.Button) *model.Button {
+	leaf := *b
+	leaf.SubButtons = nil
+	return &leaf
+}
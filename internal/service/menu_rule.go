@@ -0,0 +1,359 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"wechat-service/internal/model"
+	"wechat-service/internal/repository"
+	"wechat-service/pkg/logger"
+	"wechat-service/pkg/ratelimit"
+	"wechat-service/pkg/tracing"
+)
+
+// ErrFollowerNotFound is returned when an openid has no stored profile
+var ErrFollowerNotFound = errors.New("follower not found")
+
+// ConditionalMenuClient creates and deletes conditional menus of one
+// account
+type ConditionalMenuClient interface {
+	AddConditional(ctx context.Context, m *model.Menu, rule *model.MatchRule) (int64, error)
+	DeleteConditional(ctx context.Context, menuID int64) error
+}
+
+// MenuMatch is the result of TryMatch
+type MenuMatch struct {
+	OpenID string               `json:"openid"`
+	Rule   *repository.MenuRule `json:"rule"` // nil when the default menu is shown
+	// Undetermined lists rules with a client platform criterion, which
+	// the stored profile cannot evaluate
+	Undetermined []int64 `json:"undetermined,omitempty"`
+}
+
+// SyncResult reports what Sync changed on WeChat
+type SyncResult struct {
+	Deployed []int64 `json:"deployed"`
+	Removed  []int64 `json:"removed"`
+}
+
+// ConditionalMenuService deploys the conditional menus defined by menu
+// rules. WeChat shows a follower the most recently created conditional
+// menu they match, so rules are deployed in ascending priority. A
+// default menu must be published before any conditional menu.
+type ConditionalMenuService struct {
+	client  ConditionalMenuClient
+	rules   repository.MenuRuleStore
+	users   *repository.UserRepository
+	limiter *ratelimit.Limiter
+	log     *logger.Logger
+}
+
+// NewConditionalMenuService creates a new conditional menu service.
+// limiter may be nil.
+func NewConditionalMenuService(
+	client ConditionalMenuClient,
+	rules repository.MenuRuleStore,
+	users *repository.UserRepository,
+	limiter *ratelimit.Limiter,
+	log *logger.Logger,
+) *ConditionalMenuService {
+	return &ConditionalMenuService{
+		client:  client,
+		rules:   rules,
+		users:   users,
+		limiter: limiter,
+		log:     log,
+	}
+}
+
+// Rules returns all rules, highest priority first
+func (s *ConditionalMenuService) Rules(ctx context.Context) ([]*repository.MenuRule, error) {
+	return s.rules.List(ctx)
+}
+
+// SaveRule validates and stores a rule, then recreates its conditional
+// menu on WeChat, which has no update call: a deployed menu is deleted and
+// an enabled rule is deployed again. The deployed rules that outrank it
+// are recreated after it, so that WeChat's precedence, newest first, keeps
+// following the priorities.
+func (s *ConditionalMenuService) SaveRule(ctx context.Context, rule *repository.MenuRule) error {
+	ctx, span := tracing.Start(ctx, "ConditionalMenuService.SaveRule")
+	defer span.End()
+
+	if err := ValidateMenuRule(rule); err != nil {
+		return err
+	}
+
+	rule.MenuID = 0
+	if rule.ID != 0 {
+		existing, err := s.rules.Get(ctx, rule.ID)
+		if err != nil {
+			return err
+		}
+		if existing.Deployed() {
+			if err := s.undeploy(ctx, existing); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := s.rules.Save(ctx, rule); err != nil {
+		return err
+	}
+	if rule.Enabled {
+		return s.deployRanked(ctx, rule)
+	}
+	return nil
+}
+
+// DeleteRule deletes a rule and its conditional menu
+func (s *ConditionalMenuService) DeleteRule(ctx context.Context, id int64) error {
+	ctx, span := tracing.Start(ctx, "ConditionalMenuService.DeleteRule")
+	defer span.End()
+
+	rule, err := s.rules.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if rule.Deployed() {
+		if err := s.undeploy(ctx, rule); err != nil {
+			return err
+		}
+	}
+	return s.rules.Delete(ctx, id)
+}
+
+// Sync deploys enabled rules missing on WeChat and removes the menus of
+// disabled ones. With redeploy, every menu is deleted and created again
+// so that WeChat's precedence follows the current priorities.
+func (s *ConditionalMenuService) Sync(ctx context.Context, redeploy bool) (*SyncResult, error) {
+	ctx, span := tracing.Start(ctx, "ConditionalMenuService.Sync")
+	defer span.End()
+
+	rules, err := s.rules.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &SyncResult{Deployed: []int64{}, Removed: []int64{}}
+	for _, rule := range rules {
+		if rule.Deployed() && (redeploy || !rule.Enabled) {
+			if err := s.undeploy(ctx, rule); err != nil {
+				return result, err
+			}
+			result.Removed = append(result.Removed, rule.ID)
+		}
+	}
+
+	// Lowest priority first, so the highest priority menu is the newest
+	for i := len(rules) - 1; i >= 0; i-- {
+		rule := rules[i]
+		if !rule.Enabled || rule.Deployed() {
+			continue
+		}
+		if err := s.deploy(ctx, rule); err != nil {
+			return result, err
+		}
+		result.Deployed = append(result.Deployed, rule.ID)
+	}
+
+	logger.FromContextOr(ctx, s.log).Info("Conditional menus synced",
+		"deployed", len(result.Deployed), "removed", len(result.Removed))
+	return result, nil
+}
+
+// TryMatch returns the conditional menu the follower openid would see,
+// judged from their stored profile
+func (s *ConditionalMenuService) TryMatch(ctx context.Context, openid string) (*MenuMatch, error) {
+	ctx, span := tracing.Start(ctx, "ConditionalMenuService.TryMatch")
+	defer span.End()
+
+	user, err := s.users.GetByOpenID(ctx, openid)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, ErrFollowerNotFound
+	}
+
+	rules, err := s.rules.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	match := &MenuMatch{OpenID: openid}
+	for _, rule := range rules {
+		if !rule.Enabled || !rule.Deployed() {
+			continue
+		}
+		if rule.ClientPlatform != "" {
+			match.Undetermined = append(match.Undetermined, rule.ID)
+			continue
+		}
+		if ruleMatchesUser(rule, user) {
+			match.Rule = rule
+			break
+		}
+	}
+	return match, nil
+}
+
+// deployRanked deploys rule below the deployed rules that outrank it: they
+// are deleted first and recreated after rule, lowest priority first, as
+// Sync does
+func (s *ConditionalMenuService) deployRanked(ctx context.Context, rule *repository.MenuRule) error {
+	rules, err := s.rules.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	var above []*repository.MenuRule
+	for _, r := range rules {
+		if r.ID == rule.ID {
+			break
+		}
+		if r.Deployed() {
+			above = append(above, r)
+		}
+	}
+
+	for _, r := range above {
+		if err := s.undeploy(ctx, r); err != nil {
+			return err
+		}
+	}
+	if err := s.deploy(ctx, rule); err != nil {
+		return err
+	}
+	for i := len(above) - 1; i >= 0; i-- {
+		if err := s.deploy(ctx, above[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deploy creates the conditional menu of rule and records its menuid
+func (s *ConditionalMenuService) deploy(ctx context.Context, rule *repository.MenuRule) error {
+	if err := s.allow(ctx, "menu_addconditional"); err != nil {
+		return err
+	}
+	menuID, err := s.client.AddConditional(ctx, rule.Menu, rule.MatchRule())
+	if err != nil {
+		return fmt.Errorf("failed to create conditional menu for rule %d: %w", rule.ID, err)
+	}
+	if err := s.rules.SetMenuID(ctx, rule.ID, menuID); err != nil {
+		return err
+	}
+	rule.MenuID = menuID
+
+	logger.FromContextOr(ctx, s.log).Info("Conditional menu created", "rule_id", rule.ID, "menu_id", menuID)
+	return nil
+}
+
+// undeploy deletes the conditional menu of rule
+func (s *ConditionalMenuService) undeploy(ctx context.Context, rule *repository.MenuRule) error {
+	if err := s.allow(ctx, "menu_delconditional"); err != nil {
+		return err
+	}
+	if err := s.client.DeleteConditional(ctx, rule.MenuID); err != nil {
+		return fmt.Errorf("failed to delete conditional menu %d: %w", rule.MenuID, err)
+	}
+	if err := s.rules.SetMenuID(ctx, rule.ID, 0); err != nil {
+		return err
+	}
+
+	logger.FromContextOr(ctx, s.log).Info("Conditional menu deleted", "rule_id", rule.ID, "menu_id", rule.MenuID)
+	rule.MenuID = 0
+	return nil
+}
+
+// allow consumes one call of apiName from the daily quota
+func (s *ConditionalMenuService) allow(ctx context.Context, apiName string) error {
+	if s.limiter == nil {
+		return nil
+	}
+	if ok, err := s.limiter.AllowContext(ctx, apiName); !ok {
+		return fmt.Errorf("%s: %w", apiName, err)
+	}
+	return nil
+}
+
+// ruleMatchesUser reports whether every criterion of rule, except the
+// client platform, matches user
+func ruleMatchesUser(rule *repository.MenuRule, user *repository.User) bool {
+	if rule.TagID != 0 && !hasTag(user.TagIDList, rule.TagID) {
+		return false
+	}
+	if rule.Sex != 0 && rule.Sex != user.Sex {
+		return false
+	}
+	if rule.Language != "" && rule.Language != user.Language {
+		return false
+	}
+	if rule.Country != "" && rule.Country != user.Country {
+		return false
+	}
+	if rule.Province != "" && rule.Province != user.Province {
+		return false
+	}
+	if rule.City != "" && rule.City != user.City {
+		return false
+	}
+	return true
+}
+
+// hasTag returns true if tagID is in tags
+func hasTag(tags []int, tagID int) bool {
+	for _, t := range tags {
+		if t == tagID {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateMenuRule checks a rule and its menu, reporting all problems at
+// once as MenuErrors
+func ValidateMenuRule(rule *repository.MenuRule) error {
+	var errs MenuErrors
+	addf := func(path, format string, args ...interface{}) {
+		errs = append(errs, MenuError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if strings.TrimSpace(rule.Name) == "" {
+		addf("name", "is required")
+	}
+	if rule.TagID == 0 && rule.Sex == 0 && rule.ClientPlatform == "" && rule.Language == "" &&
+		rule.Country == "" && rule.Province == "" && rule.City == "" {
+		addf("rule", "at least one match criterion is required")
+	}
+	if rule.Sex < 0 || rule.Sex > 2 {
+		addf("sex", "must be 1 (male) or 2 (female), got %d", rule.Sex)
+	}
+	switch rule.ClientPlatform {
+	case "", model.PlatformIOS, model.PlatformAndroid, model.PlatformOthers:
+	default:
+		addf("client_platform", "must be 1 (iOS), 2 (Android) or 3 (others), got %q", rule.ClientPlatform)
+	}
+	if rule.Province != "" && rule.Country == "" {
+		addf("province", "requires country")
+	}
+	if rule.City != "" && rule.Province == "" {
+		addf("city", "requires province")
+	}
+
+	var menuErrs MenuErrors
+	if err := ValidateMenu(rule.Menu); errors.As(err, &menuErrs) {
+		for _, me := range menuErrs {
+			addf("menu."+me.Path, "%s", me.Message)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
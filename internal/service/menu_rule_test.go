@@ -0,0 +1,633 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"wechat-service/internal/model"
+	"wechat-service/internal/repository"
+	"wechat-service/pkg/async"
+	"wechat-service/pkg/cache"
+
+	"github.com/silenceper/wechat/v2/officialaccount/message"
+)
+
+// fakeConditionalClient keeps conditional menus in memory. Menu IDs grow,
+// so the highest live ID is the menu WeChat gives precedence to.
+type fakeConditionalClient struct {
+	mu     sync.Mutex
+	nextID int64
+	live   map[int64]*model.MatchRule
+	adds   int
+	fail   error
+}
+
+func newFakeConditionalClient() *fakeConditionalClient {
+	return &fakeConditionalClient{live: make(map[int64]*model.MatchRule)}
+}
+
+func (c *fakeConditionalClient) AddConditional(ctx context.Context, m *model.Menu, rule *model.MatchRule) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fail != nil {
+		return 0, c.fail
+	}
+	c.nextID++
+	c.adds++
+	c.live[c.nextID] = rule
+	return c.nextID, nil
+}
+
+func (c *fakeConditionalClient) DeleteConditional(ctx context.Context, menuID int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.live[menuID]; !ok {
+		return fmt.Errorf("menu %d does not exist", menuID)
+	}
+	delete(c.live, menuID)
+	return nil
+}
+
+// testMenu returns a valid one-button menu
+func testMenu(key string) *model.Menu {
+	return &model.Menu{Buttons: []*model.Button{{Type: model.ButtonClick, Name: "Help", Key: key}}}
+}
+
+// newTestConditionalService returns a service over a fake client and
+// memory stores
+func newTestConditionalService() (*ConditionalMenuService, *fakeConditionalClient, *repository.UserRepository) {
+	client := newFakeConditionalClient()
+	users := repository.NewUserRepositoryForApp("wx1")
+	svc := NewConditionalMenuService(client, repository.NewMemoryMenuRuleStore("wx1"), users, nil, testLogger())
+	return svc, client, users
+}
+
+// precedence returns the names of the deployed rules in the order WeChat
+// evaluates them, newest menu first
+func precedence(t *testing.T, svc *ConditionalMenuService, client *fakeConditionalClient) []string {
+	t.Helper()
+	rules, err := svc.Rules(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var deployed []*repository.MenuRule
+	for _, r := range rules {
+		if r.Deployed() {
+			if _, ok := client.live[r.MenuID]; !ok {
+				t.Errorf("rule %s points at deleted menu %d", r.Name, r.MenuID)
+			}
+			deployed = append(deployed, r)
+		}
+	}
+	if len(deployed) != len(client.live) {
+		t.Errorf("%d rules deployed but %d menus live", len(deployed), len(client.live))
+	}
+	sort.Slice(deployed, func(i, j int) bool { return deployed[i].MenuID > deployed[j].MenuID })
+	names := make([]string, len(deployed))
+	for i, r := range deployed {
+		names[i] = r.Name
+	}
+	return names
+}
+
+func TestSaveRuleKeepsPriorityOrder(t *testing.T) {
+	type save struct {
+		name     string
+		priority int
+		disabled bool
+	}
+
+	tests := []struct {
+		name  string
+		saves []save
+		want  []string // precedence on WeChat, highest first
+	}{
+		{
+			name:  "ascending saves",
+			saves: []save{{"low", 1, false}, {"mid", 5, false}, {"high", 9, false}},
+			want:  []string{"high", "mid", "low"},
+		},
+		{
+			name:  "descending saves",
+			saves: []save{{"high", 9, false}, {"mid", 5, false}, {"low", 1, false}},
+			want:  []string{"high", "mid", "low"},
+		},
+		{
+			name:  "inserted in the middle",
+			saves: []save{{"high", 9, false}, {"low", 1, false}, {"mid", 5, false}},
+			want:  []string{"high", "mid", "low"},
+		},
+		{
+			name:  "disabled rules are skipped",
+			saves: []save{{"high", 9, true}, {"low", 1, false}, {"mid", 5, false}},
+			want:  []string{"mid", "low"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, client, _ := newTestConditionalService()
+			ctx := context.Background()
+			for _, s := range tt.saves {
+				rule := &repository.MenuRule{Name: s.name, Sex: 1, Priority: s.priority,
+					Enabled: !s.disabled, Menu: testMenu(s.name)}
+				if err := svc.SaveRule(ctx, rule); err != nil {
+					t.Fatalf("SaveRule(%s): %v", s.name, err)
+				}
+			}
+
+			if got := precedence(t, svc, client); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("precedence = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSaveRuleUpdateAndDelete(t *testing.T) {
+	svc, client, _ := newTestConditionalService()
+	ctx := context.Background()
+
+	low := &repository.MenuRule{Name: "low", Sex: 1, Priority: 1, Enabled: true, Menu: testMenu("low")}
+	high := &repository.MenuRule{Name: "high", Sex: 2, Priority: 9, Enabled: true, Menu: testMenu("high")}
+	for _, r := range []*repository.MenuRule{low, high} {
+		if err := svc.SaveRule(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	steps := []struct {
+		name string
+		do   func() error
+		want []string
+	}{
+		{
+			name: "raise low above high",
+			do:   func() error { low.Priority = 10; return svc.SaveRule(ctx, low) },
+			want: []string{"low", "high"},
+		},
+		{
+			name: "disable low",
+			do:   func() error { low.Enabled = false; return svc.SaveRule(ctx, low) },
+			want: []string{"high"},
+		},
+		{
+			name: "delete high",
+			do:   func() error { return svc.DeleteRule(ctx, high.ID) },
+			want: []string{},
+		},
+	}
+
+	for _, step := range steps {
+		if err := step.do(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if got := precedence(t, svc, client); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: precedence = %v, want %v", step.name, got, step.want)
+		}
+	}
+}
+
+func TestSync(t *testing.T) {
+	tests := []struct {
+		name         string
+		redeploy     bool
+		wantDeployed int
+		wantRemoved  int
+	}{
+		{name: "deploys missing", wantDeployed: 1},
+		{name: "redeploy recreates all", redeploy: true, wantDeployed: 3, wantRemoved: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, client, _ := newTestConditionalService()
+			ctx := context.Background()
+			for i, name := range []string{"a", "b"} {
+				rule := &repository.MenuRule{Name: name, Sex: 1, Priority: i, Enabled: true, Menu: testMenu(name)}
+				if err := svc.SaveRule(ctx, rule); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// A rule stored while WeChat was unreachable
+			client.fail = errors.New("unreachable")
+			pending := &repository.MenuRule{Name: "c", Sex: 2, Priority: 5, Enabled: true, Menu: testMenu("c")}
+			if err := svc.SaveRule(ctx, pending); err == nil {
+				t.Fatal("expected SaveRule to fail")
+			}
+			client.fail = nil
+
+			result, err := svc.Sync(ctx, tt.redeploy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result.Deployed) != tt.wantDeployed || len(result.Removed) != tt.wantRemoved {
+				t.Errorf("deployed %v, removed %v; want %d and %d", result.Deployed, result.Removed,
+					tt.wantDeployed, tt.wantRemoved)
+			}
+			if got, want := precedence(t, svc, client), []string{"c", "b", "a"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("precedence = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestTryMatch(t *testing.T) {
+	rules := []*repository.MenuRule{
+		{Name: "vip", TagID: 100, Priority: 9},
+		{Name: "women in Guangzhou", Sex: 2, Country: "中国", Province: "广东", City: "广州", Priority: 5},
+		{Name: "ios", ClientPlatform: model.PlatformIOS, Priority: 4},
+		{Name: "english", Language: "en", Priority: 1},
+	}
+
+	tests := []struct {
+		name             string
+		user             *repository.User
+		want             string // "" for the default menu
+		wantUndetermined int    // platform rules outranking the match
+	}{
+		{name: "tagged", user: &repository.User{TagIDList: []int{7, 100}, Language: "en"}, want: "vip"},
+		{
+			name: "location and sex",
+			user: &repository.User{Sex: 2, Country: "中国", Province: "广东", City: "广州"},
+			want: "women in Guangzhou",
+		},
+		{
+			name:             "wrong city",
+			user:             &repository.User{Sex: 2, Country: "中国", Province: "广东", City: "深圳"},
+			wantUndetermined: 1,
+		},
+		{name: "language", user: &repository.User{Language: "en"}, want: "english", wantUndetermined: 1},
+		{name: "nothing matches", user: &repository.User{Language: "zh_CN"}, wantUndetermined: 1},
+	}
+
+	svc, _, users := newTestConditionalService()
+	ctx := context.Background()
+	for _, r := range rules {
+		r.Enabled = true
+		r.Menu = testMenu(r.Name)
+		if err := svc.SaveRule(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.user.OpenID = fmt.Sprintf("o%d", i)
+			if err := users.Save(ctx, tt.user); err != nil {
+				t.Fatal(err)
+			}
+
+			match, err := svc.TryMatch(ctx, tt.user.OpenID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if match.Rule != nil {
+				got = match.Rule.Name
+			}
+			if got != tt.want {
+				t.Errorf("matched %q, want %q", got, tt.want)
+			}
+			if len(match.Undetermined) != tt.wantUndetermined {
+				t.Errorf("undetermined = %v, want %d rules", match.Undetermined, tt.wantUndetermined)
+			}
+		})
+	}
+
+	if _, err := svc.TryMatch(ctx, "unknown"); !errors.Is(err, ErrFollowerNotFound) {
+		t.Errorf("TryMatch(unknown) = %v, want ErrFollowerNotFound", err)
+	}
+}
+
+func TestValidateMenuRule(t *testing.T) {
+	tests := []struct {
+		name      string
+		rule      repository.MenuRule
+		wantPaths []string
+	}{
+		{name: "valid", rule: repository.MenuRule{Name: "r", TagID: 1, Menu: testMenu("k")}},
+		{name: "no name", rule: repository.MenuRule{TagID: 1, Menu: testMenu("k")}, wantPaths: []string{"name"}},
+		{name: "no criterion", rule: repository.MenuRule{Name: "r", Menu: testMenu("k")}, wantPaths: []string{"rule"}},
+		{name: "bad sex", rule: repository.MenuRule{Name: "r", Sex: 3, Menu: testMenu("k")}, wantPaths: []string{"sex"}},
+		{
+			name:      "bad platform",
+			rule:      repository.MenuRule{Name: "r", ClientPlatform: "9", Menu: testMenu("k")},
+			wantPaths: []string{"client_platform"},
+		},
+		{
+			name:      "city without province",
+			rule:      repository.MenuRule{Name: "r", Country: "中国", City: "广州", Menu: testMenu("k")},
+			wantPaths: []string{"city"},
+		},
+		{
+			name:      "province without country",
+			rule:      repository.MenuRule{Name: "r", Province: "广东", Menu: testMenu("k")},
+			wantPaths: []string{"province"},
+		},
+		{name: "menu problems", rule: repository.MenuRule{Name: "r", TagID: 1}, wantPaths: []string{"menu.button"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateMenuRule(&tt.rule)
+			var errs MenuErrors
+			if err != nil && !errors.As(err, &errs) {
+				t.Fatalf("err = %v, want MenuErrors", err)
+			}
+			var paths []string
+			for _, e := range errs {
+				paths = append(paths, e.Path)
+			}
+			if !reflect.DeepEqual(paths, tt.wantPaths) {
+				t.Errorf("paths = %v, want %v", paths, tt.wantPaths)
+			}
+		})
+	}
+}
+
+// fakeFollowerClient returns canned profiles and lists openids in pages
+// of pageSize
+type fakeFollowerClient struct {
+	profiles map[string]*repository.User
+	openids  []string
+	pageSize int
+	pages    int // ListFollowers calls
+}
+
+func (c *fakeFollowerClient) GetFollower(ctx context.Context, openid string) (*repository.User, error) {
+	u, ok := c.profiles[openid]
+	if !ok {
+		return nil, errors.New("user info failed")
+	}
+	copied := *u
+	return &copied, nil
+}
+
+func (c *fakeFollowerClient) ListFollowers(ctx context.Context, next string) ([]string, string, error) {
+	c.pages++
+	start := 0
+	if next != "" {
+		for i, openid := range c.openids {
+			if openid == next {
+				start = i + 1
+			}
+		}
+	}
+	end := min(start+c.pageSize, len(c.openids))
+	page := c.openids[start:end]
+	if end == len(c.openids) {
+		return page, "", nil
+	}
+	return page, page[len(page)-1], nil
+}
+
+// waitTasks waits until p has run n tasks
+func waitTasks(t *testing.T, p *async.Processor, n int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if stats := p.GetStats(); stats.TotalProcessed+stats.TotalFailed >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("%d tasks did not run: %+v", n, p.GetStats())
+}
+
+// blockingFollowerClient holds GetFollower until release is closed
+type blockingFollowerClient struct {
+	*fakeFollowerClient
+	release chan struct{}
+}
+
+func (c *blockingFollowerClient) GetFollower(ctx context.Context, openid string) (*repository.User, error) {
+	<-c.release
+	return c.fakeFollowerClient.GetFollower(ctx, openid)
+}
+
+func TestOnSubscribeStoresProfile(t *testing.T) {
+	followers := &fakeFollowerClient{profiles: map[string]*repository.User{
+		"o1": {OpenID: "o1", Sex: 2, Language: "en", City: "广州", TagIDList: []int{100}},
+	}}
+
+	tests := []struct {
+		name        string
+		openid      string
+		noProcessor bool
+		stored      *repository.User // known before the event
+		wantSex     int
+		wantTags    []int
+		wantCity    string
+	}{
+		{name: "profile fetched", openid: "o1", wantSex: 2, wantTags: []int{100}, wantCity: "广州"},
+		{name: "profile fetched without processor", openid: "o1", noProcessor: true, wantSex: 2, wantTags: []int{100}, wantCity: "广州"},
+		{name: "fetch fails", openid: "o2"},
+		{
+			name:    "fetch fails, known follower",
+			openid:  "o3",
+			stored:  &repository.User{OpenID: "o3", Sex: 1, City: "深圳"},
+			wantSex: 1, wantCity: "深圳",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			users := repository.NewUserRepositoryForApp("wx1")
+			if tt.stored != nil {
+				users.Save(ctx, tt.stored)
+			}
+			client := &blockingFollowerClient{fakeFollowerClient: followers, release: make(chan struct{})}
+			events := NewEventService(users)
+			events.SetFollowerClient(client, nil)
+			var p *async.Processor
+			if !tt.noProcessor {
+				p = newTestProcessor(t, 1)
+				events.SetProcessor(p, "wx1")
+			}
+
+			msg := &message.MixMessage{}
+			msg.FromUserName = message.CDATA(tt.openid)
+			if reply := events.OnSubscribe(ctx, msg); reply == nil {
+				t.Fatal("no reply")
+			}
+
+			// The subscriber is stored before the profile is fetched
+			user, _ := users.GetByOpenID(ctx, tt.openid)
+			if user == nil {
+				t.Fatal("subscriber not stored")
+			}
+			if user.Subscribe != 1 || user.SubscribeTime.IsZero() {
+				t.Errorf("subscribe = %d at %v", user.Subscribe, user.SubscribeTime)
+			}
+			subscribedAt := user.SubscribeTime
+
+			close(client.release)
+			if p != nil {
+				waitTasks(t, p, 1)
+			} else {
+				deadline := time.Now().Add(5 * time.Second)
+				for user.City != tt.wantCity && time.Now().Before(deadline) {
+					time.Sleep(time.Millisecond)
+					user, _ = users.GetByOpenID(ctx, tt.openid)
+				}
+			}
+
+			user, _ = users.GetByOpenID(ctx, tt.openid)
+			if user.Subscribe != 1 || !user.SubscribeTime.Equal(subscribedAt) {
+				t.Errorf("subscribe = %d at %v, want 1 at %v", user.Subscribe, user.SubscribeTime, subscribedAt)
+			}
+			if user.Sex != tt.wantSex || user.City != tt.wantCity || !reflect.DeepEqual(user.TagIDList, tt.wantTags) {
+				t.Errorf("profile = sex %d, city %q, tags %v", user.Sex, user.City, user.TagIDList)
+			}
+		})
+	}
+}
+
+func TestMenuEventsCountMatches(t *testing.T) {
+	ctx := context.Background()
+	rules := repository.NewMemoryMenuRuleStore("wx1")
+	rule := &repository.MenuRule{Name: "r", Sex: 1, Menu: testMenu("k")}
+	if err := rules.Save(ctx, rule); err != nil {
+		t.Fatal(err)
+	}
+	if err := rules.SetMenuID(ctx, rule.ID, 42); err != nil {
+		t.Fatal(err)
+	}
+
+	events := NewEventService(nil)
+	events.SetMenuRuleStore(rules)
+	var observed []string
+	events.AddMenuEventObserver(func(ctx context.Context, openid, event string) {
+		observed = append(observed, openid+":"+event)
+	})
+
+	tests := []struct {
+		event  message.EventType
+		menuID string
+	}{
+		{event: message.EventClick, menuID: "42"},
+		{event: message.EventView, menuID: "42"},
+		{event: message.EventClick, menuID: ""},   // default menu
+		{event: message.EventClick, menuID: "99"}, // unknown conditional menu
+	}
+	for _, tt := range tests {
+		msg := &message.MixMessage{MenuID: tt.menuID}
+		msg.FromUserName = "o1"
+		msg.Event = tt.event
+		if tt.event == message.EventClick {
+			events.OnClick(ctx, msg)
+		} else {
+			events.OnView(ctx, msg)
+		}
+	}
+
+	got, err := rules.Get(ctx, rule.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.MatchCount != 2 {
+		t.Errorf("match count = %d, want 2", got.MatchCount)
+	}
+	if len(observed) != len(tests) {
+		t.Errorf("observed %v, want %d events", observed, len(tests))
+	}
+}
+
+func TestMenuEventsDeduplicated(t *testing.T) {
+	type delivery struct {
+		openid     string
+		createTime int64
+		event      message.EventType
+	}
+	tests := []struct {
+		name       string
+		noStore    bool
+		deliveries []delivery
+		want       int
+	}{
+		{
+			name:       "retried click",
+			deliveries: []delivery{{"o1", 100, message.EventClick}, {"o1", 100, message.EventClick}, {"o1", 100, message.EventClick}},
+			want:       1,
+		},
+		{
+			name:       "clicks at different times",
+			deliveries: []delivery{{"o1", 100, message.EventClick}, {"o1", 101, message.EventClick}},
+			want:       2,
+		},
+		{
+			name:       "click and view at the same time",
+			deliveries: []delivery{{"o1", 100, message.EventClick}, {"o1", 100, message.EventView}},
+			want:       2,
+		},
+		{
+			name:       "different followers",
+			deliveries: []delivery{{"o1", 100, message.EventView}, {"o2", 100, message.EventView}},
+			want:       2,
+		},
+		{
+			name:       "no dedup store",
+			noStore:    true,
+			deliveries: []delivery{{"o1", 100, message.EventClick}, {"o1", 100, message.EventClick}},
+			want:       2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			rules := repository.NewMemoryMenuRuleStore("wx1")
+			rule := &repository.MenuRule{Name: "r", Sex: 1, Menu: testMenu("k")}
+			if err := rules.Save(ctx, rule); err != nil {
+				t.Fatal(err)
+			}
+			if err := rules.SetMenuID(ctx, rule.ID, 42); err != nil {
+				t.Fatal(err)
+			}
+
+			events := NewEventService(nil)
+			events.SetMenuRuleStore(rules)
+			if !tt.noStore {
+				store := cache.NewMemoryCache(0, 0)
+				defer store.Close()
+				events.SetDedupStore(store)
+			}
+			observed := 0
+			events.AddMenuEventObserver(func(ctx context.Context, openid, event string) {
+				observed++
+			})
+
+			for _, d := range tt.deliveries {
+				msg := &message.MixMessage{MenuID: "42"}
+				msg.FromUserName = message.CDATA(d.openid)
+				msg.CreateTime = d.createTime
+				msg.Event = d.event
+				if d.event == message.EventClick {
+					if reply := events.OnClick(ctx, msg); reply == nil {
+						t.Error("retried click got no reply")
+					}
+				} else {
+					events.OnView(ctx, msg)
+				}
+			}
+
+			if observed != tt.want {
+				t.Errorf("observed %d events, want %d", observed, tt.want)
+			}
+			got, err := rules.Get(ctx, rule.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.MatchCount != int64(tt.want) {
+				t.Errorf("match count = %d, want %d", got.MatchCount, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,425 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"wechat-service/internal/model"
+	"wechat-service/internal/repository"
+)
+
+// fakeMenuClient holds a live default menu in memory
+type fakeMenuClient struct {
+	mu   sync.Mutex
+	live *model.Menu
+	sets int
+}
+
+func (c *fakeMenuClient) GetMenu(ctx context.Context) (*model.Menu, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.live == nil {
+		return &model.Menu{}, nil
+	}
+	return c.live, nil
+}
+
+func (c *fakeMenuClient) SetMenu(ctx context.Context, m *model.Menu) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.live = m
+	c.sets++
+	return nil
+}
+
+// newTestMenuService returns a service over a fake client keeping its
+// history in memory
+func newTestMenuService() (*MenuService, *fakeMenuClient) {
+	client := &fakeMenuClient{}
+	svc := NewMenuService(client, nil, testLogger())
+	svc.SetVersionStore(repository.NewMemoryMenuVersionStore("wx1"))
+	return svc, client
+}
+
+func TestMenuPublish(t *testing.T) {
+	// step publishes menu, or sets it live behind the service's back
+	// when external
+	type step struct {
+		key      string
+		force    bool
+		external bool
+	}
+
+	tests := []struct {
+		name          string
+		steps         []step
+		wantPublished []bool   // per publish step
+		wantSources   []string // recorded versions, oldest first
+		wantSets      int
+	}{
+		{
+			name:          "first publish",
+			steps:         []step{{key: "a"}},
+			wantPublished: []bool{true},
+			wantSources:   []string{repository.MenuSourcePublish},
+			wantSets:      1,
+		},
+		{
+			name:          "unchanged menu skipped",
+			steps:         []step{{key: "a"}, {key: "a"}},
+			wantPublished: []bool{true, false},
+			wantSources:   []string{repository.MenuSourcePublish},
+			wantSets:      1,
+		},
+		{
+			name:          "forced publish",
+			steps:         []step{{key: "a"}, {key: "a", force: true}},
+			wantPublished: []bool{true, true},
+			wantSources:   []string{repository.MenuSourcePublish, repository.MenuSourcePublish},
+			wantSets:      2,
+		},
+		{
+			name:          "drift recorded before publishing",
+			steps:         []step{{key: "a"}, {key: "b", external: true}, {key: "c"}},
+			wantPublished: []bool{true, true},
+			wantSources:   []string{repository.MenuSourcePublish, repository.MenuSourceDrift, repository.MenuSourcePublish},
+			wantSets:      3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, client := newTestMenuService()
+			ctx := context.Background()
+
+			var published []bool
+			for _, s := range tt.steps {
+				if s.external {
+					client.SetMenu(ctx, testMenu(s.key))
+					continue
+				}
+				result, err := svc.Publish(ctx, testMenu(s.key), PublishOptions{Force: s.force, Author: "alice"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				published = append(published, result.Published)
+			}
+
+			for i, want := range tt.wantPublished {
+				if published[i] != want {
+					t.Errorf("publish %d: published = %v, want %v", i, published[i], want)
+				}
+			}
+			versions, err := svc.Versions(ctx, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(versions) != len(tt.wantSources) {
+				t.Fatalf("%d versions recorded, want %d", len(versions), len(tt.wantSources))
+			}
+			for i, want := range tt.wantSources {
+				// Versions lists newest first
+				if got := versions[len(versions)-1-i].Source; got != want {
+					t.Errorf("version %d: source %q, want %q", i+1, got, want)
+				}
+			}
+			if client.sets != tt.wantSets {
+				t.Errorf("menu set %d times, want %d", client.sets, tt.wantSets)
+			}
+		})
+	}
+}
+
+func TestMenuRollback(t *testing.T) {
+	tests := []struct {
+		name        string
+		version     int
+		history     bool
+		wantErr     error
+		wantKey     string
+		wantVersion int
+	}{
+		{name: "to first version", version: 1, history: true, wantKey: "a", wantVersion: 3},
+		{name: "to live version", version: 2, history: true, wantKey: "b"},
+		{name: "unknown version", version: 9, history: true, wantErr: repository.ErrMenuVersionNotFound, wantKey: "b"},
+		{name: "without history", version: 1, wantErr: errors.New("menu history is not enabled"), wantKey: "b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, client := newTestMenuService()
+			if !tt.history {
+				svc.SetVersionStore(nil)
+			}
+			ctx := context.Background()
+			for _, key := range []string{"a", "b"} {
+				if _, err := svc.Publish(ctx, testMenu(key), PublishOptions{Author: "alice"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			result, err := svc.Rollback(ctx, tt.version, "bob")
+			if tt.wantErr != nil {
+				if err == nil || (!errors.Is(err, tt.wantErr) && err.Error() != tt.wantErr.Error()) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := client.live.Buttons[0].Key; got != tt.wantKey {
+				t.Errorf("live menu %q, want %q", got, tt.wantKey)
+			}
+			if tt.wantVersion == 0 {
+				if result != nil && result.Version != nil {
+					t.Errorf("recorded version %d, want none", result.Version.Version)
+				}
+				return
+			}
+			v := result.Version
+			if v == nil {
+				t.Fatal("no version recorded")
+			}
+			if v.Version != tt.wantVersion || v.Source != repository.MenuSourceRollback ||
+				v.RollbackOf != tt.version || v.Author != "bob" {
+				t.Errorf("recorded %+v", v)
+			}
+		})
+	}
+}
+
+func TestMenuCheckDrift(t *testing.T) {
+	tests := []struct {
+		name      string
+		published string // published through the service first, if set
+		live      string // then set live directly, if set
+		wantDrift bool
+	}{
+		{name: "no menu", wantDrift: false},
+		{name: "existing menu recorded", live: "a", wantDrift: true},
+		{name: "unchanged", published: "a", wantDrift: false},
+		{name: "changed outside", published: "a", live: "b", wantDrift: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, client := newTestMenuService()
+			ctx := context.Background()
+			if tt.published != "" {
+				if _, err := svc.Publish(ctx, testMenu(tt.published), PublishOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.live != "" {
+				client.SetMenu(ctx, testMenu(tt.live))
+			}
+
+			v, err := svc.CheckDrift(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (v != nil) != tt.wantDrift {
+				t.Fatalf("drift = %+v, want drift %v", v, tt.wantDrift)
+			}
+			if v != nil && (v.Source != repository.MenuSourceDrift || v.Author != driftAuthor) {
+				t.Errorf("recorded %+v", v)
+			}
+
+			// A second check finds the drift already recorded
+			if v, err := svc.CheckDrift(ctx); err != nil || v != nil {
+				t.Errorf("second check = %+v, %v", v, err)
+			}
+		})
+	}
+}
+
+// menuErrorPaths returns the paths reported by ValidateMenu
+func menuErrorPaths(t *testing.T, err error) []string {
+	t.Helper()
+	if err == nil {
+		return nil
+	}
+	var errs MenuErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("err = %v, want MenuErrors", err)
+	}
+	paths := make([]string, len(errs))
+	for i, e := range errs {
+		paths[i] = e.Path
+	}
+	return paths
+}
+
+func TestValidateMenu(t *testing.T) {
+	click := func(name string) *model.Button {
+		return &model.Button{Type: model.ButtonClick, Name: name, Key: "k"}
+	}
+
+	tests := []struct {
+		name string
+		menu *model.Menu
+		want []string // error paths, none when valid
+	}{
+		{name: "nil menu", menu: nil, want: []string{"button"}},
+		{name: "no buttons", menu: &model.Menu{}, want: []string{"button"}},
+		{name: "valid click", menu: &model.Menu{Buttons: []*model.Button{click("Help")}}},
+		{
+			name: "valid sub-menu",
+			menu: &model.Menu{Buttons: []*model.Button{{Name: "More", SubButtons: []*model.Button{
+				{Type: model.ButtonView, Name: "Site", URL: "https://example.com"},
+				{Type: model.ButtonMiniprogram, Name: "App", URL: "https://example.com", AppID: "wxa", PagePath: "pages/index"},
+				{Type: model.ButtonArticleID, Name: "News", ArticleID: "a1"},
+			}}}},
+		},
+		{
+			name: "too many buttons",
+			menu: &model.Menu{Buttons: []*model.Button{click("A"), click("B"), click("C"), click("D")}},
+			want: []string{"button"},
+		},
+		{
+			name: "too many sub-buttons",
+			menu: &model.Menu{Buttons: []*model.Button{{Name: "More", SubButtons: []*model.Button{
+				click("1"), click("2"), click("3"), click("4"), click("5"), click("6"),
+			}}}},
+			want: []string{"button[0].sub_button"},
+		},
+		{
+			name: "name byte limits",
+			menu: &model.Menu{Buttons: []*model.Button{
+				click("一二三四五六"), // 18 bytes
+				{Name: "More", SubButtons: []*model.Button{click(strings.Repeat("x", 61))}},
+				click(" "),
+			}},
+			want: []string{"button[0].name", "button[1].sub_button[0].name", "button[2].name"},
+		},
+		{
+			name: "fields required by type",
+			menu: &model.Menu{Buttons: []*model.Button{
+				{Type: model.ButtonClick, Name: "A"},
+				{Type: model.ButtonView, Name: "B"},
+				{Type: model.ButtonMiniprogram, Name: "C", URL: "https://example.com"},
+			}},
+			want: []string{"button[0].key", "button[1].url", "button[2].appid", "button[2].pagepath"},
+		},
+		{
+			name: "bad types",
+			menu: &model.Menu{Buttons: []*model.Button{
+				{Name: "A"},
+				{Type: "swipe", Name: "B"},
+				{Type: model.ButtonClick, Name: "C", SubButtons: []*model.Button{click("1")}},
+			}},
+			want: []string{"button[0].type", "button[1].type", "button[2].type"},
+		},
+		{
+			name: "nested sub-buttons",
+			menu: &model.Menu{Buttons: []*model.Button{{Name: "More", SubButtons: []*model.Button{
+				{Type: model.ButtonClick, Name: "1", Key: "k", SubButtons: []*model.Button{click("x")}},
+				nil,
+			}}}},
+			want: []string{"button[0].sub_button[0].sub_button", "button[0].sub_button[1]"},
+		},
+		{
+			name: "long key",
+			menu: &model.Menu{Buttons: []*model.Button{{Type: model.ButtonClick, Name: "A", Key: strings.Repeat("k", 129)}}},
+			want: []string{"button[0].key"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := menuErrorPaths(t, ValidateMenu(tt.menu))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("error paths %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffMenus(t *testing.T) {
+	sub := func(keys ...string) *model.Menu {
+		b := &model.Button{Name: "More"}
+		for _, k := range keys {
+			b.SubButtons = append(b.SubButtons, &model.Button{Type: model.ButtonClick, Name: k, Key: k})
+		}
+		return &model.Menu{Buttons: []*model.Button{b}}
+	}
+
+	tests := []struct {
+		name string
+		from *model.Menu
+		to   *model.Menu
+		want []string // "path kind"
+	}{
+		{name: "both empty", from: nil, to: &model.Menu{}},
+		{name: "same", from: testMenu("a"), to: testMenu("a")},
+		{name: "added from nothing", from: nil, to: testMenu("a"), want: []string{"button[0] added"}},
+		{name: "removed", from: testMenu("a"), to: &model.Menu{}, want: []string{"button[0] removed"}},
+		{name: "changed key", from: testMenu("a"), to: testMenu("b"), want: []string{"button[0] changed"}},
+		{name: "sub-button added", from: sub("a"), to: sub("a", "b"), want: []string{"button[0].sub_button[1] added"}},
+		{
+			name: "sub-button changed and removed",
+			from: sub("a", "b"),
+			to:   sub("c"),
+			want: []string{"button[0].sub_button[0] changed", "button[0].sub_button[1] removed"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, c := range DiffMenus(tt.from, tt.to) {
+				got = append(got, c.Path+" "+c.Kind)
+				if c.Kind == model.MenuChangeChanged && (c.Old.SubButtons != nil || c.New.SubButtons != nil) {
+					t.Errorf("%s: changed buttons carry sub-buttons", c.Path)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("changes %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMenu(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		data    string
+		wantKey string
+		wantErr bool
+	}{
+		{name: "yaml", format: "yaml", data: "button:\n  - type: click\n    name: Help\n    key: help\n", wantKey: "help"},
+		{name: "json", format: "json", data: `{"button":[{"type":"click","name":"Help","key":"help"}]}`, wantKey: "help"},
+		{name: "yaml unknown key", format: "yaml", data: "button:\n  - type: click\n    name: Help\n    keys: help\n", wantErr: true},
+		{name: "json unknown key", format: "json", data: `{"buttons":[]}`, wantErr: true},
+		{name: "malformed", format: "json", data: `{"button":`, wantErr: true},
+		{name: "unknown format", format: "toml", data: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := ParseMenu([]byte(tt.data), tt.format)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && m.Buttons[0].Key != tt.wantKey {
+				t.Errorf("key = %q, want %q", m.Buttons[0].Key, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestLoadMenuFileExample(t *testing.T) {
+	m, err := LoadMenuFile(filepath.Join("..", "..", "menu.example.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateMenu(m); err != nil {
+		t.Errorf("example menu is invalid: %v", err)
+	}
+}
@@ -1,14 +1,35 @@
 package service
 
 import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
 	"wechat-service/internal/repository"
+	"wechat-service/pkg/cache"
+	"wechat-service/pkg/tracing"
 
 	"github.com/silenceper/wechat/v2/officialaccount/message"
 )
 
+// MessageDedupTTL is how long a handled MsgID is remembered. WeChat
+// retries an unanswered callback three times within about 15 seconds.
+const MessageDedupTTL = 5 * time.Minute
+
+// replyPending marks a MsgID whose first delivery is still being handled
+const replyPending = "pending"
+
 // MessageService handles message business logic
 type MessageService struct {
-	repo *repository.MessageRepository
+	repo  *repository.MessageRepository
+	dedup cache.Store
+}
+
+// replyRecord is the reply to a message, kept for callback retries
+type replyRecord struct {
+	MsgType message.MsgType `json:"msg_type,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
 }
 
 // NewMessageService creates a new message service
@@ -18,8 +39,16 @@ func NewMessageService(repo *repository.MessageRepository) *MessageService {
 	}
 }
 
+// SetDedupStore sets the store used to recognize retried callbacks
+func (s *MessageService) SetDedupStore(store cache.Store) {
+	s.dedup = store
+}
+
 // OnTextMessage handles text messages - SDK calls this
-func (s *MessageService) OnTextMessage(msg *message.MixMessage) *message.Reply {
+func (s *MessageService) OnTextMessage(ctx context.Context, msg *message.MixMessage) *message.Reply {
+	_, span := tracing.Start(ctx, "MessageService.OnTextMessage")
+	defer span.End()
+
 	return &message.Reply{
 		MsgType: message.MsgTypeText,
 		MsgData: message.NewText(string(msg.Content)),
@@ -27,7 +56,10 @@ func (s *MessageService) OnTextMessage(msg *message.MixMessage) *message.Reply {
 }
 
 // OnImageMessage handles image messages
-func (s *MessageService) OnImageMessage(msg *message.MixMessage) *message.Reply {
+func (s *MessageService) OnImageMessage(ctx context.Context, msg *message.MixMessage) *message.Reply {
+	_, span := tracing.Start(ctx, "MessageService.OnImageMessage")
+	defer span.End()
+
 	return &message.Reply{
 		MsgType: message.MsgTypeImage,
 		MsgData: message.NewImage(string(msg.MediaID)),
@@ -35,49 +67,165 @@ func (s *MessageService) OnImageMessage(msg *message.MixMessage) *message.Reply
 }
 
 // OnVoiceMessage handles voice messages
-func (s *MessageService) OnVoiceMessage(msg *message.MixMessage) *message.Reply {
+func (s *MessageService) OnVoiceMessage(ctx context.Context, msg *message.MixMessage) *message.Reply {
+	_, span := tracing.Start(ctx, "MessageService.OnVoiceMessage")
+	defer span.End()
+
 	return nil
 }
 
 // OnVideoMessage handles video messages
-func (s *MessageService) OnVideoMessage(msg *message.MixMessage) *message.Reply {
+func (s *MessageService) OnVideoMessage(ctx context.Context, msg *message.MixMessage) *message.Reply {
+	_, span := tracing.Start(ctx, "MessageService.OnVideoMessage")
+	defer span.End()
+
 	return nil
 }
 
 // OnLocationMessage handles location messages
-func (s *MessageService) OnLocationMessage(msg *message.MixMessage) *message.Reply {
+func (s *MessageService) OnLocationMessage(ctx context.Context, msg *message.MixMessage) *message.Reply {
+	_, span := tracing.Start(ctx, "MessageService.OnLocationMessage")
+	defer span.End()
+
 	return nil
 }
 
 // OnLinkMessage handles link messages
-func (s *MessageService) OnLinkMessage(msg *message.MixMessage) *message.Reply {
+func (s *MessageService) OnLinkMessage(ctx context.Context, msg *message.MixMessage) *message.Reply {
+	_, span := tracing.Start(ctx, "MessageService.OnLinkMessage")
+	defer span.End()
+
 	return nil
 }
 
 // SaveMessage saves a message to repository
-func (s *MessageService) SaveMessage(msg *message.MixMessage) error {
+func (s *MessageService) SaveMessage(ctx context.Context, msg *message.MixMessage) error {
+	ctx, span := tracing.Start(ctx, "MessageService.SaveMessage")
+	defer span.End()
+
 	if s.repo == nil {
 		return nil
 	}
 
 	repoMsg := &repository.Message{
-		MsgID: msg.MsgID,
+		MsgID:        msg.MsgID,
+		FromUser:     string(msg.FromUserName),
+		ToUser:       string(msg.ToUserName),
+		MsgType:      string(msg.MsgType),
+		Content:      msg.Content,
+		MediaID:      msg.MediaID,
+		PicURL:       msg.PicURL,
+		Format:       msg.Format,
+		ThumbMediaID: msg.ThumbMediaID,
+		LocationX:    msg.LocationX,
+		LocationY:    msg.LocationY,
+		Scale:        int(msg.Scale),
+		Label:        msg.Label,
+		Title:        msg.Title,
+		Description:  msg.Description,
+		URL:          msg.URL,
+	}
+
+	return s.repo.Save(ctx, repoMsg)
+}
+
+// Claim marks msg as being handled. It returns false for a retry of a
+// message already claimed, together with the reply sent the first time
+// once it is known. Messages without MsgID, or without a dedup store,
+// are always claimed; so are messages whose claim fails with an error.
+func (s *MessageService) Claim(ctx context.Context, msg *message.MixMessage) (bool, *message.Reply, error) {
+	ctx, span := tracing.Start(ctx, "MessageService.Claim")
+	defer span.End()
+
+	if s.dedup == nil || msg.MsgID == 0 {
+		return true, nil, nil
+	}
+
+	key := dedupKey(msg)
+	claimed, err := s.dedup.SetNX(ctx, key, replyPending, MessageDedupTTL)
+	if err != nil || claimed {
+		return true, nil, err
+	}
+
+	record, err := cache.GetJSON[replyRecord](ctx, s.dedup, key)
+	if err != nil {
+		// Still pending, or expired since
+		return false, nil, nil
+	}
+	reply, err := decodeReply(record)
+	return false, reply, err
+}
+
+// RememberReply stores the reply to a claimed msg, which may be nil, so
+// that retries of msg are answered the same way
+func (s *MessageService) RememberReply(ctx context.Context, msg *message.MixMessage, reply *message.Reply) error {
+	ctx, span := tracing.Start(ctx, "MessageService.RememberReply")
+	defer span.End()
+
+	if s.dedup == nil || msg.MsgID == 0 {
+		return nil
 	}
 
-	return s.repo.Save(repoMsg)
+	var record replyRecord
+	if reply != nil {
+		data, err := json.Marshal(reply.MsgData)
+		if err != nil {
+			return err
+		}
+		record = replyRecord{MsgType: reply.MsgType, Data: data}
+	}
+	return cache.SetJSON(ctx, s.dedup, dedupKey(msg), record, MessageDedupTTL)
+}
+
+// dedupKey returns the dedup store key of msg
+func dedupKey(msg *message.MixMessage) string {
+	return "msg:" + strconv.FormatInt(msg.MsgID, 10)
+}
+
+// decodeReply rebuilds a reply from its record; an empty record is no
+// reply
+func decodeReply(record replyRecord) (*message.Reply, error) {
+	var data interface{}
+	switch record.MsgType {
+	case "":
+		return nil, nil
+	case message.MsgTypeText:
+		data = &message.Text{}
+	case message.MsgTypeImage:
+		data = &message.Image{}
+	case message.MsgTypeVoice:
+		data = &message.Voice{}
+	case message.MsgTypeVideo:
+		data = &message.Video{}
+	case message.MsgTypeMusic:
+		data = &message.Music{}
+	case message.MsgTypeNews:
+		data = &message.News{}
+	case message.MsgTypeTransfer:
+		data = &message.TransferCustomer{}
+	default:
+		return nil, message.ErrUnsupportReply
+	}
+	if err := json.Unmarshal(record.Data, data); err != nil {
+		return nil, err
+	}
+	return &message.Reply{MsgType: record.MsgType, MsgData: data}, nil
 }
 
 // GetMessageStats returns message statistics
-func (s *MessageService) GetMessageStats() map[string]int {
+func (s *MessageService) GetMessageStats(ctx context.Context) map[string]int {
+	ctx, span := tracing.Start(ctx, "MessageService.GetMessageStats")
+	defer span.End()
+
 	if s.repo == nil {
 		return nil
 	}
 
 	return map[string]int{
-		"text":  s.repo.CountByType("text"),
-		"image": s.repo.CountByType("image"),
-		"voice": s.repo.CountByType("voice"),
-		"video": s.repo.CountByType("video"),
-		"total": s.repo.Count(),
+		"text":  s.repo.CountByType(ctx, "text"),
+		"image": s.repo.CountByType(ctx, "image"),
+		"voice": s.repo.CountByType(ctx, "voice"),
+		"video": s.repo.CountByType(ctx, "video"),
+		"total": s.repo.Count(ctx),
 	}
 }
@@ -0,0 +1,125 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"wechat-service/pkg/cache"
+
+	"github.com/silenceper/wechat/v2/officialaccount/message"
+)
+
+func TestMessageServiceClaim(t *testing.T) {
+	text := &message.Reply{MsgType: message.MsgTypeText, MsgData: message.NewText("hello")}
+	image := &message.Reply{MsgType: message.MsgTypeImage, MsgData: message.NewImage("media-1")}
+	news := &message.Reply{MsgType: message.MsgTypeNews, MsgData: message.NewNews([]*message.Article{
+		message.NewArticle("title", "desc", "https://example.com/p.png", "https://example.com"),
+	})}
+
+	tests := []struct {
+		name        string
+		msgID       int64
+		noStore     bool
+		first       bool           // claim and answer the message once before
+		firstReply  *message.Reply // reply remembered by the first delivery
+		pending     bool           // the first delivery is still being handled
+		wantClaimed bool
+		wantReply   *message.Reply
+	}{
+		{name: "first delivery", msgID: 1, wantClaimed: true},
+		{name: "no msgid", msgID: 0, first: true, wantClaimed: true},
+		{name: "no store", msgID: 1, noStore: true, first: true, wantClaimed: true},
+		{name: "retry while pending", msgID: 1, pending: true},
+		{name: "retry after no reply", msgID: 1, first: true},
+		{name: "retry after text", msgID: 1, first: true, firstReply: text, wantReply: text},
+		{name: "retry after image", msgID: 1, first: true, firstReply: image, wantReply: image},
+		{name: "retry after news", msgID: 1, first: true, firstReply: news, wantReply: news},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			svc := NewMessageService(nil)
+			if !tt.noStore {
+				store := cache.NewMemoryCache(0, 0)
+				defer store.Close()
+				svc.SetDedupStore(store)
+			}
+			msg := &message.MixMessage{}
+			msg.MsgID = tt.msgID
+
+			if tt.first || tt.pending {
+				if _, _, err := svc.Claim(ctx, msg); err != nil {
+					t.Fatalf("first Claim: %v", err)
+				}
+			}
+			if tt.first {
+				if err := svc.RememberReply(ctx, msg, tt.firstReply); err != nil {
+					t.Fatalf("RememberReply: %v", err)
+				}
+			}
+
+			claimed, reply, err := svc.Claim(ctx, msg)
+			if err != nil {
+				t.Fatalf("Claim: %v", err)
+			}
+			if claimed != tt.wantClaimed {
+				t.Errorf("claimed = %v, want %v", claimed, tt.wantClaimed)
+			}
+			if (reply == nil) != (tt.wantReply == nil) {
+				t.Fatalf("reply = %+v, want %+v", reply, tt.wantReply)
+			}
+			if reply == nil {
+				return
+			}
+			if reply.MsgType != tt.wantReply.MsgType {
+				t.Errorf("reply type = %q, want %q", reply.MsgType, tt.wantReply.MsgType)
+			}
+			switch want := tt.wantReply.MsgData.(type) {
+			case *message.Text:
+				if got, ok := reply.MsgData.(*message.Text); !ok || got.Content != want.Content {
+					t.Errorf("reply data = %+v, want %+v", reply.MsgData, want)
+				}
+			case *message.Image:
+				if got, ok := reply.MsgData.(*message.Image); !ok || got.Image.MediaID != want.Image.MediaID {
+					t.Errorf("reply data = %+v, want %+v", reply.MsgData, want)
+				}
+			case *message.News:
+				got, ok := reply.MsgData.(*message.News)
+				if !ok || len(got.Articles) != 1 || got.Articles[0].Title != want.Articles[0].Title {
+					t.Errorf("reply data = %+v, want %+v", reply.MsgData, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMessageServiceClaimIsAtomic(t *testing.T) {
+	ctx := context.Background()
+	store := cache.NewMemoryCache(0, 0)
+	defer store.Close()
+	svc := NewMessageService(nil)
+	svc.SetDedupStore(store)
+
+	msg := &message.MixMessage{}
+	msg.MsgID = 42
+
+	const deliveries = 20
+	claims := make(chan bool, deliveries)
+	for i := 0; i < deliveries; i++ {
+		go func() {
+			claimed, _, _ := svc.Claim(ctx, msg)
+			claims <- claimed
+		}()
+	}
+
+	var n int
+	for i := 0; i < deliveries; i++ {
+		if <-claims {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("%d concurrent deliveries claimed the message, want 1", n)
+	}
+}
@@ -1,26 +1,53 @@
 package service
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
 	"wechat-service/internal/config"
 	"wechat-service/pkg/cache"
 	"wechat-service/pkg/logger"
+	"wechat-service/pkg/metrics"
+
+	"github.com/silenceper/wechat/v2/credential"
+)
+
+const (
+	tokenPath       = "/cgi-bin/token?grant_type=client_credential&appid=%s&secret=%s"
+	stableTokenPath = "/cgi-bin/stable_token"
 )
 
-// Server wraps the SDK's token management with additional features
+// Server is the access token handle of one account (see
+// OfficialAccount.SetAccessTokenHandle). It caches tokens under the SDK's
+// cache keys, refreshes them ahead of expiry and records every fetch.
 type Server struct {
 	cfg       *config.Config
 	cache     cache.Cache
 	log       *logger.Logger
+	metrics   *metrics.Metrics
+	client    *http.Client
 	mu        sync.RWMutex
+	fetchMu   sync.Mutex
 	stats     ServerStats
 	stopCh    chan struct{}
 	wg        sync.WaitGroup
 }
 
+// tokenResponse is the reply of the token endpoints
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+	ErrCode     int64  `json:"errcode"`
+	ErrMsg      string `json:"errmsg"`
+}
+
 // ServerStats represents token server statistics
 type ServerStats struct {
 	RefreshCount    int64     `json:"refresh_count"`
@@ -35,8 +62,10 @@ func NewServer(cfg *config.Config, cacheInst cache.Cache, log *logger.Logger) *S
 		cfg:    cfg,
 		cache:  cacheInst,
 		log:    log,
+		client: &http.Client{Timeout: 10 * time.Second},
 		stopCh: make(chan struct{}),
 	}
+	s.syncRefreshTime()
 
 	// Start proactive refresh if enabled
 	if cfg.AccessToken.EnableProactive {
@@ -46,6 +75,50 @@ func NewServer(cfg *config.Config, cacheInst cache.Cache, log *logger.Logger) *S
 	return s
 }
 
+// SetMetrics enables token refresh metrics and the token age gauge
+func (s *Server) SetMetrics(m *metrics.Metrics) {
+	s.mu.Lock()
+	s.metrics = m
+	s.mu.Unlock()
+
+	m.RegisterTokenAge(func() float64 {
+		last := s.GetStats().LastRefreshTime
+		if last.IsZero() {
+			return 0
+		}
+		return time.Since(last).Seconds()
+	})
+}
+
+// SetHTTPClient replaces the client used to call the token endpoints
+func (s *Server) SetHTTPClient(client *http.Client) {
+	s.fetchMu.Lock()
+	s.client = client
+	s.fetchMu.Unlock()
+}
+
+// GetAccessToken returns the access token, for credential.AccessTokenHandle
+func (s *Server) GetAccessToken() (string, error) {
+	return s.GetAccessTokenContext(context.Background())
+}
+
+// GetAccessTokenContext returns the cached access token, fetching a new
+// one from WeChat when the cache has none
+func (s *Server) GetAccessTokenContext(ctx context.Context) (string, error) {
+	if token := s.cachedToken(); token != "" {
+		return token, nil
+	}
+
+	s.fetchMu.Lock()
+	defer s.fetchMu.Unlock()
+
+	// Another caller may have fetched while we waited
+	if token := s.cachedToken(); token != "" {
+		return token, nil
+	}
+	return s.fetch(ctx)
+}
+
 // GetStats returns current server statistics
 func (s *Server) GetStats() ServerStats {
 	s.mu.RLock()
@@ -58,12 +131,25 @@ func (s *Server) GetStats() ServerStats {
 	}
 }
 
-// recordSuccess records a successful refresh
-func (s *Server) recordSuccess() {
+// RefreshStats returns the refresh failure count and the last successful
+// refresh time, for monitor.TokenStatsProvider
+func (s *Server) RefreshStats() (int64, time.Time) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.stats.FailureCount, s.stats.LastRefreshTime
+}
+
+// recordSuccess records a successful refresh at now
+func (s *Server) recordSuccess(now time.Time) {
 	s.mu.Lock()
 	s.stats.RefreshCount++
-	s.stats.LastRefreshTime = time.Now()
+	s.stats.LastRefreshTime = now
+	m := s.metrics
 	s.mu.Unlock()
+
+	if m != nil {
+		m.IncTokenRefresh()
+	}
 }
 
 // recordFailure records a failed refresh
@@ -98,19 +184,157 @@ func (s *Server) startProactiveRefresh() {
 	}()
 }
 
-// proactiveRefresh performs proactive token refresh
+// proactiveRefresh refreshes the token when it would be older than
+// AccessToken.CacheDuration by the next tick
 func (s *Server) proactiveRefresh() {
-	// The SDK handles token refresh automatically via cache
-	// This is for custom logging and metrics
-	s.log.Debug("Proactive refresh check", "refresh_count", s.stats.RefreshCount)
+	s.syncRefreshTime()
+	_, last := s.RefreshStats()
+
+	interval := time.Duration(s.cfg.AccessToken.RefreshInterval) * time.Second
+	maxAge := time.Duration(s.cfg.AccessToken.CacheDuration) * time.Second
+	if s.cachedToken() != "" && !last.IsZero() && time.Since(last)+interval < maxAge {
+		s.log.Debug("Proactive refresh check", "token_age", time.Since(last).Round(time.Second))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	s.Refresh(ctx)
 }
 
 // Refresh forces a token refresh
 func (s *Server) Refresh(ctx context.Context) error {
-	// SDK manages token refresh automatically
-	// This can be used for manual refresh if needed
-	s.log.Info("Manual token refresh triggered")
-	return nil
+	s.fetchMu.Lock()
+	defer s.fetchMu.Unlock()
+
+	_, err := s.fetch(ctx)
+	return err
+}
+
+// fetch requests a token from WeChat, caches it and records the outcome.
+// Callers hold fetchMu.
+func (s *Server) fetch(ctx context.Context) (string, error) {
+	res, err := s.requestToken(ctx)
+	if err != nil {
+		s.recordFailure()
+		s.log.Error("Access token refresh failed", "error", err, "failure_count", s.GetStats().FailureCount)
+		return "", err
+	}
+
+	// Expire the cached token ahead of WeChat, with the SDK's margins
+	margin := 1500 * time.Second
+	if s.cfg.AccessToken.UseStableAPI {
+		margin = 300 * time.Second
+	}
+	ttl := time.Duration(res.ExpiresIn)*time.Second - margin
+	if ttl <= 0 {
+		ttl = time.Duration(res.ExpiresIn) * time.Second
+	}
+	if maxAge := time.Duration(s.cfg.AccessToken.CacheDuration) * time.Second; maxAge > 0 && ttl > maxAge {
+		ttl = maxAge
+	}
+
+	now := time.Now()
+	if err := s.cache.Set(s.cacheKey(), res.AccessToken, ttl); err != nil {
+		s.log.Warn("Failed to cache access token", "error", err)
+	}
+	s.cache.Set(s.refreshedKey(), strconv.FormatInt(now.UnixNano(), 10), ttl)
+	s.recordSuccess(now)
+
+	s.log.Info("Access token refreshed", "expires_in", res.ExpiresIn)
+	return res.AccessToken, nil
+}
+
+// requestToken calls the token endpoint selected by AccessToken.UseStableAPI
+func (s *Server) requestToken(ctx context.Context) (*tokenResponse, error) {
+	base := "https://" + s.cfg.GetAPIEndpoint()
+
+	var req *http.Request
+	var err error
+	if s.cfg.AccessToken.UseStableAPI {
+		body, _ := json.Marshal(map[string]interface{}{
+			"grant_type":    "client_credential",
+			"appid":         s.cfg.WeChat.AppID,
+			"secret":        s.cfg.WeChat.AppSecret,
+			"force_refresh": false,
+		})
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, base+stableTokenPath, bytes.NewReader(body))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+	} else {
+		url := base + fmt.Sprintf(tokenPath, s.cfg.WeChat.AppID, s.cfg.WeChat.AppSecret)
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to build token request: %w", err)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned %d", resp.StatusCode)
+	}
+
+	var res tokenResponse
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, fmt.Errorf("failed to decode token response: %w", err)
+	}
+	if res.ErrCode != 0 {
+		return nil, fmt.Errorf("get access_token error: errcode=%d, errmsg=%s", res.ErrCode, res.ErrMsg)
+	}
+	if res.AccessToken == "" {
+		return nil, fmt.Errorf("token response has no access_token")
+	}
+	return &res, nil
+}
+
+// cachedToken returns the cached token, or "" when there is none
+func (s *Server) cachedToken() string {
+	token, _ := s.cache.Get(s.cacheKey()).(string)
+	return token
+}
+
+// syncRefreshTime adopts the refresh time cached by the last fetch, which
+// may come from an earlier run or another instance sharing the cache
+func (s *Server) syncRefreshTime() {
+	val := s.cache.Get(s.refreshedKey())
+	if val == nil {
+		return
+	}
+	nanos, err := strconv.ParseInt(fmt.Sprint(val), 10, 64)
+	if err != nil {
+		return
+	}
+
+	refreshed := time.Unix(0, nanos)
+	s.mu.Lock()
+	if refreshed.After(s.stats.LastRefreshTime) {
+		s.stats.LastRefreshTime = refreshed
+	}
+	s.mu.Unlock()
+}
+
+// cacheKey returns the SDK's cache key for the account's token, so tokens
+// cached before the server took over stay in use
+func (s *Server) cacheKey() string {
+	if s.cfg.AccessToken.UseStableAPI {
+		return fmt.Sprintf("%s_stable_access_token_%s", credential.CacheKeyOfficialAccountPrefix, s.cfg.WeChat.AppID)
+	}
+	return fmt.Sprintf("%s_access_token_%s", credential.CacheKeyOfficialAccountPrefix, s.cfg.WeChat.AppID)
+}
+
+// refreshedKey returns the key holding the time of the last fetch
+func (s *Server) refreshedKey() string {
+	return s.cacheKey() + "_refreshed_at"
 }
 
 // Stop stops the token server
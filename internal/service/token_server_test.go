@@ -0,0 +1,297 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"wechat-service/internal/config"
+	"wechat-service/pkg/cache"
+	"wechat-service/pkg/metrics"
+	"wechat-service/pkg/monitor"
+)
+
+// newTestTokenServer returns a Server for wx1 fetching tokens from a TLS
+// test server running handler, and the number of requests it received
+func newTestTokenServer(t *testing.T, stable bool, handler http.HandlerFunc) (*Server, *int32) {
+	t.Helper()
+	var hits int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		handler(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	cfg := &config.Config{}
+	cfg.WeChat.AppID = "wx1"
+	cfg.WeChat.AppSecret = "secret-wx1"
+	cfg.APIDomain.Primary = strings.TrimPrefix(srv.URL, "https://")
+	cfg.AccessToken.CacheDuration = 7000
+	cfg.AccessToken.RefreshInterval = 3600
+	cfg.AccessToken.UseStableAPI = stable
+
+	c := cache.NewMemoryCache(0, time.Hour)
+	t.Cleanup(func() { c.Close() })
+
+	s := NewServer(cfg, c, testLogger())
+	s.SetHTTPClient(srv.Client())
+	t.Cleanup(s.Stop)
+	return s, &hits
+}
+
+// tokenReply answers every token request with body
+func tokenReply(body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}
+}
+
+func TestServerGetAccessToken(t *testing.T) {
+	tests := []struct {
+		name         string
+		stable       bool
+		status       int
+		body         string
+		wantToken    string
+		wantErr      bool
+		wantRefresh  int64
+		wantFailures int64
+	}{
+		{name: "fetched", body: `{"access_token":"tok-1","expires_in":7200}`, wantToken: "tok-1", wantRefresh: 1},
+		{name: "stable api", stable: true, body: `{"access_token":"tok-s","expires_in":7200}`, wantToken: "tok-s", wantRefresh: 1},
+		{name: "errcode", body: `{"errcode":40001,"errmsg":"invalid credential"}`, wantErr: true, wantFailures: 1},
+		{name: "http error", status: http.StatusBadGateway, wantErr: true, wantFailures: 1},
+		{name: "no token", body: `{"expires_in":7200}`, wantErr: true, wantFailures: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, hits := newTestTokenServer(t, tt.stable, func(w http.ResponseWriter, r *http.Request) {
+				wantPath := "/cgi-bin/token"
+				if tt.stable {
+					wantPath = "/cgi-bin/stable_token"
+					var req map[string]interface{}
+					if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req["appid"] != "wx1" {
+						t.Errorf("stable token request = %v, %v", req, err)
+					}
+				} else if r.URL.Query().Get("appid") != "wx1" {
+					t.Errorf("token request query = %s", r.URL.RawQuery)
+				}
+				if r.URL.Path != wantPath {
+					t.Errorf("path = %s, want %s", r.URL.Path, wantPath)
+				}
+				if tt.status != 0 {
+					w.WriteHeader(tt.status)
+				}
+				w.Write([]byte(tt.body))
+			})
+
+			for i := 0; i < 2; i++ {
+				token, err := s.GetAccessTokenContext(context.Background())
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("call %d: err = %v, wantErr %v", i, err, tt.wantErr)
+				}
+				if token != tt.wantToken {
+					t.Errorf("call %d: token = %q, want %q", i, token, tt.wantToken)
+				}
+			}
+
+			// A cached token is served without another request
+			wantHits := int32(2)
+			if !tt.wantErr {
+				wantHits = 1
+			}
+			if got := atomic.LoadInt32(hits); got != wantHits {
+				t.Errorf("token endpoint hit %d times, want %d", got, wantHits)
+			}
+
+			stats := s.GetStats()
+			if stats.RefreshCount != tt.wantRefresh || stats.FailureCount != tt.wantFailures*int64(wantHits) {
+				t.Errorf("stats = %+v, want %d refreshes and %d failures", stats, tt.wantRefresh, tt.wantFailures*int64(wantHits))
+			}
+			if (tt.wantRefresh > 0) == stats.LastRefreshTime.IsZero() {
+				t.Errorf("LastRefreshTime = %v after %d refreshes", stats.LastRefreshTime, tt.wantRefresh)
+			}
+		})
+	}
+}
+
+func TestServerRefreshFailureFiresRule(t *testing.T) {
+	var failing atomic.Bool
+	s, _ := newTestTokenServer(t, false, func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.Write([]byte(`{"errcode":-1,"errmsg":"system error"}`))
+			return
+		}
+		w.Write([]byte(`{"access_token":"tok-1","expires_in":7200}`))
+	})
+
+	rule := monitor.TokenFailureRule(s)
+	ctx := context.Background()
+
+	steps := []struct {
+		name      string
+		refresh   bool
+		fail      bool
+		wantAlert bool
+	}{
+		{name: "primes on success", refresh: true},
+		{name: "failed refresh alerts", refresh: true, fail: true, wantAlert: true},
+		{name: "no new failures"},
+		{name: "recovered", refresh: true},
+	}
+
+	for _, step := range steps {
+		failing.Store(step.fail)
+		if step.refresh {
+			err := s.Refresh(ctx)
+			if (err != nil) != step.fail {
+				t.Fatalf("%s: Refresh err = %v", step.name, err)
+			}
+		}
+
+		alerts := rule.Evaluate(time.Now())
+		if got := len(alerts) > 0; got != step.wantAlert {
+			t.Fatalf("%s: alerts = %+v, want alert %v", step.name, alerts, step.wantAlert)
+		}
+		if step.wantAlert && alerts[0].Type != monitor.AlertTypeTokenRefreshFailure {
+			t.Errorf("%s: alert type = %s", step.name, alerts[0].Type)
+		}
+	}
+}
+
+func TestTokenFreshnessCheckWithServer(t *testing.T) {
+	tests := []struct {
+		name      string
+		refreshed time.Duration // age of a refresh cached by another instance, 0 for none
+		fetch     bool
+		want      string
+	}{
+		{name: "never refreshed", want: monitor.StatusWarn},
+		{name: "fetched", fetch: true, want: monitor.StatusOK},
+		{name: "refreshed by another instance", refreshed: time.Minute, want: monitor.StatusOK},
+		{name: "stale", refreshed: 3 * time.Hour, want: monitor.StatusFail},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestTokenServer(t, false, tokenReply(`{"access_token":"tok-1","expires_in":7200}`))
+			if tt.refreshed > 0 {
+				at := time.Now().Add(-tt.refreshed).UnixNano()
+				s.cache.Set(s.refreshedKey(), strconv.FormatInt(at, 10), time.Hour)
+				s.syncRefreshTime()
+			}
+			if tt.fetch {
+				if _, err := s.GetAccessTokenContext(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			check := monitor.TokenFreshnessCheck(s.cfg, s)
+			if got, message := check(context.Background()); got != tt.want {
+				t.Errorf("status = %s (%s), want %s", got, message, tt.want)
+			}
+		})
+	}
+}
+
+func TestServerProactiveRefresh(t *testing.T) {
+	tests := []struct {
+		name      string
+		cached    bool
+		age       time.Duration
+		wantFetch bool
+	}{
+		{name: "no token", wantFetch: true},
+		{name: "fresh token kept", cached: true, age: time.Minute},
+		{name: "expires before next tick", cached: true, age: 4000 * time.Second, wantFetch: true},
+		{name: "token of unknown age", cached: true, wantFetch: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, hits := newTestTokenServer(t, false, tokenReply(`{"access_token":"tok-new","expires_in":7200}`))
+			if tt.cached {
+				s.cache.Set(s.cacheKey(), "tok-old", time.Hour)
+			}
+			if tt.age > 0 {
+				at := time.Now().Add(-tt.age).UnixNano()
+				s.cache.Set(s.refreshedKey(), strconv.FormatInt(at, 10), time.Hour)
+			}
+
+			s.proactiveRefresh()
+
+			if got := atomic.LoadInt32(hits) > 0; got != tt.wantFetch {
+				t.Errorf("fetched = %v, want %v", got, tt.wantFetch)
+			}
+			want := "tok-old"
+			if tt.wantFetch {
+				want = "tok-new"
+			}
+			if token, _ := s.GetAccessToken(); token != want {
+				t.Errorf("token = %q, want %q", token, want)
+			}
+		})
+	}
+}
+
+// tokenMetricValue returns the value of the single-series metric name
+func tokenMetricValue(t *testing.T, m *metrics.Metrics, name string) float64 {
+	t.Helper()
+	families, err := m.Gatherer().Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		metric := f.GetMetric()[0]
+		if metric.GetCounter() != nil {
+			return metric.GetCounter().GetValue()
+		}
+		return metric.GetGauge().GetValue()
+	}
+	t.Fatalf("metric %s not exported", name)
+	return 0
+}
+
+func TestServerTokenMetrics(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		refreshes    int
+		wantRefresh  float64
+		wantPositive bool // token age gauge above zero
+	}{
+		{name: "before any refresh"},
+		{name: "refreshed", body: `{"access_token":"tok-1","expires_in":7200}`, refreshes: 2, wantRefresh: 2, wantPositive: true},
+		{name: "failed refreshes", body: `{"errcode":-1}`, refreshes: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestTokenServer(t, false, tokenReply(tt.body))
+			m := metrics.NewMetrics(nil, "wx1")
+			s.SetMetrics(m)
+
+			for i := 0; i < tt.refreshes; i++ {
+				s.Refresh(context.Background())
+			}
+			time.Sleep(time.Millisecond)
+
+			if got := tokenMetricValue(t, m, "wechat_token_refreshes_total"); got != tt.wantRefresh {
+				t.Errorf("refresh counter = %v, want %v", got, tt.wantRefresh)
+			}
+			if got := tokenMetricValue(t, m, "wechat_access_token_age_seconds"); (got > 0) != tt.wantPositive {
+				t.Errorf("token age = %v, want positive %v", got, tt.wantPositive)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+-- Monitoring: alert and health check history
+-- PostgreSQL
+
+-- =====================================================
+-- ALERTS TABLE
+-- =====================================================
+CREATE TABLE IF NOT EXISTS alerts (
+    id              VARCHAR(64) PRIMARY KEY,
+    appid           VARCHAR(64),
+    nickname        VARCHAR(256),
+    type            VARCHAR(64) NOT NULL,
+    description     VARCHAR(512),
+    count           INTEGER DEFAULT 0,
+    first_time      TIMESTAMP WITH TIME ZONE,
+    example         JSONB DEFAULT '{}',
+    severity        VARCHAR(16) NOT NULL,
+    status          VARCHAR(16) NOT NULL DEFAULT 'firing',  -- firing, acknowledged, resolved
+    acknowledged_by VARCHAR(64),
+    acknowledged_at TIMESTAMP WITH TIME ZONE,
+    resolved_at     TIMESTAMP WITH TIME ZONE,
+    created_at      TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_alerts_type ON alerts(type);
+CREATE INDEX IF NOT EXISTS idx_alerts_severity ON alerts(severity);
+CREATE INDEX IF NOT EXISTS idx_alerts_status ON alerts(status);
+CREATE INDEX IF NOT EXISTS idx_alerts_created_at ON alerts(created_at DESC);
+
+-- =====================================================
+-- HEALTH CHECKS TABLE
+-- =====================================================
+CREATE TABLE IF NOT EXISTS health_checks (
+    id              BIGSERIAL PRIMARY KEY,
+    name            VARCHAR(64) NOT NULL,
+    status          VARCHAR(16) NOT NULL,
+    message         TEXT,
+    critical        BOOLEAN DEFAULT FALSE,
+    duration        VARCHAR(32),
+    checked_at      TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_health_checks_name_time ON health_checks(name, checked_at DESC);
+CREATE INDEX IF NOT EXISTS idx_health_checks_checked_at ON health_checks(checked_at DESC);
+
+COMMENT ON TABLE alerts IS 'Alerts pushed by WeChat or raised by internal anomaly rules';
+COMMENT ON TABLE health_checks IS 'Periodic health check results';
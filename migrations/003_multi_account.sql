@@ -0,0 +1,66 @@
+-- Multi-account: partition per-account data by app_id
+-- PostgreSQL
+
+-- =====================================================
+-- USERS
+-- =====================================================
+ALTER TABLE users ADD COLUMN IF NOT EXISTS app_id VARCHAR(64) NOT NULL DEFAULT '';
+
+-- An openid is only unique within one account
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_openid_key;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_app_openid ON users(app_id, openid);
+
+-- =====================================================
+-- MESSAGES
+-- =====================================================
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS app_id VARCHAR(64) NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS idx_messages_app_msg_id ON messages(app_id, msg_id);
+CREATE INDEX IF NOT EXISTS idx_messages_app_user_time ON messages(app_id, from_user, created_at DESC);
+
+-- =====================================================
+-- EVENTS
+-- =====================================================
+ALTER TABLE events ADD COLUMN IF NOT EXISTS app_id VARCHAR(64) NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS idx_events_app_openid_time ON events(app_id, openid, created_at DESC);
+
+-- =====================================================
+-- MENU RULES
+-- =====================================================
+ALTER TABLE menu_rules ADD COLUMN IF NOT EXISTS app_id VARCHAR(64) NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS idx_menu_rules_app ON menu_rules(app_id, is_enabled, priority DESC);
+
+-- =====================================================
+-- DAILY STATS
+-- =====================================================
+ALTER TABLE daily_stats ADD COLUMN IF NOT EXISTS app_id VARCHAR(64) NOT NULL DEFAULT '';
+
+ALTER TABLE daily_stats DROP CONSTRAINT IF EXISTS daily_stats_stat_date_key;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_daily_stats_app_date ON daily_stats(app_id, stat_date);
+
+-- The single-account function conflicts on stat_date, which is no longer
+-- unique; replace it with one keyed by account
+DROP FUNCTION IF EXISTS increment_daily_stats(DATE, VARCHAR);
+
+CREATE OR REPLACE FUNCTION increment_daily_stats(p_app_id VARCHAR, p_stat_date DATE, p_field VARCHAR)
+RETURNS VOID AS $$
+BEGIN
+    INSERT INTO daily_stats (app_id, stat_date, new_subscribers, unsubscribes, messages_in, messages_out, active_users)
+    VALUES (
+        p_app_id,
+        p_stat_date,
+        (p_field = 'new_subscribers'::VARCHAR)::INT,
+        (p_field = 'unsubscribes'::VARCHAR)::INT,
+        (p_field = 'messages_in'::VARCHAR)::INT,
+        (p_field = 'messages_out'::VARCHAR)::INT,
+        0
+    )
+    ON CONFLICT (app_id, stat_date) DO UPDATE SET
+        new_subscribers = daily_stats.new_subscribers + (p_field = 'new_subscribers'::VARCHAR)::INT,
+        unsubscribes = daily_stats.unsubscribes + (p_field = 'unsubscribes'::VARCHAR)::INT,
+        messages_in = daily_stats.messages_in + (p_field = 'messages_in'::VARCHAR)::INT,
+        messages_out = daily_stats.messages_out + (p_field = 'messages_out'::VARCHAR)::INT;
+END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,19 @@
+-- Menu version history, for auditing and rollback
+-- PostgreSQL
+
+-- =====================================================
+-- MENU VERSIONS TABLE
+-- =====================================================
+CREATE TABLE IF NOT EXISTS menu_versions (
+    id              BIGSERIAL PRIMARY KEY,
+    app_id          VARCHAR(64) NOT NULL DEFAULT '',
+    version         INTEGER NOT NULL,
+    menu            JSONB NOT NULL,
+    diff            JSONB DEFAULT '[]',  -- changes from the previously live menu
+    author          VARCHAR(64) NOT NULL DEFAULT '',
+    source          VARCHAR(16) NOT NULL,  -- publish, rollback, drift
+    rollback_of     INTEGER NOT NULL DEFAULT 0,
+    created_at      TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_menu_versions_app_version ON menu_versions(app_id, version DESC);
@@ -0,0 +1,14 @@
+-- Conditional menus: store the menu of each rule and allow rules that are
+-- not deployed to WeChat yet
+-- PostgreSQL
+
+-- =====================================================
+-- MENU RULES
+-- =====================================================
+ALTER TABLE menu_rules ADD COLUMN IF NOT EXISTS menu JSONB;
+
+-- menu_id is 0 until the conditional menu is created on WeChat
+ALTER TABLE menu_rules ALTER COLUMN menu_id SET DEFAULT 0;
+
+-- Menu events are counted by menu_id
+CREATE INDEX IF NOT EXISTS idx_menu_rules_app_menu_id ON menu_rules(app_id, menu_id);
@@ -0,0 +1,34 @@
+-- Menu A/B tests: experiments, follower assignments and per-follower
+-- event counts
+-- PostgreSQL
+
+-- =====================================================
+-- EXPERIMENTS TABLE
+-- =====================================================
+CREATE TABLE IF NOT EXISTS experiments (
+    id              BIGSERIAL PRIMARY KEY,
+    app_id          VARCHAR(64) NOT NULL DEFAULT '',
+    name            VARCHAR(255) NOT NULL,
+    status          VARCHAR(16) NOT NULL DEFAULT 'draft',  -- draft, running, stopped
+    variants        JSONB NOT NULL,  -- the first one is the control
+    created_at      TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    started_at      TIMESTAMP WITH TIME ZONE,
+    stopped_at      TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_experiments_app_id ON experiments(app_id, id DESC);
+
+-- =====================================================
+-- EXPERIMENT ASSIGNMENTS TABLE
+-- =====================================================
+CREATE TABLE IF NOT EXISTS experiment_assignments (
+    experiment_id   BIGINT NOT NULL REFERENCES experiments(id) ON DELETE CASCADE,
+    openid          VARCHAR(64) NOT NULL,
+    variant         VARCHAR(64) NOT NULL,
+    clicks          BIGINT NOT NULL DEFAULT 0,
+    views           BIGINT NOT NULL DEFAULT 0,
+    assigned_at     TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (experiment_id, openid)
+);
+
+CREATE INDEX IF NOT EXISTS idx_experiment_assignments_variant ON experiment_assignments(experiment_id, variant);
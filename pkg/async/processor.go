@@ -3,52 +3,96 @@ package async
 import (
 	"context"
 	"errors"
+	"fmt"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"wechat-service/internal/config"
 	"wechat-service/pkg/logger"
+	"wechat-service/pkg/metrics"
+	"wechat-service/pkg/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Common errors
+var (
+	ErrQueueFull       = errors.New("queue full")
+	ErrProcessorClosed = errors.New("processor is shutting down")
 )
 
+// workerStopTimeout bounds the wait for workers once Shutdown has
+// cancelled their tasks; a task ignoring cancellation is abandoned
+var workerStopTimeout = 5 * time.Second
+
 // Task represents an async task
 type Task struct {
-	ID        string
-	Type      string
-	Payload   interface{}
-	Retry     int
-	MaxRetry  int
-	CreatedAt time.Time
-	Execute   func(ctx context.Context, payload interface{}) error
+	ID        string                                               `json:"id"`
+	Type      string                                               `json:"type"`
+	Payload   interface{}                                          `json:"payload"`
+	Retry     int                                                  `json:"retry"`
+	MaxRetry  int                                                  `json:"max_retry"`
+	CreatedAt time.Time                                            `json:"created_at"`
+	RequestID string                                               `json:"request_id,omitempty"`
+	Execute   func(ctx context.Context, payload interface{}) error `json:"-"`
+
+	// parent links the task span to the span that submitted it
+	parent trace.SpanContext
+	// log is the submitter's context-scoped logger
+	log *logger.Logger
 }
 
 // Processor handles async task processing
 type Processor struct {
 	cfg      *config.Config
 	log      *logger.Logger
+	metrics  *metrics.Metrics
+	store    TaskStore
 	queue    chan *Task
 	workers  int
 	wg       sync.WaitGroup
+	retryWg  sync.WaitGroup
+	retrying int64
 	stopCh   chan struct{}
+	drainCh  chan struct{}
+	baseCtx  context.Context
+	cancel   context.CancelFunc
+	closed   bool
+	leftover []*Task
+	handlers map[string]func(ctx context.Context, payload interface{}) error
 	mu       sync.RWMutex
 	stats    ProcessorStats
 }
 
 // ProcessorStats holds processing statistics
 type ProcessorStats struct {
-	TotalProcessed int64
-	TotalFailed    int64
-	TotalRetried   int64
-	QueueSize      int
+	TotalProcessed    int64
+	TotalFailed       int64
+	TotalRetried      int64
+	TotalPanics       int64
+	TotalDeadLettered int64
+	QueueSize         int
+	QueueCapacity     int
 }
 
 // NewProcessor creates a new async processor
-func NewProcessor(cfg *config.Config, log *logger.Logger) *Processor {
+func NewProcessor(cfg *config.Config, log *logger.Logger, m *metrics.Metrics) *Processor {
+	ctx, cancel := context.WithCancel(context.Background())
 	p := &Processor{
-		cfg:     cfg,
-		log:     log,
-		queue:   make(chan *Task, cfg.Async.QueueSize),
-		workers: cfg.Async.Workers,
-		stopCh:  make(chan struct{}),
+		cfg:      cfg,
+		log:      log,
+		metrics:  m,
+		store:    NewFileStore(cfg.Async.PersistPath),
+		queue:    make(chan *Task, cfg.Async.QueueSize),
+		workers:  cfg.Async.Workers,
+		stopCh:   make(chan struct{}),
+		drainCh:  make(chan struct{}),
+		baseCtx:  ctx,
+		cancel:   cancel,
+		handlers: make(map[string]func(ctx context.Context, payload interface{}) error),
 	}
 
 	// Start workers
@@ -60,6 +104,69 @@ func NewProcessor(cfg *config.Config, log *logger.Logger) *Processor {
 	return p
 }
 
+// SetStore replaces the store used to persist leftover tasks on shutdown
+func (p *Processor) SetStore(store TaskStore) {
+	p.mu.Lock()
+	p.store = store
+	p.mu.Unlock()
+}
+
+// Handle registers execute for tasks of taskType restored from the task
+// store, whose Execute function could not be persisted
+func (p *Processor) Handle(taskType string, execute func(ctx context.Context, payload interface{}) error) {
+	p.mu.Lock()
+	p.handlers[taskType] = execute
+	p.mu.Unlock()
+}
+
+// Restore resubmits the tasks persisted by a previous shutdown, executing
+// each with the function registered for its type by Handle. Payloads are
+// restored as decoded JSON. Tasks without a handler, or that the queue
+// cannot take, are persisted again. It returns the number resubmitted.
+func (p *Processor) Restore(ctx context.Context) (int, error) {
+	p.mu.RLock()
+	store := p.store
+	p.mu.RUnlock()
+	if store == nil {
+		return 0, nil
+	}
+
+	tasks, err := store.Load()
+	if err != nil {
+		return 0, fmt.Errorf("failed to load persisted tasks: %w", err)
+	}
+
+	var kept []*Task
+	restored := 0
+	for _, task := range tasks {
+		p.mu.RLock()
+		execute := p.handlers[task.Type]
+		p.mu.RUnlock()
+		if execute == nil {
+			p.log.Warn("No handler for persisted task, keeping it", "task_id", task.ID, "task_type", task.Type)
+			kept = append(kept, task)
+			continue
+		}
+
+		task.Execute = execute
+		if err := p.Submit(ctx, task); err != nil {
+			kept = append(kept, task)
+			continue
+		}
+		restored++
+	}
+
+	if len(kept) > 0 {
+		if err := store.Save(kept); err != nil {
+			return restored, fmt.Errorf("failed to persist %d tasks again: %w", len(kept), err)
+		}
+	}
+	if restored > 0 {
+		p.log.Info("Restored persisted async tasks", "count", restored, "kept", len(kept))
+	}
+	return restored, nil
+}
+
 // worker is a background worker
 func (p *Processor) worker(id int) {
 	defer p.wg.Done()
@@ -67,24 +174,86 @@ func (p *Processor) worker(id int) {
 	for {
 		select {
 		case task := <-p.queue:
+			if p.stopping() {
+				p.addLeftover(task)
+				return
+			}
 			p.processTask(task)
 		case <-p.stopCh:
 			p.log.Debug("Worker stopping", "id", id)
 			return
+		case <-p.drainCh:
+			p.drain(id)
+			return
+		}
+	}
+}
+
+// drain keeps processing queued tasks until the queue is empty and no
+// retries are pending, or until a hard stop is requested
+func (p *Processor) drain(id int) {
+	for {
+		select {
+		case task := <-p.queue:
+			if p.stopping() {
+				p.addLeftover(task)
+				return
+			}
+			p.processTask(task)
+		case <-p.stopCh:
+			p.log.Debug("Worker stopping during drain", "id", id)
+			return
+		default:
+			if atomic.LoadInt64(&p.retrying) == 0 {
+				p.log.Debug("Worker drained", "id", id)
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
 		}
 	}
 }
 
 // processTask processes a single task
 func (p *Processor) processTask(task *Task) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(p.baseCtx, 30*time.Second)
 	defer cancel()
 
-	err := task.Execute(ctx, task.Payload)
+	log := task.log
+	if log == nil {
+		log = p.log
+		if task.RequestID != "" {
+			log = log.With("request_id", task.RequestID)
+		}
+	}
+	log = log.With("task_id", task.ID, "task_type", task.Type)
+	ctx = logger.NewContext(ctx, log)
+	if task.RequestID != "" {
+		ctx = logger.WithRequestID(ctx, task.RequestID)
+	}
+
+	ctx = trace.ContextWithSpanContext(ctx, task.parent)
+	ctx, span := tracing.Start(ctx, "async.Task",
+		attribute.String("task.id", task.ID),
+		attribute.String("task.type", task.Type),
+		attribute.Int("task.retry", task.Retry),
+	)
+
+	if p.metrics != nil {
+		p.metrics.SetAsyncQueueSize(len(p.queue))
+		p.metrics.IncAsyncInFlight()
+		defer p.metrics.DecAsyncInFlight()
+	}
+
+	err := p.execute(ctx, task)
+	tracing.End(span, err)
+	if err != nil && p.stopping() {
+		// Interrupted by a hard stop, the task is persisted as it was
+		log.Warn("Task interrupted by shutdown", "error", err)
+		p.addLeftover(task)
+		return
+	}
 	if err != nil {
-		p.log.Error("Task failed",
-			"task_id", task.ID,
-			"task_type", task.Type,
+		log.Error("Task failed",
 			"retry", task.Retry,
 			"error", err,
 		)
@@ -100,15 +269,13 @@ func (p *Processor) processTask(task *Task) {
 			p.stats.TotalRetried++
 			p.mu.Unlock()
 
-			// Requeue with delay
-			go func() {
-				time.Sleep(time.Duration(p.cfg.Async.RetryDelay) * time.Millisecond)
-				p.queue <- task
-			}()
+			p.scheduleRetry(task)
 		} else {
-			p.log.Error("Task exceeded max retries, dropping",
-				"task_id", task.ID,
-				"task_type", task.Type,
+			p.mu.Lock()
+			p.stats.TotalDeadLettered++
+			p.mu.Unlock()
+
+			log.Error("Task exceeded max retries, dropping",
 				"max_retry", task.MaxRetry,
 			)
 		}
@@ -120,25 +287,122 @@ func (p *Processor) processTask(task *Task) {
 	p.mu.Unlock()
 }
 
-// Submit submits a task for async processing
-func (p *Processor) Submit(task *Task) error {
+// execute runs the task, converting a panic into an error so that one
+// misbehaving task cannot take down the process
+func (p *Processor) execute(ctx context.Context, task *Task) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("task panicked: %v", r)
+
+			logger.FromContextOr(ctx, p.log).Error("Task panic recovered",
+				"panic", r,
+				"stack", string(debug.Stack()),
+			)
+
+			p.mu.Lock()
+			p.stats.TotalPanics++
+			p.mu.Unlock()
+
+			if p.metrics != nil {
+				p.metrics.IncMessagePanic()
+			}
+		}
+	}()
+
+	return task.Execute(ctx, task.Payload)
+}
+
+// scheduleRetry requeues the task after the configured delay, waiting for
+// room in the queue. While the processor is draining the delay is skipped.
+// Only a hard stop turns the task into a leftover for persistence.
+func (p *Processor) scheduleRetry(task *Task) {
+	atomic.AddInt64(&p.retrying, 1)
+	p.retryWg.Add(1)
+
+	go func() {
+		defer p.retryWg.Done()
+		defer atomic.AddInt64(&p.retrying, -1)
+
+		select {
+		case <-time.After(time.Duration(p.cfg.Async.RetryDelay) * time.Millisecond):
+		case <-p.drainCh:
+		case <-p.stopCh:
+			p.addLeftover(task)
+			return
+		}
+
+		select {
+		case p.queue <- task:
+		case <-p.stopCh:
+			p.addLeftover(task)
+		}
+	}()
+}
+
+// stopping reports whether a hard stop was requested
+func (p *Processor) stopping() bool {
+	select {
+	case <-p.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// addLeftover records a task that could not be processed before shutdown
+func (p *Processor) addLeftover(task *Task) {
+	p.mu.Lock()
+	p.leftover = append(p.leftover, task)
+	p.mu.Unlock()
+}
+
+// Submit submits a task for async processing. The span in ctx, if any,
+// becomes the parent of the task's span.
+func (p *Processor) Submit(ctx context.Context, task *Task) error {
+	task.parent = trace.SpanContextFromContext(ctx)
+	task.log = logger.FromContextOr(ctx, nil)
+	if task.RequestID == "" {
+		task.RequestID = logger.RequestIDFromContext(ctx)
+	}
+
+	// The read lock is held across the check and the send, so no task
+	// enters the queue once Shutdown has marked the processor closed
+	p.mu.RLock()
+	if p.closed {
+		p.mu.RUnlock()
+		p.log.Warn("Async processor shutting down, rejecting task",
+			"task_id", task.ID,
+			"task_type", task.Type,
+		)
+		return ErrProcessorClosed
+	}
+	var queued bool
 	select {
 	case p.queue <- task:
-		p.mu.Lock()
-		p.stats.QueueSize = len(p.queue)
-		p.mu.Unlock()
-		return nil
+		queued = true
 	default:
+	}
+	p.mu.RUnlock()
+
+	if !queued {
 		p.log.Warn("Async queue full, dropping task",
 			"task_id", task.ID,
 			"queue_size", len(p.queue),
 		)
-		return errors.New("queue full")
+		return ErrQueueFull
+	}
+
+	p.mu.Lock()
+	p.stats.QueueSize = len(p.queue)
+	p.mu.Unlock()
+	if p.metrics != nil {
+		p.metrics.SetAsyncQueueSize(len(p.queue))
 	}
+	return nil
 }
 
 // SubmitFunc submits a task with execute function
-func (p *Processor) SubmitFunc(taskType string, payload interface{}, execute func(ctx context.Context, payload interface{}) error) error {
+func (p *Processor) SubmitFunc(ctx context.Context, taskType string, payload interface{}, execute func(ctx context.Context, payload interface{}) error) error {
 	task := &Task{
 		ID:        generateID(),
 		Type:      taskType,
@@ -147,11 +411,11 @@ func (p *Processor) SubmitFunc(taskType string, payload interface{}, execute fun
 		MaxRetry:  p.cfg.Async.RetryCount,
 		CreatedAt: time.Now(),
 	}
-	return p.Submit(task)
+	return p.Submit(ctx, task)
 }
 
 // SubmitWithRetry submits with custom retry count
-func (p *Processor) SubmitWithRetry(taskType string, payload interface{}, execute func(ctx context.Context, payload interface{}) error, maxRetry int) error {
+func (p *Processor) SubmitWithRetry(ctx context.Context, taskType string, payload interface{}, execute func(ctx context.Context, payload interface{}) error, maxRetry int) error {
 	task := &Task{
 		ID:        generateID(),
 		Type:      taskType,
@@ -160,7 +424,7 @@ func (p *Processor) SubmitWithRetry(taskType string, payload interface{}, execut
 		MaxRetry:  maxRetry,
 		CreatedAt: time.Now(),
 	}
-	return p.Submit(task)
+	return p.Submit(ctx, task)
 }
 
 // GetStats returns current statistics
@@ -169,18 +433,90 @@ func (p *Processor) GetStats() ProcessorStats {
 	defer p.mu.RUnlock()
 
 	return ProcessorStats{
-		TotalProcessed: p.stats.TotalProcessed,
-		TotalFailed:    p.stats.TotalFailed,
-		TotalRetried:   p.stats.TotalRetried,
-		QueueSize:      len(p.queue),
+		TotalProcessed:    p.stats.TotalProcessed,
+		TotalFailed:       p.stats.TotalFailed,
+		TotalRetried:      p.stats.TotalRetried,
+		TotalPanics:       p.stats.TotalPanics,
+		TotalDeadLettered: p.stats.TotalDeadLettered,
+		QueueSize:         len(p.queue),
+		QueueCapacity:     cap(p.queue),
 	}
 }
 
-// Stop stops the processor
-func (p *Processor) Stop() {
-	close(p.stopCh)
-	p.wg.Wait()
+// Shutdown stops accepting new tasks and drains queued and in-flight tasks
+// until ctx is done. Tasks still pending at the deadline are persisted to the
+// task store. It returns ctx.Err() if the deadline was hit.
+func (p *Processor) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.mu.Unlock()
+
+	p.log.Info("Async processor draining", "queue_size", len(p.queue))
+	close(p.drainCh)
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		p.log.Warn("Async drain deadline reached, stopping workers", "queue_size", len(p.queue))
+		close(p.stopCh)
+		p.cancel()
+		select {
+		case <-done:
+		case <-time.After(workerStopTimeout):
+			p.log.Error("Async workers did not stop after cancellation, abandoning them",
+				"timeout", workerStopTimeout)
+		}
+	}
+
+	p.retryWg.Wait()
+	p.cancel()
+
+	p.persistLeftovers()
 	p.log.Info("Async processor stopped", "stats", p.GetStats())
+	return err
+}
+
+// persistLeftovers saves tasks left in the queue or awaiting retry
+func (p *Processor) persistLeftovers() {
+	p.mu.Lock()
+	tasks := p.leftover
+	p.leftover = nil
+	store := p.store
+	p.mu.Unlock()
+
+	for len(p.queue) > 0 {
+		tasks = append(tasks, <-p.queue)
+	}
+
+	if len(tasks) == 0 || store == nil {
+		return
+	}
+
+	if err := store.Save(tasks); err != nil {
+		p.log.Error("Failed to persist leftover tasks", "count", len(tasks), "error", err)
+		return
+	}
+	p.log.Warn("Persisted leftover async tasks", "count", len(tasks))
+}
+
+// Stop stops the processor, draining for at most Async.ShutdownTimeout
+func (p *Processor) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(p.cfg.Async.ShutdownTimeout)*time.Second)
+	defer cancel()
+
+	p.Shutdown(ctx)
 }
 
 // generateID generates a unique task ID
@@ -0,0 +1,375 @@
+package async
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"wechat-service/internal/config"
+	"wechat-service/pkg/logger"
+)
+
+// memoryStore is a TaskStore kept in memory
+type memoryStore struct {
+	mu    sync.Mutex
+	tasks []*Task
+}
+
+func (s *memoryStore) Save(tasks []*Task) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tasks = append(s.tasks, tasks...)
+	return nil
+}
+
+func (s *memoryStore) Load() ([]*Task, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tasks := s.tasks
+	s.tasks = nil
+	return tasks, nil
+}
+
+// newTestProcessor creates a processor with a memory store
+func newTestProcessor(workers, queueSize, retryCount int) (*Processor, *memoryStore) {
+	cfg := &config.Config{}
+	cfg.Async.Workers = workers
+	cfg.Async.QueueSize = queueSize
+	cfg.Async.RetryCount = retryCount
+	cfg.Async.RetryDelay = 1
+	cfg.Async.ShutdownTimeout = 5
+
+	p := NewProcessor(cfg, logger.New(nil), nil)
+	store := &memoryStore{}
+	p.SetStore(store)
+	return p, store
+}
+
+func TestProcessorOutcomes(t *testing.T) {
+	tests := []struct {
+		name      string
+		failures  int // calls failing before one succeeds
+		panics    bool
+		maxRetry  int
+		wantCalls int32
+		wantStats ProcessorStats
+	}{
+		{name: "success", wantCalls: 1, wantStats: ProcessorStats{TotalProcessed: 1}},
+		{
+			name: "retried then succeeds", failures: 2, maxRetry: 3, wantCalls: 3,
+			wantStats: ProcessorStats{TotalProcessed: 1, TotalFailed: 2, TotalRetried: 2},
+		},
+		{
+			name: "dead lettered", failures: 10, maxRetry: 2, wantCalls: 3,
+			wantStats: ProcessorStats{TotalFailed: 3, TotalRetried: 2, TotalDeadLettered: 1},
+		},
+		{
+			name: "panic isolated", failures: 10, panics: true, wantCalls: 1,
+			wantStats: ProcessorStats{TotalFailed: 1, TotalPanics: 1, TotalDeadLettered: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _ := newTestProcessor(2, 10, 0)
+
+			var calls int32
+			err := p.SubmitWithRetry(context.Background(), "test", nil, func(ctx context.Context, _ interface{}) error {
+				n := atomic.AddInt32(&calls, 1)
+				if int(n) <= tt.failures {
+					if tt.panics {
+						panic("boom")
+					}
+					return errors.New("failed")
+				}
+				return nil
+			}, tt.maxRetry)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := p.Shutdown(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", calls, tt.wantCalls)
+			}
+			got := p.GetStats()
+			got.QueueSize, got.QueueCapacity = 0, 0
+			if got != tt.wantStats {
+				t.Errorf("stats = %+v, want %+v", got, tt.wantStats)
+			}
+		})
+	}
+}
+
+func TestProcessorRetryWaitsForQueueRoom(t *testing.T) {
+	// One worker and a queue of one: the retry must wait for the queue
+	// instead of being dropped while other tasks fill it
+	p, store := newTestProcessor(1, 1, 0)
+	ctx := context.Background()
+
+	var failed atomic.Bool
+	var done atomic.Int32
+	flaky := func(ctx context.Context, _ interface{}) error {
+		if failed.CompareAndSwap(false, true) {
+			return errors.New("first attempt fails")
+		}
+		done.Add(1)
+		return nil
+	}
+	if err := p.SubmitWithRetry(ctx, "flaky", nil, flaky, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	steady := func(ctx context.Context, _ interface{}) error {
+		time.Sleep(5 * time.Millisecond)
+		done.Add(1)
+		return nil
+	}
+	submitted := int32(1)
+	for i := 0; i < 20; i++ {
+		if p.SubmitFunc(ctx, "steady", nil, steady) == nil {
+			submitted++
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := p.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if done.Load() != submitted {
+		t.Errorf("completed %d of %d tasks", done.Load(), submitted)
+	}
+	if len(store.tasks) != 0 {
+		t.Errorf("%d tasks persisted, want none", len(store.tasks))
+	}
+}
+
+func TestProcessorShutdown(t *testing.T) {
+	tests := []struct {
+		name          string
+		tasks         int
+		taskDuration  time.Duration
+		ignoreCancel  bool // the first task runs on after cancellation
+		deadline      time.Duration
+		wantErr       bool
+		wantPersisted bool
+	}{
+		{name: "drains the queue", tasks: 5, taskDuration: time.Millisecond, deadline: time.Second},
+		{
+			name: "persists what the deadline leaves", tasks: 5, taskDuration: 200 * time.Millisecond,
+			deadline: 50 * time.Millisecond, wantErr: true, wantPersisted: true,
+		},
+		{
+			name: "abandons a task ignoring cancellation", tasks: 3, taskDuration: 200 * time.Millisecond,
+			ignoreCancel: true, deadline: 50 * time.Millisecond, wantErr: true, wantPersisted: true,
+		},
+	}
+
+	defer func(timeout time.Duration) { workerStopTimeout = timeout }(workerStopTimeout)
+	workerStopTimeout = 100 * time.Millisecond
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, store := newTestProcessor(1, 10, 0)
+
+			release := make(chan struct{})
+			defer close(release)
+
+			var done atomic.Int32
+			for i := 0; i < tt.tasks; i++ {
+				stuck := tt.ignoreCancel && i == 0
+				err := p.SubmitFunc(context.Background(), "slow", i, func(ctx context.Context, _ interface{}) error {
+					if stuck {
+						<-release
+						return nil
+					}
+					select {
+					case <-time.After(tt.taskDuration):
+						done.Add(1)
+						return nil
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.deadline)
+			defer cancel()
+			start := time.Now()
+			err := p.Shutdown(ctx)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Shutdown err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("Shutdown took %v", elapsed)
+			}
+
+			persisted := len(store.tasks)
+			if (persisted > 0) != tt.wantPersisted {
+				t.Errorf("%d tasks persisted, wantPersisted %v", persisted, tt.wantPersisted)
+			}
+			// Every task either completed or was persisted, including the
+			// one the hard stop interrupted
+			stuck := 0
+			if tt.ignoreCancel {
+				stuck = 1
+			}
+			if int(done.Load())+persisted+stuck != tt.tasks {
+				t.Errorf("completed %d and persisted %d of %d tasks", done.Load(), persisted, tt.tasks)
+			}
+			if err := p.Submit(context.Background(), &Task{ID: "late"}); !errors.Is(err, ErrProcessorClosed) {
+				t.Errorf("Submit after shutdown = %v, want ErrProcessorClosed", err)
+			}
+		})
+	}
+}
+
+func TestProcessorSubmitDuringShutdown(t *testing.T) {
+	for run := 0; run < 20; run++ {
+		p, store := newTestProcessor(2, 1000, 0)
+
+		var accepted, done atomic.Int32
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 50; i++ {
+					err := p.SubmitFunc(context.Background(), "count", i, func(ctx context.Context, _ interface{}) error {
+						done.Add(1)
+						return nil
+					})
+					if err == nil {
+						accepted.Add(1)
+					}
+				}
+			}()
+		}
+
+		time.Sleep(time.Duration(run%3) * time.Millisecond)
+		if err := p.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		wg.Wait()
+
+		// Every accepted task ran or was persisted; none slipped into the
+		// queue after it was drained
+		if got := int(done.Load()) + len(store.tasks); got != int(accepted.Load()) {
+			t.Fatalf("run %d: %d tasks accepted, %d ran or persisted", run, accepted.Load(), got)
+		}
+	}
+}
+
+func TestProcessorRestore(t *testing.T) {
+	tests := []struct {
+		name         string
+		persisted    []*Task
+		handled      []string
+		wantRestored int
+		wantKept     int
+	}{
+		{name: "nothing persisted"},
+		{
+			name:         "handled types",
+			persisted:    []*Task{{ID: "1", Type: "send"}, {ID: "2", Type: "send"}},
+			handled:      []string{"send"},
+			wantRestored: 2,
+		},
+		{
+			name:         "unknown type kept",
+			persisted:    []*Task{{ID: "1", Type: "send"}, {ID: "2", Type: "other"}},
+			handled:      []string{"send"},
+			wantRestored: 1,
+			wantKept:     1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, store := newTestProcessor(1, 10, 0)
+			store.tasks = tt.persisted
+
+			var ran atomic.Int32
+			for _, taskType := range tt.handled {
+				p.Handle(taskType, func(ctx context.Context, _ interface{}) error {
+					ran.Add(1)
+					return nil
+				})
+			}
+
+			restored, err := p.Restore(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if restored != tt.wantRestored {
+				t.Errorf("restored = %d, want %d", restored, tt.wantRestored)
+			}
+			if len(store.tasks) != tt.wantKept {
+				t.Errorf("kept = %d, want %d", len(store.tasks), tt.wantKept)
+			}
+
+			p.Shutdown(context.Background())
+			if int(ran.Load()) != tt.wantRestored {
+				t.Errorf("ran %d restored tasks, want %d", ran.Load(), tt.wantRestored)
+			}
+		})
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	tests := []struct {
+		name  string
+		saves [][]*Task
+		want  []string
+	}{
+		{name: "missing file"},
+		{name: "one save", saves: [][]*Task{{{ID: "a", Type: "t"}}}, want: []string{"a"}},
+		{
+			name:  "saves append",
+			saves: [][]*Task{{{ID: "a"}, {ID: "b"}}, {{ID: "c", Payload: map[string]interface{}{"openid": "o1"}}}},
+			want:  []string{"a", "b", "c"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewFileStore(filepath.Join(t.TempDir(), "data", "pending.json"))
+			for _, tasks := range tt.saves {
+				if err := store.Save(tasks); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			tasks, err := store.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, task := range tasks {
+				ids = append(ids, task.ID)
+			}
+			if len(ids) != len(tt.want) {
+				t.Fatalf("loaded %v, want %v", ids, tt.want)
+			}
+			for i := range ids {
+				if ids[i] != tt.want[i] {
+					t.Errorf("loaded %v, want %v", ids, tt.want)
+				}
+			}
+
+			again, err := store.Load()
+			if err != nil || len(again) != 0 {
+				t.Errorf("second Load = %d tasks, %v; want none", len(again), err)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package async
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// TaskStore persists tasks that could not be processed before shutdown
+type TaskStore interface {
+	Save(tasks []*Task) error
+	// Load removes and returns the persisted tasks
+	Load() ([]*Task, error)
+}
+
+// FileStore appends leftover tasks to a JSON lines file. Execute functions
+// cannot be serialized, so only task metadata and payload are kept.
+type FileStore struct {
+	path string
+}
+
+// NewFileStore creates a file-backed task store
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+// Save appends tasks to the store file, one JSON object per line
+func (s *FileStore) Save(tasks []*Task) error {
+	if s.path == "" {
+		return fmt.Errorf("task store path is empty")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("failed to create task store directory: %w", err)
+	}
+
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open task store: %w", err)
+	}
+	defer file.Close()
+
+	enc := json.NewEncoder(file)
+	for _, task := range tasks {
+		if err := enc.Encode(task); err != nil {
+			return fmt.Errorf("failed to encode task %s: %w", task.ID, err)
+		}
+	}
+	return nil
+}
+
+// Load reads every task of the store file and removes the file. A missing
+// file holds no tasks.
+func (s *FileStore) Load() ([]*Task, error) {
+	if s.path == "" {
+		return nil, nil
+	}
+
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open task store: %w", err)
+	}
+	defer file.Close()
+
+	var tasks []*Task
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var task Task
+		if err := json.Unmarshal(scanner.Bytes(), &task); err != nil {
+			return nil, fmt.Errorf("failed to decode task on line %d: %w", line, err)
+		}
+		tasks = append(tasks, &task)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read task store: %w", err)
+	}
+
+	if err := os.Remove(s.path); err != nil {
+		return nil, fmt.Errorf("failed to clear task store: %w", err)
+	}
+	return tasks, nil
+}
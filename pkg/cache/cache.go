@@ -1,8 +1,56 @@
 package cache
 
 import (
+	"time"
+
+	"wechat-service/internal/config"
+	"wechat-service/pkg/metrics"
+
 	"github.com/silenceper/wechat/v2/cache"
 )
 
 // Cache is re-exported from wechat SDK
 type Cache = cache.Cache
+
+// New creates the cache selected by Cache.Type: memory for an in-process
+// cache, layered for a local LRU in front of Redis, redis (the default)
+// for Redis alone. Redis latencies and layer hits are recorded in m, which
+// may be nil.
+func New(cfg *config.Config, m *metrics.Metrics) (Store, error) {
+	if cfg.Cache.Type == "memory" {
+		return NewMemoryCache(
+			cfg.Cache.Memory.MaxEntries,
+			time.Duration(cfg.Cache.Memory.CleanupInterval)*time.Second,
+		), nil
+	}
+
+	remote, err := NewRedisCacheFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if m != nil {
+		remote.SetLatencyObserver(func(operation string, d time.Duration) {
+			m.ObserveDependencyLatency("redis", operation, d.Seconds())
+		})
+	}
+
+	if cfg.Cache.Type == "layered" {
+		layered := NewLayeredCache(
+			remote,
+			time.Duration(cfg.Cache.LocalTTL)*time.Second,
+			cfg.Cache.Memory.MaxEntries,
+			cfg.Cache.InvalidationChannel,
+		)
+		if m != nil {
+			layered.SetLookupObserver(m.ObserveCacheLookup)
+		}
+		return layered, nil
+	}
+	return remote, nil
+}
+
+// Namespace returns the key prefix for appID in the configured
+// environment, for use with WithNamespace
+func Namespace(cfg *config.Config, appID string) string {
+	return Prefix("wechat-service", cfg.Server.Env, appID)
+}
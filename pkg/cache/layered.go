@@ -0,0 +1,264 @@
+package cache
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Cache layers reported to a LookupObserver
+const (
+	LayerLocal = "local"
+	LayerRedis = "redis"
+)
+
+// LookupObserver receives the outcome of each lookup per layer, e.g.
+// Metrics.ObserveCacheLookup
+type LookupObserver func(layer string, hit bool)
+
+// invalidation is published on every Set and Delete so that other
+// replicas drop their local copy
+type invalidation struct {
+	Origin string `json:"origin"`
+	Key    string `json:"key"`
+}
+
+// LayeredCache keeps a short-lived local LRU copy of values read from
+// Redis. A local copy never outlives the Redis entry it was read from.
+// Writes go to Redis and invalidate the local copy on every replica
+// through Redis pub/sub. If an invalidation is missed, for example while
+// the subscription reconnects, a replica serves a stale value for at most
+// localTTL.
+type LayeredCache struct {
+	local    *MemoryCache
+	remote   *RedisCache
+	localTTL time.Duration
+	channel  string
+	origin   string
+	observe  LookupObserver
+
+	// epoch counts invalidations, so that a value read from Redis before
+	// an invalidation is not cached locally after it
+	mu    sync.Mutex
+	epoch uint64
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewLayeredCache creates a layered cache over remote and starts listening
+// for invalidations on channel
+func NewLayeredCache(remote *RedisCache, localTTL time.Duration, maxEntries int, channel string) *LayeredCache {
+	if localTTL <= 0 {
+		localTTL = 5 * time.Second
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &LayeredCache{
+		local:    NewMemoryCache(maxEntries, localTTL),
+		remote:   remote,
+		localTTL: localTTL,
+		channel:  channel,
+		origin:   generateOrigin(),
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+
+	go c.listen(ctx)
+
+	return c
+}
+
+// SetLookupObserver sets the observer fed with per-layer hits and misses
+func (c *LayeredCache) SetLookupObserver(observe LookupObserver) {
+	c.observe = observe
+}
+
+// Get implements cache.Cache, serving from the local layer when possible
+func (c *LayeredCache) Get(key string) interface{} {
+	if val := c.local.Get(key); val != nil {
+		c.record(LayerLocal, true)
+		return val
+	}
+	c.record(LayerLocal, false)
+
+	val, err := c.load(context.Background(), key)
+	if err != nil {
+		return nil
+	}
+	return val
+}
+
+// Set writes to Redis and invalidates the local copies
+func (c *LayeredCache) Set(key string, val interface{}, ttl time.Duration) error {
+	if err := c.remote.Set(key, val, ttl); err != nil {
+		return err
+	}
+	c.invalidate(key)
+	return nil
+}
+
+// IsExist checks the local layer, then Redis
+func (c *LayeredCache) IsExist(key string) bool {
+	if c.local.IsExist(key) {
+		return true
+	}
+	return c.remote.IsExist(key)
+}
+
+// Delete removes key from Redis and invalidates the local copies
+func (c *LayeredCache) Delete(key string) error {
+	err := c.remote.Delete(key)
+	c.invalidate(key)
+	return err
+}
+
+// GetContext implements Store
+func (c *LayeredCache) GetContext(ctx context.Context, key string) ([]byte, error) {
+	if val := c.local.Get(key); val != nil {
+		c.record(LayerLocal, true)
+		return serialize(val)
+	}
+	c.record(LayerLocal, false)
+
+	val, err := c.load(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(val), nil
+}
+
+// SetContext implements Store
+func (c *LayeredCache) SetContext(ctx context.Context, key string, val interface{}, ttl time.Duration) error {
+	if err := c.remote.SetContext(ctx, key, val, ttl); err != nil {
+		return err
+	}
+	c.invalidate(key)
+	return nil
+}
+
+// DeleteContext implements Store
+func (c *LayeredCache) DeleteContext(ctx context.Context, key string) error {
+	err := c.remote.DeleteContext(ctx, key)
+	c.invalidate(key)
+	return err
+}
+
+// Incr implements Store
+func (c *LayeredCache) Incr(ctx context.Context, key string, delta int64) (int64, error) {
+	n, err := c.remote.Incr(ctx, key, delta)
+	if err != nil {
+		return 0, err
+	}
+	c.invalidate(key)
+	return n, nil
+}
+
+// SetNX implements Store
+func (c *LayeredCache) SetNX(ctx context.Context, key string, val interface{}, ttl time.Duration) (bool, error) {
+	ok, err := c.remote.SetNX(ctx, key, val, ttl)
+	if ok {
+		c.invalidate(key)
+	}
+	return ok, err
+}
+
+// Close stops listening for invalidations and the local sweep
+func (c *LayeredCache) Close() error {
+	c.cancel()
+	<-c.done
+	return c.local.Close()
+}
+
+// load reads key from Redis and keeps a local copy for at most localTTL
+// and never past the Redis expiry. The copy is skipped when key may have
+// been invalidated during the read.
+func (c *LayeredCache) load(ctx context.Context, key string) (string, error) {
+	c.mu.Lock()
+	epoch := c.epoch
+	c.mu.Unlock()
+
+	val, ttl, err := c.remote.getWithTTL(ctx, key)
+	if err != nil {
+		c.record(LayerRedis, false)
+		return "", err
+	}
+	c.record(LayerRedis, true)
+
+	if ttl < 0 || ttl > c.localTTL {
+		ttl = c.localTTL
+	}
+	c.mu.Lock()
+	if c.epoch == epoch && ttl > 0 {
+		c.local.Set(key, val, ttl)
+	}
+	c.mu.Unlock()
+	return val, nil
+}
+
+// drop removes the local copy of key
+func (c *LayeredCache) drop(key string) {
+	c.mu.Lock()
+	c.epoch++
+	c.local.Delete(key)
+	c.mu.Unlock()
+}
+
+// invalidate drops the local copy and tells other replicas to do the same
+func (c *LayeredCache) invalidate(key string) {
+	c.drop(key)
+
+	msg, _ := json.Marshal(invalidation{Origin: c.origin, Key: key})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	// A lost message only delays invalidation until localTTL expires
+	_ = c.remote.Publish(ctx, c.channel, string(msg))
+}
+
+// listen drops local copies invalidated by other replicas
+func (c *LayeredCache) listen(ctx context.Context) {
+	defer close(c.done)
+
+	sub := c.remote.Subscribe(ctx, c.channel)
+	defer sub.Close()
+
+	ch := sub.Channel()
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			var inv invalidation
+			if err := json.Unmarshal([]byte(msg.Payload), &inv); err != nil || inv.Origin == c.origin {
+				continue
+			}
+			c.drop(inv.Key)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// record reports a lookup to the observer
+func (c *LayeredCache) record(layer string, hit bool) {
+	if c.observe != nil {
+		c.observe(layer, hit)
+	}
+}
+
+// generateOrigin returns an identifier for this replica, used to ignore
+// its own invalidations
+func generateOrigin() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b))
+}
+
+var _ Store = (*LayeredCache)(nil)
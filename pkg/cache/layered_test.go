@@ -0,0 +1,259 @@
+package cache
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"wechat-service/internal/config"
+	"wechat-service/pkg/metrics"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// newTestLayeredCache returns a layered cache over mr once it listens for
+// invalidations
+func newTestLayeredCache(t *testing.T, mr *miniredis.Miniredis, localTTL time.Duration) *LayeredCache {
+	t.Helper()
+	const channel = "test:invalidate"
+	listening := mr.PubSubNumSub(channel)[channel]
+
+	c := NewLayeredCache(NewRedisCache(mr.Addr(), "", 0), localTTL, 0, channel)
+	t.Cleanup(func() { c.Close() })
+
+	for deadline := time.Now().Add(2 * time.Second); mr.PubSubNumSub(channel)[channel] == listening; {
+		if time.Now().After(deadline) {
+			t.Fatal("layered cache not subscribed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return c
+}
+
+// localExpiry returns when the local copy of key expires, zero when it
+// does not, and whether there is a local copy
+func localExpiry(c *LayeredCache, key string) (time.Time, bool) {
+	c.local.mu.Lock()
+	defer c.local.mu.Unlock()
+	elem, ok := c.local.items[key]
+	if !ok {
+		return time.Time{}, false
+	}
+	return elem.Value.(*memoryEntry).expiresAt, true
+}
+
+func TestLayeredCacheLocalTTL(t *testing.T) {
+	tests := []struct {
+		name     string
+		redisTTL time.Duration // 0 for no expiry
+		localTTL time.Duration
+		wantTTL  time.Duration
+	}{
+		{name: "no redis expiry", localTTL: 10 * time.Second, wantTTL: 10 * time.Second},
+		{name: "redis expires later", redisTTL: time.Minute, localTTL: 10 * time.Second, wantTTL: 10 * time.Second},
+		{name: "redis expires sooner", redisTTL: 2 * time.Second, localTTL: 10 * time.Second, wantTTL: 2 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mr := miniredis.RunT(t)
+			c := newTestLayeredCache(t, mr, tt.localTTL)
+			ctx := context.Background()
+
+			if err := c.remote.SetContext(ctx, "k", "v", tt.redisTTL); err != nil {
+				t.Fatal(err)
+			}
+			got, err := c.GetContext(ctx, "k")
+			if err != nil || string(got) != "v" {
+				t.Fatalf("GetContext = %q, %v; want v", got, err)
+			}
+
+			expiresAt, ok := localExpiry(c, "k")
+			if !ok {
+				t.Fatal("no local copy")
+			}
+			ttl := time.Until(expiresAt)
+			if ttl > tt.wantTTL || ttl < tt.wantTTL-time.Second {
+				t.Errorf("local TTL = %v, want about %v", ttl, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestLayeredCacheInvalidationDuringLoad(t *testing.T) {
+	tests := []struct {
+		name       string
+		invalidate bool // invalidate the key while Redis is read
+		wantLocal  bool
+	}{
+		{name: "no invalidation", wantLocal: true},
+		{name: "invalidated during read", invalidate: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mr := miniredis.RunT(t)
+			c := newTestLayeredCache(t, mr, time.Minute)
+			ctx := context.Background()
+			if err := c.remote.SetContext(ctx, "k", "old", 0); err != nil {
+				t.Fatal(err)
+			}
+
+			// The latency observer runs after the read, before the local copy
+			// is stored, as an invalidation from another replica could
+			var once sync.Once
+			c.remote.SetLatencyObserver(func(operation string, d time.Duration) {
+				if tt.invalidate && operation == "get" {
+					once.Do(func() { c.drop("k") })
+				}
+			})
+
+			if got := c.Get("k"); got != "old" {
+				t.Fatalf("Get = %v, want old", got)
+			}
+			if _, ok := localExpiry(c, "k"); ok != tt.wantLocal {
+				t.Errorf("local copy = %v, want %v", ok, tt.wantLocal)
+			}
+		})
+	}
+}
+
+func TestLayeredCacheInvalidatesReplicas(t *testing.T) {
+	tests := []struct {
+		name   string
+		write  func(ctx context.Context, c *LayeredCache) error
+		want   string // "" when the key is gone
+		remote bool   // whether the key is still in Redis
+	}{
+		{
+			name:   "set",
+			write:  func(ctx context.Context, c *LayeredCache) error { return c.SetContext(ctx, "k", "new", 0) },
+			want:   "new",
+			remote: true,
+		},
+		{
+			name:  "delete",
+			write: func(ctx context.Context, c *LayeredCache) error { return c.DeleteContext(ctx, "k") },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mr := miniredis.RunT(t)
+			reader := newTestLayeredCache(t, mr, time.Minute)
+			writer := newTestLayeredCache(t, mr, time.Minute)
+			ctx := context.Background()
+
+			if err := writer.SetContext(ctx, "k", "old", 0); err != nil {
+				t.Fatal(err)
+			}
+			if got := reader.Get("k"); got != "old" {
+				t.Fatalf("Get = %v, want old", got)
+			}
+
+			if err := tt.write(ctx, writer); err != nil {
+				t.Fatal(err)
+			}
+
+			deadline := time.Now().Add(2 * time.Second)
+			for {
+				got, _ := reader.Get("k").(string)
+				if got == tt.want {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("reader still sees %q, want %q", got, tt.want)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if mr.Exists("k") != tt.remote {
+				t.Errorf("key in redis = %v, want %v", mr.Exists("k"), tt.remote)
+			}
+		})
+	}
+}
+
+func TestNewRecordsCacheLookups(t *testing.T) {
+	tests := []struct {
+		name       string
+		stored     bool
+		reads      int
+		wantLookup map[string]float64 // "layer/result" -> count
+	}{
+		{
+			name:   "hit then local hits",
+			stored: true,
+			reads:  3,
+			wantLookup: map[string]float64{
+				"local/miss": 1, "local/hit": 2, "redis/hit": 1, "redis/miss": 0,
+			},
+		},
+		{
+			name:  "misses",
+			reads: 2,
+			wantLookup: map[string]float64{
+				"local/miss": 2, "local/hit": 0, "redis/hit": 0, "redis/miss": 2,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mr := miniredis.RunT(t)
+			cfg := &config.Config{}
+			cfg.Cache.Type = "layered"
+			cfg.Cache.LocalTTL = 60
+			cfg.Cache.InvalidationChannel = "test:invalidate"
+			cfg.Cache.Redis.Addr = mr.Addr()
+
+			m := metrics.NewMetrics(nil, "")
+			store, err := New(cfg, m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.(*LayeredCache).Close()
+
+			ctx := context.Background()
+			if tt.stored {
+				if err := mr.Set("k", "v"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < tt.reads; i++ {
+				store.GetContext(ctx, "k")
+			}
+
+			for key, want := range tt.wantLookup {
+				if got := lookupCount(t, m, key); got != want {
+					t.Errorf("%s = %v, want %v", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+// lookupCount returns the wechat_cache_lookups_total counter for
+// "layer/result"
+func lookupCount(t *testing.T, m *metrics.Metrics, key string) float64 {
+	t.Helper()
+	families, err := m.Gatherer().Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	for _, f := range families {
+		if f.GetName() != "wechat_cache_lookups_total" {
+			continue
+		}
+		for _, metric := range f.GetMetric() {
+			labels := make(map[string]string)
+			for _, lp := range metric.GetLabel() {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+			if labels["layer"]+"/"+labels["result"] == key {
+				return metric.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
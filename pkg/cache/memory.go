@@ -0,0 +1,283 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemoryCache is an in-process cache with TTL expiry and optional LRU
+// eviction. Expired entries are dropped on access and by a background
+// sweep; Close stops the sweep.
+type MemoryCache struct {
+	mu         sync.Mutex
+	items      map[string]*list.Element
+	lru        *list.List // front is most recently used
+	maxEntries int
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// memoryEntry is one cached value
+type memoryEntry struct {
+	key       string
+	value     interface{}
+	expiresAt time.Time // zero means no expiry
+}
+
+// expired reports whether the entry has expired at now
+func (e *memoryEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && now.After(e.expiresAt)
+}
+
+// NewMemoryCache creates an in-process cache. maxEntries > 0 bounds the
+// number of entries, evicting the least recently used; cleanupInterval
+// sets how often expired entries are swept, defaulting to one minute.
+func NewMemoryCache(maxEntries int, cleanupInterval time.Duration) *MemoryCache {
+	if cleanupInterval <= 0 {
+		cleanupInterval = time.Minute
+	}
+
+	c := &MemoryCache{
+		items:      make(map[string]*list.Element),
+		lru:        list.New(),
+		maxEntries: maxEntries,
+		stopCh:     make(chan struct{}),
+	}
+
+	c.wg.Add(1)
+	go c.sweep(cleanupInterval)
+
+	return c
+}
+
+// Get implements cache.Cache, returning nil for missing or expired keys
+func (c *MemoryCache) Get(key string) interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*memoryEntry)
+	if entry.expired(time.Now()) {
+		c.removeElement(elem)
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	return entry.value
+}
+
+// Set stores a value with TTL; a TTL <= 0 never expires
+func (c *MemoryCache) Set(key string, val interface{}, ttl time.Duration) error {
+	var expiresAt time.Time
+	if ttl > 0 {
+		expiresAt = time.Now().Add(ttl)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		entry := elem.Value.(*memoryEntry)
+		entry.value = val
+		entry.expiresAt = expiresAt
+		c.lru.MoveToFront(elem)
+		return nil
+	}
+
+	c.insert(key, val, expiresAt)
+	return nil
+}
+
+// IsExist checks if a key exists and has not expired
+func (c *MemoryCache) IsExist(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return false
+	}
+	if elem.Value.(*memoryEntry).expired(time.Now()) {
+		c.removeElement(elem)
+		return false
+	}
+	return true
+}
+
+// Delete removes a key
+func (c *MemoryCache) Delete(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		c.removeElement(elem)
+	}
+	return nil
+}
+
+// GetContext implements Store
+func (c *MemoryCache) GetContext(ctx context.Context, key string) ([]byte, error) {
+	val := c.Get(key)
+	if val == nil {
+		return nil, ErrNotFound
+	}
+	return serialize(val)
+}
+
+// SetContext implements Store. The value is stored serialized, as Redis
+// would, so both backends return the same from Get.
+func (c *MemoryCache) SetContext(ctx context.Context, key string, val interface{}, ttl time.Duration) error {
+	data, err := serialize(val)
+	if err != nil {
+		return err
+	}
+	return c.Set(key, string(data), ttl)
+}
+
+// DeleteContext implements Store
+func (c *MemoryCache) DeleteContext(ctx context.Context, key string) error {
+	return c.Delete(key)
+}
+
+// Incr implements Store. The counter keeps its expiry.
+func (c *MemoryCache) Incr(ctx context.Context, key string, delta int64) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if ok && elem.Value.(*memoryEntry).expired(time.Now()) {
+		c.removeElement(elem)
+		ok = false
+	}
+	if !ok {
+		c.insert(key, strconv.FormatInt(delta, 10), time.Time{})
+		return delta, nil
+	}
+
+	entry := elem.Value.(*memoryEntry)
+	current, err := toInt64(entry.value)
+	if err != nil {
+		return 0, err
+	}
+	current += delta
+	entry.value = strconv.FormatInt(current, 10)
+	c.lru.MoveToFront(elem)
+	return current, nil
+}
+
+// SetNX implements Store
+func (c *MemoryCache) SetNX(ctx context.Context, key string, val interface{}, ttl time.Duration) (bool, error) {
+	data, err := serialize(val)
+	if err != nil {
+		return false, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		if !elem.Value.(*memoryEntry).expired(time.Now()) {
+			return false, nil
+		}
+		c.removeElement(elem)
+	}
+
+	var expiresAt time.Time
+	if ttl > 0 {
+		expiresAt = time.Now().Add(ttl)
+	}
+	c.insert(key, string(data), expiresAt)
+	return true, nil
+}
+
+// toInt64 converts a stored counter value
+func toInt64(v interface{}) (int64, error) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), nil
+	case int64:
+		return n, nil
+	case string:
+		i, err := strconv.ParseInt(n, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("cache: value is not an integer: %w", err)
+		}
+		return i, nil
+	default:
+		return 0, fmt.Errorf("cache: value of type %T is not an integer", v)
+	}
+}
+
+// Len returns the number of entries, including expired ones not yet swept
+func (c *MemoryCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// Close stops the background sweep
+func (c *MemoryCache) Close() error {
+	c.stopOnce.Do(func() { close(c.stopCh) })
+	c.wg.Wait()
+	return nil
+}
+
+// insert adds a new entry, evicting the least recently used ones beyond
+// maxEntries. c.mu must be held and key must not be present.
+func (c *MemoryCache) insert(key string, val interface{}, expiresAt time.Time) {
+	c.items[key] = c.lru.PushFront(&memoryEntry{key: key, value: val, expiresAt: expiresAt})
+	if c.maxEntries > 0 {
+		for c.lru.Len() > c.maxEntries {
+			c.removeElement(c.lru.Back())
+		}
+	}
+}
+
+// removeElement drops elem. c.mu must be held.
+func (c *MemoryCache) removeElement(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.items, elem.Value.(*memoryEntry).key)
+}
+
+// sweep periodically removes expired entries
+func (c *MemoryCache) sweep(interval time.Duration) {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.deleteExpired()
+		case <-c.stopCh:
+			return
+		}
+	}
+}
+
+// deleteExpired removes all expired entries
+func (c *MemoryCache) deleteExpired() {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for elem := c.lru.Back(); elem != nil; {
+		prev := elem.Prev()
+		if elem.Value.(*memoryEntry).expired(now) {
+			c.removeElement(elem)
+		}
+		elem = prev
+	}
+}
+
+var _ Store = (*MemoryCache)(nil)
@@ -0,0 +1,250 @@
+package cache
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"wechat-service/internal/config"
+)
+
+func TestMemoryCacheTTL(t *testing.T) {
+	tests := []struct {
+		name      string
+		ttl       time.Duration
+		wait      time.Duration
+		wantFound bool
+	}{
+		{name: "no expiry", ttl: 0, wait: 20 * time.Millisecond, wantFound: true},
+		{name: "negative ttl never expires", ttl: -time.Second, wait: 20 * time.Millisecond, wantFound: true},
+		{name: "within ttl", ttl: time.Minute, wantFound: true},
+		{name: "expired", ttl: 10 * time.Millisecond, wait: 20 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewMemoryCache(0, time.Hour)
+			defer c.Close()
+
+			c.Set("k", "v", tt.ttl)
+			time.Sleep(tt.wait)
+
+			if got := c.IsExist("k"); got != tt.wantFound {
+				t.Errorf("IsExist = %v, want %v", got, tt.wantFound)
+			}
+			got := c.Get("k")
+			if tt.wantFound && got != "v" {
+				t.Errorf("Get = %v, want v", got)
+			}
+			if !tt.wantFound && got != nil {
+				t.Errorf("Get = %v, want nil", got)
+			}
+		})
+	}
+}
+
+func TestMemoryCacheLRU(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxEntries int
+		ops        []string // "set:k" or "get:k"
+		want       []string // keys left, in any order
+	}{
+		{name: "unbounded", ops: []string{"set:a", "set:b", "set:c"}, want: []string{"a", "b", "c"}},
+		{name: "evicts oldest", maxEntries: 2, ops: []string{"set:a", "set:b", "set:c"}, want: []string{"b", "c"}},
+		{name: "get refreshes", maxEntries: 2, ops: []string{"set:a", "set:b", "get:a", "set:c"}, want: []string{"a", "c"}},
+		{name: "overwrite refreshes", maxEntries: 2, ops: []string{"set:a", "set:b", "set:a", "set:c"}, want: []string{"a", "c"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewMemoryCache(tt.maxEntries, time.Hour)
+			defer c.Close()
+
+			for _, op := range tt.ops {
+				key := op[4:]
+				if op[:3] == "set" {
+					c.Set(key, key, 0)
+				} else {
+					c.Get(key)
+				}
+			}
+
+			if c.Len() != len(tt.want) {
+				t.Errorf("Len = %d, want %d", c.Len(), len(tt.want))
+			}
+			for _, key := range tt.want {
+				if !c.IsExist(key) {
+					t.Errorf("%s evicted", key)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryCacheSweep(t *testing.T) {
+	c := NewMemoryCache(0, 10*time.Millisecond)
+	defer c.Close()
+
+	c.Set("short", "v", 5*time.Millisecond)
+	c.Set("long", "v", time.Minute)
+
+	deadline := time.Now().Add(time.Second)
+	for c.Len() != 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if c.Len() != 1 || !c.IsExist("long") {
+		t.Errorf("Len = %d after sweep, want only the unexpired entry", c.Len())
+	}
+}
+
+func TestMemoryCacheIncr(t *testing.T) {
+	tests := []struct {
+		name    string
+		initial interface{} // stored with Set first, unless nil
+		deltas  []int64
+		want    int64
+		wantErr bool
+	}{
+		{name: "new counter", deltas: []int64{1}, want: 1},
+		{name: "accumulates", deltas: []int64{1, 2, -1}, want: 2},
+		{name: "existing string", initial: "10", deltas: []int64{5}, want: 15},
+		{name: "existing int", initial: 3, deltas: []int64{1}, want: 4},
+		{name: "not a number", initial: "abc", deltas: []int64{1}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewMemoryCache(0, time.Hour)
+			defer c.Close()
+			if tt.initial != nil {
+				c.Set("n", tt.initial, 0)
+			}
+
+			var got int64
+			var err error
+			for _, d := range tt.deltas {
+				if got, err = c.Incr(context.Background(), "n", d); err != nil {
+					break
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("Incr = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryCacheSetNX(t *testing.T) {
+	tests := []struct {
+		name   string
+		first  time.Duration // TTL of the first SetNX
+		wait   time.Duration
+		wantOK bool // result of the second SetNX
+	}{
+		{name: "held", first: time.Minute, wantOK: false},
+		{name: "expired", first: 10 * time.Millisecond, wait: 20 * time.Millisecond, wantOK: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewMemoryCache(0, time.Hour)
+			defer c.Close()
+			ctx := context.Background()
+
+			if ok, err := c.SetNX(ctx, "k", "first", tt.first); !ok || err != nil {
+				t.Fatalf("first SetNX = %v, %v", ok, err)
+			}
+			time.Sleep(tt.wait)
+			ok, err := c.SetNX(ctx, "k", "second", time.Minute)
+			if err != nil || ok != tt.wantOK {
+				t.Errorf("second SetNX = %v, %v, want %v", ok, err, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestMemoryCacheStoreRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		val  interface{}
+		want []byte
+	}{
+		{name: "string", val: "v", want: []byte("v")},
+		{name: "bytes", val: []byte("raw"), want: []byte("raw")},
+		{name: "struct as json", val: struct{ A int }{1}, want: []byte(`{"A":1}`)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewMemoryCache(0, time.Hour)
+			defer c.Close()
+			ctx := context.Background()
+
+			if err := c.SetContext(ctx, "k", tt.val, 0); err != nil {
+				t.Fatal(err)
+			}
+			got, err := c.GetContext(ctx, "k")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetContext = %q, want %q", got, tt.want)
+			}
+			if _, err := c.GetContext(ctx, "missing"); err != ErrNotFound {
+				t.Errorf("GetContext(missing) err = %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
+
+func TestMemoryCacheConcurrent(t *testing.T) {
+	c := NewMemoryCache(50, time.Millisecond)
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				key := string(rune('a' + (i*j)%26))
+				c.Set(key, j, time.Millisecond)
+				c.Get(key)
+				c.Incr(context.Background(), "counter", 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if c.Len() > 50 {
+		t.Errorf("Len = %d, want at most 50", c.Len())
+	}
+}
+
+func TestNewSelectsMemory(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Cache.Type = "memory"
+	cfg.Cache.Memory.MaxEntries = 1
+
+	store, err := New(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, ok := store.(*MemoryCache)
+	if !ok {
+		t.Fatalf("New returned %T, want *MemoryCache", store)
+	}
+	defer c.Close()
+
+	c.Set("a", 1, 0)
+	c.Set("b", 2, 0)
+	if c.Len() != 1 {
+		t.Errorf("Len = %d, want max_entries applied", c.Len())
+	}
+}
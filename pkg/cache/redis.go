@@ -2,18 +2,31 @@ package cache
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
 	"time"
 
+	"wechat-service/internal/config"
+	"wechat-service/pkg/tracing"
+
 	"github.com/go-redis/redis/v8"
-	"github.com/silenceper/wechat/v2/cache"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// RedisCache implements cache.Cache interface using Redis
+// LatencyObserver receives the duration of each cache operation
+type LatencyObserver func(operation string, d time.Duration)
+
+// RedisCache implements cache.Cache interface using Redis, standalone or
+// through Sentinel or Cluster
 type RedisCache struct {
-	client *redis.Client
+	client  redis.UniversalClient
+	observe LatencyObserver
 }
 
-// NewRedisCache creates a new Redis cache instance
+// NewRedisCache creates a new Redis cache instance for a standalone server
 func NewRedisCache(addr, password string, db int) *RedisCache {
 	client := redis.NewClient(&redis.Options{
 		Addr:     addr,
@@ -23,62 +36,225 @@ func NewRedisCache(addr, password string, db int) *RedisCache {
 	return &RedisCache{client: client}
 }
 
-// Get implements cache.Cache (no error return)
+// NewRedisCacheFromConfig creates a Redis cache from Cache.Redis, in
+// standalone, sentinel or cluster mode
+func NewRedisCacheFromConfig(cfg *config.Config) (*RedisCache, error) {
+	r := cfg.Cache.Redis
+
+	opts := &redis.UniversalOptions{
+		Username:         r.Username,
+		Password:         r.Password,
+		SentinelPassword: r.SentinelPassword,
+		DB:               r.DB,
+		PoolSize:         r.PoolSize,
+		MinIdleConns:     r.MinIdleConns,
+		DialTimeout:      time.Duration(r.DialTimeout) * time.Millisecond,
+		ReadTimeout:      time.Duration(r.ReadTimeout) * time.Millisecond,
+		WriteTimeout:     time.Duration(r.WriteTimeout) * time.Millisecond,
+	}
+
+	if r.TLS.Enabled {
+		tlsConfig, err := redisTLSConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		opts.TLSConfig = tlsConfig
+	}
+
+	var client redis.UniversalClient
+	switch r.Mode {
+	case "", "standalone":
+		opts.Addrs = []string{r.Addr}
+		client = redis.NewClient(opts.Simple())
+	case "sentinel":
+		opts.Addrs = r.Addrs
+		opts.MasterName = r.MasterName
+		client = redis.NewFailoverClient(opts.Failover())
+	case "cluster":
+		opts.Addrs = r.Addrs
+		client = redis.NewClusterClient(opts.Cluster())
+	default:
+		return nil, fmt.Errorf("unknown redis mode: %q", r.Mode)
+	}
+
+	return &RedisCache{client: client}, nil
+}
+
+// redisTLSConfig builds the TLS configuration from Cache.Redis.TLS
+func redisTLSConfig(cfg *config.Config) (*tls.Config, error) {
+	t := cfg.Cache.Redis.TLS
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read redis CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in redis CA file %s", t.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load redis client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// SetLatencyObserver sets the observer fed with operation latencies,
+// e.g. Metrics.ObserveDependencyLatency
+func (c *RedisCache) SetLatencyObserver(observe LatencyObserver) {
+	c.observe = observe
+}
+
+// begin starts a span for an operation and returns a function that ends
+// it and reports the latency. The span is only started under a parent
+// span: the SDK cache interface carries no context, and its calls would
+// otherwise each become a root trace.
+func (c *RedisCache) begin(ctx context.Context, operation string) func() {
+	start := time.Now()
+	var span trace.Span
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		_, span = tracing.Start(ctx, "redis."+operation,
+			attribute.String("db.system", "redis"),
+		)
+	}
+
+	return func() {
+		if span != nil {
+			span.End()
+		}
+		if c.observe != nil {
+			c.observe(operation, time.Since(start))
+		}
+	}
+}
+
+// Get implements cache.Cache, returning nil when the key is missing or
+// Redis fails. Use GetContext to tell the two apart.
 func (c *RedisCache) Get(key string) interface{} {
-	val, _ := c.client.Get(context.Background(), key).Result()
+	defer c.begin(context.Background(), "get")()
+	val, err := c.client.Get(context.Background(), key).Result()
+	if err != nil {
+		return nil
+	}
 	return val
 }
 
 // Set stores a value in cache with TTL
 func (c *RedisCache) Set(key string, val interface{}, ttl time.Duration) error {
+	defer c.begin(context.Background(), "set")()
 	return c.client.Set(context.Background(), key, val, ttl).Err()
 }
 
 // IsExist checks if a key exists
 func (c *RedisCache) IsExist(key string) bool {
+	defer c.begin(context.Background(), "exists")()
 	result, _ := c.client.Exists(context.Background(), key).Result()
 	return result > 0
 }
 
 // Delete removes a key from cache
 func (c *RedisCache) Delete(key string) error {
+	defer c.begin(context.Background(), "delete")()
 	return c.client.Del(context.Background(), key).Err()
 }
 
-// MemoryCache is a simple in-memory cache using Redis (miniredis in tests)
-type MemoryCache struct {
-	client *redis.Client
+// GetContext implements Store
+func (c *RedisCache) GetContext(ctx context.Context, key string) ([]byte, error) {
+	defer c.begin(ctx, "get")()
+	val, err := c.client.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+	return val, err
 }
 
-// NewMemoryCache creates a memory cache for development
-func NewMemoryCache() *MemoryCache {
-	client := redis.NewClient(&redis.Options{
-		Addr: "127.0.0.1:6379",
+// getWithTTL returns the value of key and its remaining TTL, negative when
+// the key does not expire, or ErrNotFound
+func (c *RedisCache) getWithTTL(ctx context.Context, key string) (string, time.Duration, error) {
+	defer c.begin(ctx, "get")()
+
+	var get *redis.StringCmd
+	var pttl *redis.DurationCmd
+	_, err := c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		get = pipe.Get(ctx, key)
+		pttl = pipe.PTTL(ctx, key)
+		return nil
 	})
-	return &MemoryCache{client: client}
+	if err == redis.Nil {
+		return "", 0, ErrNotFound
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	return get.Val(), pttl.Val(), nil
 }
 
-// Get implements cache.Cache
-func (c *MemoryCache) Get(key string) interface{} {
-	val, _ := c.client.Get(context.Background(), key).Result()
-	return val
+// SetContext implements Store
+func (c *RedisCache) SetContext(ctx context.Context, key string, val interface{}, ttl time.Duration) error {
+	data, err := serialize(val)
+	if err != nil {
+		return err
+	}
+	defer c.begin(ctx, "set")()
+	return c.client.Set(ctx, key, data, ttl).Err()
 }
 
-// Set stores a value in memory cache with TTL
-func (c *MemoryCache) Set(key string, val interface{}, ttl time.Duration) error {
-	return c.client.Set(context.Background(), key, val, ttl).Err()
+// DeleteContext implements Store
+func (c *RedisCache) DeleteContext(ctx context.Context, key string) error {
+	defer c.begin(ctx, "delete")()
+	return c.client.Del(ctx, key).Err()
 }
 
-// IsExist checks if a key exists
-func (c *MemoryCache) IsExist(key string) bool {
-	result, _ := c.client.Exists(context.Background(), key).Result()
-	return result > 0
+// Incr implements Store
+func (c *RedisCache) Incr(ctx context.Context, key string, delta int64) (int64, error) {
+	defer c.begin(ctx, "incr")()
+	return c.client.IncrBy(ctx, key, delta).Result()
 }
 
-// Delete removes a key from memory cache
-func (c *MemoryCache) Delete(key string) error {
-	return c.client.Del(context.Background(), key).Err()
+// SetNX implements Store
+func (c *RedisCache) SetNX(ctx context.Context, key string, val interface{}, ttl time.Duration) (bool, error) {
+	data, err := serialize(val)
+	if err != nil {
+		return false, err
+	}
+	defer c.begin(ctx, "setnx")()
+	return c.client.SetNX(ctx, key, data, ttl).Result()
+}
+
+// Publish sends message on a pub/sub channel
+func (c *RedisCache) Publish(ctx context.Context, channel, message string) error {
+	defer c.begin(ctx, "publish")()
+	return c.client.Publish(ctx, channel, message).Err()
+}
+
+// Subscribe subscribes to a pub/sub channel. The subscription reconnects
+// on its own until closed.
+func (c *RedisCache) Subscribe(ctx context.Context, channel string) *redis.PubSub {
+	return c.client.Subscribe(ctx, channel)
+}
+
+// Close closes the connection pool
+func (c *RedisCache) Close() error {
+	return c.client.Close()
+}
+
+// Ping checks connectivity to Redis
+func (c *RedisCache) Ping(ctx context.Context) error {
+	defer c.begin(ctx, "ping")()
+	return c.client.Ping(ctx).Err()
 }
 
-var _ cache.Cache = (*RedisCache)(nil)
-var _ cache.Cache = (*MemoryCache)(nil)
+var _ Store = (*RedisCache)(nil)
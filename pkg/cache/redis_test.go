@@ -0,0 +1,84 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestRedisCacheSpans(t *testing.T) {
+	tests := []struct {
+		name      string
+		parent    bool
+		call      func(ctx context.Context, c *RedisCache)
+		wantSpans []string
+	}{
+		{
+			name: "sdk get",
+			call: func(ctx context.Context, c *RedisCache) { c.Get("k") },
+		},
+		{
+			name: "sdk set",
+			call: func(ctx context.Context, c *RedisCache) { c.Set("k", "v", time.Minute) },
+		},
+		{
+			name: "context get without parent",
+			call: func(ctx context.Context, c *RedisCache) { c.GetContext(ctx, "k") },
+		},
+		{
+			name:      "context get under parent",
+			parent:    true,
+			call:      func(ctx context.Context, c *RedisCache) { c.GetContext(ctx, "k") },
+			wantSpans: []string{"redis.get", "parent"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := tracetest.NewSpanRecorder()
+			provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+			previous := otel.GetTracerProvider()
+			otel.SetTracerProvider(provider)
+			defer otel.SetTracerProvider(previous)
+
+			mr := miniredis.RunT(t)
+			c := NewRedisCache(mr.Addr(), "", 0)
+			var operations []string
+			c.SetLatencyObserver(func(operation string, d time.Duration) {
+				operations = append(operations, operation)
+			})
+
+			ctx := context.Background()
+			if tt.parent {
+				var span trace.Span
+				ctx, span = provider.Tracer("test").Start(ctx, "parent")
+				tt.call(ctx, c)
+				span.End()
+			} else {
+				tt.call(ctx, c)
+			}
+
+			var got []string
+			for _, s := range recorder.Ended() {
+				got = append(got, s.Name())
+			}
+			if len(got) != len(tt.wantSpans) {
+				t.Fatalf("spans = %v, want %v", got, tt.wantSpans)
+			}
+			for i := range got {
+				if got[i] != tt.wantSpans[i] {
+					t.Errorf("spans = %v, want %v", got, tt.wantSpans)
+				}
+			}
+			if len(operations) != 1 {
+				t.Errorf("latencies recorded for %v, want one operation", operations)
+			}
+		})
+	}
+}
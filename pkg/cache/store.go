@@ -0,0 +1,175 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Common errors
+var (
+	ErrNotFound = errors.New("cache: key not found")
+)
+
+// Store is the error-returning API implemented by every cache in this
+// package alongside the SDK-compatible Cache. Values are written with
+// serialize: strings and bytes as is, anything else as JSON.
+type Store interface {
+	Cache
+
+	// GetContext returns the raw value of key, or ErrNotFound
+	GetContext(ctx context.Context, key string) ([]byte, error)
+	// SetContext stores val under key; a TTL <= 0 never expires
+	SetContext(ctx context.Context, key string, val interface{}, ttl time.Duration) error
+	// DeleteContext removes key
+	DeleteContext(ctx context.Context, key string) error
+	// Incr adds delta to the integer stored at key, starting from 0, and
+	// returns the new value
+	Incr(ctx context.Context, key string, delta int64) (int64, error)
+	// SetNX stores val only if key does not exist and reports whether it did
+	SetNX(ctx context.Context, key string, val interface{}, ttl time.Duration) (bool, error)
+}
+
+// GetJSON reads key and decodes it as JSON into a T
+func GetJSON[T any](ctx context.Context, s Store, key string) (T, error) {
+	var v T
+	data, err := s.GetContext(ctx, key)
+	if err != nil {
+		return v, err
+	}
+	if err := deserialize(data, &v); err != nil {
+		return v, err
+	}
+	return v, nil
+}
+
+// SetJSON encodes v as JSON and stores it under key. Unlike SetContext,
+// strings and bytes are encoded too, so that GetJSON reads them back.
+func SetJSON(ctx context.Context, s Store, key string, v interface{}, ttl time.Duration) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.SetContext(ctx, key, data, ttl)
+}
+
+// loadGroup collapses concurrent GetOrLoad misses for the same key of the
+// same underlying store; see flightKey
+var loadGroup singleflight.Group
+
+// flightKey identifies key across every Store sharing loadGroup: the
+// namespaces of s are resolved and the key is scoped to the backing store
+func flightKey(s Store, key string) string {
+	for {
+		n, ok := s.(*namespaced)
+		if !ok {
+			return fmt.Sprintf("%p|%s", s, key)
+		}
+		s, key = n.store, n.prefix+key
+	}
+}
+
+// GetOrLoad returns the cached T under key or calls load once, however
+// many callers miss concurrently, and caches its result for ttl. An entry
+// that cannot be read or decoded is treated as a miss. If caching the
+// loaded value fails, the value is returned together with the error.
+// load runs without the caller's cancellation, since other callers may be
+// waiting on it.
+func GetOrLoad[T any](ctx context.Context, s Store, key string, ttl time.Duration, load func(ctx context.Context) (T, error)) (T, error) {
+	if v, err := GetJSON[T](ctx, s, key); err == nil {
+		return v, nil
+	}
+
+	res, err, _ := loadGroup.Do(flightKey(s, key), func() (interface{}, error) {
+		loadCtx := context.WithoutCancel(ctx)
+		loaded, err := load(loadCtx)
+		if err != nil {
+			return nil, err
+		}
+		if err := SetJSON(loadCtx, s, key, loaded, ttl); err != nil {
+			return loaded, err
+		}
+		return loaded, nil
+	})
+
+	v, ok := res.(T)
+	if !ok && err == nil {
+		// Another caller loaded a different type under the same key
+		return load(ctx)
+	}
+	return v, err
+}
+
+// Prefix builds a key namespace such as "wechat-service:production:wx123:"
+// from its non-empty parts
+func Prefix(parts ...string) string {
+	var nonEmpty []string
+	for _, p := range parts {
+		if p != "" {
+			nonEmpty = append(nonEmpty, p)
+		}
+	}
+	return strings.Join(nonEmpty, ":") + ":"
+}
+
+// namespaced prefixes every key of an underlying Store
+type namespaced struct {
+	store  Store
+	prefix string
+}
+
+// WithNamespace returns a Store that prefixes every key with prefix, so
+// that accounts and environments sharing a Redis do not collide
+func WithNamespace(s Store, prefix string) Store {
+	return &namespaced{store: s, prefix: prefix}
+}
+
+// Get implements cache.Cache
+func (n *namespaced) Get(key string) interface{} {
+	return n.store.Get(n.prefix + key)
+}
+
+// Set implements cache.Cache
+func (n *namespaced) Set(key string, val interface{}, ttl time.Duration) error {
+	return n.store.Set(n.prefix+key, val, ttl)
+}
+
+// IsExist implements cache.Cache
+func (n *namespaced) IsExist(key string) bool {
+	return n.store.IsExist(n.prefix + key)
+}
+
+// Delete implements cache.Cache
+func (n *namespaced) Delete(key string) error {
+	return n.store.Delete(n.prefix + key)
+}
+
+// GetContext implements Store
+func (n *namespaced) GetContext(ctx context.Context, key string) ([]byte, error) {
+	return n.store.GetContext(ctx, n.prefix+key)
+}
+
+// SetContext implements Store
+func (n *namespaced) SetContext(ctx context.Context, key string, val interface{}, ttl time.Duration) error {
+	return n.store.SetContext(ctx, n.prefix+key, val, ttl)
+}
+
+// DeleteContext implements Store
+func (n *namespaced) DeleteContext(ctx context.Context, key string) error {
+	return n.store.DeleteContext(ctx, n.prefix+key)
+}
+
+// Incr implements Store
+func (n *namespaced) Incr(ctx context.Context, key string, delta int64) (int64, error) {
+	return n.store.Incr(ctx, n.prefix+key, delta)
+}
+
+// SetNX implements Store
+func (n *namespaced) SetNX(ctx context.Context, key string, val interface{}, ttl time.Duration) (bool, error) {
+	return n.store.SetNX(ctx, n.prefix+key, val, ttl)
+}
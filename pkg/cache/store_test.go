@@ -0,0 +1,238 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSetJSONRoundTrip(t *testing.T) {
+	type token struct {
+		Value string `json:"value"`
+	}
+
+	tests := []struct {
+		name  string
+		value interface{}
+		read  func(ctx context.Context, s Store) (interface{}, error)
+	}{
+		{
+			name:  "string",
+			value: "abc",
+			read: func(ctx context.Context, s Store) (interface{}, error) {
+				return GetJSON[string](ctx, s, "k")
+			},
+		},
+		{
+			name:  "json-looking string",
+			value: `{"a":1}`,
+			read: func(ctx context.Context, s Store) (interface{}, error) {
+				return GetJSON[string](ctx, s, "k")
+			},
+		},
+		{
+			name:  "int",
+			value: 42,
+			read: func(ctx context.Context, s Store) (interface{}, error) {
+				return GetJSON[int](ctx, s, "k")
+			},
+		},
+		{
+			name:  "struct",
+			value: token{Value: "t"},
+			read: func(ctx context.Context, s Store) (interface{}, error) {
+				return GetJSON[token](ctx, s, "k")
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := NewMemoryCache(0, 0)
+			defer s.Close()
+
+			if err := SetJSON(ctx, s, "k", tt.value, time.Minute); err != nil {
+				t.Fatalf("SetJSON: %v", err)
+			}
+			got, err := tt.read(ctx, s)
+			if err != nil {
+				t.Fatalf("GetJSON: %v", err)
+			}
+			if got != tt.value {
+				t.Errorf("GetJSON = %v, want %v", got, tt.value)
+			}
+		})
+	}
+}
+
+func TestGetOrLoad(t *testing.T) {
+	tests := []struct {
+		name      string
+		cached    string // JSON stored before the call, if any
+		loaded    string
+		loadErr   error
+		want      string
+		wantLoads int32
+		wantErr   bool
+	}{
+		{name: "miss loads and caches", loaded: "fresh", want: "fresh", wantLoads: 1},
+		{name: "hit skips load", cached: `"cached"`, loaded: "fresh", want: "cached"},
+		{name: "undecodable entry is a miss", cached: "not json", loaded: "fresh", want: "fresh", wantLoads: 1},
+		{name: "load error", loadErr: errors.New("boom"), wantLoads: 1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := NewMemoryCache(0, 0)
+			defer s.Close()
+			if tt.cached != "" {
+				if err := s.SetContext(ctx, "k", tt.cached, 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var loads int32
+			got, err := GetOrLoad(ctx, s, "k", time.Minute, func(ctx context.Context) (string, error) {
+				atomic.AddInt32(&loads, 1)
+				return tt.loaded, tt.loadErr
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if loads != tt.wantLoads {
+				t.Errorf("loads = %d, want %d", loads, tt.wantLoads)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			// The second call must be served from the cache
+			again, err := GetOrLoad(ctx, s, "k", time.Minute, func(ctx context.Context) (string, error) {
+				t.Error("unexpected second load")
+				return "", nil
+			})
+			if err != nil || again != tt.want {
+				t.Errorf("second GetOrLoad = %q, %v; want %q", again, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetOrLoadCollapsesConcurrentMisses(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryCache(0, 0)
+	defer s.Close()
+
+	var loads int32
+	release := make(chan struct{})
+	load := func(ctx context.Context) (int, error) {
+		atomic.AddInt32(&loads, 1)
+		<-release
+		return 7, nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]int, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = GetOrLoad(ctx, s, "k", time.Minute, load)
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if loads != 1 {
+		t.Errorf("loads = %d, want 1", loads)
+	}
+	for i, r := range results {
+		if r != 7 {
+			t.Errorf("result %d = %d, want 7", i, r)
+		}
+	}
+}
+
+func TestGetOrLoadIsolatesNamespaces(t *testing.T) {
+	ctx := context.Background()
+	shared := NewMemoryCache(0, 0)
+	defer shared.Close()
+	other := NewMemoryCache(0, 0)
+	defer other.Close()
+
+	tests := []struct {
+		name  string
+		store Store
+		value string
+	}{
+		{name: "account a", store: WithNamespace(shared, "a:"), value: "token-a"},
+		{name: "account b", store: WithNamespace(shared, "b:"), value: "token-b"},
+		{name: "other backend", store: other, value: "token-other"},
+		{name: "nested namespace", store: WithNamespace(WithNamespace(shared, "a:"), "x:"), value: "token-ax"},
+	}
+
+	// Every loader blocks until all of them started, so the flights overlap
+	var started sync.WaitGroup
+	started.Add(len(tests))
+	var wg sync.WaitGroup
+	got := make([]string, len(tests))
+	for i, tt := range tests {
+		wg.Add(1)
+		go func(i int, s Store, value string) {
+			defer wg.Done()
+			got[i], _ = GetOrLoad(ctx, s, "token", time.Minute, func(ctx context.Context) (string, error) {
+				started.Done()
+				started.Wait()
+				return value, nil
+			})
+		}(i, tt.store, tt.value)
+	}
+	wg.Wait()
+
+	for i, tt := range tests {
+		if got[i] != tt.value {
+			t.Errorf("%s: got %q, want %q", tt.name, got[i], tt.value)
+		}
+	}
+}
+
+func TestGetOrLoadDetachesLoadFromCaller(t *testing.T) {
+	s := NewMemoryCache(0, 0)
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	got, err := GetOrLoad(ctx, s, "k", time.Minute, func(ctx context.Context) (string, error) {
+		return "v", ctx.Err()
+	})
+	if err != nil || got != "v" {
+		t.Errorf("GetOrLoad = %q, %v; want v, nil", got, err)
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	tests := []struct {
+		parts []string
+		want  string
+	}{
+		{parts: []string{"wechat-service", "production", "wx1"}, want: "wechat-service:production:wx1:"},
+		{parts: []string{"wechat-service", "", "wx1"}, want: "wechat-service:wx1:"},
+		{parts: []string{"wechat-service"}, want: "wechat-service:"},
+	}
+
+	for _, tt := range tests {
+		if got := Prefix(tt.parts...); got != tt.want {
+			t.Errorf("Prefix(%q) = %q, want %q", tt.parts, got, tt.want)
+		}
+	}
+}
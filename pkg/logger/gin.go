@@ -1,17 +1,69 @@
 package logger
 
 import (
+	"net/url"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-// GinLogger returns a Gin middleware for logging requests
+// RequestID returns a Gin middleware that assigns each request an ID,
+// taken from the X-Request-ID header when present, and attaches a logger
+// carrying it to the request context. For WeChat callbacks the nonce and
+// msg_signature query parameters are logged as well so a request can be
+// matched against WeChat's retries. The ID is echoed in the response.
+func RequestID(l *Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(RequestIDHeader)
+		if id == "" || len(id) > 64 {
+			id = NewRequestID()
+		}
+
+		fields := []any{"request_id", id}
+		if nonce := c.Query("nonce"); nonce != "" {
+			fields = append(fields, "nonce", nonce)
+		}
+		if sig := c.Query("msg_signature"); sig != "" {
+			fields = append(fields, "msg_signature", sig)
+		}
+
+		ctx := WithRequestID(c.Request.Context(), id)
+		ctx = NewContext(ctx, l.With(fields...))
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Header(RequestIDHeader, id)
+		c.Set("request_id", id)
+
+		c.Next()
+	}
+}
+
+// loggedQueryKeys are the query parameters kept in the access log. Others,
+// such as signatures, echostr, openids and tokens, are left out.
+var loggedQueryKeys = map[string]bool{
+	"timestamp":    true,
+	"nonce":        true,
+	"encrypt_type": true,
+	"appid":        true,
+	"type":         true,
+	"severity":     true,
+	"status":       true,
+	"name":         true,
+	"since":        true,
+	"until":        true,
+	"limit":        true,
+	"force":        true,
+	"redeploy":     true,
+}
+
+// GinLogger returns a Gin middleware for logging requests. Only the query
+// parameters in loggedQueryKeys are logged. When the RequestID middleware
+// runs first the access log carries its fields.
 func GinLogger(l *Logger) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		start := time.Now()
 		path := c.Request.URL.Path
-		query := c.Request.URL.RawQuery
+		query := loggedQuery(c.Request.URL)
 
 		c.Next()
 
@@ -24,13 +76,23 @@ func GinLogger(l *Logger) gin.HandlerFunc {
 			path = path + "?" + query
 		}
 
-		l.Infof("[GIN] %s | %3d | %13v | %15s | %-7s %s",
-			time.Now().Format("2006/01/02 - 15:04:05"),
-			statusCode,
-			latency,
-			clientIP,
-			method,
-			path,
+		FromContextOr(c.Request.Context(), l).Info("HTTP request",
+			"status", statusCode,
+			"latency", latency,
+			"client_ip", clientIP,
+			"method", method,
+			"path", path,
 		)
 	}
 }
+
+// loggedQuery returns the query of u reduced to loggedQueryKeys
+func loggedQuery(u *url.URL) string {
+	values := u.Query()
+	for key := range values {
+		if !loggedQueryKeys[key] {
+			delete(values, key)
+		}
+	}
+	return values.Encode()
+}
@@ -0,0 +1,162 @@
+package logger
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRequestID(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name       string
+		header     string
+		query      string
+		wantID     string // expected ID, generated when empty
+		wantFields []string
+	}{
+		{name: "generated", wantFields: []string{"request_id="}},
+		{name: "from header", header: "req-1", wantID: "req-1", wantFields: []string{"request_id=req-1"}},
+		{name: "overlong header replaced", header: strings.Repeat("x", 65)},
+		{
+			name:       "callback parameters",
+			header:     "req-2",
+			query:      "?nonce=n1&msg_signature=abc",
+			wantID:     "req-2",
+			wantFields: []string{"request_id=req-2", "nonce=n1", "msg_signature=abc"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, read := newFileLogger(t, "text", "info")
+
+			var ctxID string
+			r := gin.New()
+			r.Use(RequestID(l), GinLogger(l))
+			r.GET("/wechat", func(c *gin.Context) {
+				ctxID = RequestIDFromContext(c.Request.Context())
+				FromContext(c.Request.Context()).Info("handled")
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/wechat"+tt.query, nil)
+			if tt.header != "" {
+				req.Header.Set(RequestIDHeader, tt.header)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			id := w.Header().Get(RequestIDHeader)
+			switch {
+			case tt.wantID != "" && id != tt.wantID:
+				t.Errorf("response ID = %q, want %q", id, tt.wantID)
+			case tt.wantID == "" && (len(id) != 16 || id == tt.header):
+				t.Errorf("response ID = %q, want a generated one", id)
+			}
+			if ctxID != id {
+				t.Errorf("context ID = %q, response ID = %q", ctxID, id)
+			}
+
+			// Both the handler's record and the access log carry the fields
+			lines := strings.Split(strings.TrimSpace(read()), "\n")
+			if len(lines) != 2 {
+				t.Fatalf("got %d records, want 2:\n%s", len(lines), strings.Join(lines, "\n"))
+			}
+			for _, line := range lines {
+				if !strings.Contains(line, "request_id="+id) {
+					t.Errorf("record lacks the request ID %s: %s", id, line)
+				}
+				for _, field := range tt.wantFields {
+					if !strings.Contains(line, field) {
+						t.Errorf("record lacks %s: %s", field, line)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestGinLoggerQuery(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name     string
+		query    string
+		wantPath string
+		hidden   []string
+	}{
+		{name: "no query", wantPath: "path=/wechat\n"},
+		{
+			name:     "callback",
+			query:    "?signature=sig1&timestamp=1700000000&nonce=n1&openid=oABCDEFGHIJKLMNOPQRSTUVWXYZa&encrypt_type=aes&msg_signature=msig1",
+			wantPath: `path="/wechat?encrypt_type=aes&nonce=n1&timestamp=1700000000"`,
+			hidden:   []string{"sig1", "msig1", "oABC"},
+		},
+		{name: "verification", query: "?signature=sig1&echostr=ECHO123", wantPath: "path=/wechat\n", hidden: []string{"sig1", "ECHO123"}},
+		{name: "token", query: "?access_token=TOK123&limit=5", wantPath: `path="/wechat?limit=5"`, hidden: []string{"TOK123"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, read := newFileLogger(t, "text", "info")
+
+			r := gin.New()
+			r.Use(GinLogger(l))
+			r.GET("/wechat", func(c *gin.Context) {})
+			r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/wechat"+tt.query, nil))
+
+			out := read()
+			if !strings.Contains(out, tt.wantPath) {
+				t.Errorf("%s missing from:\n%s", tt.wantPath, out)
+			}
+			for _, value := range tt.hidden {
+				if strings.Contains(out, value) {
+					t.Errorf("%s logged:\n%s", value, out)
+				}
+			}
+		})
+	}
+}
+
+func TestContextLogger(t *testing.T) {
+	fallback := New(nil)
+	carried := New(nil)
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want *Logger
+	}{
+		{name: "nil context", ctx: nil, want: fallback},
+		{name: "no logger", ctx: context.Background(), want: fallback},
+		{name: "carried logger", ctx: NewContext(context.Background(), carried), want: carried},
+		{name: "nil logger", ctx: NewContext(context.Background(), nil), want: fallback},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FromContextOr(tt.ctx, fallback); got != tt.want {
+				t.Errorf("FromContextOr returned %p, want %p", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithContextFields(t *testing.T) {
+	l, read := newFileLogger(t, "text", "info")
+	ctx := NewContext(context.Background(), l.With("request_id", "r1"))
+	ctx = WithContextFields(ctx, "openid", "o1", "msg_id", int64(7))
+
+	FromContext(ctx).Info("handled")
+	out := read()
+	for _, want := range []string{"request_id=r1", "openid=o1", "msg_id=7"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("%s missing from:\n%s", want, out)
+		}
+	}
+}
@@ -1,92 +1,230 @@
 package logger
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"os"
-	"path/filepath"
-	"time"
+	"strings"
+
+	"wechat-service/internal/config"
 )
 
-// Logger wraps logging functionality
+// Logger wraps a slog.Logger with the service's logging conventions:
+// a message followed by alternating key/value pairs
 type Logger struct {
-	*log.Logger
-	level  string
-	output io.Writer
+	slog     *slog.Logger
+	level    *slog.LevelVar
+	rotator  *RotatingWriter
+	redactor *Redactor
 }
 
-// New creates a new Logger instance
-func New() *Logger {
-	logDir := "logs"
-	if err := os.MkdirAll(logDir, 0755); err != nil {
-		log.Printf("Warning: failed to create log directory: %v", err)
+// New creates a new Logger from the Logging section and
+// Monitoring.LogLevel. A nil cfg logs text at info level to stdout.
+func New(cfg *config.Config) *Logger {
+	level := new(slog.LevelVar)
+	format, output, dir := "text", "stdout", "logs"
+	var rotate RotateOptions
+	redact := true
+	var redactFields map[string]string
+
+	if cfg != nil {
+		level.Set(ParseLevel(cfg.Monitoring.LogLevel))
+		format = cfg.Logging.Format
+		output = cfg.Logging.Output
+		dir = cfg.Logging.Dir
+		rotate = RotateOptions{
+			MaxSizeMB:  cfg.Logging.MaxSizeMB,
+			MaxAgeDays: cfg.Logging.MaxAgeDays,
+			MaxBackups: cfg.Logging.MaxBackups,
+			Compress:   cfg.Logging.Compress,
+		}
+		redact = !cfg.Logging.Redaction.Disabled
+		redactFields = cfg.Logging.Redaction.Fields
+	}
+
+	w, rotator := openOutput(output, dir, rotate)
+
+	opts := &slog.HandlerOptions{Level: level}
+	var redactor *Redactor
+	if redact {
+		redactor = NewRedactor(redactFields)
+		opts.ReplaceAttr = redactor.ReplaceAttr
+	}
+	var handler slog.Handler
+	if format == "json" {
+		handler = slog.NewJSONHandler(w, opts)
+	} else {
+		handler = slog.NewTextHandler(w, opts)
 	}
 
-	currentDate := time.Now().Format("2006-01-02")
-	logFile := filepath.Join(logDir, fmt.Sprintf("wechat-service_%s.log", currentDate))
+	return &Logger{
+		slog:     slog.New(handler),
+		level:    level,
+		rotator:  rotator,
+		redactor: redactor,
+	}
+}
+
+// openOutput opens the writer for output: stdout, file or both. File
+// output goes through a RotatingWriter.
+func openOutput(output, dir string, opts RotateOptions) (io.Writer, *RotatingWriter) {
+	if output == "stdout" || output == "" {
+		return os.Stdout, nil
+	}
 
-	file, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	rotator, err := NewRotatingWriter(dir, "wechat-service", opts)
 	if err != nil {
 		log.Printf("Warning: failed to open log file: %v", err)
-		file = os.Stdout
+		return os.Stdout, nil
+	}
+
+	if output == "both" {
+		return io.MultiWriter(os.Stdout, rotator), rotator
+	}
+	return rotator, rotator
+}
+
+// ParseLevel maps debug, info, warn and error to slog levels, defaulting
+// to info
+func ParseLevel(level string) slog.Level {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// SetLevel changes the minimum level at runtime
+func (l *Logger) SetLevel(level string) {
+	l.level.Set(ParseLevel(level))
+}
+
+// SetRedactFields replaces the per-field redaction overrides at runtime.
+// It has no effect when redaction is disabled.
+func (l *Logger) SetRedactFields(fields map[string]string) {
+	if l.redactor != nil {
+		l.redactor.SetFields(fields)
 	}
+}
+
+// ApplyConfig applies the settings of cfg that can change at runtime:
+// the level and the redaction fields. Format and output need a restart.
+func (l *Logger) ApplyConfig(cfg *config.Config) {
+	l.SetLevel(cfg.Monitoring.LogLevel)
+	l.SetRedactFields(cfg.Logging.Redaction.Fields)
+}
 
+// With returns a logger that adds the given key/value pairs to every record
+func (l *Logger) With(args ...interface{}) *Logger {
 	return &Logger{
-		Logger: log.New(file, "", log.LstdFlags),
-		level:  "info",
-		output: file,
+		slog:     l.slog.With(args...),
+		level:    l.level,
+		rotator:  l.rotator,
+		redactor: l.redactor,
+	}
+}
+
+// Slog returns the underlying slog.Logger
+func (l *Logger) Slog() *slog.Logger {
+	return l.slog
+}
+
+// Close closes the log file, if any
+func (l *Logger) Close() error {
+	if l.rotator == nil {
+		return nil
 	}
+	return l.rotator.Close()
 }
 
-// Debug logs a debug message
-func (l *Logger) Debug(v ...interface{}) {
-	l.Printf("[DEBUG] "+fmt.Sprint(v...)+"\n")
+// Reopen reopens the log file, if any, after it was moved externally
+func (l *Logger) Reopen() error {
+	if l.rotator == nil {
+		return nil
+	}
+	return l.rotator.Reopen()
+}
+
+// Watch applies configuration reloads of w to the logger and reopens the
+// log file on SIGHUP, which the watcher owns, after logrotate moved it
+func (l *Logger) Watch(w *config.Watcher) {
+	w.Subscribe(func(_, cfg *config.Config) {
+		l.ApplyConfig(cfg)
+	})
+	w.OnSIGHUP(func() {
+		if err := l.Reopen(); err != nil {
+			l.Error("Failed to reopen log file", "error", err)
+		} else {
+			l.Info("Log file reopened")
+		}
+	})
+}
+
+// Debug logs a debug message with key/value pairs
+func (l *Logger) Debug(msg string, args ...interface{}) {
+	l.slog.Debug(msg, args...)
 }
 
 // Debugf logs a formatted debug message
 func (l *Logger) Debugf(format string, v ...interface{}) {
-	l.Printf("[DEBUG] "+fmt.Sprintf(format, v...)+"\n")
+	l.logf(slog.LevelDebug, format, v...)
 }
 
-// Info logs an info message
-func (l *Logger) Info(v ...interface{}) {
-	l.Printf("[INFO] "+fmt.Sprint(v...)+"\n")
+// Info logs an info message with key/value pairs
+func (l *Logger) Info(msg string, args ...interface{}) {
+	l.slog.Info(msg, args...)
 }
 
 // Infof logs a formatted info message
 func (l *Logger) Infof(format string, v ...interface{}) {
-	l.Printf("[INFO] "+fmt.Sprintf(format, v...)+"\n")
+	l.logf(slog.LevelInfo, format, v...)
 }
 
-// Warn logs a warning message
-func (l *Logger) Warn(v ...interface{}) {
-	l.Printf("[WARN] "+fmt.Sprint(v...)+"\n")
+// Warn logs a warning message with key/value pairs
+func (l *Logger) Warn(msg string, args ...interface{}) {
+	l.slog.Warn(msg, args...)
 }
 
 // Warnf logs a formatted warning message
 func (l *Logger) Warnf(format string, v ...interface{}) {
-	l.Printf("[WARN] "+fmt.Sprintf(format, v...)+"\n")
+	l.logf(slog.LevelWarn, format, v...)
 }
 
-// Error logs an error message
-func (l *Logger) Error(v ...interface{}) {
-	l.Printf("[ERROR] "+fmt.Sprint(v...)+"\n")
+// Error logs an error message with key/value pairs
+func (l *Logger) Error(msg string, args ...interface{}) {
+	l.slog.Error(msg, args...)
 }
 
 // Errorf logs a formatted error message
 func (l *Logger) Errorf(format string, v ...interface{}) {
-	l.Printf("[ERROR] "+fmt.Sprintf(format, v...)+"\n")
+	l.logf(slog.LevelError, format, v...)
 }
 
-// Fatal logs a fatal message and exits
-func (l *Logger) Fatal(v ...interface{}) {
-	l.Printf("[FATAL] "+fmt.Sprint(v...)+"\n")
+// Fatal logs an error message with key/value pairs and exits
+func (l *Logger) Fatal(msg string, args ...interface{}) {
+	l.slog.Error(msg, args...)
 	os.Exit(1)
 }
 
-// Fatalf logs a formatted fatal message and exits
+// Fatalf logs a formatted error message and exits
 func (l *Logger) Fatalf(format string, v ...interface{}) {
-	l.Printf("[FATAL] "+fmt.Sprintf(format, v...)+"\n")
+	l.logf(slog.LevelError, format, v...)
 	os.Exit(1)
 }
+
+// logf formats the message only when the level is enabled
+func (l *Logger) logf(level slog.Level, format string, v ...interface{}) {
+	ctx := context.Background()
+	if !l.slog.Enabled(ctx, level) {
+		return
+	}
+	l.slog.Log(ctx, level, fmt.Sprintf(format, v...))
+}
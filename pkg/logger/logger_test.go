@@ -0,0 +1,154 @@
+package logger
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"wechat-service/internal/config"
+)
+
+// newFileLogger returns a logger writing to a file in a temporary
+// directory and a function reading what was written so far
+func newFileLogger(t *testing.T, format, level string) (*Logger, func() string) {
+	t.Helper()
+	cfg := &config.Config{}
+	cfg.Monitoring.LogLevel = level
+	cfg.Logging.Format = format
+	cfg.Logging.Output = "file"
+	cfg.Logging.Dir = t.TempDir()
+	cfg.Logging.Redaction.Disabled = true
+
+	l := New(cfg)
+	t.Cleanup(func() { l.Close() })
+	return l, func() string { return readLog(t, cfg.Logging.Dir) }
+}
+
+// readLog returns the contents of the log file in dir
+func readLog(t *testing.T, dir string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, "wechat-service.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		level string
+		want  slog.Level
+	}{
+		{level: "debug", want: slog.LevelDebug},
+		{level: "INFO", want: slog.LevelInfo},
+		{level: "warn", want: slog.LevelWarn},
+		{level: "warning", want: slog.LevelWarn},
+		{level: "error", want: slog.LevelError},
+		{level: "", want: slog.LevelInfo},
+		{level: "verbose", want: slog.LevelInfo},
+	}
+
+	for _, tt := range tests {
+		if got := ParseLevel(tt.level); got != tt.want {
+			t.Errorf("ParseLevel(%q) = %v, want %v", tt.level, got, tt.want)
+		}
+	}
+}
+
+func TestLoggerLevels(t *testing.T) {
+	tests := []struct {
+		name  string
+		level string
+		want  []string
+		skip  []string
+	}{
+		{name: "debug", level: "debug", want: []string{"debug-msg", "info-msg", "warn-msg", "error-msg"}},
+		{name: "info", level: "info", want: []string{"info-msg", "warn-msg", "error-msg"}, skip: []string{"debug-msg"}},
+		{name: "error", level: "error", want: []string{"error-msg"}, skip: []string{"debug-msg", "info-msg", "warn-msg"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, read := newFileLogger(t, "text", tt.level)
+			l.Debug("debug-msg")
+			l.Info("info-msg")
+			l.Warnf("%s-msg", "warn")
+			l.Error("error-msg")
+
+			out := read()
+			for _, msg := range tt.want {
+				if !strings.Contains(out, msg) {
+					t.Errorf("%s missing from:\n%s", msg, out)
+				}
+			}
+			for _, msg := range tt.skip {
+				if strings.Contains(out, msg) {
+					t.Errorf("%s logged at level %s:\n%s", msg, tt.level, out)
+				}
+			}
+		})
+	}
+}
+
+func TestLoggerSetLevel(t *testing.T) {
+	l, read := newFileLogger(t, "text", "error")
+	l.Info("before")
+	l.SetLevel("debug")
+	l.Debug("after")
+
+	out := read()
+	if strings.Contains(out, "before") || !strings.Contains(out, "after") {
+		t.Errorf("level change not applied:\n%s", out)
+	}
+}
+
+func TestLoggerFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		check  func(t *testing.T, out string)
+	}{
+		{
+			name:   "json",
+			format: "json",
+			check: func(t *testing.T, out string) {
+				var rec map[string]interface{}
+				if err := json.Unmarshal([]byte(out), &rec); err != nil {
+					t.Fatalf("not one JSON record: %v\n%s", err, out)
+				}
+				want := map[string]interface{}{
+					"level": "ERROR", "msg": "Server error", "error": "boom",
+					"app_id": "wx1", "attempt": float64(2),
+				}
+				for k, v := range want {
+					if rec[k] != v {
+						t.Errorf("%s = %v, want %v", k, rec[k], v)
+					}
+				}
+			},
+		},
+		{
+			name:   "text",
+			format: "text",
+			check: func(t *testing.T, out string) {
+				for _, want := range []string{`level=ERROR`, `msg="Server error"`, `error=boom`, `app_id=wx1`, `attempt=2`} {
+					if !strings.Contains(out, want) {
+						t.Errorf("%s missing from:\n%s", want, out)
+					}
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, read := newFileLogger(t, tt.format, "info")
+			l.With("app_id", "wx1").Error("Server error", "error", errors.New("boom"), "attempt", 2)
+			tt.check(t, strings.TrimSpace(read()))
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package logger
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// Redaction modes
+const (
+	RedactFull    = "full"    // replace the whole value
+	RedactPartial = "partial" // keep a short prefix and suffix
+	RedactText    = "text"    // mask sensitive patterns inside free text
+	RedactNone    = "none"    // log as is
+)
+
+const redactedValue = "***"
+
+// DefaultRedactFields maps log keys to redaction modes. Keys are matched
+// case-insensitively; keys not listed here use RedactText.
+var DefaultRedactFields = map[string]string{
+	"access_token":     RedactFull,
+	"token":            RedactFull,
+	"app_secret":       RedactFull,
+	"appsecret":        RedactFull,
+	"secret":           RedactFull,
+	"encoding_aes_key": RedactFull,
+	"aes_key":          RedactFull,
+	"password":         RedactFull,
+	"admin_token":      RedactFull,
+	"authorization":    RedactFull,
+	"openid":           RedactPartial,
+	"unionid":          RedactPartial,
+	"from_user":        RedactPartial,
+	"to_user":          RedactPartial,
+	"msg_signature":    RedactPartial,
+}
+
+var (
+	// accessTokenPattern matches access_token query parameters and
+	// key/value pairs in URLs and payloads
+	accessTokenPattern = regexp.MustCompile(`(?i)(access_token["']?\s*[=:]\s*["']?)[^&\s"',}]+`)
+	// openIDPattern matches official account openids
+	openIDPattern = regexp.MustCompile(`\bo[A-Za-z0-9_-]{27}\b`)
+	// idNumberPattern matches 18-digit PRC resident ID numbers
+	idNumberPattern = regexp.MustCompile(`\b\d{17}[\dXx]\b`)
+	// digitsPattern matches runs of digits, of which phonePattern picks
+	// mainland mobile numbers. Matching whole runs keeps the neighbours of
+	// a number out of the match, so adjacent numbers are all found.
+	digitsPattern = regexp.MustCompile(`\d+`)
+	phonePattern  = regexp.MustCompile(`^1[3-9]\d{9}$`)
+)
+
+// Redactor masks sensitive values in log records. Its field modes can be
+// swapped at runtime.
+type Redactor struct {
+	fields atomic.Pointer[map[string]string]
+}
+
+// NewRedactor creates a redactor using DefaultRedactFields overlaid with
+// overrides
+func NewRedactor(overrides map[string]string) *Redactor {
+	r := &Redactor{}
+	r.SetFields(overrides)
+	return r
+}
+
+// SetFields replaces the per-field overrides applied on top of
+// DefaultRedactFields
+func (r *Redactor) SetFields(overrides map[string]string) {
+	fields := make(map[string]string, len(DefaultRedactFields)+len(overrides))
+	for k, v := range DefaultRedactFields {
+		fields[k] = v
+	}
+	for k, v := range overrides {
+		fields[strings.ToLower(k)] = strings.ToLower(v)
+	}
+	r.fields.Store(&fields)
+}
+
+// mode returns the redaction mode for key
+func (r *Redactor) mode(key string) string {
+	if mode, ok := (*r.fields.Load())[strings.ToLower(key)]; ok {
+		return mode
+	}
+	return RedactText
+}
+
+// ReplaceAttr is a slog.HandlerOptions.ReplaceAttr function
+func (r *Redactor) ReplaceAttr(_ []string, a slog.Attr) slog.Attr {
+	if a.Value.Kind() == slog.KindGroup {
+		return a
+	}
+	a.Value = r.redactValue(a.Key, a.Value)
+	return a
+}
+
+// redactValue masks v according to the mode for key
+func (r *Redactor) redactValue(key string, v slog.Value) slog.Value {
+	switch r.mode(key) {
+	case RedactNone:
+		return v
+	case RedactFull:
+		return slog.StringValue(redactedValue)
+	case RedactPartial:
+		return slog.StringValue(MaskPartial(valueString(v)))
+	}
+
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.StringValue(MaskText(v.String()))
+	case slog.KindAny:
+		switch val := v.Any().(type) {
+		case map[string]interface{}:
+			return slog.AnyValue(r.redactMap(val))
+		case map[string]string:
+			out := make(map[string]interface{}, len(val))
+			for k, s := range val {
+				out[k] = s
+			}
+			return slog.AnyValue(r.redactMap(out))
+		case error:
+			return slog.StringValue(MaskText(val.Error()))
+		case fmt.Stringer:
+			return slog.StringValue(MaskText(val.String()))
+		}
+	}
+	return v
+}
+
+// redactMap returns a copy of m with its values redacted by key
+func (r *Redactor) redactMap(m map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(m))
+	for k, val := range m {
+		out[k] = r.redactValue(k, slog.AnyValue(val)).Any()
+	}
+	return out
+}
+
+// valueString renders v as a string
+func valueString(v slog.Value) string {
+	if v.Kind() == slog.KindString {
+		return v.String()
+	}
+	return fmt.Sprint(v.Any())
+}
+
+// MaskPartial keeps the first and last four characters of s, or masks it
+// entirely when it is too short for that to hide anything
+func MaskPartial(s string) string {
+	if len(s) <= 12 {
+		return redactedValue
+	}
+	return s[:4] + redactedValue + s[len(s)-4:]
+}
+
+// MaskText masks access tokens, openids, ID numbers and mobile numbers
+// found in free text
+func MaskText(s string) string {
+	if s == "" {
+		return s
+	}
+	s = accessTokenPattern.ReplaceAllString(s, "${1}"+redactedValue)
+	s = openIDPattern.ReplaceAllStringFunc(s, MaskPartial)
+	s = idNumberPattern.ReplaceAllStringFunc(s, func(id string) string {
+		return id[:6] + "********" + id[14:]
+	})
+	s = digitsPattern.ReplaceAllStringFunc(s, func(digits string) string {
+		if !phonePattern.MatchString(digits) {
+			return digits
+		}
+		return digits[:3] + "****" + digits[7:]
+	})
+	return s
+}
@@ -0,0 +1,148 @@
+package logger
+
+import (
+	"errors"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+
+	"wechat-service/internal/config"
+)
+
+func TestMaskText(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "empty", in: "", want: ""},
+		{name: "plain", in: "menu published", want: "menu published"},
+		{
+			name: "access token in url",
+			in:   "GET /cgi-bin/menu/get?access_token=ACCESS_TOKEN_123&lang=zh",
+			want: "GET /cgi-bin/menu/get?access_token=***&lang=zh",
+		},
+		{name: "access token in json", in: `{"access_token":"abc.def","expires_in":7200}`, want: `{"access_token":"***","expires_in":7200}`},
+		{name: "openid", in: "user oABCDEFGHIJKLMNOPQRSTUVWXYZa subscribed", want: "user oABC***XYZa subscribed"},
+		{name: "id number", in: "id 11010519491231002X given", want: "id 110105********002X given"},
+		{name: "mobile number", in: "call 13812345678 now", want: "call 138****5678 now"},
+		{name: "mobile number alone", in: "13812345678", want: "138****5678"},
+		{name: "longer digit run kept", in: "order 123812345678901", want: "order 123812345678901"},
+		{name: "adjacent mobile numbers", in: "13812345678,13987654321", want: "138****5678,139****4321"},
+		{name: "mobile numbers one character apart", in: "13812345678 13987654321 15012345678", want: "138****5678 139****4321 150****5678"},
+		{name: "mobile number after letters", in: "tel:13812345678", want: "tel:138****5678"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MaskText(tt.in); got != tt.want {
+				t.Errorf("MaskText(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaskPartial(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "", want: "***"},
+		{in: "short", want: "***"},
+		{in: "exactly12chr", want: "***"},
+		{in: "oABCDEFGHIJKLMNOPQRSTUVWXYZa", want: "oABC***XYZa"},
+	}
+
+	for _, tt := range tests {
+		if got := MaskPartial(tt.in); got != tt.want {
+			t.Errorf("MaskPartial(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRedactorReplaceAttr(t *testing.T) {
+	const openID = "oABCDEFGHIJKLMNOPQRSTUVWXYZa"
+
+	tests := []struct {
+		name      string
+		overrides map[string]string
+		attr      slog.Attr
+		want      interface{}
+	}{
+		{name: "token", attr: slog.String("access_token", "secret-token"), want: "***"},
+		{name: "key case ignored", attr: slog.String("AppSecret", "s3cret"), want: "***"},
+		{name: "openid partial", attr: slog.String("openid", openID), want: "oABC***XYZa"},
+		{name: "free text", attr: slog.String("content", "my phone is 13812345678"), want: "my phone is 138****5678"},
+		{name: "error text", attr: slog.Any("error", errors.New("bad access_token=abc")), want: "bad access_token=***"},
+		{name: "numbers untouched", attr: slog.Int("count", 13812345678), want: int64(13812345678)},
+		{
+			name: "map values by key",
+			attr: slog.Any("example", map[string]interface{}{"openid": openID, "token": "t", "note": "ok"}),
+			want: map[string]interface{}{"openid": "oABC***XYZa", "token": "***", "note": "ok"},
+		},
+		{name: "override to none", overrides: map[string]string{"openid": "none"}, attr: slog.String("openid", openID), want: openID},
+		{name: "override to full", overrides: map[string]string{"Nickname": "FULL"}, attr: slog.String("nickname", "Li Lei"), want: "***"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := NewRedactor(tt.overrides).ReplaceAttr(nil, tt.attr)
+			if v := got.Value.Any(); !reflect.DeepEqual(v, tt.want) {
+				t.Errorf("%s = %#v, want %#v", tt.attr.Key, v, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoggerRedaction(t *testing.T) {
+	tests := []struct {
+		name     string
+		disabled bool
+		fields   map[string]string
+		want     []string
+		wantNot  []string
+	}{
+		{
+			name:    "enabled",
+			want:    []string{"access_token=***", "openid=oABC***XYZa"},
+			wantNot: []string{"tok-123", "oABCDEFGHIJKLMNOPQRSTUVWXYZa"},
+		},
+		{
+			name:     "disabled",
+			disabled: true,
+			want:     []string{"access_token=tok-123", "openid=oABCDEFGHIJKLMNOPQRSTUVWXYZa"},
+		},
+		{
+			name:    "field override",
+			fields:  map[string]string{"openid": "full"},
+			want:    []string{"access_token=***", "openid=***"},
+			wantNot: []string{"oABC"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{}
+			cfg.Logging.Output = "file"
+			cfg.Logging.Dir = t.TempDir()
+			cfg.Logging.Redaction.Disabled = tt.disabled
+			cfg.Logging.Redaction.Fields = tt.fields
+			l := New(cfg)
+			defer l.Close()
+
+			l.Info("Token fetched", "access_token", "tok-123", "openid", "oABCDEFGHIJKLMNOPQRSTUVWXYZa")
+			out := readLog(t, cfg.Logging.Dir)
+			for _, want := range tt.want {
+				if !strings.Contains(out, want) {
+					t.Errorf("%s missing from:\n%s", want, out)
+				}
+			}
+			for _, s := range tt.wantNot {
+				if strings.Contains(out, s) {
+					t.Errorf("%s leaked into:\n%s", s, out)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,290 @@
+package logger
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat is the timestamp embedded in rotated file names
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// RotatingWriter writes to <dir>/<name>.log and rotates it when it exceeds
+// maxSize or the local date changes. Rotated files are renamed to
+// <name>_<timestamp>.log, optionally gzipped, and pruned by age and count.
+// An existing backup is never overwritten.
+type RotatingWriter struct {
+	dir        string
+	name       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	compress   bool
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	openDate string
+	cleanWg  sync.WaitGroup
+	cleanMu  sync.Mutex // serializes compression and pruning
+}
+
+// RotateOptions configures a RotatingWriter. Zero or negative values
+// disable the corresponding limit.
+type RotateOptions struct {
+	MaxSizeMB  int
+	MaxAgeDays int
+	MaxBackups int
+	Compress   bool
+}
+
+// NewRotatingWriter opens the active log file in dir
+func NewRotatingWriter(dir, name string, opts RotateOptions) (*RotatingWriter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %w", err)
+	}
+
+	w := &RotatingWriter{
+		dir:        dir,
+		name:       name,
+		maxSize:    int64(opts.MaxSizeMB) << 20,
+		maxAge:     time.Duration(opts.MaxAgeDays) * 24 * time.Hour,
+		maxBackups: opts.MaxBackups,
+		compress:   opts.Compress,
+	}
+
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// path returns the active log file path
+func (w *RotatingWriter) path() string {
+	return filepath.Join(w.dir, w.name+".log")
+}
+
+// open opens the active file for appending. A file left over from a
+// previous day is rotated first.
+func (w *RotatingWriter) open() error {
+	info, err := os.Stat(w.path())
+	if err == nil && info.ModTime().Format("2006-01-02") != time.Now().Format("2006-01-02") && info.Size() > 0 {
+		if err := w.archive(info.ModTime()); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(w.path(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+
+	info, err = file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat log file: %w", err)
+	}
+
+	w.file = file
+	w.size = info.Size()
+	w.openDate = time.Now().Format("2006-01-02")
+	return nil
+}
+
+// Write writes p, rotating first when the size limit or date requires it
+func (w *RotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	dateChanged := time.Now().Format("2006-01-02") != w.openDate
+	tooBig := w.maxSize > 0 && w.size+int64(len(p)) > w.maxSize && w.size > 0
+	if dateChanged || tooBig {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Rotate forces a rotation
+func (w *RotatingWriter) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.rotate()
+}
+
+// Reopen closes and reopens the active file without rotating, for use
+// after an external tool such as logrotate moved it
+func (w *RotatingWriter) Reopen() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+	return w.open()
+}
+
+// Close closes the active file and waits for pending compression
+func (w *RotatingWriter) Close() error {
+	w.mu.Lock()
+	var err error
+	if w.file != nil {
+		err = w.file.Close()
+		w.file = nil
+	}
+	w.mu.Unlock()
+
+	w.cleanWg.Wait()
+	return err
+}
+
+// rotate archives the active file and opens a new one. w.mu must be held.
+func (w *RotatingWriter) rotate() error {
+	if w.file != nil {
+		if err := w.file.Close(); err != nil {
+			return fmt.Errorf("failed to close log file: %w", err)
+		}
+		w.file = nil
+	}
+
+	if err := w.archive(time.Now()); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+// archive renames the active file to a timestamped backup and starts
+// compression and pruning in the background. Cleanups run one at a time,
+// so pruning never removes a file while it is being compressed.
+func (w *RotatingWriter) archive(at time.Time) error {
+	backup := w.backupPath(at)
+	if err := os.Rename(w.path(), backup); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to rotate log file: %w", err)
+	}
+
+	w.cleanWg.Add(1)
+	go func() {
+		defer w.cleanWg.Done()
+		w.cleanMu.Lock()
+		defer w.cleanMu.Unlock()
+
+		if w.compress {
+			// A backup pruned by an earlier cleanup is gone already
+			if err := compressFile(backup); err != nil && !os.IsNotExist(err) {
+				fmt.Fprintf(os.Stderr, "logger: failed to compress %s: %v\n", backup, err)
+			}
+		}
+		w.prune()
+	}()
+	return nil
+}
+
+// backupPath returns a backup name for a file rotated at at, adding a
+// counter when a backup, compressed or not, already has the name
+func (w *RotatingWriter) backupPath(at time.Time) string {
+	base := filepath.Join(w.dir, fmt.Sprintf("%s_%s", w.name, at.Format(backupTimeFormat)))
+	path := base + ".log"
+	for i := 1; exists(path) || exists(path+".gz"); i++ {
+		path = fmt.Sprintf("%s-%d.log", base, i)
+	}
+	return path
+}
+
+// exists reports whether path exists
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// prune removes backups beyond maxBackups or older than maxAge
+func (w *RotatingWriter) prune() {
+	if w.maxBackups <= 0 && w.maxAge <= 0 {
+		return
+	}
+
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return
+	}
+
+	type backup struct {
+		path    string
+		modTime time.Time
+	}
+	var backups []backup
+	prefix := w.name + "_"
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if !strings.HasSuffix(name, ".log") && !strings.HasSuffix(name, ".log.gz") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backup{filepath.Join(w.dir, name), info.ModTime()})
+	}
+
+	sort.Slice(backups, func(i, j int) bool { return backups[i].modTime.After(backups[j].modTime) })
+
+	cutoff := time.Now().Add(-w.maxAge)
+	for i, b := range backups {
+		expired := w.maxAge > 0 && b.modTime.Before(cutoff)
+		excess := w.maxBackups > 0 && i >= w.maxBackups
+		if expired || excess {
+			os.Remove(b.path)
+		}
+	}
+}
+
+// compressFile gzips path to path.gz and removes the original
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(dst)
+	if _, err := io.Copy(gz, src); err != nil {
+		gz.Close()
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	src.Close()
+	return os.Remove(path)
+}
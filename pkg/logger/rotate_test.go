@@ -0,0 +1,151 @@
+package logger
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listBackups returns the names of the rotated files in dir
+func listBackups(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "app_") {
+			names = append(names, e.Name())
+		}
+	}
+	return names
+}
+
+func TestRotatingWriter(t *testing.T) {
+	tests := []struct {
+		name        string
+		opts        RotateOptions
+		writes      int // writes of a 600 KB line
+		rotations   int // forced rotations after the writes
+		wantBackups int
+		wantGzip    bool
+	}{
+		{name: "under the size limit", opts: RotateOptions{MaxSizeMB: 1}, writes: 1},
+		{name: "size limit", opts: RotateOptions{MaxSizeMB: 1}, writes: 3, wantBackups: 2},
+		{name: "no size limit", opts: RotateOptions{MaxSizeMB: -1}, writes: 3},
+		{name: "rapid rotations keep every backup", writes: 1, rotations: 5, wantBackups: 5},
+		{name: "max backups", opts: RotateOptions{MaxBackups: 2}, writes: 1, rotations: 5, wantBackups: 2},
+		{name: "compressed", opts: RotateOptions{Compress: true}, writes: 1, rotations: 3, wantBackups: 3, wantGzip: true},
+		{
+			name:   "compressed and pruned",
+			opts:   RotateOptions{Compress: true, MaxBackups: 2},
+			writes: 1, rotations: 5, wantBackups: 2, wantGzip: true,
+		},
+	}
+
+	line := []byte(strings.Repeat("x", 600<<10) + "\n")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			w, err := NewRotatingWriter(dir, "app", tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < tt.writes; i++ {
+				if _, err := w.Write(line); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < tt.rotations; i++ {
+				if _, err := w.Write([]byte("line\n")); err != nil {
+					t.Fatal(err)
+				}
+				if err := w.Rotate(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			backups := listBackups(t, dir)
+			if len(backups) != tt.wantBackups {
+				t.Errorf("backups = %v, want %d", backups, tt.wantBackups)
+			}
+			for _, b := range backups {
+				if gz := strings.HasSuffix(b, ".log.gz"); gz != tt.wantGzip {
+					t.Errorf("backup %s compressed = %v, want %v", b, gz, tt.wantGzip)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(dir, "app.log")); err != nil {
+				t.Errorf("active file: %v", err)
+			}
+		})
+	}
+}
+
+func TestRotatingWriterArchivesPreviousDay(t *testing.T) {
+	tests := []struct {
+		name        string
+		age         time.Duration
+		content     string
+		wantBackups int
+	}{
+		{name: "yesterday", age: 24 * time.Hour, content: "old\n", wantBackups: 1},
+		{name: "yesterday but empty", age: 24 * time.Hour},
+		{name: "today", content: "new\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			active := filepath.Join(dir, "app.log")
+			if err := os.WriteFile(active, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			mtime := time.Now().Add(-tt.age)
+			if err := os.Chtimes(active, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+
+			w, err := NewRotatingWriter(dir, "app", RotateOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Close()
+
+			if got := listBackups(t, dir); len(got) != tt.wantBackups {
+				t.Errorf("backups = %v, want %d", got, tt.wantBackups)
+			}
+		})
+	}
+}
+
+func TestBackupPathNeverReusesAName(t *testing.T) {
+	dir := t.TempDir()
+	w := &RotatingWriter{dir: dir, name: "app"}
+	at := time.Date(2026, 1, 2, 3, 4, 5, 6e6, time.Local)
+
+	tests := []struct {
+		existing string // file created before the call
+		want     string
+	}{
+		{want: "app_2026-01-02T03-04-05.006.log"},
+		{existing: "app_2026-01-02T03-04-05.006.log", want: "app_2026-01-02T03-04-05.006-1.log"},
+		{existing: "app_2026-01-02T03-04-05.006-1.log.gz", want: "app_2026-01-02T03-04-05.006-2.log"},
+	}
+
+	for _, tt := range tests {
+		if tt.existing != "" {
+			if err := os.WriteFile(filepath.Join(dir, tt.existing), nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := filepath.Base(w.backupPath(at)); got != tt.want {
+			t.Errorf("with %q present: backupPath = %q, want %q", tt.existing, got, tt.want)
+		}
+	}
+}
@@ -1,18 +1,24 @@
 package metrics
 
 import (
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+// unmatchedEndpoint is the endpoint label of requests matching no route
+const unmatchedEndpoint = "unmatched"
+
 // GinMiddleware returns Gin middleware for metrics
 func GinMiddleware(m *Metrics) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		start := time.Now()
+		// Unmatched paths share one label, so probes of arbitrary URLs
+		// cannot grow the series without bound
 		path := c.FullPath()
 		if path == "" {
-			path = c.Request.URL.Path
+			path = unmatchedEndpoint
 		}
 		method := c.Request.Method
 
@@ -21,7 +27,12 @@ func GinMiddleware(m *Metrics) gin.HandlerFunc {
 		duration := time.Since(start).Seconds()
 		status := c.Writer.Status()
 
-		m.IncHTTPRequest(path, method, string(rune(status)))
+		m.IncHTTPRequest(path, method, strconv.Itoa(status))
 		m.ObserveLatency(path, method, duration)
 	}
 }
+
+// GinHandler returns a Gin handler exposing the metrics registry
+func GinHandler(m *Metrics) gin.HandlerFunc {
+	return gin.WrapH(m.Handler())
+}
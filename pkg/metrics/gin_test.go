@@ -0,0 +1,129 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// counterValue returns the value of the counter name with labels, or 0
+func counterValue(t *testing.T, m *Metrics, name string, labels map[string]string) float64 {
+	t.Helper()
+	families, err := m.Gatherer().Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+	next:
+		for _, metric := range f.GetMetric() {
+			got := make(map[string]string)
+			for _, lp := range metric.GetLabel() {
+				got[lp.GetName()] = lp.GetValue()
+			}
+			for k, v := range labels {
+				if got[k] != v {
+					continue next
+				}
+			}
+			return metric.GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+func TestGinMiddlewareStatusLabel(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name   string
+		status int
+		want   string
+	}{
+		{name: "ok", status: http.StatusOK, want: "200"},
+		{name: "not found", status: http.StatusNotFound, want: "404"},
+		{name: "rate limited", status: http.StatusTooManyRequests, want: "429"},
+		{name: "server error", status: http.StatusInternalServerError, want: "500"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMetrics(nil, "wx1")
+			r := gin.New()
+			r.Use(GinMiddleware(m))
+			r.GET("/items/:id", func(c *gin.Context) { c.Status(tt.status) })
+
+			r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/items/7", nil))
+
+			labels := map[string]string{"endpoint": "/items/:id", "method": "GET", "status": tt.want, "app_id": "wx1"}
+			if got := counterValue(t, m, "wechat_http_requests_total", labels); got != 1 {
+				t.Errorf("requests with status %q = %v, want 1", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestIncHTTPErrorStatusLabel(t *testing.T) {
+	tests := []struct {
+		status int
+		want   string
+	}{
+		{status: 500, want: "500"},
+		{status: 503, want: "503"},
+	}
+
+	for _, tt := range tests {
+		m := NewMetrics(nil, "")
+		m.IncHTTPError("/wechat", "POST", tt.status)
+
+		labels := map[string]string{"endpoint": "/wechat", "method": "POST", "status": tt.want}
+		if got := counterValue(t, m, "wechat_http_requests_total", labels); got != 1 {
+			t.Errorf("IncHTTPError(%d): requests with status %q = %v, want 1", tt.status, tt.want, got)
+		}
+	}
+}
+
+func TestGinMiddlewareEndpointLabel(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name  string
+		paths []string
+		want  map[string]float64 // requests by endpoint label
+	}{
+		{name: "route pattern", paths: []string{"/items/7", "/items/8"}, want: map[string]float64{"/items/:id": 2}},
+		{
+			name:  "unmatched paths share a label",
+			paths: []string{"/wp-login.php", "/.env", "/items/7/extra"},
+			want:  map[string]float64{"unmatched": 3, "/wp-login.php": 0, "/.env": 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMetrics(nil, "wx1")
+			r := gin.New()
+			r.Use(GinMiddleware(m))
+			r.GET("/items/:id", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+			for _, path := range tt.paths {
+				r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+			}
+
+			for endpoint, want := range tt.want {
+				var got float64
+				for _, status := range []string{"200", "404"} {
+					labels := map[string]string{"endpoint": endpoint, "method": "GET", "status": status}
+					got += counterValue(t, m, "wechat_http_requests_total", labels)
+				}
+				if got != want {
+					t.Errorf("requests to %q = %v, want %v", endpoint, got, want)
+				}
+			}
+		})
+	}
+}
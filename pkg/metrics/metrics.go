@@ -1,12 +1,21 @@
 package metrics
 
 import (
+	"net/http"
+	"strconv"
+	"sync"
+
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-// Metrics holds all Prometheus metrics
+// Metrics holds all Prometheus metrics. The recording methods are safe to
+// call on a nil *Metrics, which records nothing.
 type Metrics struct {
+	registerer prometheus.Registerer
+	gatherer   prometheus.Gatherer
 	httpRequests    *prometheus.CounterVec
 	httpLatency     *prometheus.HistogramVec
 	messagesReceived *prometheus.CounterVec
@@ -15,19 +24,55 @@ type Metrics struct {
 	errors          *prometheus.CounterVec
 	panics          prometheus.Counter
 	tokenRefreshes  prometheus.Counter
+	alertsReceived  *prometheus.CounterVec
+	callbackLatency *prometheus.HistogramVec
+	dedupHits       prometheus.Counter
+	dependencyLatency *prometheus.HistogramVec
+	asyncQueueSize  prometheus.Gauge
+	asyncInFlight   prometheus.Gauge
+	cacheLookups    *prometheus.CounterVec
+	tokenAgeOnce    sync.Once
 }
 
-// NewMetrics creates new metrics instance
-func NewMetrics() *Metrics {
+// callbackBuckets cover the 5 second window WeChat waits for a reply
+var callbackBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2, 3, 4, 5}
+
+// NewMetrics creates new metrics instance registered with reg. A nil reg
+// creates a dedicated registry with Go runtime and process collectors, so
+// several instances (tests, accounts) can coexist. A non-empty appID is
+// attached to every metric as the const label app_id. When reg is not also
+// a Gatherer, Handler falls back to the default gatherer.
+func NewMetrics(reg prometheus.Registerer, appID string) *Metrics {
+	if reg == nil {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(
+			collectors.NewGoCollector(),
+			collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		)
+		reg = registry
+	}
+
+	gatherer, ok := reg.(prometheus.Gatherer)
+	if !ok {
+		gatherer = prometheus.DefaultGatherer
+	}
+
+	if appID != "" {
+		reg = prometheus.WrapRegistererWith(prometheus.Labels{"app_id": appID}, reg)
+	}
+	factory := promauto.With(reg)
+
 	return &Metrics{
-		httpRequests: promauto.NewCounterVec(
+		registerer: reg,
+		gatherer:   gatherer,
+		httpRequests: factory.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: "wechat_http_requests_total",
 				Help: "Total HTTP requests",
 			},
 			[]string{"endpoint", "method", "status"},
 		),
-		httpLatency: promauto.NewHistogramVec(
+		httpLatency: factory.NewHistogramVec(
 			prometheus.HistogramOpts{
 				Name:    "wechat_http_latency_seconds",
 				Help:    "HTTP request latency",
@@ -35,86 +80,248 @@ func NewMetrics() *Metrics {
 			},
 			[]string{"endpoint", "method"},
 		),
-		messagesReceived: promauto.NewCounterVec(
+		messagesReceived: factory.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: "wechat_messages_received_total",
 				Help: "Total messages received by type",
 			},
 			[]string{"type"},
 		),
-		messagesSent: promauto.NewCounterVec(
+		messagesSent: factory.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: "wechat_messages_sent_total",
 				Help: "Total messages sent by type",
 			},
 			[]string{"type"},
 		),
-		eventsReceived: promauto.NewCounterVec(
+		eventsReceived: factory.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: "wechat_events_received_total",
 				Help: "Total events received by type",
 			},
 			[]string{"type"},
 		),
-		errors: promauto.NewCounterVec(
+		errors: factory.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: "wechat_errors_total",
 				Help: "Total errors by type",
 			},
 			[]string{"type"},
 		),
-		panics: promauto.NewCounter(prometheus.CounterOpts{
+		panics: factory.NewCounter(prometheus.CounterOpts{
 			Name: "wechat_panics_total",
 			Help: "Total panics",
 		}),
-		tokenRefreshes: promauto.NewCounter(prometheus.CounterOpts{
+		tokenRefreshes: factory.NewCounter(prometheus.CounterOpts{
 			Name: "wechat_token_refreshes_total",
 			Help: "Total token refreshes",
 		}),
+		alertsReceived: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "wechat_alerts_received_total",
+				Help: "Total WeChat callback-failure alerts by type and severity",
+			},
+			[]string{"type", "severity"},
+		),
+		callbackLatency: factory.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "wechat_callback_latency_seconds",
+				Help:    "Callback processing latency by message and event type",
+				Buckets: callbackBuckets,
+			},
+			[]string{"msg_type", "event"},
+		),
+		dedupHits: factory.NewCounter(prometheus.CounterOpts{
+			Name: "wechat_dedup_hits_total",
+			Help: "Total duplicate callbacks skipped (WeChat retries)",
+		}),
+		dependencyLatency: factory.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "wechat_dependency_latency_seconds",
+				Help:    "Latency of calls to Redis and the database",
+				Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+			},
+			[]string{"dependency", "operation"},
+		),
+		asyncQueueSize: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "wechat_async_queue_size",
+			Help: "Tasks waiting in the async queue",
+		}),
+		asyncInFlight: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "wechat_async_in_flight",
+			Help: "Async tasks currently executing",
+		}),
+		cacheLookups: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "wechat_cache_lookups_total",
+				Help: "Cache lookups by layer (local, redis) and result (hit, miss)",
+			},
+			[]string{"layer", "result"},
+		),
 	}
 }
 
 // IncHTTPRequest increments HTTP request counter
 func (m *Metrics) IncHTTPRequest(endpoint, method, status string) {
+	if m == nil {
+		return
+	}
 	m.httpRequests.WithLabelValues(endpoint, method, status).Inc()
 }
 
 // IncHTTPError increments HTTP error counter
 func (m *Metrics) IncHTTPError(endpoint, method string, status int) {
-	m.httpRequests.WithLabelValues(endpoint, method, string(rune(status))).Inc()
+	if m == nil {
+		return
+	}
+	m.httpRequests.WithLabelValues(endpoint, method, strconv.Itoa(status)).Inc()
 }
 
 // ObserveLatency records request latency
 func (m *Metrics) ObserveLatency(endpoint, method string, duration float64) {
+	if m == nil {
+		return
+	}
 	m.httpLatency.WithLabelValues(endpoint, method).Observe(duration)
 }
 
 // IncMessageReceived increments message received counter
 func (m *Metrics) IncMessageReceived(msgType string) {
+	if m == nil {
+		return
+	}
 	m.messagesReceived.WithLabelValues(msgType).Inc()
 }
 
 // IncMessageSent increments message sent counter
 func (m *Metrics) IncMessageSent(msgType string) {
+	if m == nil {
+		return
+	}
 	m.messagesSent.WithLabelValues(msgType).Inc()
 }
 
 // IncEventReceived increments event received counter
 func (m *Metrics) IncEventReceived(eventType string) {
+	if m == nil {
+		return
+	}
 	m.eventsReceived.WithLabelValues(eventType).Inc()
 }
 
 // IncMessageError increments message error counter
 func (m *Metrics) IncMessageError(errType string) {
+	if m == nil {
+		return
+	}
 	m.errors.WithLabelValues(errType).Inc()
 }
 
 // IncMessagePanic increments panic counter
 func (m *Metrics) IncMessagePanic() {
+	if m == nil {
+		return
+	}
 	m.panics.Inc()
 }
 
 // IncTokenRefresh increments token refresh counter
 func (m *Metrics) IncTokenRefresh() {
+	if m == nil {
+		return
+	}
 	m.tokenRefreshes.Inc()
 }
+
+// IncAlertReceived increments alert counter
+func (m *Metrics) IncAlertReceived(alertType, severity string) {
+	if m == nil {
+		return
+	}
+	m.alertsReceived.WithLabelValues(alertType, severity).Inc()
+}
+
+// ObserveCallbackLatency records callback processing latency
+func (m *Metrics) ObserveCallbackLatency(msgType, event string, duration float64) {
+	if m == nil {
+		return
+	}
+	m.callbackLatency.WithLabelValues(msgType, event).Observe(duration)
+}
+
+// IncDedupHit increments duplicate callback counter
+func (m *Metrics) IncDedupHit() {
+	if m == nil {
+		return
+	}
+	m.dedupHits.Inc()
+}
+
+// ObserveDependencyLatency records latency of a Redis or database call
+func (m *Metrics) ObserveDependencyLatency(dependency, operation string, duration float64) {
+	if m == nil {
+		return
+	}
+	m.dependencyLatency.WithLabelValues(dependency, operation).Observe(duration)
+}
+
+// SetAsyncQueueSize sets the async queue depth gauge
+func (m *Metrics) SetAsyncQueueSize(size int) {
+	if m == nil {
+		return
+	}
+	m.asyncQueueSize.Set(float64(size))
+}
+
+// IncAsyncInFlight increments the executing async task gauge
+func (m *Metrics) IncAsyncInFlight() {
+	if m == nil {
+		return
+	}
+	m.asyncInFlight.Inc()
+}
+
+// DecAsyncInFlight decrements the executing async task gauge
+func (m *Metrics) DecAsyncInFlight() {
+	if m == nil {
+		return
+	}
+	m.asyncInFlight.Dec()
+}
+
+// ObserveCacheLookup records a cache lookup in layer
+func (m *Metrics) ObserveCacheLookup(layer string, hit bool) {
+	if m == nil {
+		return
+	}
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.cacheLookups.WithLabelValues(layer, result).Inc()
+}
+
+// RegisterTokenAge exposes the access token age in seconds, computed by ageFn
+// at scrape time. Only the first registration takes effect.
+func (m *Metrics) RegisterTokenAge(ageFn func() float64) {
+	if m == nil {
+		return
+	}
+	m.tokenAgeOnce.Do(func() {
+		promauto.With(m.registerer).NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "wechat_access_token_age_seconds",
+			Help: "Seconds since the access token was last refreshed",
+		}, ageFn)
+	})
+}
+
+// Handler returns an HTTP handler exposing the metrics of this instance's
+// registry
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.gatherer, promhttp.HandlerOpts{})
+}
+
+// Gatherer returns the registry metrics are gathered from
+func (m *Metrics) Gatherer() prometheus.Gatherer {
+	return m.gatherer
+}
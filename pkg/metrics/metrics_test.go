@@ -0,0 +1,109 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestNewMetricsRegistry(t *testing.T) {
+	tests := []struct {
+		name    string
+		appIDs  []string // one Metrics per app ID on the same registry
+		shared  bool     // pass a registry instead of nil
+		wantApp []string // app_id labels expected on the shared counter
+	}{
+		{name: "own registry", appIDs: []string{""}},
+		{name: "own registry twice", appIDs: []string{"", ""}},
+		{name: "one account", appIDs: []string{"wx1"}, shared: true, wantApp: []string{"wx1"}},
+		{name: "accounts share a registry", appIDs: []string{"wx1", "wx2"}, shared: true, wantApp: []string{"wx1", "wx2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reg *prometheus.Registry
+			if tt.shared {
+				reg = prometheus.NewRegistry()
+			}
+
+			var all []*Metrics
+			for _, id := range tt.appIDs {
+				var m *Metrics
+				if reg != nil {
+					m = NewMetrics(reg, id)
+				} else {
+					m = NewMetrics(nil, id)
+				}
+				m.IncMessageReceived("text")
+				all = append(all, m)
+			}
+
+			for _, m := range all {
+				if got := counterValue(t, m, "wechat_messages_received_total", map[string]string{"type": "text"}); got != 1 {
+					t.Errorf("messages received = %v, want 1", got)
+				}
+			}
+			if reg == nil {
+				return
+			}
+			for _, id := range tt.wantApp {
+				labels := map[string]string{"type": "text", "app_id": id}
+				if got := counterValue(t, all[0], "wechat_messages_received_total", labels); got != 1 {
+					t.Errorf("messages received for %s = %v, want 1", id, got)
+				}
+			}
+		})
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	tests := []struct {
+		name  string
+		appID string
+		want  string
+	}{
+		{name: "unlabelled", want: `wechat_token_refreshes_total 1`},
+		{name: "app id label", appID: "wx1", want: `wechat_token_refreshes_total{app_id="wx1"} 1`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMetrics(nil, tt.appID)
+			m.IncTokenRefresh()
+
+			w := httptest.NewRecorder()
+			m.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+			body, _ := io.ReadAll(w.Body)
+			if !strings.Contains(string(body), tt.want) {
+				t.Errorf("metrics output lacks %q:\n%s", tt.want, body)
+			}
+		})
+	}
+}
+
+func TestNilMetrics(t *testing.T) {
+	var m *Metrics
+
+	// None of these may panic
+	m.IncHTTPRequest("/wechat", "POST", "200")
+	m.IncHTTPError("/wechat", "POST", 500)
+	m.ObserveLatency("/wechat", "POST", 0.1)
+	m.IncMessageReceived("text")
+	m.IncMessageSent("text")
+	m.IncEventReceived("subscribe")
+	m.IncMessageError("alert_signature")
+	m.IncMessagePanic()
+	m.IncTokenRefresh()
+	m.IncAlertReceived("token_refresh_failure", "critical")
+	m.ObserveCallbackLatency("event", "CLICK", 0.1)
+	m.IncDedupHit()
+	m.ObserveDependencyLatency("redis", "get", 0.001)
+	m.SetAsyncQueueSize(3)
+	m.IncAsyncInFlight()
+	m.DecAsyncInFlight()
+	m.ObserveCacheLookup("local", true)
+	m.RegisterTokenAge(func() float64 { return 1 })
+}
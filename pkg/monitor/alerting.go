@@ -0,0 +1,258 @@
+package monitor
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// maxGroupSamples bounds the alerts kept as examples in a group
+const maxGroupSamples = 10
+
+// alertGroup collects alerts of the same type between notifications
+type alertGroup struct {
+	alertType    string
+	severity     string
+	samples      []Alert
+	count        int
+	pending      int
+	firstSeen    time.Time
+	lastSeen     time.Time
+	lastNotified time.Time
+	notified     bool
+}
+
+// alertDispatcher groups alerts and rate-limits notifications
+type alertDispatcher struct {
+	mu        sync.Mutex
+	groups    map[string]*alertGroup
+	notifiers []Notifier
+	sent      []time.Time // notification times within the last hour
+	sendWg    sync.WaitGroup
+}
+
+// severityRank orders severities for picking the worst in a group
+var severityRank = map[string]int{
+	SeverityLow:      1,
+	SeverityMedium:   2,
+	SeverityHigh:     3,
+	SeverityCritical: 4,
+}
+
+// initNotifiers builds notifiers from configuration
+func (m *Monitor) initNotifiers() {
+	if m.cfg.Monitoring.AlertWebhook != "" {
+		m.AddNotifier(&WebhookNotifier{url: m.cfg.Monitoring.AlertWebhook, client: m.httpClient})
+	}
+
+	for _, nc := range m.cfg.Monitoring.Notifiers {
+		n, err := NewNotifier(nc, m.httpClient)
+		if err != nil {
+			m.log.Warn("Skipping alert notifier", "type", nc.Type, "error", err)
+			continue
+		}
+		m.AddNotifier(n)
+	}
+}
+
+// AddNotifier registers an additional alert notifier
+func (m *Monitor) AddNotifier(n Notifier) {
+	m.dispatcher.mu.Lock()
+	m.dispatcher.notifiers = append(m.dispatcher.notifiers, n)
+	m.dispatcher.mu.Unlock()
+}
+
+// groupAlert adds an alert to the group of its type. The first alert of a
+// critical group is sent right away.
+func (m *Monitor) groupAlert(alert Alert) {
+	d := &m.dispatcher
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	g, ok := d.groups[alert.Type]
+	if !ok {
+		g = &alertGroup{
+			alertType: alert.Type,
+			severity:  alert.Severity,
+			firstSeen: alert.CreatedAt,
+		}
+		d.groups[alert.Type] = g
+	}
+
+	count := alert.Count
+	if count <= 0 {
+		count = 1
+	}
+	g.count += count
+	g.pending += count
+	g.lastSeen = alert.CreatedAt
+	if severityRank[alert.Severity] > severityRank[g.severity] {
+		g.severity = alert.Severity
+	}
+
+	g.samples = append(g.samples, alert)
+	if len(g.samples) > maxGroupSamples {
+		g.samples = g.samples[len(g.samples)-maxGroupSamples:]
+	}
+
+	// Critical alerts are not held for the group window
+	if g.severity == SeverityCritical && !g.notified {
+		if m.sendLocked(alert.CreatedAt, g.notification(NotificationFiring)) {
+			g.notified = true
+			g.lastNotified = alert.CreatedAt
+			g.pending = 0
+		}
+	}
+}
+
+// dispatchAlerts evaluates alert groups and sends due notifications:
+// the first one after the group window, or at once for critical groups,
+// repeats no more often than the repeat interval, and a resolution once a
+// type has been quiet for the resolve timeout
+func (m *Monitor) dispatchAlerts(now time.Time) {
+	window := time.Duration(m.cfg.Monitoring.AlertGroupWindow) * time.Second
+	repeat := time.Duration(m.cfg.Monitoring.AlertRepeatInterval) * time.Second
+	resolve := time.Duration(m.cfg.Monitoring.AlertResolveTimeout) * time.Second
+
+	d := &m.dispatcher
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for alertType, g := range d.groups {
+		switch {
+		case now.Sub(g.lastSeen) >= resolve:
+			// A group whose firing notice was held back by the rate limit
+			// is reported on resolution, so its alerts are not lost. While
+			// the limit holds, the group is kept and retried.
+			if (g.notified || g.pending > 0) && !m.sendLocked(now, g.notification(NotificationResolved)) {
+				continue
+			}
+			m.resolveType(alertType, now)
+			delete(d.groups, alertType)
+
+		case !g.notified && (g.severity == SeverityCritical || now.Sub(g.firstSeen) >= window):
+			if m.sendLocked(now, g.notification(NotificationFiring)) {
+				g.notified = true
+				g.lastNotified = now
+				g.pending = 0
+			}
+
+		case g.notified && g.pending > 0 && now.Sub(g.lastNotified) >= repeat:
+			if m.sendLocked(now, g.notification(NotificationFiring)) {
+				g.lastNotified = now
+				g.pending = 0
+			}
+		}
+	}
+}
+
+// resolveType marks stored alerts of a type as resolved once the group
+// has gone quiet
+func (m *Monitor) resolveType(alertType string, now time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := m.alertStore().ResolveByType(ctx, alertType, now); err != nil {
+		m.log.Error("Failed to resolve alerts", "type", alertType, "error", err)
+	}
+}
+
+// notification builds a notification from the group
+func (g *alertGroup) notification(kind string) Notification {
+	samples := make([]Alert, len(g.samples))
+	copy(samples, g.samples)
+
+	return Notification{
+		Kind:      kind,
+		Type:      g.alertType,
+		Severity:  g.severity,
+		Count:     g.count,
+		FirstSeen: g.firstSeen,
+		LastSeen:  g.lastSeen,
+		Alerts:    samples,
+	}
+}
+
+// sendLocked fans a notification out to all notifiers unless the hourly
+// cap is reached. The dispatcher lock must be held.
+func (m *Monitor) sendLocked(now time.Time, n Notification) bool {
+	d := &m.dispatcher
+
+	cutoff := now.Add(-time.Hour)
+	kept := d.sent[:0]
+	for _, t := range d.sent {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	d.sent = kept
+
+	if limit := m.cfg.Monitoring.AlertMaxPerHour; limit > 0 && len(d.sent) >= limit {
+		m.log.Warn("Alert notification rate limit reached, deferring",
+			"type", n.Type,
+			"kind", n.Kind,
+			"max_per_hour", limit,
+		)
+		return false
+	}
+	d.sent = append(d.sent, now)
+
+	for _, notifier := range d.notifiers {
+		d.sendWg.Add(1)
+		go func(notifier Notifier) {
+			defer d.sendWg.Done()
+			m.notifyWithRetry(notifier, n)
+		}(notifier)
+	}
+	return true
+}
+
+// notifyWithRetry delivers a notification with exponential backoff
+func (m *Monitor) notifyWithRetry(notifier Notifier, n Notification) {
+	const attempts = 3
+	backoff := time.Second
+
+	for i := 1; i <= attempts; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := notifier.Notify(ctx, n)
+		cancel()
+		if err == nil {
+			return
+		}
+
+		m.log.Error("Failed to send alert notification",
+			"notifier", notifier.Name(),
+			"type", n.Type,
+			"kind", n.Kind,
+			"attempt", i,
+			"error", err,
+		)
+
+		if i < attempts {
+			select {
+			case <-time.After(backoff):
+				backoff *= 2
+			case <-m.stopCh:
+				return
+			}
+		}
+	}
+}
+
+// runDispatcher evaluates alert groups until the monitor stops
+func (m *Monitor) runDispatcher() {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			m.dispatchAlerts(now)
+		case <-m.stopCh:
+			m.dispatcher.sendWg.Wait()
+			return
+		}
+	}
+}
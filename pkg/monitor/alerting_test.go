@@ -0,0 +1,161 @@
+package monitor
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"wechat-service/internal/config"
+	"wechat-service/pkg/logger"
+)
+
+// recordingNotifier keeps every notification it receives
+type recordingNotifier struct {
+	mu   sync.Mutex
+	sent []Notification
+}
+
+func (n *recordingNotifier) Name() string { return "recording" }
+
+func (n *recordingNotifier) Notify(ctx context.Context, notification Notification) error {
+	n.mu.Lock()
+	n.sent = append(n.sent, notification)
+	n.mu.Unlock()
+	return nil
+}
+
+// kinds returns the sent notifications as sorted "type/kind" strings
+func (n *recordingNotifier) kinds() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var kinds []string
+	for _, s := range n.sent {
+		kinds = append(kinds, s.Type+"/"+s.Kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// newTestMonitor returns a monitor with alerting enabled and a recording
+// notifier
+func newTestMonitor(maxPerHour int) (*Monitor, *recordingNotifier) {
+	cfg := &config.Config{}
+	cfg.Monitoring.AlertEnabled = true
+	cfg.Monitoring.AlertGroupWindow = 60
+	cfg.Monitoring.AlertRepeatInterval = 1800
+	cfg.Monitoring.AlertResolveTimeout = 900
+	cfg.Monitoring.AlertMaxPerHour = maxPerHour
+
+	m := NewMonitor(cfg, logger.New(nil))
+	n := &recordingNotifier{}
+	m.AddNotifier(n)
+	return m, n
+}
+
+func TestAlertDispatch(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// step raises an alert of type when alertType is set and dispatches
+	// otherwise, at start+offset
+	type step struct {
+		offset    time.Duration
+		alertType string
+	}
+
+	tests := []struct {
+		name       string
+		maxPerHour int
+		steps      []step
+		want       []string
+		wantGroups int
+	}{
+		{
+			name:       "held for the group window",
+			steps:      []step{{0, AlertTypeDNSTimeout}, {30 * time.Second, ""}},
+			wantGroups: 1,
+		},
+		{
+			name:       "sent after the group window",
+			steps:      []step{{0, AlertTypeDNSTimeout}, {time.Minute, ""}},
+			want:       []string{"DNS_TIMEOUT/firing"},
+			wantGroups: 1,
+		},
+		{
+			name:       "critical sent at once",
+			steps:      []step{{0, AlertTypeMarkFail}},
+			want:       []string{"MARK_FAIL/firing"},
+			wantGroups: 1,
+		},
+		{
+			name: "critical not repeated within the interval",
+			steps: []step{
+				{0, AlertTypeMarkFail}, {time.Second, AlertTypeMarkFail}, {time.Minute, ""},
+			},
+			want:       []string{"MARK_FAIL/firing"},
+			wantGroups: 1,
+		},
+		{
+			name: "resolved after going quiet",
+			steps: []step{
+				{0, AlertTypeDNSTimeout}, {time.Minute, ""}, {16 * time.Minute, ""},
+			},
+			want: []string{"DNS_TIMEOUT/firing", "DNS_TIMEOUT/resolved"},
+		},
+		{
+			name:       "rate-limited resolution is retried",
+			maxPerHour: 1,
+			steps: []step{
+				{0, AlertTypeDNSTimeout}, {time.Minute, ""},
+				{16 * time.Minute, ""}, // limit reached, group kept
+				{62 * time.Minute, ""},
+			},
+			want: []string{"DNS_TIMEOUT/firing", "DNS_TIMEOUT/resolved"},
+		},
+		{
+			name:       "rate-limited resolution kept while limited",
+			maxPerHour: 1,
+			steps: []step{
+				{0, AlertTypeDNSTimeout}, {time.Minute, ""}, {16 * time.Minute, ""},
+			},
+			want:       []string{"DNS_TIMEOUT/firing"},
+			wantGroups: 1,
+		},
+		{
+			name:       "never notified group reported on resolution",
+			maxPerHour: 1,
+			steps: []step{
+				{0, AlertTypeMarkFail}, {0, AlertTypeDNSTimeout},
+				{time.Minute, ""},       // DNS_TIMEOUT held back by the limit
+				{16 * time.Minute, ""},  // both quiet, still limited
+				{62 * time.Minute, ""},  // one resolution fits the limit
+				{123 * time.Minute, ""}, // then the other
+			},
+			want: []string{"DNS_TIMEOUT/resolved", "MARK_FAIL/firing", "MARK_FAIL/resolved"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, n := newTestMonitor(tt.maxPerHour)
+			for _, s := range tt.steps {
+				at := start.Add(s.offset)
+				if s.alertType != "" {
+					m.RaiseAlert(Alert{Type: s.alertType, Count: 1, CreatedAt: at})
+				} else {
+					m.dispatchAlerts(at)
+				}
+			}
+			m.dispatcher.sendWg.Wait()
+
+			if got := n.kinds(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sent %v, want %v", got, tt.want)
+			}
+			if got := len(m.dispatcher.groups); got != tt.wantGroups {
+				t.Errorf("%d groups left, want %d", got, tt.wantGroups)
+			}
+		})
+	}
+}
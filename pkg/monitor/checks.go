@@ -0,0 +1,159 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"wechat-service/internal/config"
+	"wechat-service/pkg/async"
+)
+
+// wechatAPICheckInterval is how long a WeChat API check result is reused,
+// so that frequent readiness probes do not each call WeChat
+const wechatAPICheckInterval = time.Minute
+
+// Pinger is implemented by dependencies that support a connectivity check,
+// such as cache.RedisCache
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// ContextPinger is implemented by *sql.DB
+type ContextPinger interface {
+	PingContext(ctx context.Context) error
+}
+
+// TokenStatsProvider exposes access token refresh statistics, such as
+// service.Server
+type TokenStatsProvider interface {
+	RefreshStats() (failures int64, lastRefresh time.Time)
+}
+
+// QueueStatsProvider exposes async queue statistics
+type QueueStatsProvider interface {
+	GetStats() async.ProcessorStats
+}
+
+// RedisCheck returns a check that pings Redis
+func RedisCheck(client Pinger) CheckFunc {
+	return func(ctx context.Context) (string, string) {
+		if err := client.Ping(ctx); err != nil {
+			return StatusFail, fmt.Sprintf("redis ping failed: %v", err)
+		}
+		return StatusOK, "redis reachable"
+	}
+}
+
+// PostgresCheck returns a check that pings the database
+func PostgresCheck(db ContextPinger) CheckFunc {
+	return func(ctx context.Context) (string, string) {
+		if err := db.PingContext(ctx); err != nil {
+			return StatusFail, fmt.Sprintf("postgres ping failed: %v", err)
+		}
+		return StatusOK, "postgres reachable"
+	}
+}
+
+// TokenFreshnessCheck returns a check that fails when the access token has
+// not been refreshed within AccessToken.CacheDuration
+func TokenFreshnessCheck(cfg *config.Config, tokens TokenStatsProvider) CheckFunc {
+	return func(ctx context.Context) (string, string) {
+		failures, lastRefresh := tokens.RefreshStats()
+		if lastRefresh.IsZero() {
+			return StatusWarn, "no token refresh recorded yet"
+		}
+
+		age := time.Since(lastRefresh)
+		maxAge := time.Duration(cfg.AccessToken.CacheDuration) * time.Second
+		if age > maxAge {
+			return StatusFail, fmt.Sprintf("token last refreshed %s ago (max %s), %d failures",
+				age.Round(time.Second), maxAge, failures)
+		}
+		return StatusOK, fmt.Sprintf("token refreshed %s ago", age.Round(time.Second))
+	}
+}
+
+// QueueSaturationCheck returns a check that warns when the async queue is
+// above warnRatio of its capacity and fails when it is full
+func QueueSaturationCheck(queue QueueStatsProvider, warnRatio float64) CheckFunc {
+	return func(ctx context.Context) (string, string) {
+		stats := queue.GetStats()
+		if stats.QueueCapacity == 0 {
+			return StatusOK, "queue unbuffered"
+		}
+
+		ratio := float64(stats.QueueSize) / float64(stats.QueueCapacity)
+		message := fmt.Sprintf("queue %d/%d (%.0f%%)", stats.QueueSize, stats.QueueCapacity, ratio*100)
+		switch {
+		case ratio >= 1:
+			return StatusFail, message
+		case ratio >= warnRatio:
+			return StatusWarn, message
+		default:
+			return StatusOK, message
+		}
+	}
+}
+
+// WeChatAPICheck returns a check that verifies the configured WeChat API
+// domain answers HTTP requests. Any HTTP response counts as reachable.
+func WeChatAPICheck(cfg *config.Config, client *http.Client) CheckFunc {
+	return func(ctx context.Context) (string, string) {
+		url := "https://" + cfg.GetAPIEndpoint() + "/cgi-bin/getcallbackip"
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return StatusFail, fmt.Sprintf("failed to build request: %v", err)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return StatusFail, fmt.Sprintf("%s unreachable: %v", cfg.GetAPIEndpoint(), err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return StatusWarn, fmt.Sprintf("%s returned %d", cfg.GetAPIEndpoint(), resp.StatusCode)
+		}
+		return StatusOK, fmt.Sprintf("%s reachable", cfg.GetAPIEndpoint())
+	}
+}
+
+// CachedCheck returns a check that runs check at most once per interval
+// and reports its last result in between
+func CachedCheck(check CheckFunc, interval time.Duration) CheckFunc {
+	var mu sync.Mutex
+	var status, message string
+	var checkedAt time.Time
+
+	return func(ctx context.Context) (string, string) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if checkedAt.IsZero() || time.Since(checkedAt) >= interval {
+			status, message = check(ctx)
+			checkedAt = time.Now()
+		}
+		return status, message
+	}
+}
+
+// RegisterDefaultChecks registers the standard dependency checks. Nil
+// dependencies are skipped.
+func (m *Monitor) RegisterDefaultChecks(redis Pinger, db ContextPinger, tokens TokenStatsProvider, queue QueueStatsProvider) {
+	if redis != nil {
+		m.AddHealthCheck("redis", true, RedisCheck(redis))
+	}
+	if db != nil {
+		m.AddHealthCheck("postgres", true, PostgresCheck(db))
+	}
+	if tokens != nil {
+		m.AddHealthCheck("access_token", false, TokenFreshnessCheck(m.cfg, tokens))
+	}
+	if queue != nil {
+		m.AddHealthCheck("async_queue", false, QueueSaturationCheck(queue, 0.8))
+	}
+	m.AddHealthCheck("wechat_api", false, CachedCheck(WeChatAPICheck(m.cfg, m.httpClient), wechatAPICheckInterval))
+}
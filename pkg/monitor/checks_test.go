@@ -0,0 +1,145 @@
+package monitor
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"wechat-service/internal/config"
+	"wechat-service/pkg/async"
+)
+
+// fixedTokens is a TokenStatsProvider returning canned stats
+type fixedTokens struct {
+	failures    int64
+	lastRefresh time.Time
+}
+
+func (f *fixedTokens) RefreshStats() (int64, time.Time) {
+	return f.failures, f.lastRefresh
+}
+
+func TestTokenFailureRule(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures []int64 // failure count per evaluation
+		want     []int   // alert count per evaluation, 0 for none
+	}{
+		{name: "first evaluation primes", failures: []int64{3}, want: []int{0}},
+		{name: "new failures fire", failures: []int64{3, 5, 5, 6}, want: []int{0, 2, 0, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens := &fixedTokens{}
+			rule := TokenFailureRule(tokens)
+			for i, failures := range tt.failures {
+				tokens.failures = failures
+				alerts := rule.Evaluate(time.Now())
+				got := 0
+				if len(alerts) > 0 {
+					got = alerts[0].Count
+				}
+				if got != tt.want[i] {
+					t.Errorf("evaluation %d: count %d, want %d", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestQueueSaturationCheck(t *testing.T) {
+	tests := []struct {
+		name           string
+		size, capacity int
+		want           string
+	}{
+		{name: "unbuffered", want: StatusOK},
+		{name: "low", size: 10, capacity: 100, want: StatusOK},
+		{name: "high", size: 85, capacity: 100, want: StatusWarn},
+		{name: "full", size: 100, capacity: 100, want: StatusFail},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queue := &fixedQueue{stats: async.ProcessorStats{QueueSize: tt.size, QueueCapacity: tt.capacity}}
+			if got, message := QueueSaturationCheck(queue, 0.8)(context.Background()); got != tt.want {
+				t.Errorf("status = %s (%s), want %s", got, message, tt.want)
+			}
+		})
+	}
+}
+
+func TestWeChatAPICheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		want   string
+	}{
+		{name: "reachable", status: http.StatusOK, want: StatusOK},
+		{name: "client error still reachable", status: http.StatusForbidden, want: StatusOK},
+		{name: "server error", status: http.StatusBadGateway, want: StatusWarn},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/cgi-bin/getcallbackip" {
+					t.Errorf("path = %s", r.URL.Path)
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			cfg := &config.Config{}
+			cfg.APIDomain.Primary = strings.TrimPrefix(server.URL, "https://")
+			if got, message := WeChatAPICheck(cfg, server.Client())(context.Background()); got != tt.want {
+				t.Errorf("status = %s (%s), want %s", got, message, tt.want)
+			}
+		})
+	}
+}
+
+func TestCachedCheck(t *testing.T) {
+	tests := []struct {
+		name      string
+		interval  time.Duration
+		calls     int
+		wait      time.Duration // between calls
+		wantRuns  int32
+		wantFinal string
+	}{
+		{name: "reused within interval", interval: time.Minute, calls: 3, wantRuns: 1, wantFinal: StatusOK},
+		{name: "rerun after interval", interval: 5 * time.Millisecond, calls: 3, wait: 10 * time.Millisecond, wantRuns: 3, wantFinal: StatusFail},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var runs atomic.Int32
+			check := CachedCheck(func(ctx context.Context) (string, string) {
+				if runs.Add(1) == 1 {
+					return StatusOK, "first"
+				}
+				return StatusFail, "later"
+			}, tt.interval)
+
+			var status string
+			for i := 0; i < tt.calls; i++ {
+				if i > 0 {
+					time.Sleep(tt.wait)
+				}
+				status, _ = check(context.Background())
+			}
+			if runs.Load() != tt.wantRuns {
+				t.Errorf("runs = %d, want %d", runs.Load(), tt.wantRuns)
+			}
+			if status != tt.wantFinal {
+				t.Errorf("status = %s, want %s", status, tt.wantFinal)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package monitor
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RegisterHealthRoutes registers the health, liveness and readiness endpoints
+func RegisterHealthRoutes(r gin.IRoutes, m *Monitor) {
+	r.GET(m.cfg.Monitoring.HealthPath, ReadinessHandler(m))
+	r.GET(m.cfg.Monitoring.LivenessPath, LivenessHandler(m))
+	r.GET(m.cfg.Monitoring.ReadinessPath, ReadinessHandler(m))
+}
+
+// LivenessHandler answers liveness probes
+func LivenessHandler(m *Monitor) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, m.Liveness())
+	}
+}
+
+// ReadinessHandler answers readiness probes with the detailed report. It
+// fails only when a critical check fails; degraded still answers 200.
+func ReadinessHandler(m *Monitor) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		report := m.Readiness(c.Request.Context())
+		c.JSON(statusCode(report), report)
+	}
+}
+
+// statusCode maps a health report to an HTTP status
+func statusCode(report HealthReport) int {
+	if report.Status == HealthUnhealthy {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusOK
+}
@@ -1,9 +1,8 @@
 package monitor
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
+	"database/sql"
 	"fmt"
 	"net/http"
 	"sync"
@@ -11,6 +10,7 @@ import (
 
 	"wechat-service/internal/config"
 	"wechat-service/pkg/logger"
+	"wechat-service/pkg/metrics"
 )
 
 // Alert represents a monitoring alert
@@ -24,6 +24,10 @@ type Alert struct {
 	FirstTime   time.Time              `json:"first_time"`
 	Example     map[string]interface{} `json:"example"`
 	Severity    string                 `json:"severity"`
+	Status      string                 `json:"status"`
+	AcknowledgedBy string              `json:"acknowledged_by,omitempty"`
+	AcknowledgedAt *time.Time          `json:"acknowledged_at,omitempty"`
+	ResolvedAt  *time.Time             `json:"resolved_at,omitempty"`
 	CreatedAt   time.Time              `json:"created_at"`
 }
 
@@ -35,6 +39,12 @@ const (
 	AlertTypeRequestTimeout   = "REQUEST_TIMEOUT"
 	AlertTypeResponseInvalid  = "RESPONSE_INVALID"
 	AlertTypeMarkFail         = "MARK_FAIL"
+
+	// Raised internally by anomaly rules
+	AlertTypeTokenRefreshFailure = "TOKEN_REFRESH_FAILURE"
+	AlertTypeQuotaHigh           = "API_QUOTA_HIGH"
+	AlertTypeDeadLetterGrowth    = "ASYNC_DEAD_LETTER"
+	AlertTypeCallbackSlow        = "CALLBACK_LATENCY_HIGH"
 )
 
 // Severity levels
@@ -50,94 +60,265 @@ type Monitor struct {
 	cfg        *config.Config
 	log        *logger.Logger
 	httpClient *http.Client
-	alerts     []Alert
-	alertMu    sync.RWMutex
+	store      AlertStore
 	stopCh     chan struct{}
 	wg         sync.WaitGroup
+	dispatcher alertDispatcher
+
+	// Anomaly rules
+	rules  []Rule
+	rulesMu sync.RWMutex
 
 	// Health checks
-	checks []HealthCheck
+	checks []healthCheckEntry
 	mu     sync.RWMutex
 }
 
-// HealthCheck represents a health check function
+// Health check statuses
+const (
+	StatusOK   = "ok"
+	StatusWarn = "warn"
+	StatusFail = "fail"
+)
+
+// Overall health states
+const (
+	HealthHealthy   = "healthy"
+	HealthDegraded  = "degraded"
+	HealthUnhealthy = "unhealthy"
+)
+
+// CheckFunc runs a single health check and returns its status and a message.
+// It must honor ctx cancellation; the monitor applies a per-check timeout.
+type CheckFunc func(ctx context.Context) (string, string)
+
+// HealthCheck represents the result of a health check
 type HealthCheck struct {
-	Name    string
-	Status  string
-	Message string
-	LastRun time.Time
+	Name     string    `json:"name"`
+	Status   string    `json:"status"`
+	Message  string    `json:"message"`
+	Critical bool      `json:"critical"`
+	Duration string    `json:"duration"`
+	LastRun  time.Time `json:"last_run"`
+}
+
+// HealthReport is the detailed response of the health endpoints
+type HealthReport struct {
+	Status    string        `json:"status"`
+	Checks    []HealthCheck `json:"checks,omitempty"`
+	Timestamp time.Time     `json:"timestamp"`
+}
+
+// healthCheckEntry is a registered health check
+type healthCheckEntry struct {
+	name     string
+	critical bool
+	fn       CheckFunc
 }
 
 // NewMonitor creates a new monitoring instance
 func NewMonitor(cfg *config.Config, log *logger.Logger) *Monitor {
-	return &Monitor{
+	m := &Monitor{
 		cfg: cfg,
 		log: log,
 		httpClient: &http.Client{
 			Timeout: 10 * time.Second,
 		},
-		alerts:  make([]Alert, 0),
+		store:   NewMemoryAlertStore(1000),
 		stopCh:  make(chan struct{}),
-		checks:  make([]HealthCheck, 0),
+		checks:  make([]healthCheckEntry, 0),
+		dispatcher: alertDispatcher{
+			groups: make(map[string]*alertGroup),
+		},
 	}
+	m.initNotifiers()
+
+	return m
 }
 
-// AddHealthCheck adds a health check
-func (m *Monitor) AddHealthCheck(name string, checkFunc func() (string, string)) {
+// SetAlertStore replaces the alert and health history store, e.g. with a
+// PostgresAlertStore when a database is configured
+func (m *Monitor) SetAlertStore(store AlertStore) {
 	m.mu.Lock()
-	defer m.mu.Unlock()
+	m.store = store
+	m.mu.Unlock()
+}
 
-	m.checks = append(m.checks, HealthCheck{
-		Name: name,
-	})
+// UseDatabase keeps alerts and health history in db, the database opened
+// by repository.OpenDB when database.type is set, and records query
+// latencies in m. m may be nil.
+func (m *Monitor) UseDatabase(db *sql.DB, mt *metrics.Metrics) {
+	store := NewPostgresAlertStore(db)
+	if mt != nil {
+		store.SetLatencyObserver(func(operation string, d time.Duration) {
+			mt.ObserveDependencyLatency("postgres", operation, d.Seconds())
+		})
+	}
+	m.SetAlertStore(store)
 }
 
-// RunHealthChecks runs all health checks
-func (m *Monitor) RunHealthChecks() []HealthCheck {
+// alertStore returns the current store
+func (m *Monitor) alertStore() AlertStore {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
+	return m.store
+}
 
-	results := make([]HealthCheck, len(m.checks))
-	for i, check := range m.checks {
-		// In production, call the actual check function
-		results[i] = HealthCheck{
-			Name:    check.Name,
-			Status:  "ok",
-			Message: "Healthy",
-			LastRun: time.Now(),
-		}
+// AddHealthCheck adds a health check. Critical checks gate readiness;
+// non-critical failures only mark the service as degraded.
+func (m *Monitor) AddHealthCheck(name string, critical bool, checkFunc CheckFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.checks = append(m.checks, healthCheckEntry{
+		name:     name,
+		critical: critical,
+		fn:       checkFunc,
+	})
+}
+
+// RunHealthChecks runs all health checks concurrently, each bounded by
+// Monitoring.HealthCheckTimeout
+func (m *Monitor) RunHealthChecks(ctx context.Context) []HealthCheck {
+	m.mu.RLock()
+	checks := make([]healthCheckEntry, len(m.checks))
+	copy(checks, m.checks)
+	m.mu.RUnlock()
+
+	timeout := time.Duration(m.cfg.Monitoring.HealthCheckTimeout) * time.Second
+	results := make([]HealthCheck, len(checks))
+
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check healthCheckEntry) {
+			defer wg.Done()
+			results[i] = m.runCheck(ctx, check, timeout)
+		}(i, check)
 	}
+	wg.Wait()
 
 	return results
 }
 
+// runCheck runs one check with a timeout, recovering from panics
+func (m *Monitor) runCheck(ctx context.Context, check healthCheckEntry, timeout time.Duration) HealthCheck {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	type outcome struct{ status, message string }
+	done := make(chan outcome, 1)
+
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- outcome{StatusFail, fmt.Sprintf("check panicked: %v", r)}
+			}
+		}()
+		status, message := check.fn(ctx)
+		done <- outcome{status, message}
+	}()
+
+	result := HealthCheck{
+		Name:     check.name,
+		Critical: check.critical,
+		LastRun:  start,
+	}
+
+	select {
+	case o := <-done:
+		result.Status = o.status
+		result.Message = o.message
+	case <-ctx.Done():
+		result.Status = StatusFail
+		result.Message = fmt.Sprintf("check timed out after %s", timeout)
+	}
+	result.Duration = time.Since(start).String()
+
+	if result.Status != StatusOK {
+		m.log.Warn("Health check not ok",
+			"check", result.Name,
+			"status", result.Status,
+			"message", result.Message,
+		)
+	}
+
+	return result
+}
+
+// Liveness reports whether the process is alive. It runs no dependency
+// checks so that a broken dependency does not get the pod restarted.
+func (m *Monitor) Liveness() HealthReport {
+	return HealthReport{
+		Status:    HealthHealthy,
+		Timestamp: time.Now(),
+	}
+}
+
+// Readiness runs all checks and reports whether the service can take traffic
+func (m *Monitor) Readiness(ctx context.Context) HealthReport {
+	checks := m.RunHealthChecks(ctx)
+	return HealthReport{
+		Status:    aggregateStatus(checks),
+		Checks:    checks,
+		Timestamp: time.Now(),
+	}
+}
+
 // GetHealthStatus returns overall health status
 func (m *Monitor) GetHealthStatus() string {
-	checks := m.RunHealthChecks()
+	return aggregateStatus(m.RunHealthChecks(context.Background()))
+}
+
+// aggregateStatus folds check results into an overall health state
+func aggregateStatus(checks []HealthCheck) string {
+	status := HealthHealthy
 	for _, check := range checks {
-		if check.Status != "ok" {
-			return "unhealthy"
+		if check.Status == StatusOK {
+			continue
 		}
+		if check.Critical && check.Status == StatusFail {
+			return HealthUnhealthy
+		}
+		status = HealthDegraded
 	}
-	return "healthy"
+	return status
 }
 
 // HandleAlert processes an incoming alert from WeChat
-func (m *Monitor) HandleAlert(alertData map[string]interface{}) {
-	alert := Alert{
-		ID:        generateAlertID(),
+func (m *Monitor) HandleAlert(alertData map[string]interface{}) Alert {
+	return m.RaiseAlert(Alert{
 		AppID:     getString(alertData, "appid"),
 		Nickname:  getString(alertData, "nickname"),
 		Type:      getString(alertData, "type"),
 		Count:     getInt(alertData, "count"),
 		FirstTime: parseTime(getString(alertData, "time")),
 		Example:   getMap(alertData, "example"),
-		Severity:  m.calculateSeverity(getString(alertData, "type")),
-		CreatedAt: time.Now(),
-	}
+	})
+}
 
-	// Set description based on type
-	alert.Description = m.getDescription(alert.Type)
+// RaiseAlert records an alert and feeds it to notification grouping.
+// Missing ID, severity, description and timestamps are filled in.
+func (m *Monitor) RaiseAlert(alert Alert) Alert {
+	if alert.ID == "" {
+		alert.ID = generateAlertID()
+	}
+	if alert.Severity == "" {
+		alert.Severity = m.calculateSeverity(alert.Type)
+	}
+	if alert.Description == "" {
+		alert.Description = m.getDescription(alert.Type)
+	}
+	if alert.CreatedAt.IsZero() {
+		alert.CreatedAt = time.Now()
+	}
+	if alert.FirstTime.IsZero() {
+		alert.FirstTime = alert.CreatedAt
+	}
+	if alert.Status == "" {
+		alert.Status = AlertStatusFiring
+	}
 
 	m.log.Error("Alert received",
 		"type", alert.Type,
@@ -147,18 +328,28 @@ func (m *Monitor) HandleAlert(alertData map[string]interface{}) {
 	)
 
 	// Store alert
-	m.mu.Lock()
-	m.alerts = append(m.alerts, alert)
-	// Keep only last 100 alerts
-	if len(m.alerts) > 100 {
-		m.alerts = m.alerts[len(m.alerts)-100:]
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := m.alertStore().SaveAlert(ctx, alert); err != nil {
+		m.log.Error("Failed to store alert", "alert_id", alert.ID, "error", err)
 	}
-	m.mu.Unlock()
 
-	// Send webhook notification
-	if m.cfg.Monitoring.AlertEnabled && m.cfg.Monitoring.AlertWebhook != "" {
-		go m.sendAlertWebhook(alert)
+	// Group for notification; the dispatcher sends grouped notices
+	if m.cfg.Monitoring.AlertEnabled {
+		m.groupAlert(alert)
+	}
+
+	return alert
+}
+
+// IsKnownAlertType reports whether t is an alert type pushed by WeChat
+func IsKnownAlertType(t string) bool {
+	switch t {
+	case AlertTypeDNSFailure, AlertTypeDNSTimeout, AlertTypeConnectionTimeout,
+		AlertTypeRequestTimeout, AlertTypeResponseInvalid, AlertTypeMarkFail:
+		return true
 	}
+	return false
 }
 
 // calculateSeverity returns severity level for alert type
@@ -166,11 +357,13 @@ func (m *Monitor) calculateSeverity(alertType string) string {
 	switch alertType {
 	case AlertTypeMarkFail:
 		return SeverityCritical
-	case AlertTypeConnectionTimeout, AlertTypeRequestTimeout:
+	case AlertTypeConnectionTimeout, AlertTypeRequestTimeout, AlertTypeCallbackSlow:
+		return SeverityHigh
+	case AlertTypeTokenRefreshFailure:
 		return SeverityHigh
 	case AlertTypeDNSFailure, AlertTypeResponseInvalid:
 		return SeverityHigh
-	case AlertTypeDNSTimeout:
+	case AlertTypeDNSTimeout, AlertTypeQuotaHigh, AlertTypeDeadLetterGrowth:
 		return SeverityMedium
 	default:
 		return SeverityLow
@@ -186,64 +379,84 @@ func (m *Monitor) getDescription(alertType string) string {
 		AlertTypeRequestTimeout:    "Server did not respond within 5 seconds",
 		AlertTypeResponseInvalid:   "Server response was invalid",
 		AlertTypeMarkFail:          "Server auto-blocked (multiple failures)",
+		AlertTypeTokenRefreshFailure: "Access token refresh failed",
+		AlertTypeQuotaHigh:           "Daily API quota nearly exhausted",
+		AlertTypeDeadLetterGrowth:    "Async tasks dropped after exhausting retries",
+		AlertTypeCallbackSlow:        "Callback latency approaching the 5 second limit",
 	}
 	return descriptions[alertType]
 }
 
-// sendAlertWebhook sends alert to webhook URL
-func (m *Monitor) sendAlertWebhook(alert Alert) {
-	if m.cfg.Monitoring.AlertWebhook == "" {
-		return
-	}
-
-	data, err := json.Marshal(alert)
-	if err != nil {
-		m.log.Error("Failed to marshal alert", "error", err)
-		return
-	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	req, err := http.NewRequestWithContext(ctx, "POST", m.cfg.Monitoring.AlertWebhook, bytes.NewBuffer(data))
+// GetAlerts returns the 100 most recent alerts
+func (m *Monitor) GetAlerts() []Alert {
+	alerts, err := m.QueryAlerts(context.Background(), AlertFilter{Limit: 100})
 	if err != nil {
-		m.log.Error("Failed to create alert webhook request", "error", err)
-		return
+		m.log.Error("Failed to load alerts", "error", err)
+		return make([]Alert, 0)
 	}
-	req.Header.Set("Content-Type", "application/json")
+	return alerts
+}
 
-	resp, err := m.httpClient.Do(req)
-	if err != nil {
-		m.log.Error("Failed to send alert webhook", "error", err)
-		return
-	}
-	defer resp.Body.Close()
+// QueryAlerts returns alerts matching the filter, newest first
+func (m *Monitor) QueryAlerts(ctx context.Context, filter AlertFilter) ([]Alert, error) {
+	return m.alertStore().ListAlerts(ctx, filter)
+}
 
-	if resp.StatusCode != 200 {
-		m.log.Error("Alert webhook returned non-200", "status", resp.StatusCode)
-	}
+// AcknowledgeAlert marks an alert as acknowledged by an operator
+func (m *Monitor) AcknowledgeAlert(ctx context.Context, id, by string) error {
+	return m.alertStore().AcknowledgeAlert(ctx, id, by, time.Now())
 }
 
-// GetAlerts returns recent alerts
-func (m *Monitor) GetAlerts() []Alert {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
+// ResolveAlert marks an alert as resolved
+func (m *Monitor) ResolveAlert(ctx context.Context, id string) error {
+	return m.alertStore().ResolveAlert(ctx, id, time.Now())
+}
 
-	// Return copy
-	alerts := make([]Alert, len(m.alerts))
-	copy(alerts, m.alerts)
-	return alerts
+// QueryHealthHistory returns recorded health check results, newest first
+func (m *Monitor) QueryHealthHistory(ctx context.Context, filter HealthFilter) ([]HealthCheck, error) {
+	return m.alertStore().ListHealthResults(ctx, filter)
 }
 
 // ClearAlerts clears all alerts
 func (m *Monitor) ClearAlerts() {
-	m.mu.Lock()
-	m.alerts = make([]Alert, 0)
-	m.mu.Unlock()
+	if _, err := m.alertStore().PurgeAlerts(context.Background(), time.Now().Add(time.Second)); err != nil {
+		m.log.Error("Failed to clear alerts", "error", err)
+	}
+}
+
+// applyRetention purges alerts and health results older than the
+// configured retention
+func (m *Monitor) applyRetention(ctx context.Context) {
+	store := m.alertStore()
+	now := time.Now()
+
+	if days := m.cfg.Monitoring.AlertRetentionDays; days > 0 {
+		n, err := store.PurgeAlerts(ctx, now.AddDate(0, 0, -days))
+		if err != nil {
+			m.log.Error("Failed to purge alerts", "error", err)
+		} else if n > 0 {
+			m.log.Info("Purged old alerts", "count", n)
+		}
+	}
+
+	if days := m.cfg.Monitoring.HealthRetentionDays; days > 0 {
+		n, err := store.PurgeHealthResults(ctx, now.AddDate(0, 0, -days))
+		if err != nil {
+			m.log.Error("Failed to purge health results", "error", err)
+		} else if n > 0 {
+			m.log.Info("Purged old health results", "count", n)
+		}
+	}
 }
 
 // StartMonitoring starts background monitoring
 func (m *Monitor) StartMonitoring() {
+	m.wg.Add(1)
+	go m.runDispatcher()
+
+	m.wg.Add(1)
+	go m.runRules()
+
 	m.wg.Add(1)
 	go func() {
 		defer m.wg.Done()
@@ -264,16 +477,24 @@ func (m *Monitor) StartMonitoring() {
 
 // runPeriodicChecks runs periodic monitoring checks
 func (m *Monitor) runPeriodicChecks() {
-	// Check health status
-	status := m.GetHealthStatus()
-	if status != "healthy" {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// Check health status and record history
+	results := m.RunHealthChecks(ctx)
+	if status := aggregateStatus(results); status != HealthHealthy {
 		m.log.Warn("Health check failed", "status", status)
 	}
+	if len(results) > 0 {
+		if err := m.alertStore().SaveHealthResults(ctx, results); err != nil {
+			m.log.Error("Failed to store health results", "error", err)
+		}
+	}
+
+	m.applyRetention(ctx)
 
-	// Could add more periodic checks here:
-	// - Check API response times
-	// - Check token freshness
-	// - Check disk space, memory, etc.
+	// Token freshness, quota, dead letters and callback latency are
+	// covered by anomaly rules, see runRules
 }
 
 // Stop stops monitoring
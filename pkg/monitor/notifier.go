@@ -0,0 +1,309 @@
+package monitor
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"wechat-service/internal/config"
+)
+
+// Notification kinds
+const (
+	NotificationFiring   = "firing"
+	NotificationResolved = "resolved"
+)
+
+// Notification is a grouped alert delivered to notifiers
+type Notification struct {
+	Kind      string    `json:"kind"`
+	Type      string    `json:"type"`
+	Severity  string    `json:"severity"`
+	Count     int       `json:"count"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Alerts    []Alert   `json:"alerts"`
+}
+
+// Title returns a one-line summary of the notification
+func (n Notification) Title() string {
+	if n.Kind == NotificationResolved {
+		return fmt.Sprintf("[RESOLVED] %s", n.Type)
+	}
+	return fmt.Sprintf("[%s] %s x%d", strings.ToUpper(n.Severity), n.Type, n.Count)
+}
+
+// Markdown renders the notification as markdown
+func (n Notification) Markdown() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "### %s\n", n.Title())
+	if len(n.Alerts) > 0 {
+		if desc := n.Alerts[len(n.Alerts)-1].Description; desc != "" {
+			fmt.Fprintf(&b, "> %s\n\n", desc)
+		}
+	}
+	fmt.Fprintf(&b, "- Severity: %s\n", n.Severity)
+	fmt.Fprintf(&b, "- Occurrences: %d\n", n.Count)
+	fmt.Fprintf(&b, "- First seen: %s\n", n.FirstSeen.Format("2006-01-02 15:04:05"))
+	fmt.Fprintf(&b, "- Last seen: %s\n", n.LastSeen.Format("2006-01-02 15:04:05"))
+	if n.Kind == NotificationResolved {
+		b.WriteString("- No new alerts within the resolve timeout\n")
+	}
+	return b.String()
+}
+
+// Notifier delivers alert notifications to one channel
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, n Notification) error
+}
+
+// NewNotifier creates a notifier from its configuration
+func NewNotifier(cfg config.NotifierConfig, client *http.Client) (Notifier, error) {
+	switch cfg.Type {
+	case "webhook":
+		return &WebhookNotifier{url: cfg.URL, client: client}, nil
+	case "wecom":
+		return &WeComNotifier{url: cfg.URL, client: client}, nil
+	case "dingtalk":
+		return &DingTalkNotifier{url: cfg.URL, secret: cfg.Secret, client: client}, nil
+	case "feishu":
+		return &FeishuNotifier{url: cfg.URL, secret: cfg.Secret, client: client}, nil
+	case "email":
+		return &EmailNotifier{cfg: cfg}, nil
+	default:
+		return nil, fmt.Errorf("unknown notifier type: %q", cfg.Type)
+	}
+}
+
+// WebhookNotifier posts the notification as JSON to a generic webhook
+type WebhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+// Name returns the notifier name
+func (n *WebhookNotifier) Name() string { return "webhook" }
+
+// Notify posts the notification
+func (n *WebhookNotifier) Notify(ctx context.Context, notification Notification) error {
+	return postJSON(ctx, n.client, n.url, notification)
+}
+
+// WeComNotifier posts markdown messages to a WeCom group robot
+type WeComNotifier struct {
+	url    string
+	client *http.Client
+}
+
+// Name returns the notifier name
+func (n *WeComNotifier) Name() string { return "wecom" }
+
+// Notify posts the notification
+func (n *WeComNotifier) Notify(ctx context.Context, notification Notification) error {
+	payload := map[string]interface{}{
+		"msgtype": "markdown",
+		"markdown": map[string]string{
+			"content": notification.Markdown(),
+		},
+	}
+	return postRobot(ctx, n.client, n.url, payload)
+}
+
+// DingTalkNotifier posts markdown messages to a DingTalk robot
+type DingTalkNotifier struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+// Name returns the notifier name
+func (n *DingTalkNotifier) Name() string { return "dingtalk" }
+
+// Notify posts the notification, signing the URL when a secret is set
+func (n *DingTalkNotifier) Notify(ctx context.Context, notification Notification) error {
+	target := n.url
+	if n.secret != "" {
+		timestamp := strconv.FormatInt(time.Now().UnixMilli(), 10)
+		mac := hmac.New(sha256.New, []byte(n.secret))
+		mac.Write([]byte(timestamp + "\n" + n.secret))
+		sign := url.QueryEscape(base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+
+		sep := "?"
+		if strings.Contains(target, "?") {
+			sep = "&"
+		}
+		target = target + sep + "timestamp=" + timestamp + "&sign=" + sign
+	}
+
+	payload := map[string]interface{}{
+		"msgtype": "markdown",
+		"markdown": map[string]string{
+			"title": notification.Title(),
+			"text":  notification.Markdown(),
+		},
+	}
+	return postRobot(ctx, n.client, target, payload)
+}
+
+// FeishuNotifier posts text messages to a Feishu (Lark) robot
+type FeishuNotifier struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+// Name returns the notifier name
+func (n *FeishuNotifier) Name() string { return "feishu" }
+
+// Notify posts the notification, signing the body when a secret is set
+func (n *FeishuNotifier) Notify(ctx context.Context, notification Notification) error {
+	payload := map[string]interface{}{
+		"msg_type": "text",
+		"content": map[string]string{
+			"text": notification.Markdown(),
+		},
+	}
+
+	if n.secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		mac := hmac.New(sha256.New, []byte(timestamp+"\n"+n.secret))
+		payload["timestamp"] = timestamp
+		payload["sign"] = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	}
+
+	return postRobot(ctx, n.client, n.url, payload)
+}
+
+// EmailNotifier sends notifications through SMTP
+type EmailNotifier struct {
+	cfg config.NotifierConfig
+}
+
+// Name returns the notifier name
+func (n *EmailNotifier) Name() string { return "email" }
+
+// Notify sends the notification as a plain text email
+func (n *EmailNotifier) Notify(ctx context.Context, notification Notification) error {
+	if len(n.cfg.To) == 0 {
+		return fmt.Errorf("email notifier has no recipients")
+	}
+
+	port := n.cfg.SMTPPort
+	if port == 0 {
+		port = 25
+	}
+	addr := net.JoinHostPort(n.cfg.SMTPHost, strconv.Itoa(port))
+
+	var auth smtp.Auth
+	if n.cfg.Username != "" {
+		auth = smtp.PlainAuth("", n.cfg.Username, n.cfg.Password, n.cfg.SMTPHost)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.cfg.To, ", "))
+	fmt.Fprintf(&msg, "Subject: wechat-service alert: %s\r\n", notification.Title())
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	msg.WriteString(notification.Markdown())
+
+	// net/smtp has no context support; run it so ctx can still bound the wait
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- smtp.SendMail(addr, auth, n.cfg.From, n.cfg.To, msg.Bytes())
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// maxNotifierResponseBytes caps the notifier response read
+const maxNotifierResponseBytes = 64 << 10
+
+// robotResponse is the reply of a WeCom, DingTalk or Feishu robot. WeCom
+// and DingTalk report errcode and errmsg, Feishu code and msg; a non-zero
+// code means the message was rejected even though the status is 200.
+type robotResponse struct {
+	ErrCode *int   `json:"errcode"`
+	ErrMsg  string `json:"errmsg"`
+	Code    *int   `json:"code"`
+	Msg     string `json:"msg"`
+}
+
+// postJSON posts payload as JSON and treats non-2xx responses as errors
+func postJSON(ctx context.Context, client *http.Client, target string, payload interface{}) error {
+	_, err := post(ctx, client, target, payload)
+	return err
+}
+
+// postRobot posts payload to a group robot and also treats a non-zero
+// error code in the response body as an error
+func postRobot(ctx context.Context, client *http.Client, target string, payload interface{}) error {
+	body, err := post(ctx, client, target, payload)
+	if err != nil {
+		return err
+	}
+
+	var resp robotResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return fmt.Errorf("failed to decode robot response: %w", err)
+	}
+	switch {
+	case resp.ErrCode != nil && *resp.ErrCode != 0:
+		return fmt.Errorf("robot returned errcode %d: %s", *resp.ErrCode, resp.ErrMsg)
+	case resp.Code != nil && *resp.Code != 0:
+		return fmt.Errorf("robot returned code %d: %s", *resp.Code, resp.Msg)
+	}
+	return nil
+}
+
+// post posts payload as JSON and returns the response body, treating
+// non-2xx responses as errors
+func post(ctx context.Context, client *http.Client, target string, payload interface{}) ([]byte, error) {
+	if target == "" {
+		return nil, fmt.Errorf("notifier URL is empty")
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal notification: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxNotifierResponseBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read notifier response: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("notifier returned status %d", resp.StatusCode)
+	}
+	return body, nil
+}
@@ -0,0 +1,56 @@
+package monitor
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"wechat-service/internal/config"
+)
+
+func TestNotifierResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		notifier string
+		status   int
+		body     string
+		wantErr  bool
+	}{
+		{name: "wecom ok", notifier: "wecom", body: `{"errcode":0,"errmsg":"ok"}`},
+		{name: "wecom rejected", notifier: "wecom", body: `{"errcode":93000,"errmsg":"invalid webhook url"}`, wantErr: true},
+		{name: "dingtalk ok", notifier: "dingtalk", body: `{"errcode":0,"errmsg":"ok"}`},
+		{name: "dingtalk bad signature", notifier: "dingtalk", body: `{"errcode":310000,"errmsg":"sign not match"}`, wantErr: true},
+		{name: "feishu ok", notifier: "feishu", body: `{"code":0,"msg":"success","data":{}}`},
+		{name: "feishu bad signature", notifier: "feishu", body: `{"code":19021,"msg":"sign match fail or timestamp is not within one hour from current time"}`, wantErr: true},
+		{name: "robot not json", notifier: "wecom", body: `<html>bad gateway</html>`, wantErr: true},
+		{name: "robot http error", notifier: "dingtalk", status: http.StatusBadGateway, body: `{"errcode":0}`, wantErr: true},
+		{name: "webhook body ignored", notifier: "webhook", body: `{"errcode":1}`},
+		{name: "webhook http error", notifier: "webhook", status: http.StatusInternalServerError, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.status != 0 {
+					w.WriteHeader(tt.status)
+				}
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			n, err := NewNotifier(config.NotifierConfig{Type: tt.notifier, URL: srv.URL, Secret: "s"}, srv.Client())
+			if err != nil {
+				t.Fatal(err)
+			}
+			notification := Notification{
+				Kind: NotificationFiring, Type: AlertTypeTokenRefreshFailure, Severity: "critical",
+				Count: 1, FirstSeen: time.Now(), LastSeen: time.Now(),
+			}
+			if err := n.Notify(context.Background(), notification); (err != nil) != tt.wantErr {
+				t.Errorf("Notify err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,336 @@
+package monitor
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"wechat-service/internal/config"
+)
+
+// Rule evaluates one anomaly condition against our own metrics and returns
+// the alerts to raise. Rules keep their own state so that they fire on
+// transitions rather than on every evaluation; Evaluate may be called
+// concurrently, so that state is guarded. AppID is the account the rule
+// watches, stamped on its alerts; it is empty for service-wide rules.
+type Rule struct {
+	Name     string
+	AppID    string
+	Evaluate func(now time.Time) []Alert
+}
+
+// UsageProvider exposes daily API quota usage, such as ratelimit.Limiter
+type UsageProvider interface {
+	GetUsage(apiName string) (int, int, error)
+}
+
+// LatencyProvider reports recent callback latency
+type LatencyProvider interface {
+	P95() time.Duration
+}
+
+// AddRule registers an anomaly rule
+func (m *Monitor) AddRule(rule Rule) {
+	m.rulesMu.Lock()
+	m.rules = append(m.rules, rule)
+	m.rulesMu.Unlock()
+}
+
+// RegisterDefaultRules registers the standard anomaly rules, with the
+// token and quota rules watching the service's own account. Nil providers
+// are skipped.
+func (m *Monitor) RegisterDefaultRules(tokens TokenStatsProvider, usage UsageProvider, queue QueueStatsProvider, latency LatencyProvider) {
+	m.RegisterAccountRules(m.cfg, tokens, usage)
+	if queue != nil {
+		m.AddRule(DeadLetterRule(queue, int64(m.cfg.Monitoring.DeadLetterAlertThreshold)))
+	}
+	if latency != nil {
+		threshold := time.Duration(m.cfg.Monitoring.LatencyAlertThreshold) * time.Millisecond
+		m.AddRule(CallbackLatencyRule(latency, threshold))
+	}
+}
+
+// RegisterAccountRules registers the token and quota rules of the account
+// cfg is scoped to (see Config.ForAccount); their alerts carry its app ID.
+// Nil providers are skipped.
+func (m *Monitor) RegisterAccountRules(cfg *config.Config, tokens TokenStatsProvider, usage UsageProvider) {
+	appID := cfg.WeChat.AppID
+	if appID == "" {
+		appID = m.defaultAppID()
+	}
+
+	if tokens != nil {
+		rule := TokenFailureRule(tokens)
+		rule.AppID = appID
+		m.AddRule(rule)
+	}
+	if usage != nil {
+		apis := make([]string, 0, len(cfg.RateLimit.APIQuotas))
+		for api := range cfg.RateLimit.APIQuotas {
+			apis = append(apis, api)
+		}
+		sort.Strings(apis)
+		rule := QuotaUsageRule(usage, apis, m.cfg.Monitoring.QuotaAlertThreshold)
+		rule.AppID = appID
+		m.AddRule(rule)
+	}
+}
+
+// EvaluateRules runs all rules once and raises the resulting alerts
+func (m *Monitor) EvaluateRules(now time.Time) {
+	m.rulesMu.RLock()
+	rules := make([]Rule, len(m.rules))
+	copy(rules, m.rules)
+	m.rulesMu.RUnlock()
+
+	for _, rule := range rules {
+		for _, alert := range m.evaluateRule(rule, now) {
+			if alert.AppID == "" {
+				alert.AppID = rule.AppID
+			}
+			if alert.AppID == "" {
+				alert.AppID = m.defaultAppID()
+			}
+			m.RaiseAlert(alert)
+		}
+	}
+}
+
+// defaultAppID returns the app ID of the first configured account, for
+// alerts of service-wide rules
+func (m *Monitor) defaultAppID() string {
+	if accounts := m.cfg.GetAccounts(); len(accounts) > 0 {
+		return accounts[0].AppID
+	}
+	return ""
+}
+
+// evaluateRule runs a rule, recovering from panics
+func (m *Monitor) evaluateRule(rule Rule, now time.Time) (alerts []Alert) {
+	defer func() {
+		if r := recover(); r != nil {
+			m.log.Error("Anomaly rule panicked", "rule", rule.Name, "panic", r)
+			alerts = nil
+		}
+	}()
+	return rule.Evaluate(now)
+}
+
+// runRules evaluates anomaly rules every Monitoring.RuleInterval
+func (m *Monitor) runRules() {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(time.Duration(m.cfg.Monitoring.RuleInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			m.EvaluateRules(now)
+		case <-m.stopCh:
+			return
+		}
+	}
+}
+
+// TokenFailureRule fires when the token server records new refresh failures
+func TokenFailureRule(tokens TokenStatsProvider) Rule {
+	var mu sync.Mutex
+	var last int64
+	var primed bool
+
+	return Rule{
+		Name: "token_refresh_failure",
+		Evaluate: func(now time.Time) []Alert {
+			mu.Lock()
+			defer mu.Unlock()
+
+			failures, lastRefresh := tokens.RefreshStats()
+			delta := failures - last
+			wasPrimed := primed
+			last, primed = failures, true
+
+			if !wasPrimed || delta <= 0 {
+				return nil
+			}
+			return []Alert{{
+				Type:  AlertTypeTokenRefreshFailure,
+				Count: int(delta),
+				Example: map[string]interface{}{
+					"failure_count":     failures,
+					"last_refresh_time": lastRefresh,
+				},
+			}}
+		},
+	}
+}
+
+// QuotaUsageRule fires when an API's daily usage crosses threshold (a
+// fraction of its quota). It fires again only after usage drops back below.
+func QuotaUsageRule(usage UsageProvider, apis []string, threshold float64) Rule {
+	var mu sync.Mutex
+	firing := make(map[string]bool)
+
+	return Rule{
+		Name: "api_quota_high",
+		Evaluate: func(now time.Time) []Alert {
+			mu.Lock()
+			defer mu.Unlock()
+
+			var alerts []Alert
+			for _, api := range apis {
+				count, quota, err := usage.GetUsage(api)
+				if err != nil || quota <= 0 {
+					continue
+				}
+
+				ratio := float64(count) / float64(quota)
+				if ratio < threshold {
+					firing[api] = false
+					continue
+				}
+				if firing[api] {
+					continue
+				}
+				firing[api] = true
+
+				alerts = append(alerts, Alert{
+					Type:  AlertTypeQuotaHigh,
+					Count: 1,
+					Example: map[string]interface{}{
+						"api":   api,
+						"used":  count,
+						"quota": quota,
+						"usage": fmt.Sprintf("%.0f%%", ratio*100),
+					},
+				})
+			}
+			return alerts
+		},
+	}
+}
+
+// DeadLetterRule fires when at least threshold async tasks were dropped
+// after exhausting retries since the previous evaluation
+func DeadLetterRule(queue QueueStatsProvider, threshold int64) Rule {
+	var mu sync.Mutex
+	var last int64
+	var primed bool
+
+	return Rule{
+		Name: "async_dead_letter",
+		Evaluate: func(now time.Time) []Alert {
+			mu.Lock()
+			defer mu.Unlock()
+
+			stats := queue.GetStats()
+			delta := stats.TotalDeadLettered - last
+			wasPrimed := primed
+			last, primed = stats.TotalDeadLettered, true
+
+			if !wasPrimed || delta < threshold || delta <= 0 {
+				return nil
+			}
+			return []Alert{{
+				Type:  AlertTypeDeadLetterGrowth,
+				Count: int(delta),
+				Example: map[string]interface{}{
+					"total_dead_lettered": stats.TotalDeadLettered,
+					"queue_size":          stats.QueueSize,
+				},
+			}}
+		},
+	}
+}
+
+// CallbackLatencyRule fires when callback p95 latency rises above threshold
+func CallbackLatencyRule(latency LatencyProvider, threshold time.Duration) Rule {
+	var mu sync.Mutex
+	var firing bool
+
+	return Rule{
+		Name: "callback_latency",
+		Evaluate: func(now time.Time) []Alert {
+			mu.Lock()
+			defer mu.Unlock()
+
+			p95 := latency.P95()
+			if p95 < threshold {
+				firing = false
+				return nil
+			}
+			if firing {
+				return nil
+			}
+			firing = true
+
+			return []Alert{{
+				Type:  AlertTypeCallbackSlow,
+				Count: 1,
+				Example: map[string]interface{}{
+					"p95_ms":       p95.Milliseconds(),
+					"threshold_ms": threshold.Milliseconds(),
+				},
+			}}
+		},
+	}
+}
+
+// LatencyTracker keeps recent callback latencies for percentile queries
+type LatencyTracker struct {
+	mu      sync.Mutex
+	window  time.Duration
+	samples []latencySample
+	next    int
+	size    int
+}
+
+// latencySample is one observed latency
+type latencySample struct {
+	at       time.Time
+	duration time.Duration
+}
+
+// NewLatencyTracker creates a tracker holding up to size samples, at least
+// one, observed within window
+func NewLatencyTracker(size int, window time.Duration) *LatencyTracker {
+	if size < 1 {
+		size = 1
+	}
+	return &LatencyTracker{
+		window:  window,
+		samples: make([]latencySample, size),
+	}
+}
+
+// Observe records a latency
+func (t *LatencyTracker) Observe(d time.Duration) {
+	t.mu.Lock()
+	t.samples[t.next] = latencySample{at: time.Now(), duration: d}
+	t.next = (t.next + 1) % len(t.samples)
+	if t.size < len(t.samples) {
+		t.size++
+	}
+	t.mu.Unlock()
+}
+
+// P95 returns the 95th percentile latency within the window
+func (t *LatencyTracker) P95() time.Duration {
+	cutoff := time.Now().Add(-t.window)
+
+	t.mu.Lock()
+	durations := make([]time.Duration, 0, t.size)
+	for i := 0; i < t.size; i++ {
+		if s := t.samples[i]; s.at.After(cutoff) {
+			durations = append(durations, s.duration)
+		}
+	}
+	t.mu.Unlock()
+
+	if len(durations) == 0 {
+		return 0
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	return durations[(len(durations)*95-1)/100]
+}
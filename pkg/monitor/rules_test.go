@@ -0,0 +1,286 @@
+package monitor
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"wechat-service/internal/config"
+	"wechat-service/pkg/async"
+)
+
+// fixedLatency is a LatencyProvider returning a settable p95
+type fixedLatency struct {
+	mu  sync.Mutex
+	p95 time.Duration
+}
+
+func (l *fixedLatency) P95() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.p95
+}
+
+func (l *fixedLatency) set(d time.Duration) {
+	l.mu.Lock()
+	l.p95 = d
+	l.mu.Unlock()
+}
+
+// fixedUsage is a UsageProvider returning canned usage per API
+type fixedUsage map[string][2]int
+
+func (u fixedUsage) GetUsage(api string) (int, int, error) {
+	return u[api][0], u[api][1], nil
+}
+
+// fixedQueue is a QueueStatsProvider returning settable stats
+type fixedQueue struct {
+	mu    sync.Mutex
+	stats async.ProcessorStats
+}
+
+func (q *fixedQueue) GetStats() async.ProcessorStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.stats
+}
+
+func TestLatencyTracker(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		samples []time.Duration
+		want    time.Duration
+	}{
+		{name: "empty", size: 10, want: 0},
+		{name: "one sample", size: 10, samples: []time.Duration{5}, want: 5},
+		{name: "p95 of 100", size: 100, samples: series(100), want: 95},
+		{name: "keeps the newest", size: 10, samples: append(series(100), 1, 1, 1, 1, 1, 1, 1, 1, 1, 2), want: 2},
+		{name: "zero size holds one", size: 0, samples: []time.Duration{3, 4}, want: 4},
+		{name: "negative size holds one", size: -5, samples: []time.Duration{7}, want: 7},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := NewLatencyTracker(tt.size, time.Minute)
+			for _, d := range tt.samples {
+				tracker.Observe(d)
+			}
+			if got := tracker.P95(); got != tt.want {
+				t.Errorf("P95 = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// series returns the durations 1..n
+func series(n int) []time.Duration {
+	ds := make([]time.Duration, n)
+	for i := range ds {
+		ds[i] = time.Duration(i + 1)
+	}
+	return ds
+}
+
+func TestLatencyTrackerWindow(t *testing.T) {
+	tracker := NewLatencyTracker(10, 20*time.Millisecond)
+	tracker.Observe(time.Second)
+	time.Sleep(30 * time.Millisecond)
+	tracker.Observe(time.Millisecond)
+
+	if got := tracker.P95(); got != time.Millisecond {
+		t.Errorf("P95 = %v, want samples outside the window ignored", got)
+	}
+}
+
+func TestCallbackLatencyRule(t *testing.T) {
+	tests := []struct {
+		name   string
+		p95s   []time.Duration // one per evaluation
+		alerts []int           // alerts expected per evaluation
+	}{
+		{name: "below threshold", p95s: []time.Duration{10, 50}, alerts: []int{0, 0}},
+		{name: "fires once while high", p95s: []time.Duration{200, 300, 200}, alerts: []int{1, 0, 0}},
+		{name: "fires again after recovering", p95s: []time.Duration{200, 10, 200}, alerts: []int{1, 0, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			latency := &fixedLatency{}
+			rule := CallbackLatencyRule(latency, 100)
+			for i, p95 := range tt.p95s {
+				latency.set(p95)
+				if got := len(rule.Evaluate(time.Now())); got != tt.alerts[i] {
+					t.Errorf("evaluation %d: %d alerts, want %d", i, got, tt.alerts[i])
+				}
+			}
+		})
+	}
+}
+
+func TestQuotaUsageRule(t *testing.T) {
+	tests := []struct {
+		name  string
+		usage []fixedUsage // one per evaluation
+		want  []int
+	}{
+		{
+			name:  "below threshold",
+			usage: []fixedUsage{{"menu_create": {10, 100}}},
+			want:  []int{0},
+		},
+		{
+			name:  "fires once per crossing",
+			usage: []fixedUsage{{"menu_create": {80, 100}}, {"menu_create": {90, 100}}, {"menu_create": {10, 100}}, {"menu_create": {85, 100}}},
+			want:  []int{1, 0, 0, 1},
+		},
+		{
+			name:  "per api",
+			usage: []fixedUsage{{"menu_create": {80, 100}, "user_list": {99, 100}}},
+			want:  []int{2},
+		},
+		{
+			name:  "unlimited api",
+			usage: []fixedUsage{{"menu_create": {80, 0}}},
+			want:  []int{0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			usage := fixedUsage{}
+			rule := QuotaUsageRule(usage, []string{"menu_create", "user_list"}, 0.8)
+			for i, u := range tt.usage {
+				for api, v := range u {
+					usage[api] = v
+				}
+				if got := len(rule.Evaluate(time.Now())); got != tt.want[i] {
+					t.Errorf("evaluation %d: %d alerts, want %d", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDeadLetterRule(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold int64
+		totals    []int64 // TotalDeadLettered per evaluation
+		want      []int   // alert count per evaluation, 0 for none
+	}{
+		{name: "first evaluation primes", threshold: 1, totals: []int64{5}, want: []int{0}},
+		{name: "growth fires", threshold: 1, totals: []int64{5, 7, 7}, want: []int{0, 2, 0}},
+		{name: "growth below threshold", threshold: 3, totals: []int64{0, 2, 5}, want: []int{0, 0, 3}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queue := &fixedQueue{}
+			rule := DeadLetterRule(queue, tt.threshold)
+			for i, total := range tt.totals {
+				queue.mu.Lock()
+				queue.stats.TotalDeadLettered = total
+				queue.mu.Unlock()
+
+				alerts := rule.Evaluate(time.Now())
+				got := 0
+				if len(alerts) > 0 {
+					got = alerts[0].Count
+				}
+				if got != tt.want[i] {
+					t.Errorf("evaluation %d: count %d, want %d", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRulesEvaluateConcurrently(t *testing.T) {
+	latency := &fixedLatency{p95: 200}
+	queue := &fixedQueue{}
+	rules := []Rule{
+		CallbackLatencyRule(latency, 100),
+		QuotaUsageRule(fixedUsage{"menu_create": {90, 100}}, []string{"menu_create"}, 0.8),
+		DeadLetterRule(queue, 1),
+	}
+
+	for _, rule := range rules {
+		t.Run(rule.Name, func(t *testing.T) {
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			fired := 0
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					n := len(rule.Evaluate(time.Now()))
+					mu.Lock()
+					fired += n
+					mu.Unlock()
+				}()
+			}
+			wg.Wait()
+
+			// Transition rules fire at most once however many evaluations race
+			if fired > 1 {
+				t.Errorf("fired %d alerts, want at most 1", fired)
+			}
+		})
+	}
+}
+
+func TestEvaluateRulesAppID(t *testing.T) {
+	tests := []struct {
+		name     string
+		accounts []config.AccountConfig
+		appID    string // legacy wechat.app_id
+		want     []string
+	}{
+		{
+			name: "per account",
+			accounts: []config.AccountConfig{
+				{Name: "one", AppID: "wx1", APIQuotas: map[string]int{"menu_create": 100}},
+				{Name: "two", AppID: "wx2", APIQuotas: map[string]int{"menu_create": 100}},
+			},
+			// quota alerts of each account, then the service-wide latency alert
+			want: []string{"wx1", "wx2", "wx1"},
+		},
+		{name: "legacy single account", appID: "wx0", want: []string{"wx0", "wx0"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := newTestMonitor(0)
+			m.cfg.Accounts = tt.accounts
+			m.cfg.WeChat.AppID = tt.appID
+			m.cfg.RateLimit.APIQuotas = map[string]int{"menu_create": 100}
+			m.cfg.Monitoring.QuotaAlertThreshold = 0.8
+			m.cfg.Monitoring.LatencyAlertThreshold = 100
+
+			usage := fixedUsage{"menu_create": {90, 100}}
+			if len(tt.accounts) == 0 {
+				m.RegisterDefaultRules(nil, usage, nil, &fixedLatency{p95: 200 * time.Millisecond})
+			} else {
+				for _, ac := range tt.accounts {
+					m.RegisterAccountRules(m.cfg.ForAccount(ac), nil, usage)
+				}
+				m.RegisterDefaultRules(nil, nil, nil, &fixedLatency{p95: 200 * time.Millisecond})
+			}
+			m.EvaluateRules(time.Now())
+
+			alerts := m.GetAlerts()
+			sort.SliceStable(alerts, func(i, j int) bool { return alerts[i].CreatedAt.Before(alerts[j].CreatedAt) })
+			var got []string
+			for _, a := range alerts {
+				got = append(got, a.AppID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("alert app IDs = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
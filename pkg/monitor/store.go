@@ -0,0 +1,240 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Alert statuses
+const (
+	AlertStatusFiring       = "firing"
+	AlertStatusAcknowledged = "acknowledged"
+	AlertStatusResolved     = "resolved"
+)
+
+// ErrAlertNotFound is returned when an alert ID is unknown
+var ErrAlertNotFound = errors.New("alert not found")
+
+// AlertFilter selects alerts from the store. Zero values match everything.
+type AlertFilter struct {
+	Type     string
+	Severity string
+	Status   string
+	Since    time.Time
+	Until    time.Time
+	Limit    int
+}
+
+// HealthFilter selects health check results from the store
+type HealthFilter struct {
+	Name   string
+	Status string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+// AlertStore persists alerts and health check history
+type AlertStore interface {
+	SaveAlert(ctx context.Context, alert Alert) error
+	ListAlerts(ctx context.Context, filter AlertFilter) ([]Alert, error)
+	AcknowledgeAlert(ctx context.Context, id, by string, at time.Time) error
+	ResolveAlert(ctx context.Context, id string, at time.Time) error
+	ResolveByType(ctx context.Context, alertType string, at time.Time) (int64, error)
+	PurgeAlerts(ctx context.Context, before time.Time) (int64, error)
+
+	SaveHealthResults(ctx context.Context, results []HealthCheck) error
+	ListHealthResults(ctx context.Context, filter HealthFilter) ([]HealthCheck, error)
+	PurgeHealthResults(ctx context.Context, before time.Time) (int64, error)
+}
+
+// MemoryAlertStore keeps alerts and health history in memory. It is the
+// fallback when no database is configured; history is lost on restart.
+type MemoryAlertStore struct {
+	mu         sync.RWMutex
+	alerts     []Alert
+	health     []HealthCheck
+	maxEntries int
+}
+
+// NewMemoryAlertStore creates a memory store keeping at most maxEntries
+// alerts and maxEntries health results
+func NewMemoryAlertStore(maxEntries int) *MemoryAlertStore {
+	return &MemoryAlertStore{
+		alerts:     make([]Alert, 0),
+		health:     make([]HealthCheck, 0),
+		maxEntries: maxEntries,
+	}
+}
+
+// SaveAlert stores an alert
+func (s *MemoryAlertStore) SaveAlert(ctx context.Context, alert Alert) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.alerts = append(s.alerts, alert)
+	if s.maxEntries > 0 && len(s.alerts) > s.maxEntries {
+		s.alerts = s.alerts[len(s.alerts)-s.maxEntries:]
+	}
+	return nil
+}
+
+// ListAlerts returns matching alerts, newest first
+func (s *MemoryAlertStore) ListAlerts(ctx context.Context, filter AlertFilter) ([]Alert, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	alerts := make([]Alert, 0)
+	for i := len(s.alerts) - 1; i >= 0; i-- {
+		a := s.alerts[i]
+		if filter.Type != "" && a.Type != filter.Type {
+			continue
+		}
+		if filter.Severity != "" && a.Severity != filter.Severity {
+			continue
+		}
+		if filter.Status != "" && a.Status != filter.Status {
+			continue
+		}
+		if !inRange(a.CreatedAt, filter.Since, filter.Until) {
+			continue
+		}
+		alerts = append(alerts, a)
+		if filter.Limit > 0 && len(alerts) >= filter.Limit {
+			break
+		}
+	}
+	return alerts, nil
+}
+
+// AcknowledgeAlert marks an alert as acknowledged
+func (s *MemoryAlertStore) AcknowledgeAlert(ctx context.Context, id, by string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.alerts {
+		if s.alerts[i].ID != id {
+			continue
+		}
+		if s.alerts[i].Status == AlertStatusFiring {
+			s.alerts[i].Status = AlertStatusAcknowledged
+		}
+		s.alerts[i].AcknowledgedBy = by
+		s.alerts[i].AcknowledgedAt = &at
+		return nil
+	}
+	return ErrAlertNotFound
+}
+
+// ResolveAlert marks an alert as resolved
+func (s *MemoryAlertStore) ResolveAlert(ctx context.Context, id string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.alerts {
+		if s.alerts[i].ID == id {
+			s.alerts[i].Status = AlertStatusResolved
+			s.alerts[i].ResolvedAt = &at
+			return nil
+		}
+	}
+	return ErrAlertNotFound
+}
+
+// ResolveByType resolves all unresolved alerts of a type
+func (s *MemoryAlertStore) ResolveByType(ctx context.Context, alertType string, at time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int64
+	for i := range s.alerts {
+		if s.alerts[i].Type == alertType && s.alerts[i].Status != AlertStatusResolved {
+			s.alerts[i].Status = AlertStatusResolved
+			s.alerts[i].ResolvedAt = &at
+			n++
+		}
+	}
+	return n, nil
+}
+
+// PurgeAlerts deletes alerts created before the cutoff
+func (s *MemoryAlertStore) PurgeAlerts(ctx context.Context, before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := s.alerts[:0]
+	for _, a := range s.alerts {
+		if !a.CreatedAt.Before(before) {
+			kept = append(kept, a)
+		}
+	}
+	n := int64(len(s.alerts) - len(kept))
+	s.alerts = kept
+	return n, nil
+}
+
+// SaveHealthResults stores health check results
+func (s *MemoryAlertStore) SaveHealthResults(ctx context.Context, results []HealthCheck) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.health = append(s.health, results...)
+	if s.maxEntries > 0 && len(s.health) > s.maxEntries {
+		s.health = s.health[len(s.health)-s.maxEntries:]
+	}
+	return nil
+}
+
+// ListHealthResults returns matching health results, newest first
+func (s *MemoryAlertStore) ListHealthResults(ctx context.Context, filter HealthFilter) ([]HealthCheck, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	results := make([]HealthCheck, 0)
+	for i := len(s.health) - 1; i >= 0; i-- {
+		h := s.health[i]
+		if filter.Name != "" && h.Name != filter.Name {
+			continue
+		}
+		if filter.Status != "" && h.Status != filter.Status {
+			continue
+		}
+		if !inRange(h.LastRun, filter.Since, filter.Until) {
+			continue
+		}
+		results = append(results, h)
+		if filter.Limit > 0 && len(results) >= filter.Limit {
+			break
+		}
+	}
+	return results, nil
+}
+
+// PurgeHealthResults deletes health results recorded before the cutoff
+func (s *MemoryAlertStore) PurgeHealthResults(ctx context.Context, before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := s.health[:0]
+	for _, h := range s.health {
+		if !h.LastRun.Before(before) {
+			kept = append(kept, h)
+		}
+	}
+	n := int64(len(s.health) - len(kept))
+	s.health = kept
+	return n, nil
+}
+
+// inRange reports whether t is within [since, until]; zero bounds are open
+func inRange(t, since, until time.Time) bool {
+	if !since.IsZero() && t.Before(since) {
+		return false
+	}
+	if !until.IsZero() && t.After(until) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,275 @@
+package monitor
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// PostgresAlertStore persists alerts and health history in PostgreSQL.
+// The schema is created by migrations/002_monitoring.sql.
+type PostgresAlertStore struct {
+	db      *sql.DB
+	observe func(operation string, d time.Duration)
+}
+
+// NewPostgresAlertStore creates a PostgreSQL-backed alert store
+func NewPostgresAlertStore(db *sql.DB) *PostgresAlertStore {
+	return &PostgresAlertStore{db: db}
+}
+
+// SetLatencyObserver sets the observer fed with query latencies, e.g.
+// Metrics.ObserveDependencyLatency
+func (s *PostgresAlertStore) SetLatencyObserver(observe func(operation string, d time.Duration)) {
+	s.observe = observe
+}
+
+// track reports the latency of a query started at start
+func (s *PostgresAlertStore) track(operation string, start time.Time) {
+	if s.observe != nil {
+		s.observe(operation, time.Since(start))
+	}
+}
+
+// SaveAlert stores an alert
+func (s *PostgresAlertStore) SaveAlert(ctx context.Context, alert Alert) error {
+	defer s.track("save_alert", time.Now())
+
+	example, err := json.Marshal(alert.Example)
+	if err != nil {
+		return fmt.Errorf("failed to marshal alert example: %w", err)
+	}
+
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO alerts (id, appid, nickname, type, description, count, first_time,
+			example, severity, status, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		ON CONFLICT (id) DO NOTHING`,
+		alert.ID, alert.AppID, alert.Nickname, alert.Type, alert.Description, alert.Count,
+		alert.FirstTime, example, alert.Severity, alert.Status, alert.CreatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert alert: %w", err)
+	}
+	return nil
+}
+
+// ListAlerts returns matching alerts, newest first
+func (s *PostgresAlertStore) ListAlerts(ctx context.Context, filter AlertFilter) ([]Alert, error) {
+	defer s.track("list_alerts", time.Now())
+
+	var where []string
+	var args []interface{}
+	add := func(cond string, v interface{}) {
+		args = append(args, v)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+
+	if filter.Type != "" {
+		add("type = $%d", filter.Type)
+	}
+	if filter.Severity != "" {
+		add("severity = $%d", filter.Severity)
+	}
+	if filter.Status != "" {
+		add("status = $%d", filter.Status)
+	}
+	if !filter.Since.IsZero() {
+		add("created_at >= $%d", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		add("created_at <= $%d", filter.Until)
+	}
+
+	query := `SELECT id, appid, nickname, type, description, count, first_time, example,
+		severity, status, acknowledged_by, acknowledged_at, resolved_at, created_at FROM alerts`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY created_at DESC"
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query alerts: %w", err)
+	}
+	defer rows.Close()
+
+	alerts := make([]Alert, 0)
+	for rows.Next() {
+		var a Alert
+		var example []byte
+		var ackBy sql.NullString
+		var ackAt, resolvedAt sql.NullTime
+
+		if err := rows.Scan(&a.ID, &a.AppID, &a.Nickname, &a.Type, &a.Description, &a.Count,
+			&a.FirstTime, &example, &a.Severity, &a.Status, &ackBy, &ackAt, &resolvedAt, &a.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan alert: %w", err)
+		}
+		if len(example) > 0 {
+			json.Unmarshal(example, &a.Example)
+		}
+		a.AcknowledgedBy = ackBy.String
+		if ackAt.Valid {
+			a.AcknowledgedAt = &ackAt.Time
+		}
+		if resolvedAt.Valid {
+			a.ResolvedAt = &resolvedAt.Time
+		}
+		alerts = append(alerts, a)
+	}
+	return alerts, rows.Err()
+}
+
+// AcknowledgeAlert marks an alert as acknowledged
+func (s *PostgresAlertStore) AcknowledgeAlert(ctx context.Context, id, by string, at time.Time) error {
+	defer s.track("ack_alert", time.Now())
+
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE alerts SET
+			status = CASE WHEN status = $4 THEN $5 ELSE status END,
+			acknowledged_by = $2, acknowledged_at = $3
+		WHERE id = $1`,
+		id, by, at, AlertStatusFiring, AlertStatusAcknowledged,
+	)
+	return checkAffected(res, err)
+}
+
+// ResolveAlert marks an alert as resolved
+func (s *PostgresAlertStore) ResolveAlert(ctx context.Context, id string, at time.Time) error {
+	defer s.track("resolve_alert", time.Now())
+
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE alerts SET status = $2, resolved_at = $3 WHERE id = $1`,
+		id, AlertStatusResolved, at,
+	)
+	return checkAffected(res, err)
+}
+
+// ResolveByType resolves all unresolved alerts of a type
+func (s *PostgresAlertStore) ResolveByType(ctx context.Context, alertType string, at time.Time) (int64, error) {
+	defer s.track("resolve_alerts", time.Now())
+
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE alerts SET status = $2, resolved_at = $3 WHERE type = $1 AND status <> $2`,
+		alertType, AlertStatusResolved, at,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to resolve alerts: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// PurgeAlerts deletes alerts created before the cutoff
+func (s *PostgresAlertStore) PurgeAlerts(ctx context.Context, before time.Time) (int64, error) {
+	defer s.track("purge_alerts", time.Now())
+
+	res, err := s.db.ExecContext(ctx, `DELETE FROM alerts WHERE created_at < $1`, before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge alerts: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// SaveHealthResults stores health check results
+func (s *PostgresAlertStore) SaveHealthResults(ctx context.Context, results []HealthCheck) error {
+	defer s.track("save_health", time.Now())
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, r := range results {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO health_checks (name, status, message, critical, duration, checked_at)
+			VALUES ($1, $2, $3, $4, $5, $6)`,
+			r.Name, r.Status, r.Message, r.Critical, r.Duration, r.LastRun,
+		); err != nil {
+			return fmt.Errorf("failed to insert health result: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// ListHealthResults returns matching health results, newest first
+func (s *PostgresAlertStore) ListHealthResults(ctx context.Context, filter HealthFilter) ([]HealthCheck, error) {
+	defer s.track("list_health", time.Now())
+
+	var where []string
+	var args []interface{}
+	add := func(cond string, v interface{}) {
+		args = append(args, v)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+
+	if filter.Name != "" {
+		add("name = $%d", filter.Name)
+	}
+	if filter.Status != "" {
+		add("status = $%d", filter.Status)
+	}
+	if !filter.Since.IsZero() {
+		add("checked_at >= $%d", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		add("checked_at <= $%d", filter.Until)
+	}
+
+	query := `SELECT name, status, message, critical, duration, checked_at FROM health_checks`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY checked_at DESC"
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query health results: %w", err)
+	}
+	defer rows.Close()
+
+	results := make([]HealthCheck, 0)
+	for rows.Next() {
+		var h HealthCheck
+		if err := rows.Scan(&h.Name, &h.Status, &h.Message, &h.Critical, &h.Duration, &h.LastRun); err != nil {
+			return nil, fmt.Errorf("failed to scan health result: %w", err)
+		}
+		results = append(results, h)
+	}
+	return results, rows.Err()
+}
+
+// PurgeHealthResults deletes health results recorded before the cutoff
+func (s *PostgresAlertStore) PurgeHealthResults(ctx context.Context, before time.Time) (int64, error) {
+	defer s.track("purge_health", time.Now())
+
+	res, err := s.db.ExecContext(ctx, `DELETE FROM health_checks WHERE checked_at < $1`, before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge health results: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// checkAffected maps an update touching no rows to ErrAlertNotFound
+func checkAffected(res sql.Result, err error) error {
+	if err != nil {
+		return fmt.Errorf("failed to update alert: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrAlertNotFound
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package monitor
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"wechat-service/internal/config"
+	"wechat-service/pkg/logger"
+	"wechat-service/pkg/metrics"
+
+	_ "github.com/lib/pq"
+)
+
+// storedAlerts returns a store holding one alert per minute from start,
+// with the given types and severities
+func storedAlerts(t *testing.T, start time.Time, alerts ...[2]string) *MemoryAlertStore {
+	t.Helper()
+	store := NewMemoryAlertStore(0)
+	for i, a := range alerts {
+		err := store.SaveAlert(context.Background(), Alert{
+			ID:        string(rune('a' + i)),
+			Type:      a[0],
+			Severity:  a[1],
+			Status:    AlertStatusFiring,
+			CreatedAt: start.Add(time.Duration(i) * time.Minute),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+// alertIDs returns the IDs of alerts in order
+func alertIDs(alerts []Alert) []string {
+	ids := make([]string, len(alerts))
+	for i, a := range alerts {
+		ids[i] = a.ID
+	}
+	return ids
+}
+
+func TestMemoryAlertStoreList(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		filter AlertFilter
+		want   []string
+	}{
+		{name: "all newest first", want: []string{"d", "c", "b", "a"}},
+		{name: "by type", filter: AlertFilter{Type: AlertTypeDNSTimeout}, want: []string{"c", "a"}},
+		{name: "by severity", filter: AlertFilter{Severity: SeverityCritical}, want: []string{"b"}},
+		{name: "by status", filter: AlertFilter{Status: AlertStatusResolved}, want: []string{}},
+		{name: "since", filter: AlertFilter{Since: start.Add(2 * time.Minute)}, want: []string{"d", "c"}},
+		{name: "until", filter: AlertFilter{Until: start.Add(time.Minute)}, want: []string{"b", "a"}},
+		{name: "limit", filter: AlertFilter{Limit: 3}, want: []string{"d", "c", "b"}},
+	}
+
+	store := storedAlerts(t, start,
+		[2]string{AlertTypeDNSTimeout, SeverityMedium},
+		[2]string{AlertTypeMarkFail, SeverityCritical},
+		[2]string{AlertTypeDNSTimeout, SeverityMedium},
+		[2]string{AlertTypeRequestTimeout, SeverityMedium},
+	)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alerts, err := store.ListAlerts(context.Background(), tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := alertIDs(alerts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryAlertStoreUpdates(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		update     func(s *MemoryAlertStore) error
+		wantErr    error
+		wantStatus []string // per alert, oldest first
+	}{
+		{
+			name:       "acknowledge",
+			update:     func(s *MemoryAlertStore) error { return s.AcknowledgeAlert(context.Background(), "a", "alice", start) },
+			wantStatus: []string{AlertStatusAcknowledged, AlertStatusFiring, AlertStatusFiring},
+		},
+		{
+			name:       "resolve",
+			update:     func(s *MemoryAlertStore) error { return s.ResolveAlert(context.Background(), "b", start) },
+			wantStatus: []string{AlertStatusFiring, AlertStatusResolved, AlertStatusFiring},
+		},
+		{
+			name: "resolve by type",
+			update: func(s *MemoryAlertStore) error {
+				_, err := s.ResolveByType(context.Background(), AlertTypeDNSTimeout, start)
+				return err
+			},
+			wantStatus: []string{AlertStatusResolved, AlertStatusFiring, AlertStatusResolved},
+		},
+		{
+			name:       "unknown alert",
+			update:     func(s *MemoryAlertStore) error { return s.ResolveAlert(context.Background(), "z", start) },
+			wantErr:    ErrAlertNotFound,
+			wantStatus: []string{AlertStatusFiring, AlertStatusFiring, AlertStatusFiring},
+		},
+		{
+			name: "purge",
+			update: func(s *MemoryAlertStore) error {
+				_, err := s.PurgeAlerts(context.Background(), start.Add(time.Minute))
+				return err
+			},
+			wantStatus: []string{AlertStatusFiring, AlertStatusFiring},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := storedAlerts(t, start,
+				[2]string{AlertTypeDNSTimeout, SeverityMedium},
+				[2]string{AlertTypeMarkFail, SeverityCritical},
+				[2]string{AlertTypeDNSTimeout, SeverityMedium},
+			)
+			if err := tt.update(store); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+
+			alerts, err := store.ListAlerts(context.Background(), AlertFilter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for i := len(alerts) - 1; i >= 0; i-- {
+				got = append(got, alerts[i].Status)
+			}
+			if !reflect.DeepEqual(got, tt.wantStatus) {
+				t.Errorf("statuses %v, want %v", got, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestUseDatabase(t *testing.T) {
+	tests := []struct {
+		name    string
+		metrics bool
+	}{
+		{name: "with metrics", metrics: true},
+		{name: "without metrics"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Nothing listens on port 1, so queries fail without a server
+			db, err := sql.Open("postgres", "host=127.0.0.1 port=1 dbname=wechat sslmode=disable connect_timeout=1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			var mt *metrics.Metrics
+			if tt.metrics {
+				mt = metrics.NewMetrics(nil, "")
+			}
+			m := NewMonitor(&config.Config{}, logger.New(nil))
+			m.UseDatabase(db, mt)
+
+			if _, ok := m.alertStore().(*PostgresAlertStore); !ok {
+				t.Fatalf("alert store is %T, want *PostgresAlertStore", m.alertStore())
+			}
+			if _, err := m.QueryAlerts(context.Background(), AlertFilter{}); err == nil {
+				t.Fatal("query against an unreachable database succeeded")
+			}
+			if mt != nil && postgresLatencyCount(t, mt) == 0 {
+				t.Error("no postgres latency recorded for the failed query")
+			}
+		})
+	}
+}
+
+// postgresLatencyCount returns the number of postgres latencies recorded
+func postgresLatencyCount(t *testing.T, mt *metrics.Metrics) uint64 {
+	t.Helper()
+	families, err := mt.Gatherer().Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n uint64
+	for _, f := range families {
+		for _, metric := range f.GetMetric() {
+			for _, lp := range metric.GetLabel() {
+				if lp.GetName() == "dependency" && lp.GetValue() == "postgres" {
+					n += metric.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+	return n
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"wechat-service/internal/config"
@@ -18,13 +19,14 @@ var (
 
 // Limiter manages rate limiting for API calls
 type Limiter struct {
-	cfg      *config.Config
-	cache    cache.Cache
-	log      *logger.Logger
-	mu       sync.RWMutex
-	counters map[string]*apiCounter
-	stopCh   chan struct{}
-	wg       sync.WaitGroup
+	cfg       atomic.Pointer[config.Config]
+	cache     cache.Cache
+	log       *logger.Logger
+	mu        sync.RWMutex
+	counters  map[string]*apiCounter
+	stopCh    chan struct{}
+	wg        sync.WaitGroup
+	resetOnce sync.Once
 }
 
 // apiCounter tracks API usage
@@ -37,12 +39,12 @@ type apiCounter struct {
 // NewLimiter creates a new rate limiter
 func NewLimiter(cfg *config.Config, cache cache.Cache, log *logger.Logger) *Limiter {
 	l := &Limiter{
-		cfg:      cfg,
 		cache:    cache,
 		log:      log,
 		counters: make(map[string]*apiCounter),
 		stopCh:   make(chan struct{}),
 	}
+	l.cfg.Store(cfg)
 
 	if cfg.RateLimit.Enabled {
 		l.startDailyReset()
@@ -51,9 +53,21 @@ func NewLimiter(cfg *config.Config, cache cache.Cache, log *logger.Logger) *Limi
 	return l
 }
 
+// ApplyConfig switches the limiter to cfg. Quota changes take effect on
+// the next call; current counters are kept.
+func (l *Limiter) ApplyConfig(cfg *config.Config) {
+	old := l.cfg.Swap(cfg)
+	if cfg.RateLimit.Enabled {
+		l.startDailyReset()
+	}
+	if old.RateLimit.Enabled != cfg.RateLimit.Enabled {
+		l.log.Info("Rate limiting toggled", "enabled", cfg.RateLimit.Enabled)
+	}
+}
+
 // Allow checks if an API call is allowed
 func (l *Limiter) Allow(apiName string) (bool, error) {
-	if !l.cfg.RateLimit.Enabled {
+	if !l.cfg.Load().RateLimit.Enabled {
 		return true, nil
 	}
 
@@ -77,7 +91,7 @@ func (l *Limiter) Allow(apiName string) (bool, error) {
 
 // AllowContext checks with context support
 func (l *Limiter) AllowContext(ctx context.Context, apiName string) (bool, error) {
-	if !l.cfg.RateLimit.Enabled {
+	if !l.cfg.Load().RateLimit.Enabled {
 		return true, nil
 	}
 
@@ -91,10 +105,11 @@ func (l *Limiter) AllowContext(ctx context.Context, apiName string) (bool, error
 
 // getQuota returns the quota for an API
 func (l *Limiter) getQuota(apiName string) int {
-	if l.cfg.RateLimit.APIQuotas == nil {
+	quotas := l.cfg.Load().RateLimit.APIQuotas
+	if quotas == nil {
 		return 0
 	}
-	return l.cfg.RateLimit.APIQuotas[apiName]
+	return quotas[apiName]
 }
 
 // getCount gets current API usage count
@@ -146,8 +161,13 @@ func (l *Limiter) getResetTime() time.Time {
 	return time.Date(now.Year(), now.Month(), now.Day(), 23, 59, 59, 0, time.Local)
 }
 
-// startDailyReset starts background cleanup
+// startDailyReset starts background cleanup once
 func (l *Limiter) startDailyReset() {
+	l.resetOnce.Do(l.runDailyReset)
+}
+
+// runDailyReset runs the background cleanup loop
+func (l *Limiter) runDailyReset() {
 	l.wg.Add(1)
 	go func() {
 		defer l.wg.Done()